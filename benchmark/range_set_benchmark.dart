@@ -0,0 +1,91 @@
+// Range tracking with thousands of fragments: the old list (append, sort
+// and merge when asked) against RangeSet.
+//
+//   dart run benchmark/range_set_benchmark.dart
+
+import 'dart:math';
+
+import 'package:genesmanproxy/genesmanproxy.dart';
+
+/// What DownloadMeta did before RangeSet: append, then sort and merge
+/// the whole list before any lookup
+class _SortOnLookup {
+  List<(int, int)> _ranges = [];
+  bool _needsMerge = false;
+
+  void add(int start, int end) {
+    _ranges.add((start, end));
+    _needsMerge = true;
+    if (_ranges.length > 100) _merge();
+  }
+
+  bool contains(int start, int end) {
+    if (_needsMerge) _merge();
+    return _ranges.any((r) => start >= r.$1 && end <= r.$2);
+  }
+
+  List<(int, int)> gaps(int start, int end) {
+    if (_needsMerge) _merge();
+    final gaps = <(int, int)>[];
+    var pos = start;
+    for (final (s, e) in _ranges) {
+      if (e < pos) continue;
+      if (s > end) break;
+      if (s > pos) gaps.add((pos, s - 1));
+      pos = e + 1;
+    }
+    if (pos <= end) gaps.add((pos, end));
+    return gaps;
+  }
+
+  void _merge() {
+    _ranges.sort((a, b) => a.$1.compareTo(b.$1));
+    final merged = <(int, int)>[];
+    for (final range in _ranges) {
+      if (merged.isNotEmpty && range.$1 <= merged.last.$2 + 1) {
+        merged.last = (merged.last.$1, max(merged.last.$2, range.$2));
+      } else {
+        merged.add(range);
+      }
+    }
+    _ranges = merged;
+    _needsMerge = false;
+  }
+}
+
+/// Prefetch-like load: [fragments] scattered 64 KB writes, each followed
+/// by a lookup and a gap query like the serving path makes
+Duration _run(
+  int fragments,
+  void Function(int, int) add,
+  bool Function(int, int) contains,
+  List<(int, int)> Function(int, int) gaps,
+) {
+  const chunk = 64 * 1024;
+  final random = Random(1);
+  final slots = List.generate(fragments * 2, (i) => i)..shuffle(random);
+  final stopwatch = Stopwatch()..start();
+  for (int i = 0; i < fragments; i++) {
+    // Every other slot stays empty, so fragments never merge
+    final start = slots[i] * 2 * chunk;
+    add(start, start + chunk - 1);
+    contains(start, start + chunk ~/ 2);
+    gaps(start, start + 8 * chunk);
+  }
+  return stopwatch.elapsed;
+}
+
+void main() {
+  print('fragments   sort-on-lookup   RangeSet');
+  for (final fragments in const [1000, 5000, 20000]) {
+    final old = _SortOnLookup();
+    final before = _run(fragments, old.add, old.contains, old.gaps);
+    final set = RangeSet();
+    final after = _run(fragments, set.add, set.contains, set.gaps);
+    print(
+      '${'$fragments'.padLeft(9)}   '
+      '${'${before.inMilliseconds} ms'.padLeft(14)}   '
+      '${'${after.inMilliseconds} ms'.padLeft(8)}',
+    );
+  }
+}
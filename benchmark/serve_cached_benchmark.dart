@@ -0,0 +1,64 @@
+// Serving a large cached file to concurrent players, by disk read size
+// (StreamProxyBridge.diskReadBufferSize).
+//
+//   dart run benchmark/serve_cached_benchmark.dart [size in MiB]
+//
+// The file is cached once through the proxy, then read whole by 1, 4 and
+// 8 players at once for each read size. Use a few GiB (e.g. 4096) to see
+// past the page cache; the storage folder needs that much free space.
+
+import 'dart:async';
+import 'dart:io';
+
+import 'package:genesmanproxy/genesmanproxy.dart';
+import 'package:genesmanproxy/testsupport.dart';
+
+/// Read [url] whole through the proxy; returns the bytes received
+Future<int> _play(HttpClient client, Uri url) async {
+  final response = await (await client.getUrl(url)).close();
+  var received = 0;
+  await for (final chunk in response) {
+    received += chunk.length;
+  }
+  return received;
+}
+
+Future<void> main(List<String> args) async {
+  final size = (args.isEmpty ? 1024 : int.parse(args.first)) * 1024 * 1024;
+  final storage = await Directory.systemTemp.createTemp('serve_bench');
+  final origin = FakeOrigin(size: size);
+  await origin.start();
+  final proxy = await StreamProxyBridge.getInstance(
+    port: 0,
+    storageDir: storage.path,
+  );
+  final client = HttpClient()..maxConnectionsPerHost = 16;
+  try {
+    final url = proxy.getProxyUrl(origin.url());
+    final cached = await _play(client, url);
+    if (cached != size) throw StateError('Cached $cached of $size bytes');
+
+    print('read size   players   MB/s');
+    for (final bufferSize in const [64 * 1024, 256 * 1024, 1024 * 1024]) {
+      proxy.diskReadBufferSize = bufferSize;
+      for (final players in const [1, 4, 8]) {
+        final stopwatch = Stopwatch()..start();
+        final received = await Future.wait([
+          for (int i = 0; i < players; i++) _play(client, url),
+        ]);
+        final bytes = received.fold(0, (sum, n) => sum + n);
+        final seconds = stopwatch.elapsedMicroseconds / 1e6;
+        print(
+          '${'${bufferSize ~/ 1024} KB'.padLeft(9)}   '
+          '${'$players'.padLeft(7)}   '
+          '${(bytes / seconds / 1e6).toStringAsFixed(0).padLeft(4)}',
+        );
+      }
+    }
+  } finally {
+    client.close(force: true);
+    await proxy.stop();
+    await origin.close();
+    await storage.delete(recursive: true);
+  }
+}
@@ -0,0 +1,138 @@
+import 'dart:convert';
+import 'dart:io';
+
+import 'package:genesmanproxy/genesmanproxy.dart';
+
+const _usage = '''
+Usage: downstream bench [options] <url>...
+       downstream replay [options] <log>
+
+bench plays <url>s through a running proxy with synthetic players and
+reports time to first byte and stalls.
+
+  --proxy=<url>        Proxy base URL (default http://127.0.0.1:8080)
+  --key=<path>         The proxy's .signing_key, to sign stream URLs
+  --players=<n>        Concurrent players (default 4)
+  --duration=<s>       Seconds to run (default 30)
+  --pattern=<name>     linear, seeking or scrubbing (default linear)
+  --bitrate=<bps>      Bits per second per player (default 5000000)
+  --request-size=<b>   Bytes per range request (default 2097152)
+  --seek-interval=<s>  Seconds between seeks for "seeking" (default 10)
+  --seed=<n>           Random seed (default 1)
+  --json               Print the report as JSON
+
+replay sends the range requests of <log> (from GET /api/requests, or an
+access log of "URL SIZE START-END" lines) to a running proxy again and
+reports the slowest.
+
+  --proxy=<url>        Proxy base URL (default http://127.0.0.1:8080)
+  --key=<path>         The proxy's .signing_key, to sign stream URLs
+  --speed=<x>          Replay this many times faster (default 1)
+  --no-timing          Send each client's requests back to back
+  --json               Print the report as JSON''';
+
+Future<void> main(List<String> args) async {
+  final command = args.isEmpty ? null : args.first;
+  if (command != 'bench' && command != 'replay') {
+    stderr.writeln(_usage);
+    exitCode = 64;
+    return;
+  }
+
+  final options = <String, String>{};
+  final operands = <String>[];
+  for (final arg in args.skip(1)) {
+    if (arg.startsWith('--')) {
+      final eq = arg.indexOf('=');
+      if (eq < 0) {
+        options[arg.substring(2)] = 'true';
+      } else {
+        options[arg.substring(2, eq)] = arg.substring(eq + 1);
+      }
+    } else {
+      operands.add(arg);
+    }
+  }
+
+  try {
+    if (command == 'bench') {
+      final report = await _bench(options, operands);
+      _print(options, report, report.toJson);
+    } else {
+      final report = await _replay(options, operands);
+      _print(options, report, report.toJson);
+    }
+  } on FormatException catch (e) {
+    stderr.writeln('$e\n\n$_usage');
+    exitCode = 64;
+  }
+}
+
+void _print(
+  Map<String, String> options,
+  Object report,
+  Map<String, dynamic> Function() toJson,
+) => stdout.writeln(
+  options.containsKey('json') ? jsonEncode(toJson()) : '$report',
+);
+
+UrlSigner? _signer(Map<String, String> options) => options['key'] == null
+    ? null
+    : UrlSigner(base64.decode(File(options['key']!).readAsStringSync().trim()));
+
+Uri _proxy(Map<String, String> options) =>
+    Uri.parse(options['proxy'] ?? 'http://127.0.0.1:8080');
+
+Future<BenchReport> _bench(
+  Map<String, String> options,
+  List<String> urls,
+) async {
+  final BenchConfig config;
+  try {
+    int option(String name, int fallback) =>
+        options.containsKey(name) ? int.parse(options[name]!) : fallback;
+    config = BenchConfig(
+      proxy: _proxy(options),
+      urls: urls,
+      players: option('players', 4),
+      duration: Duration(seconds: option('duration', 30)),
+      pattern: SeekPattern.values.byName(options['pattern'] ?? 'linear'),
+      bitrate: option('bitrate', 5000000),
+      requestSize: option('request-size', 2 * 1024 * 1024),
+      seekInterval: Duration(seconds: option('seek-interval', 10)),
+      seed: option('seed', 1),
+      signer: _signer(options),
+    );
+    if (urls.isEmpty) throw const FormatException('No URLs given');
+  } on FormatException {
+    rethrow;
+  } on Object catch (e) {
+    throw FormatException('$e');
+  }
+  return LoadGenerator(config).run();
+}
+
+Future<ReplayReport> _replay(
+  Map<String, String> options,
+  List<String> logs,
+) async {
+  final ReplayConfig config;
+  final List<RecordedRequest> requests;
+  try {
+    if (logs.length != 1) throw const FormatException('Give one log file');
+    final speed = double.parse(options['speed'] ?? '1');
+    if (speed <= 0) throw const FormatException('Speed must be positive');
+    config = ReplayConfig(
+      proxy: _proxy(options),
+      signer: _signer(options),
+      keepTiming: !options.containsKey('no-timing'),
+      speed: speed,
+    );
+    requests = RecordedRequest.parseLog(File(logs.single).readAsStringSync());
+  } on FormatException {
+    rethrow;
+  } on Object catch (e) {
+    throw FormatException('$e');
+  }
+  return RequestReplayer(config).run(requests);
+}
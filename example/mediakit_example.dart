@@ -67,7 +67,7 @@ class _DownStreamMediaKitExampleState extends State<DownStreamMediaKitExample> {
     if (url.isEmpty) return;
 
     // 3. Get the Local Proxy URL
-    // returns http://127.0.0.1:8080/stream?url=...
+    // returns http://127.0.0.1:8080/stream/<token>
     final proxyUrl = DownStream.instance.cache(url);
     print("Playing from Proxy: $proxyUrl");
 
@@ -54,7 +54,7 @@ class _DownStreamExampleState extends State<DownStreamExample> {
     if (url.isEmpty) return;
 
     // 2. Get the Local Proxy URL
-    // This returns http://127.0.0.1:8080/stream?url=...
+    // This returns http://127.0.0.1:8080/stream/<token>
     final proxyUrl = DownStream.instance.cache(url);
 
     // 3. Initialize Video Player with Proxy URL
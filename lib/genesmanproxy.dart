@@ -1,6 +1,80 @@
+export 'src/access_control.dart';
+export 'src/access_history.dart';
+export 'src/access_plan.dart';
+export 'src/archive.dart';
+export 'src/audio_profile.dart';
+export 'src/bandwidth_guard.dart';
+export 'src/bench.dart';
+export 'src/binding.dart';
+export 'src/cache_cipher.dart';
+export 'src/cache_lifetime.dart';
+export 'src/cache_quota.dart';
+export 'src/cache_reader.dart';
+export 'src/cache_registry.dart';
+export 'src/call_context.dart';
+export 'src/certificate_pins.dart';
+export 'src/client_config.dart';
+export 'src/collections.dart';
+export 'src/completion.dart';
+export 'src/completion_marker.dart';
+export 'src/connection_metrics.dart';
+export 'src/content_resolver.dart';
 export 'src/data_source.dart';
+export 'src/delta_sync.dart';
+export 'src/document_store.dart';
 export 'src/down_stream.dart';
 export 'src/download_meta.dart';
+export 'src/download_state.dart';
+export 'src/error_pages.dart';
+export 'src/events.dart';
+export 'src/fair_queue.dart';
+export 'src/fetch_pipeline.dart';
+export 'src/fingerprints.dart';
+export 'src/handoff.dart';
+export 'src/header_audit.dart';
+export 'src/host_capabilities.dart';
+export 'src/host_policy.dart';
+export 'src/integrity.dart';
+export 'src/journal.dart';
+export 'src/library_refresh.dart';
+export 'src/load_shedding.dart';
 export 'src/logger.dart';
+export 'src/media_probe.dart';
+export 'src/meta_cipher.dart';
+export 'src/mirrors.dart';
+export 'src/namespace_policy.dart';
+export 'src/object_cache.dart';
+export 'src/offline_plan.dart';
+export 'src/playback_session.dart';
+export 'src/playlist_prefetch.dart';
+export 'src/progress_tracker.dart';
+export 'src/proxy_options.dart';
+export 'src/prometheus.dart';
+export 'src/range_header.dart';
+export 'src/range_set.dart';
+export 'src/range_sources.dart';
+export 'src/rate_limit.dart';
+export 'src/rate_shaping.dart';
+export 'src/read_ahead.dart';
+export 'src/replay.dart';
+export 'src/request_deadlines.dart';
+export 'src/retry_policy.dart';
+export 'src/scrubber.dart';
+export 'src/secret_store.dart';
+export 'src/segmented_download.dart';
+export 'src/serving_profile.dart';
+export 'src/shadow_cache.dart';
+export 'src/shared_lock.dart';
+export 'src/sidecars.dart';
+export 'src/simulation.dart';
+export 'src/static_site.dart';
+export 'src/storage_check.dart';
+export 'src/stream_manifest.dart';
 export 'src/streamproxy.dart';
-export 'src/utils.dart';
\ No newline at end of file
+export 'src/subtitles.dart';
+export 'src/tiered_storage.dart';
+export 'src/url_signing.dart';
+export 'src/utils.dart';
+export 'src/variants.dart';
+export 'src/version.dart';
+export 'src/work_units.dart';
@@ -0,0 +1,163 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+
+import 'utils.dart';
+
+/// A block of IP addresses in CIDR notation, e.g. `192.168.1.0/24`
+class IpNetwork {
+  final InternetAddress address;
+  final int prefixLength;
+
+  IpNetwork(this.address, this.prefixLength) {
+    final bits = address.rawAddress.length * 8;
+    if (prefixLength < 0 || prefixLength > bits) {
+      throw ArgumentError.value(prefixLength, 'prefixLength', '0 to $bits');
+    }
+  }
+
+  /// Parse `address/prefix`, or a single address
+  factory IpNetwork.parse(String cidr) {
+    final slash = cidr.indexOf('/');
+    final address = InternetAddress.tryParse(
+      slash < 0 ? cidr.trim() : cidr.substring(0, slash).trim(),
+    );
+    if (address == null) {
+      throw FormatException('Invalid IP network', cidr);
+    }
+    final bits = address.rawAddress.length * 8;
+    final prefix = slash < 0 ? bits : int.tryParse(cidr.substring(slash + 1));
+    if (prefix == null || prefix < 0 || prefix > bits) {
+      throw FormatException('Invalid prefix length', cidr);
+    }
+    return IpNetwork(address, prefix);
+  }
+
+  /// `127.0.0.0/8` and `::1`: apps on this device
+  static final List<IpNetwork> loopback = [
+    IpNetwork.parse('127.0.0.0/8'),
+    IpNetwork.parse('::1/128'),
+  ];
+
+  /// Every IPv4 and IPv6 address
+  static final List<IpNetwork> any = [
+    IpNetwork.parse('0.0.0.0/0'),
+    IpNetwork.parse('::/0'),
+  ];
+
+  /// Whether [other] is in this network; IPv4 clients of a server on
+  /// `::` (seen as `::ffff:a.b.c.d`) match IPv4 networks
+  bool contains(InternetAddress other) {
+    final raw = _unmapped(other.rawAddress);
+    final own = address.rawAddress;
+    if (raw.length != own.length) return false;
+    final whole = prefixLength ~/ 8;
+    for (int i = 0; i < whole; i++) {
+      if (raw[i] != own[i]) return false;
+    }
+    final rest = prefixLength % 8;
+    if (rest == 0) return true;
+    final mask = (0xff << (8 - rest)) & 0xff;
+    return raw[whole] & mask == own[whole] & mask;
+  }
+
+  static List<int> _unmapped(List<int> raw) {
+    if (raw.length != 16) return raw;
+    for (int i = 0; i < 10; i++) {
+      if (raw[i] != 0) return raw;
+    }
+    if (raw[10] != 0xff || raw[11] != 0xff) return raw;
+    return raw.sublist(12);
+  }
+
+  @override
+  String toString() => '${address.address}/$prefixLength';
+}
+
+/// Decides whether a request may be served; see [AccessPolicy.check]
+typedef AccessCheck = FutureOr<bool> Function(HttpRequest request);
+
+/// Who may use the proxy at all, checked before any endpoint runs
+///
+/// By default only apps on this device are served. A proxy shared on the
+/// LAN names the networks it serves in [allow] and should require a
+/// [key], so a device on the network cannot spend the bandwidth and disk
+/// of this one. Stream URLs stay signed either way (see `UrlSigner`).
+///
+/// Two secrets, checked in this order by the same comparison:
+///
+/// * [key] gates every endpoint, players' streams included, and is
+///   refused with 403 ([denial]);
+/// * the proxy's `apiToken`, a bearer token, gates only the API and
+///   admin endpoints on top of it, and is refused with 401
+///   ([carriesToken]).
+///
+/// A request to the API of a proxy with both set carries both.
+class AccessPolicy {
+  /// Networks clients may connect from
+  final List<IpNetwork> allow;
+
+  /// Key every request must carry, in the `X-Api-Key` header or the
+  /// `key` query parameter (players cannot send headers; proxy URLs
+  /// include it)
+  final String? key;
+
+  /// Called for requests that passed [allow] and [key]; false refuses
+  /// the request, for authentication of the app's own
+  final AccessCheck? check;
+
+  AccessPolicy({List<IpNetwork>? allow, this.key, this.check})
+    : allow = allow ?? IpNetwork.loopback;
+
+  /// Header carrying [key]
+  static const keyHeader = 'X-Api-Key';
+
+  /// Query parameter carrying [key]
+  static const keyParameter = 'key';
+
+  /// Whether [address] is in a network of [allow]
+  bool allows(InternetAddress address) =>
+      allow.any((network) => network.contains(address));
+
+  /// Whether only apps on this device are allowed
+  bool get isLoopbackOnly =>
+      allow.every((network) => network.address.isLoopback);
+
+  /// Why [request] is refused; null when it may be served
+  Future<String?> denial(HttpRequest request) async {
+    final address = request.connectionInfo?.remoteAddress;
+    if (address == null || !allows(address)) {
+      return 'Client address not allowed';
+    }
+    final expected = key;
+    if (expected != null) {
+      final given =
+          request.headers.value(keyHeader) ??
+          request.uri.queryParameters[keyParameter];
+      if (!_matches(given, expected)) {
+        return 'Missing or wrong API key';
+      }
+    }
+    if (check != null && !await check!(request)) {
+      return 'Refused by access check';
+    }
+    return null;
+  }
+
+  /// Whether [request] carries [token] as `Authorization: Bearer
+  /// <token>`; always true without a [token]
+  static bool carriesToken(HttpRequest request, String? token) {
+    if (token == null) return true;
+    final header = request.headers.value(HttpHeaders.authorizationHeader);
+    if (header == null || !header.startsWith('Bearer ')) return false;
+    return _matches(header.substring(7).trim(), token);
+  }
+
+  // Compared in constant time, so timing does not reveal the secret
+  static bool _matches(String? given, String expected) =>
+      given != null &&
+      DownStreamUtils.constantTimeEquals(
+        utf8.encode(given),
+        utf8.encode(expected),
+      );
+}
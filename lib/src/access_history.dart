@@ -0,0 +1,72 @@
+import 'dart:math';
+
+/// Per-file record of which byte ranges players read
+///
+/// Request start positions are counted in [bucketSize] buckets; buckets
+/// read on most opens (container header, seek index) and the previous stop
+/// position are predicted as the next open's first reads.
+class AccessHistory {
+  static const int bucketSize = 1024 * 1024;
+
+  final Map<int, int> _buckets;
+  int? stopPosition;
+  DateTime lastAccess;
+
+  AccessHistory({
+    Map<int, int>? buckets,
+    this.stopPosition,
+    DateTime? lastAccess,
+  }) : _buckets = buckets ?? {},
+       lastAccess = lastAccess ?? DateTime.now();
+
+  /// Record a served range
+  void record(int start, int end) {
+    final bucket = start ~/ bucketSize;
+    _buckets[bucket] = (_buckets[bucket] ?? 0) + 1;
+    stopPosition = end;
+    lastAccess = DateTime.now();
+  }
+
+  /// Ranges worth warming before the player asks, most likely first
+  ///
+  /// Buckets read at least [minHits] times (up to [maxRanges]) plus the
+  /// bucket after the previous stop position.
+  List<(int, int)> predict(
+    int totalSize, {
+    int maxRanges = 3,
+    int minHits = 2,
+  }) {
+    final hot = _buckets.entries.where((e) => e.value >= minHits).toList()
+      ..sort((a, b) => b.value.compareTo(a.value));
+    final buckets = [for (final e in hot.take(maxRanges)) e.key];
+
+    final stop = stopPosition;
+    if (stop != null && stop + 1 < totalSize) {
+      final resume = (stop + 1) ~/ bucketSize;
+      if (!buckets.contains(resume)) buckets.add(resume);
+    }
+
+    return [
+      for (final bucket in buckets)
+        if (bucket * bucketSize < totalSize)
+          (
+            bucket * bucketSize,
+            min((bucket + 1) * bucketSize, totalSize) - 1,
+          ),
+    ];
+  }
+
+  Map<String, Object?> toJson() => {
+    'buckets': _buckets.map((k, v) => MapEntry('$k', v)),
+    'stop': stopPosition,
+    'lastAccess': lastAccess.toIso8601String(),
+  };
+
+  factory AccessHistory.fromJson(Map<String, dynamic> json) => AccessHistory(
+    buckets: (json['buckets'] as Map<String, dynamic>).map(
+      (k, v) => MapEntry(int.parse(k), v as int),
+    ),
+    stopPosition: json['stop'] as int?,
+    lastAccess: DateTime.parse(json['lastAccess'] as String),
+  );
+}
@@ -0,0 +1,42 @@
+import 'dart:math';
+
+/// Byte ranges a local tool (transcoder, editor, archive reader) says it
+/// will read, in the order it will read them
+class AccessPlan {
+  /// Ranges in read order, clamped to the file and with close neighbours
+  /// merged
+  final List<(int, int)> ranges;
+
+  AccessPlan._(this.ranges);
+
+  /// Build a plan for a file of [totalSize] bytes
+  ///
+  /// Consecutive ranges less than [maxGap] bytes apart are merged into one
+  /// upstream request; fetching a few unneeded bytes beats another round
+  /// trip. Read order is kept, so a tool that reads backwards still gets
+  /// its first reads first.
+  factory AccessPlan(
+    Iterable<(int, int)> ranges,
+    int totalSize, {
+    int maxGap = 64 * 1024,
+  }) {
+    final merged = <(int, int)>[];
+    for (var (start, end) in ranges) {
+      start = max(start, 0);
+      end = min(end, totalSize - 1);
+      if (start > end) continue;
+
+      if (merged.isNotEmpty) {
+        final (lastStart, lastEnd) = merged.last;
+        if (start <= lastEnd + maxGap && end >= lastStart - maxGap) {
+          merged.last = (min(start, lastStart), max(end, lastEnd));
+          continue;
+        }
+      }
+      merged.add((start, end));
+    }
+    return AccessPlan._(merged);
+  }
+
+  int get bytes => ranges.fold(0, (sum, r) => sum + r.$2 - r.$1 + 1);
+}
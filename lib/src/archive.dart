@@ -0,0 +1,267 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+
+import 'cache_reader.dart';
+
+/// Thrown for archives that cannot be read
+class ArchiveException implements Exception {
+  final String message;
+
+  ArchiveException(this.message);
+
+  @override
+  String toString() => 'ArchiveException: $message';
+}
+
+/// A file inside a ZIP archive
+class ZipEntry {
+  final String name;
+
+  /// 0 = stored, 8 = deflate
+  final int method;
+  final int compressedSize;
+  final int size;
+  final int localHeaderOffset;
+
+  ZipEntry({
+    required this.name,
+    required this.method,
+    required this.compressedSize,
+    required this.size,
+    required this.localHeaderOffset,
+  });
+
+  bool get isDirectory => name.endsWith('/');
+
+  /// Stored entries can be served with byte ranges
+  bool get isStored => method == 0;
+
+  Map<String, Object> toJson() => {
+    'name': name,
+    'size': size,
+    'compressedSize': compressedSize,
+    'method': isStored ? 'stored' : (method == 8 ? 'deflate' : '$method'),
+    'seekable': isStored,
+  };
+}
+
+/// Reads ZIP (and ZIP64) archives through a [CacheReader]
+///
+/// Only the central directory and the requested entry are fetched, so a
+/// single video can be streamed out of a multi-gigabyte archive.
+class ZipArchive {
+  static const int _eocdSignature = 0x06054b50;
+  static const int _zip64LocatorSignature = 0x07064b50;
+  static const int _zip64EocdSignature = 0x06064b50;
+  static const int _centralSignature = 0x02014b50;
+  static const int _localSignature = 0x04034b50;
+
+  final CacheReader reader;
+  final List<ZipEntry> entries;
+
+  ZipArchive._(this.reader, this.entries);
+
+  /// Check the leading bytes for a ZIP signature
+  static bool isZip(List<int> head) =>
+      head.length >= 4 &&
+      head[0] == 0x50 &&
+      head[1] == 0x4B &&
+      head[2] == 0x03 &&
+      head[3] == 0x04;
+
+  /// Check the leading bytes for a RAR signature (not supported)
+  static bool isRar(List<int> head) =>
+      head.length >= 4 &&
+      head[0] == 0x52 &&
+      head[1] == 0x61 &&
+      head[2] == 0x72 &&
+      head[3] == 0x21;
+
+  /// Read the central directory
+  static Future<ZipArchive> open(CacheReader reader) async {
+    // EOCD is 22 bytes plus an optional comment of up to 64 KB
+    final tailLength = min(reader.length, 22 + 0xFFFF);
+    final tailStart = reader.length - tailLength;
+    final tail = await reader.readAt(tailStart, tailLength);
+
+    int eocd = -1;
+    for (int i = tail.length - 22; i >= 0; i--) {
+      if (_u32(tail, i) == _eocdSignature) {
+        eocd = i;
+        break;
+      }
+    }
+    if (eocd < 0) throw ArchiveException('Not a ZIP archive');
+
+    int count = _u16(tail, eocd + 10);
+    int cdSize = _u32(tail, eocd + 12);
+    int cdOffset = _u32(tail, eocd + 16);
+
+    // ZIP64: real values live in the ZIP64 end of central directory
+    if (count == 0xFFFF || cdSize == 0xFFFFFFFF || cdOffset == 0xFFFFFFFF) {
+      final locator = eocd - 20;
+      if (locator < 0 || _u32(tail, locator) != _zip64LocatorSignature) {
+        throw ArchiveException('ZIP64 locator missing');
+      }
+      final record = await reader.readAt(_u64(tail, locator + 8), 56);
+      if (_u32(record, 0) != _zip64EocdSignature) {
+        throw ArchiveException('ZIP64 end of central directory missing');
+      }
+      count = _u64(record, 32);
+      cdSize = _u64(record, 40);
+      cdOffset = _u64(record, 48);
+    }
+
+    final cd = await reader.readAt(cdOffset, cdSize);
+    final entries = <ZipEntry>[];
+    int p = 0;
+    for (int i = 0; i < count; i++) {
+      if (p + 46 > cd.length || _u32(cd, p) != _centralSignature) {
+        throw ArchiveException('Corrupt central directory');
+      }
+      final method = _u16(cd, p + 10);
+      int compressedSize = _u32(cd, p + 20);
+      int size = _u32(cd, p + 24);
+      final nameLength = _u16(cd, p + 28);
+      final extraLength = _u16(cd, p + 30);
+      final commentLength = _u16(cd, p + 32);
+      int localOffset = _u32(cd, p + 42);
+      final name = utf8.decode(
+        cd.sublist(p + 46, p + 46 + nameLength),
+        allowMalformed: true,
+      );
+
+      // ZIP64 extended information extra field (0x0001)
+      int e = p + 46 + nameLength;
+      final extraEnd = e + extraLength;
+      while (e + 4 <= extraEnd) {
+        final id = _u16(cd, e);
+        final length = _u16(cd, e + 2);
+        if (id == 0x0001) {
+          int q = e + 4;
+          if (size == 0xFFFFFFFF) {
+            size = _u64(cd, q);
+            q += 8;
+          }
+          if (compressedSize == 0xFFFFFFFF) {
+            compressedSize = _u64(cd, q);
+            q += 8;
+          }
+          if (localOffset == 0xFFFFFFFF) {
+            localOffset = _u64(cd, q);
+          }
+        }
+        e += 4 + length;
+      }
+
+      entries.add(
+        ZipEntry(
+          name: name,
+          method: method,
+          compressedSize: compressedSize,
+          size: size,
+          localHeaderOffset: localOffset,
+        ),
+      );
+      p = extraEnd + commentLength;
+    }
+
+    return ZipArchive._(reader, entries);
+  }
+
+  /// Find an entry by its path inside the archive
+  ZipEntry? find(String name) {
+    for (final entry in entries) {
+      if (entry.name == name) return entry;
+    }
+    return null;
+  }
+
+  /// Offset of the entry's data in the archive
+  Future<int> dataOffset(ZipEntry entry) async {
+    final header = await reader.readAt(entry.localHeaderOffset, 30);
+    if (header.length < 30 || _u32(header, 0) != _localSignature) {
+      throw ArchiveException('Corrupt local header for ${entry.name}');
+    }
+    return entry.localHeaderOffset + 30 + _u16(header, 26) + _u16(header, 28);
+  }
+
+  /// Stream the entry's uncompressed bytes
+  ///
+  /// [start]/[end] select a byte range and are only supported for stored
+  /// entries; deflated entries are always streamed from the beginning.
+  Stream<List<int>> read(
+    ZipEntry entry, {
+    int start = 0,
+    int? end,
+    int chunkSize = 1024 * 1024,
+  }) async* {
+    final offset = await dataOffset(entry);
+
+    if (entry.isStored) {
+      final last = min(end ?? entry.size - 1, entry.size - 1);
+      for (int pos = start; pos <= last; pos += chunkSize) {
+        final count = min(chunkSize, last - pos + 1);
+        yield await reader.readAt(offset + pos, count);
+      }
+      return;
+    }
+
+    if (entry.method != 8) {
+      throw ArchiveException('Unsupported compression ${entry.method}');
+    }
+    if (start != 0 || end != null) {
+      throw ArchiveException('Byte ranges need a stored entry');
+    }
+
+    Stream<List<int>> compressed() async* {
+      for (int pos = 0; pos < entry.compressedSize; pos += chunkSize) {
+        yield await reader.readAt(
+          offset + pos,
+          min(chunkSize, entry.compressedSize - pos),
+        );
+      }
+    }
+
+    yield* ZLibDecoder(raw: true).bind(compressed());
+  }
+
+  static int _u16(Uint8List b, int i) => b[i] | (b[i + 1] << 8);
+
+  static int _u32(Uint8List b, int i) =>
+      b[i] | (b[i + 1] << 8) | (b[i + 2] << 16) | (b[i + 3] << 24);
+
+  static int _u64(Uint8List b, int i) => _u32(b, i) + (_u32(b, i + 4) << 32);
+}
+
+/// MIME type for a file name, from its extension
+String mimeTypeForName(String name) {
+  final dot = name.lastIndexOf('.');
+  final ext = dot < 0 ? '' : name.substring(dot + 1).toLowerCase();
+  return switch (ext) {
+    'mp4' || 'm4v' => 'video/mp4',
+    'mkv' => 'video/x-matroska',
+    'webm' => 'video/webm',
+    'mov' => 'video/quicktime',
+    'avi' => 'video/x-msvideo',
+    'ts' => 'video/mp2t',
+    'm4s' => 'video/iso.segment',
+    'm3u8' => 'application/vnd.apple.mpegurl',
+    'mpd' => 'application/dash+xml',
+    'mp3' => 'audio/mpeg',
+    'm4a' || 'm4b' => 'audio/mp4',
+    'aac' => 'audio/aac',
+    'flac' => 'audio/flac',
+    'ogg' || 'oga' => 'audio/ogg',
+    'opus' => 'audio/opus',
+    'wav' => 'audio/wav',
+    'srt' => 'application/x-subrip',
+    'vtt' => 'text/vtt',
+    'jpg' || 'jpeg' => 'image/jpeg',
+    'png' => 'image/png',
+    'pdf' => 'application/pdf',
+    _ => 'application/octet-stream',
+  };
+}
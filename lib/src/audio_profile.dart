@@ -0,0 +1,25 @@
+import 'serving_profile.dart';
+
+/// Settings for [ServingProfile.audio]
+class AudioProfileConfig {
+  /// Serving chunk size; smaller chunks start playback sooner
+  final int chunkSize;
+
+  /// Bytes of the next playlist track to cache ahead for gapless playback
+  final int nextTrackPrefetchBytes;
+
+  /// Fraction of the current track after which the next one is prefetched
+  final double prefetchThreshold;
+
+  const AudioProfileConfig({
+    this.chunkSize = 256 * 1024,
+    this.nextTrackPrefetchBytes = 512 * 1024,
+    this.prefetchThreshold = 0.75,
+  });
+}
+
+/// Response headers of Shoutcast/Icecast streams forwarded to the player
+bool isIcyHeader(String name) {
+  final lower = name.toLowerCase();
+  return lower.startsWith('icy-') || lower.startsWith('ice-');
+}
@@ -0,0 +1,173 @@
+import 'dart:math';
+
+/// Settings for reserving upstream bandwidth for playback
+class BandwidthGuardConfig {
+  /// Upstream capacity in bytes per second; null measures it from the
+  /// fastest transfers seen while nothing was playing
+  final int? capacity;
+
+  /// Share of [capacity] kept for player requests while any are fetching,
+  /// 0 to 1; background transfers get the rest
+  final double playbackShare;
+
+  /// Playback counts as active this long after its last fetched byte, so
+  /// background transfers do not burst between two player requests
+  final Duration linger;
+
+  /// Background transfers pause this long when a player opens a file, so
+  /// its first bytes have the link to themselves
+  final Duration startupHold;
+
+  /// After [startupHold], background transfers get their share back
+  /// gradually over this long instead of at once (once the capacity is
+  /// known or measured)
+  final Duration startupRamp;
+
+  const BandwidthGuardConfig({
+    this.capacity,
+    this.playbackShare = 0.7,
+    this.linger = const Duration(seconds: 3),
+    this.startupHold = Duration.zero,
+    this.startupRamp = Duration.zero,
+  });
+}
+
+/// Paces background transfers so player requests always keep a minimum
+/// share of the upstream link
+///
+/// Player fetches report their bytes with [addPlayback]; background
+/// fetches report theirs with [addBackground] and pause for the returned
+/// delay. While no player is fetching, background transfers run at full
+/// speed and their throughput is used to measure the link when no
+/// [BandwidthGuardConfig.capacity] is configured.
+///
+/// When a player opens a file ([sessionStarted]) background transfers
+/// pause for [BandwidthGuardConfig.startupHold], then ramp back up over
+/// [BandwidthGuardConfig.startupRamp].
+class BandwidthGuard {
+  final BandwidthGuardConfig config;
+
+  final Stopwatch _clock = Stopwatch()..start();
+  int _playing = 0;
+  Duration? _lastPlayback;
+  Duration? _sessionStart;
+
+  // Background budget: when the next background byte may be fetched
+  Duration _nextBackground = Duration.zero;
+
+  // Link measurement: bytes of the current one-second window and the
+  // rates of recent windows without playback
+  int _windowStart = 0;
+  int _windowBytes = 0;
+  bool _windowPlayed = false;
+  final List<int> _idleRates = [];
+
+  BandwidthGuard([this.config = const BandwidthGuardConfig()]);
+
+  /// Whether player requests are fetching or have just been
+  bool get playbackActive {
+    if (_playing > 0) return true;
+    final last = _lastPlayback;
+    return last != null && _clock.elapsed - last < config.linger;
+  }
+
+  /// Upstream capacity in bytes per second, configured or measured; null
+  /// until something has been measured
+  int? get capacity {
+    final configured = config.capacity;
+    if (configured != null) return configured;
+    return _idleRates.isEmpty ? null : _idleRates.reduce(max);
+  }
+
+  /// Bytes per second background transfers may use right now; null when
+  /// unlimited
+  int? get backgroundLimit {
+    final link = capacity;
+    final startup = _startupShare;
+    if ((!playbackActive && startup == null) || link == null) return null;
+    final share = playbackActive ? 1 - config.playbackShare.clamp(0, 1) : 1;
+    return (link * share * (startup ?? 1)).floor();
+  }
+
+  /// Share of their usual limit background transfers get while a player
+  /// starts up: 0 during the hold, rising to 1 over the ramp; null once
+  /// startup is over
+  double? get _startupShare {
+    final start = _sessionStart;
+    if (start == null) return null;
+    final since = _clock.elapsed - start - config.startupHold;
+    if (since < Duration.zero) return 0;
+    final ramp = config.startupRamp;
+    if (since >= ramp) return null;
+    return since.inMicroseconds / ramp.inMicroseconds;
+  }
+
+  /// A player opened a file: hold background transfers back for startup
+  void sessionStarted() {
+    if (config.startupHold > Duration.zero ||
+        config.startupRamp > Duration.zero) {
+      _sessionStart = _clock.elapsed;
+    }
+  }
+
+  /// A player request started fetching from upstream
+  void playbackStarted() {
+    _playing++;
+    _lastPlayback = _clock.elapsed;
+  }
+
+  /// A player request stopped fetching (done, failed or cancelled)
+  void playbackFinished() {
+    if (_playing > 0) _playing--;
+    _lastPlayback = _clock.elapsed;
+  }
+
+  /// Account for [bytes] fetched for a player
+  void addPlayback(int bytes) {
+    _lastPlayback = _clock.elapsed;
+    _measure(bytes, playback: true);
+  }
+
+  /// Account for [bytes] fetched in the background and return how long
+  /// the transfer should pause before fetching more
+  Duration addBackground(int bytes) {
+    _measure(bytes, playback: false);
+    final now = _clock.elapsed;
+
+    // Wait out the startup hold whatever the link
+    final start = _sessionStart;
+    if (start != null && now - start < config.startupHold) {
+      return start + config.startupHold - now;
+    }
+
+    final limit = backgroundLimit;
+    if (limit == null) {
+      _nextBackground = now;
+      return Duration.zero;
+    }
+    if (limit <= 0) return config.linger;
+
+    // One budget for all background transfers together
+    final from = _nextBackground > now ? _nextBackground : now;
+    _nextBackground = from + Duration(microseconds: bytes * 1000000 ~/ limit);
+    return _nextBackground - now;
+  }
+
+  void _measure(int bytes, {required bool playback}) {
+    final second = _clock.elapsedMilliseconds ~/ 1000;
+    if (second != _windowStart) {
+      // Only windows without playback show what the link can do:
+      // with playback the background was held back on purpose
+      if (!_windowPlayed && second == _windowStart + 1) {
+        _idleRates.add(_windowBytes);
+        if (_idleRates.length > 60) _idleRates.removeAt(0);
+      }
+      _windowStart = second;
+      _windowBytes = 0;
+      _windowPlayed = false;
+    }
+    _windowBytes += bytes;
+    _windowPlayed =
+        _windowPlayed || playback || playbackActive || _startupShare != null;
+  }
+}
@@ -0,0 +1,257 @@
+import 'dart:async';
+import 'dart:io';
+import 'dart:math';
+
+import 'url_signing.dart';
+
+/// How a synthetic player moves through a file
+enum SeekPattern {
+  /// Start to end, then from the start again
+  linear,
+
+  /// Linear, jumping to a random position every `seekInterval`
+  seeking,
+
+  /// A random position for every request, like dragging the seek bar
+  scrubbing,
+}
+
+/// Settings for a [LoadGenerator] run
+class BenchConfig {
+  /// Base URL of the running proxy, e.g. `http://127.0.0.1:8080`
+  final Uri proxy;
+
+  /// Remote URLs to play; players take them in turn
+  final List<String> urls;
+
+  /// Synthetic players streaming at once
+  final int players;
+
+  /// How long the run lasts
+  final Duration duration;
+
+  final SeekPattern pattern;
+
+  /// Bits per second each player consumes once playing
+  final int bitrate;
+
+  /// Bytes per range request
+  final int requestSize;
+
+  /// Seconds of media a player buffers before it waits for playback
+  final Duration bufferTarget;
+
+  /// Time between jumps of [SeekPattern.seeking]
+  final Duration seekInterval;
+
+  /// Seed of the random positions, so runs can be repeated
+  final int seed;
+
+  /// Signs the stream URLs with the proxy's key; null sends raw `?url=`,
+  /// which the proxy only takes with `allowUnsignedUrls`
+  final UrlSigner? signer;
+
+  const BenchConfig({
+    required this.proxy,
+    required this.urls,
+    this.players = 4,
+    this.duration = const Duration(seconds: 30),
+    this.pattern = SeekPattern.linear,
+    this.bitrate = 5000000,
+    this.requestSize = 2 * 1024 * 1024,
+    this.bufferTarget = const Duration(seconds: 30),
+    this.seekInterval = const Duration(seconds: 10),
+    this.seed = 1,
+    this.signer,
+  });
+}
+
+/// Outcome of a [LoadGenerator] run
+class BenchReport {
+  int requests = 0;
+  int errors = 0;
+  int bytes = 0;
+  int seeks = 0;
+
+  /// Times the playback buffer ran dry while waiting for a response
+  int stalls = 0;
+  Duration stallTime = Duration.zero;
+  Duration elapsed = Duration.zero;
+
+  /// Time to first byte of every successful request
+  final List<Duration> timesToFirstByte = [];
+
+  /// Time to first byte at [percentile] (0-100)
+  Duration ttfb(double percentile) {
+    if (timesToFirstByte.isEmpty) return Duration.zero;
+    final sorted = [...timesToFirstByte]..sort();
+    return sorted[((sorted.length - 1) * percentile / 100).round()];
+  }
+
+  /// Bytes per second received by all players together
+  double get throughput => elapsed.inMicroseconds == 0
+      ? 0
+      : bytes * 1000000 / elapsed.inMicroseconds;
+
+  Map<String, Object> toJson() => {
+    'requests': requests,
+    'errors': errors,
+    'bytes': bytes,
+    'seeks': seeks,
+    'stalls': stalls,
+    'stallMs': stallTime.inMilliseconds,
+    'elapsedMs': elapsed.inMilliseconds,
+    'ttfbP50Ms': ttfb(50).inMicroseconds / 1000,
+    'ttfbP99Ms': ttfb(99).inMicroseconds / 1000,
+    'throughput': throughput,
+  };
+
+  @override
+  String toString() =>
+      'BenchReport(requests: $requests, errors: $errors, '
+      'ttfb p50: ${ttfb(50).inMilliseconds} ms, '
+      'p99: ${ttfb(99).inMilliseconds} ms, '
+      'stalls: $stalls (${stallTime.inMilliseconds} ms), '
+      'throughput: ${(throughput / 1024 / 1024).toStringAsFixed(1)} MB/s)';
+}
+
+/// Synthetic players against a running proxy, for sizing hardware and
+/// checking tuning changes
+///
+/// Each player requests [BenchConfig.requestSize] ranges through the
+/// proxy and plays them back at [BenchConfig.bitrate]: it fetches ahead
+/// up to [BenchConfig.bufferTarget], then waits for playback like a real
+/// player. A response that arrives after the buffer ran out is a stall.
+/// Players identify as `bench-<n>` clients, so fair scheduling treats them
+/// as separate devices.
+class LoadGenerator {
+  final BenchConfig config;
+
+  LoadGenerator(this.config);
+
+  /// Run all players for [BenchConfig.duration]
+  Future<BenchReport> run() async {
+    if (config.urls.isEmpty) {
+      throw ArgumentError.value(config.urls, 'urls', 'No URLs to play');
+    }
+    final report = BenchReport();
+    final client = HttpClient();
+    final stopwatch = Stopwatch()..start();
+    try {
+      await Future.wait([
+        for (int i = 0; i < config.players; i++)
+          _play(i, client, report, stopwatch),
+      ]);
+    } finally {
+      client.close(force: true);
+    }
+    report.elapsed = stopwatch.elapsed;
+    return report;
+  }
+
+  Future<void> _play(
+    int index,
+    HttpClient client,
+    BenchReport report,
+    Stopwatch clock,
+  ) async {
+    final random = Random(config.seed + index);
+    final url = config.urls[index % config.urls.length];
+    final signer = config.signer;
+    final uri = config.proxy.replace(
+      path: signer == null ? '/stream' : '/stream/${signer.sign(url)}',
+      queryParameters: {
+        if (signer == null) 'url': url,
+        'client': 'bench-$index',
+      },
+    );
+    final mediaPerByte = 8 * 1000000 / config.bitrate; // microseconds
+
+    int? totalSize;
+    var pos = 0;
+    var buffered = 0.0; // microseconds of media ahead of the playhead
+    var playing = false;
+    var lastSeek = clock.elapsed;
+
+    while (clock.elapsed < config.duration) {
+      final seek = switch (config.pattern) {
+        SeekPattern.linear => false,
+        SeekPattern.seeking => clock.elapsed - lastSeek >= config.seekInterval,
+        SeekPattern.scrubbing => true,
+      };
+      if (totalSize != null && (seek || pos >= totalSize)) {
+        pos = seek ? random.nextInt(totalSize) : 0;
+        buffered = 0;
+        playing = false;
+        lastSeek = clock.elapsed;
+        if (seek) report.seeks++;
+      }
+
+      final requested = clock.elapsed;
+      var received = 0;
+      try {
+        final request = await client.getUrl(uri);
+        request.headers.set(
+          'Range',
+          'bytes=$pos-${pos + config.requestSize - 1}',
+        );
+        final response = await request.close();
+        if (response.statusCode != HttpStatus.partialContent &&
+            response.statusCode != HttpStatus.ok) {
+          await response.drain<void>();
+          throw HttpException('Status ${response.statusCode}', uri: uri);
+        }
+        totalSize ??= _totalSize(response);
+
+        await for (final chunk in response) {
+          if (received == 0) {
+            report.timesToFirstByte.add(clock.elapsed - requested);
+          }
+          received += chunk.length;
+        }
+      } catch (_) {
+        report.errors++;
+        await Future<void>.delayed(const Duration(milliseconds: 100));
+        continue;
+      }
+      report.requests++;
+      report.bytes += received;
+      if (received == 0) {
+        // Past the end: start over (the size is learnt from this response)
+        pos = totalSize ?? 0;
+        continue;
+      }
+      pos += received;
+
+      // Playback consumed the buffer while the request was in flight
+      final waited = (clock.elapsed - requested).inMicroseconds;
+      if (playing) {
+        buffered -= waited;
+        if (buffered < 0) {
+          report.stalls++;
+          report.stallTime += Duration(microseconds: -buffered.round());
+          buffered = 0;
+        }
+      }
+      buffered += received * mediaPerByte;
+      playing = true;
+
+      final ahead = buffered - config.bufferTarget.inMicroseconds;
+      if (ahead > 0) {
+        final remaining = config.duration - clock.elapsed;
+        final wait = Duration(microseconds: ahead.round());
+        await Future<void>.delayed(wait < remaining ? wait : remaining);
+        buffered -= wait.inMicroseconds;
+      }
+    }
+  }
+
+  /// Total size from `Content-Range: bytes 0-99/1234`, else the length of
+  /// a full response
+  static int? _totalSize(HttpClientResponse response) {
+    final range = response.headers.value('content-range');
+    final match = range == null ? null : RegExp(r'/(\d+)$').firstMatch(range);
+    if (match != null) return int.parse(match.group(1)!);
+    return response.contentLength >= 0 ? response.contentLength : null;
+  }
+}
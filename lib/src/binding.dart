@@ -0,0 +1,166 @@
+import 'dart:async';
+import 'dart:collection';
+import 'dart:convert';
+
+import 'events.dart';
+import 'logger.dart';
+import 'secret_store.dart';
+import 'streamproxy.dart';
+
+/// A flat facade over [StreamProxyBridge] for callers across a language
+/// boundary: platform channels, FFI shims, a native shell embedding the
+/// Dart runtime
+///
+/// Only strings, ints and bools go in and out: structured values are JSON
+/// strings and files are addressed by their ID. Nothing throws; a method
+/// that fails returns -1, false or an empty string, and [lastError] tells
+/// why. Events are queued here and fetched with [pollEvents], so no
+/// callback has to cross the boundary.
+class ProxyBinding {
+  ProxyBinding._();
+
+  static StreamProxyBridge? _proxy;
+  static StreamSubscription<ProxyEvent>? _subscription;
+  static final Queue<ProxyEvent> _events = Queue();
+  static final MemorySecretStore _secrets = MemorySecretStore();
+  static String _lastError = '';
+
+  /// Events kept for [pollEvents]; the oldest are dropped beyond it
+  static int maxQueuedEvents = 1000;
+
+  /// Why the last call that failed did; empty when none has
+  static String lastError() => _lastError;
+
+  /// Hand the proxy secret [name] (see `SecretStore`), e.g. a key the
+  /// host keeps in the Android Keystore; call before [startProxy]
+  ///
+  /// Secrets handed over live in memory only; without a `signing_key`
+  /// the proxy keeps its own in the storage folder.
+  static bool putSecret(String name, String value) {
+    try {
+      SecretStore.checkName(name);
+    } on ArgumentError catch (e) {
+      _lastError = '${e.message}';
+      return false;
+    }
+    unawaited(_secrets.write(name, value));
+    return true;
+  }
+
+  /// Start the proxy caching in [storageDir] on [port] (0 picks a free
+  /// one); returns the port bound, or -1
+  static Future<int> startProxy(String storageDir, int port) =>
+      _guard(-1, () async {
+        final proxy =
+            _proxy ??
+            await StreamProxyBridge.getInstance(
+              port: port,
+              storageDir: storageDir,
+              secrets: _secrets.isEmpty ? null : _secrets,
+            );
+        if (_proxy == null) {
+          _proxy = proxy;
+          _subscription = proxy.events.listen((event) {
+            _events.add(event);
+            while (_events.length > maxQueuedEvents) {
+              _events.removeFirst();
+            }
+          });
+        }
+        return proxy.port;
+      });
+
+  /// Stop the proxy cleanly (see [StreamProxyBridge.stop])
+  static Future<bool> stopProxy() => _guard(false, () async {
+    final proxy = _proxy;
+    if (proxy == null) return true;
+    _proxy = null;
+    await _subscription?.cancel();
+    _subscription = null;
+    await proxy.stop();
+    return true;
+  });
+
+  /// Whether the proxy is running
+  static bool isRunning() => _proxy != null;
+
+  /// Proxy URL a player streams [url] from
+  static String proxyUrl(String url) =>
+      _proxy?.getProxyUrl(url).toString() ?? _notRunning('');
+
+  /// Download [url] whole in the background; returns its file ID
+  static Future<String> startDownload(String url) => _guard('', () async {
+    final proxy = _running();
+    final fileId = await proxy.enqueueDownload(url);
+    if (fileId == null) throw StateError('Size of $url unknown');
+    return fileId;
+  });
+
+  static Future<bool> pauseDownload(String fileId) => _guard(false, () async {
+    await _running().pause(fileId);
+    return true;
+  });
+
+  static Future<bool> resumeDownload(String fileId) => _guard(false, () async {
+    await _running().resume(fileId);
+    return true;
+  });
+
+  /// Stop downloading [fileId], and delete what is cached of it when
+  /// [deleteData]
+  static Future<bool> cancelDownload(String fileId, bool deleteData) =>
+      _guard(false, () async {
+        await _running().cancel(fileId, deleteData: deleteData);
+        return true;
+      });
+
+  /// State of [fileId] (a `DownloadState` name); empty when unknown
+  static String downloadState(String fileId) =>
+      _proxy?.getDownload(fileId)?.state.name ?? '';
+
+  /// JSON object describing [fileId], as `GET /api/downloads/<id>`;
+  /// empty when it is not cached
+  static Future<String> download(String fileId) => _guard('', () async {
+    final info = await _running().downloadInfo(fileId);
+    if (info == null) throw StateError('$fileId is not cached');
+    return jsonEncode(info);
+  });
+
+  /// JSON array describing every cached file, as `GET /api/downloads`
+  static Future<String> downloads() => _guard('', () async {
+    final proxy = _running();
+    final entries = [
+      for (final id in await proxy.getCachedFileIds())
+        await proxy.downloadInfo(id),
+    ];
+    return jsonEncode(entries.whereType<Map<String, Object?>>().toList());
+  });
+
+  /// Up to [max] queued events as a JSON array, oldest first (see
+  /// `ProxyEvent.toJson`); they are removed from the queue
+  static String pollEvents(int max) {
+    final taken = [
+      for (int i = 0; i < max && _events.isNotEmpty; i++)
+        _events.removeFirst().toJson(),
+    ];
+    return jsonEncode(taken);
+  }
+
+  static StreamProxyBridge _running() =>
+      _proxy ?? (throw StateError('Proxy not running'));
+
+  static T _notRunning<T>(T result) {
+    _lastError = 'Proxy not running';
+    return result;
+  }
+
+  static Future<T> _guard<T>(T failed, Future<T> Function() action) async {
+    try {
+      return await action();
+    } catch (e) {
+      _lastError = '$e';
+      Logger.error('Binding call failed: $e');
+      return failed;
+    }
+  }
+}
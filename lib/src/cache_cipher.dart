@@ -0,0 +1,82 @@
+import 'dart:convert';
+import 'dart:math';
+import 'dart:typed_data';
+
+import 'package:crypto/crypto.dart';
+import 'package:pointycastle/export.dart';
+
+/// Encrypts cached media files at rest with a user-supplied key
+///
+/// AES-256-CTR: the keystream at any offset can be computed directly, so
+/// ranges are written and read independently in any order, exactly as in
+/// a plaintext sparse file, and the file keeps its size. Each file has
+/// its own random nonce (kept in its `.meta`), so no two files, nor two
+/// versions of one, share a keystream.
+///
+/// There is no authentication tag: bytes are checked against checksums
+/// where those are known (see `Scrubber`), not by the cipher.
+class CacheCipher {
+  /// Length of a per-file nonce; the other 8 bytes of the counter block
+  /// count 16-byte blocks into the file
+  static const int nonceLength = 8;
+
+  static const int _block = 16;
+
+  static final Random _random = Random.secure();
+
+  final Uint8List _key;
+
+  CacheCipher(List<int> key) : _key = _derive(key) {
+    if (key.isEmpty) {
+      throw ArgumentError.value(key, 'key', 'must not be empty');
+    }
+  }
+
+  /// Build a cipher from a passphrase
+  factory CacheCipher.fromPassphrase(String passphrase) =>
+      CacheCipher(utf8.encode(passphrase));
+
+  static Uint8List _derive(List<int> key) => Uint8List.fromList(
+    Hmac(sha256, key).convert(utf8.encode('downstream-cache-enc')).bytes,
+  );
+
+  /// A fresh nonce for a new file
+  Uint8List newNonce() {
+    final nonce = Uint8List(nonceLength);
+    for (int i = 0; i < nonceLength; i++) {
+      nonce[i] = _random.nextInt(256);
+    }
+    return nonce;
+  }
+
+  /// Encrypt or decrypt (the same operation) [data] found at [offset] of
+  /// the file with [nonce]
+  Uint8List apply(List<int> nonce, int offset, List<int> data) {
+    if (nonce.length != nonceLength) {
+      throw ArgumentError.value(nonce, 'nonce', '$nonceLength bytes');
+    }
+    final iv = Uint8List(_block)..setRange(0, nonceLength, nonce);
+    ByteData.sublistView(iv).setUint64(nonceLength, offset ~/ _block);
+    final cipher = CTRStreamCipher(AESEngine())
+      ..init(true, ParametersWithIV(KeyParameter(_key), iv));
+
+    // Start mid-block by discarding the keystream before [offset]
+    final skip = offset % _block;
+    final input = Uint8List(skip + data.length)
+      ..setRange(skip, skip + data.length, data);
+    return Uint8List.sublistView(cipher.process(input), skip);
+  }
+
+  /// [apply] to a stream of the file with [nonce] starting at [offset]
+  Stream<List<int>> applyStream(
+    List<int> nonce,
+    int offset,
+    Stream<List<int>> stream,
+  ) async* {
+    var pos = offset;
+    await for (final chunk in stream) {
+      yield apply(nonce, pos, chunk);
+      pos += chunk.length;
+    }
+  }
+}
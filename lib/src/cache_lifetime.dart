@@ -0,0 +1,38 @@
+/// How long a cached URL may be kept, e.g. rented content or a temporary
+/// link
+///
+/// Once [expiresAt] passes the file is deleted, pinned or not and
+/// whatever the quota: its cache and, once complete, the copy in the
+/// collection.
+class CacheLifetime {
+  final DateTime expiresAt;
+
+  /// Where the completed file went (a path or content URI); null until
+  /// it completes
+  String? completedPath;
+
+  CacheLifetime(this.expiresAt, {this.completedPath});
+
+  /// A lifetime of [ttl] from [now]
+  factory CacheLifetime.fromNow(Duration ttl, {DateTime? now}) =>
+      CacheLifetime((now ?? DateTime.now()).add(ttl));
+
+  bool isExpired(DateTime now) => !now.isBefore(expiresAt);
+
+  /// Time left before it expires, zero once it has
+  Duration remaining(DateTime now) =>
+      isExpired(now) ? Duration.zero : expiresAt.difference(now);
+
+  Map<String, dynamic> toJson() => {
+    'expiresAt': expiresAt.toIso8601String(),
+    if (completedPath != null) 'completedPath': completedPath,
+  };
+
+  factory CacheLifetime.fromJson(Map<String, dynamic> json) => CacheLifetime(
+    DateTime.parse(json['expiresAt'] as String),
+    completedPath: json['completedPath'] as String?,
+  );
+
+  @override
+  String toString() => 'CacheLifetime(until $expiresAt)';
+}
@@ -0,0 +1,61 @@
+/// Disk budget for the cache folder
+///
+/// Only the sparse cache counts; files moved to the collection are never
+/// evicted.
+class CacheQuotaConfig {
+  /// Cached bytes kept at most
+  final int maxBytes;
+
+  /// How often usage is checked
+  final Duration checkInterval;
+
+  /// Files read more recently than this are never evicted
+  final Duration activeGrace;
+
+  const CacheQuotaConfig({
+    required this.maxBytes,
+    this.checkInterval = const Duration(minutes: 1),
+    this.activeGrace = const Duration(minutes: 2),
+  });
+}
+
+/// Disk usage of one cached file
+class CacheUsage {
+  final String fileId;
+  final int bytes;
+  final DateTime lastAccess;
+
+  /// Exempt from eviction (pinned, playing, downloading)
+  final bool protected;
+
+  const CacheUsage(
+    this.fileId,
+    this.bytes,
+    this.lastAccess, {
+    this.protected = false,
+  });
+}
+
+/// Least-recently-used eviction under [CacheQuotaConfig.maxBytes]
+class CacheQuota {
+  /// Files to delete, oldest access first, until the rest fits [maxBytes]
+  ///
+  /// Protected files count towards usage but are never chosen, so the
+  /// result may leave usage above the budget.
+  static List<CacheUsage> selectEvictions(
+    Iterable<CacheUsage> files,
+    int maxBytes,
+  ) {
+    int total = files.fold(0, (sum, f) => sum + f.bytes);
+    final candidates = files.where((f) => !f.protected).toList()
+      ..sort((a, b) => a.lastAccess.compareTo(b.lastAccess));
+
+    final evict = <CacheUsage>[];
+    for (final file in candidates) {
+      if (total <= maxBytes) break;
+      evict.add(file);
+      total -= file.bytes;
+    }
+    return evict;
+  }
+}
@@ -0,0 +1,16 @@
+import 'dart:typed_data';
+
+/// Random access to a remote file through the sparse cache
+///
+/// Reads are served from disk when cached; missing bytes are fetched from
+/// upstream, written to the cache, then returned. Obtain one from
+/// `StreamProxyBridge.openReader`.
+abstract class CacheReader {
+  /// Total size of the remote file
+  int get length;
+
+  /// Read up to [count] bytes starting at [offset]
+  ///
+  /// Returns fewer bytes only at end of file.
+  Future<Uint8List> readAt(int offset, int count);
+}
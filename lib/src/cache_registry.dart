@@ -0,0 +1,132 @@
+import 'dart:convert';
+
+import 'package:crypto/crypto.dart';
+
+/// What the registry knows about one cached file
+class CacheEntry {
+  final String fileId;
+  final String url;
+
+  /// Total size in bytes, once the origin reported it
+  final int? size;
+  final String? contentType;
+  final DateTime createdAt;
+
+  const CacheEntry(
+    this.fileId,
+    this.url, {
+    this.size,
+    this.contentType,
+    required this.createdAt,
+  });
+
+  Map<String, dynamic> toJson() => {
+    'fileId': fileId,
+    'url': url,
+    'size': size,
+    'contentType': contentType,
+    'createdAt': createdAt.toIso8601String(),
+  };
+
+  factory CacheEntry.fromJson(Map<String, dynamic> json) => CacheEntry(
+    json['fileId'] as String,
+    json['url'] as String,
+    size: json['size'] as int?,
+    contentType: json['contentType'] as String?,
+    createdAt: DateTime.parse(json['createdAt'] as String),
+  );
+}
+
+/// File IDs of cached URLs, and the URL, size and type behind each ID
+///
+/// An ID is the first 16 hex digits of the URL's SHA-256, which keeps
+/// file names short and matches caches written before the registry. Two
+/// URLs sharing those digits would overwrite each other's cache, so a
+/// URL whose short ID is taken by another gets the whole digest instead.
+class CacheRegistry {
+  static const int _shortLength = 16;
+
+  final Map<String, CacheEntry> _byId = {};
+  final Map<String, String> _idByUrl = {};
+
+  CacheRegistry();
+
+  /// File ID of [url]: the one it is registered under, else its short ID
+  /// unless another URL holds that
+  String idFor(String url) {
+    final known = _idByUrl[url];
+    if (known != null) return known;
+    final digest = sha256.convert(utf8.encode(url)).toString();
+    final short = digest.substring(0, _shortLength);
+    final holder = _byId[short];
+    return holder == null || holder.url == url ? short : digest;
+  }
+
+  /// URL cached as [fileId]; null when unknown
+  String? lookupUrl(String fileId) => _byId[fileId]?.url;
+
+  /// Entry of [fileId]; null when unknown
+  CacheEntry? operator [](String fileId) => _byId[fileId];
+
+  /// Every registered file, oldest first
+  List<CacheEntry> get entries => _byId.values.toList()
+    ..sort((a, b) => a.createdAt.compareTo(b.createdAt));
+
+  int get length => _byId.length;
+
+  /// Register [url] as [fileId], keeping the first creation time; true
+  /// when the entry is new or changed
+  bool record(
+    String fileId,
+    String url, {
+    int? size,
+    String? contentType,
+    DateTime? now,
+  }) {
+    final old = _byId[fileId];
+    if (old != null &&
+        old.url == url &&
+        old.size == (size ?? old.size) &&
+        old.contentType == (contentType ?? old.contentType)) {
+      return false;
+    }
+    if (old != null && old.url != url) _idByUrl.remove(old.url);
+    _byId[fileId] = CacheEntry(
+      fileId,
+      url,
+      size: size ?? (old?.url == url ? old?.size : null),
+      contentType:
+          contentType ?? (old?.url == url ? old?.contentType : null),
+      createdAt: old?.url == url ? old!.createdAt : now ?? DateTime.now(),
+    );
+    _idByUrl[url] = fileId;
+    return true;
+  }
+
+  /// Drop [fileId], e.g. once its cache was deleted
+  bool forget(String fileId) {
+    final old = _byId.remove(fileId);
+    if (old == null) return false;
+    _idByUrl.remove(old.url);
+    return true;
+  }
+
+  void clear() {
+    _byId.clear();
+    _idByUrl.clear();
+  }
+
+  List<Map<String, dynamic>> toJson() => [
+    for (final entry in _byId.values) entry.toJson(),
+  ];
+
+  factory CacheRegistry.fromJson(List<dynamic> json) {
+    final registry = CacheRegistry();
+    for (final item in json) {
+      final entry = CacheEntry.fromJson(item as Map<String, dynamic>);
+      registry._byId[entry.fileId] = entry;
+      registry._idByUrl[entry.url] = entry.fileId;
+    }
+    return registry;
+  }
+}
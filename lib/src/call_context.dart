@@ -0,0 +1,94 @@
+import 'dart:async';
+
+/// Thrown when a [CallContext] is cancelled explicitly
+class CallCancelledException implements Exception {
+  final String message;
+
+  CallCancelledException([this.message = 'Operation cancelled']);
+
+  @override
+  String toString() => 'CallCancelledException: $message';
+}
+
+/// Cancellation signal and optional deadline for a public API call
+///
+/// Pass one to any operation that accepts `context:` to bound it. Deadline
+/// expiry fails the call with a [TimeoutException], [cancel] with a
+/// [CallCancelledException]. A child context ends when its parent does.
+class CallContext {
+  final DateTime? deadline;
+
+  final Completer<void> _done = Completer<void>();
+  Timer? _timer;
+  Exception? _error;
+
+  CallContext({Duration? timeout, CallContext? parent})
+    : deadline = _earliest(
+        timeout == null ? null : DateTime.now().add(timeout),
+        parent?.deadline,
+      ) {
+    final d = deadline;
+    if (d != null) {
+      _timer = Timer(d.difference(DateTime.now()), () {
+        _finish(TimeoutException('Deadline exceeded'));
+      });
+    }
+    if (parent != null) {
+      unawaited(parent.done.then((_) => _finish(parent.error!)));
+    }
+  }
+
+  static DateTime? _earliest(DateTime? a, DateTime? b) {
+    if (a == null) return b;
+    if (b == null) return a;
+    return a.isBefore(b) ? a : b;
+  }
+
+  /// Completes when the context is cancelled or its deadline passes
+  Future<void> get done => _done.future;
+
+  /// Why the context ended, or null while it is still live
+  Exception? get error => _error;
+
+  /// Check whether the context has ended
+  bool get isDone => _error != null;
+
+  /// Time left until the deadline, or null without one
+  Duration? get remaining => deadline?.difference(DateTime.now());
+
+  /// Cancel the context (and every child context)
+  void cancel([String reason = 'Operation cancelled']) {
+    _finish(CallCancelledException(reason));
+  }
+
+  void _finish(Exception error) {
+    if (_done.isCompleted) return;
+    _error = error;
+    _timer?.cancel();
+    _done.complete();
+  }
+
+  /// Throw the context error if it has ended
+  void throwIfDone() {
+    if (_error != null) throw _error!;
+  }
+
+  /// Complete with [future], or fail as soon as the context ends
+  Future<T> guard<T>(Future<T> future) {
+    if (_error != null) return Future.error(_error!);
+
+    final completer = Completer<T>();
+    future.then(
+      (value) {
+        if (!completer.isCompleted) completer.complete(value);
+      },
+      onError: (Object e, StackTrace st) {
+        if (!completer.isCompleted) completer.completeError(e, st);
+      },
+    );
+    done.then((_) {
+      if (!completer.isCompleted) completer.completeError(_error!);
+    });
+    return completer.future;
+  }
+}
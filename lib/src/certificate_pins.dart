@@ -0,0 +1,81 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:typed_data';
+
+import 'package:crypto/crypto.dart';
+
+/// Pins for an origin's TLS certificate (see `HostPolicy.pins`)
+///
+/// `sha256/<base64>` pins the SHA-256 of the certificate's public key
+/// (its SubjectPublicKeyInfo), which survives renewals that keep the key;
+/// `cert-sha256/<base64>` pins one exact certificate. Print the pins of a
+/// server's certificate with [pinsOf] to configure them.
+class CertificatePins {
+  /// Whether [cert] matches any of [pins]
+  static bool matches(List<String> pins, X509Certificate cert) {
+    final presented = pinsOf(cert.der);
+    return pins.any(presented.contains);
+  }
+
+  /// The `sha256/` and `cert-sha256/` pins of a DER-encoded certificate
+  static List<String> pinsOf(Uint8List der) => [
+    'sha256/${_digest(subjectPublicKeyInfo(der))}',
+    'cert-sha256/${_digest(der)}',
+  ];
+
+  static String _digest(List<int> bytes) =>
+      base64.encode(sha256.convert(bytes).bytes);
+
+  /// The SubjectPublicKeyInfo element of a DER-encoded X.509 certificate
+  static Uint8List subjectPublicKeyInfo(Uint8List der) {
+    // Certificate ::= SEQUENCE { tbsCertificate, ... }
+    final (_, certificate, _) = _element(der, 0);
+    final (_, tbs, _) = _element(der, certificate);
+    // tbsCertificate ::= SEQUENCE { [0] version OPTIONAL, serialNumber,
+    //   signature, issuer, validity, subject, subjectPublicKeyInfo, ... }
+    var pos = tbs;
+    final (tag, _, versionEnd) = _element(der, pos);
+    if (tag == 0xA0) pos = versionEnd;
+    for (int i = 0; i < 5; i++) {
+      pos = _element(der, pos).$3;
+    }
+    return Uint8List.sublistView(der, pos, _element(der, pos).$3);
+  }
+
+  /// Tag, content start and end of the DER element at [offset]
+  static (int, int, int) _element(Uint8List der, int offset) {
+    if (offset + 2 > der.length) {
+      throw const FormatException('Truncated certificate');
+    }
+    final tag = der[offset];
+    var length = der[offset + 1];
+    var pos = offset + 2;
+    if (length & 0x80 != 0) {
+      final count = length & 0x7F;
+      length = 0;
+      for (int i = 0; i < count; i++) {
+        length = (length << 8) | der[pos++];
+      }
+    }
+    if (pos + length > der.length) {
+      throw const FormatException('Truncated certificate');
+    }
+    return (tag, pos, pos + length);
+  }
+}
+
+/// A host's certificate matched none of its pins
+class CertificatePinException implements Exception {
+  final String host;
+
+  /// `sha256/` pin of the certificate presented, when there was one
+  final String? presented;
+
+  const CertificatePinException(this.host, [this.presented]);
+
+  @override
+  String toString() => presented == null
+      ? 'CertificatePinException: $host is pinned but not served over TLS'
+      : 'CertificatePinException: $host presented $presented, '
+            'which matches none of its pins';
+}
@@ -0,0 +1,92 @@
+import 'dart:io';
+
+import 'data_source.dart';
+
+/// How upstream connections are made
+///
+/// The proxy builds one `HttpClient` from this and shares it between all
+/// files, so segments and ranges of one origin reuse kept-alive
+/// connections instead of opening a new one each.
+class ClientConfig {
+  /// Time to open a connection, TLS handshake included
+  final Duration connectTimeout;
+
+  /// Time from sending a request to its response headers; a timeout is
+  /// retried like a connection error
+  final Duration responseHeaderTimeout;
+
+  /// Longest wait for the next bytes of a response body; a stalled body
+  /// is cut off and resumed like a dropped connection
+  ///
+  /// Time the proxy itself holds the body back (a slow player, a rate
+  /// limit) does not count.
+  final Duration readTimeout;
+
+  /// How long an idle connection is kept for reuse
+  final Duration idleTimeout;
+
+  /// Open connections per host at most; null for no limit
+  final int? maxConnectionsPerHost;
+
+  /// Outbound proxy, `http://[user:password@]host[:port]`
+  ///
+  /// `https` requests are tunnelled through it with `CONNECT`. dart:io
+  /// has no SOCKS client, so only HTTP proxies are accepted.
+  final String? proxyUrl;
+
+  /// Trusted roots and client certificate; null for the system roots
+  final SecurityContext? securityContext;
+
+  /// Accept any certificate, e.g. a self-signed upstream
+  ///
+  /// Anyone on the path can then read and change the traffic; prefer
+  /// trusting the certificate in [securityContext] or pinning it in a
+  /// host policy.
+  final bool allowInsecureCertificates;
+
+  const ClientConfig({
+    this.connectTimeout = const Duration(seconds: 15),
+    this.responseHeaderTimeout = const Duration(seconds: 30),
+    this.readTimeout = const Duration(seconds: 60),
+    this.idleTimeout = const Duration(seconds: 15),
+    this.maxConnectionsPerHost,
+    this.proxyUrl,
+    this.securityContext,
+    this.allowInsecureCertificates = false,
+  });
+
+  /// The proxy of [proxyUrl]; throws an [ArgumentError] when it is not an
+  /// HTTP proxy URL
+  ProxyConfig? get proxy {
+    final url = proxyUrl;
+    if (url == null) return null;
+    final uri = Uri.parse(url);
+    if (uri.scheme != 'http' || uri.host.isEmpty) {
+      throw ArgumentError.value(url, 'proxyUrl', 'Not an HTTP proxy URL');
+    }
+    final credentials = uri.userInfo.split(':');
+    return ProxyConfig(
+      host: uri.host,
+      port: uri.hasPort ? uri.port : 80,
+      username: uri.userInfo.isEmpty
+          ? null
+          : Uri.decodeComponent(credentials.first),
+      password: credentials.length < 2
+          ? null
+          : Uri.decodeComponent(credentials.skip(1).join(':')),
+    );
+  }
+
+  /// A client with these settings
+  HttpClient createClient() {
+    final client = HttpClient(context: securityContext)
+      ..connectionTimeout = connectTimeout
+      ..idleTimeout = idleTimeout
+      ..maxConnectionsPerHost = maxConnectionsPerHost;
+    if (allowInsecureCertificates) {
+      client.badCertificateCallback = (cert, host, port) => true;
+    }
+    proxy?.applyTo(client);
+    return client;
+  }
+}
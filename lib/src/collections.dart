@@ -0,0 +1,129 @@
+import 'dart:io';
+
+import 'package:path/path.dart' as p;
+
+/// A named folder of completed downloads, e.g. "movies" or "podcasts",
+/// with its own quota and retention
+///
+/// Chosen when a download is enqueued; the file moves into [directory]
+/// when it completes. Once a file lands, and every minute, the oldest
+/// files are deleted until the folder is back within [maxBytes],
+/// [maxFiles] and [maxAge]. The newest file is only ever deleted for its
+/// age, never to make room.
+class Collection {
+  /// Letters, digits, `-` and `_`
+  final String name;
+
+  /// Folder of the collection; null puts it under the collections folder,
+  /// named [name]
+  final String? directory;
+
+  /// Bytes the collection may hold; null for no limit
+  final int? maxBytes;
+
+  /// Files the collection may hold; null for no limit
+  final int? maxFiles;
+
+  /// How long a file is kept after it landed; null keeps it
+  final Duration? maxAge;
+
+  Collection(
+    this.name, {
+    this.directory,
+    this.maxBytes,
+    this.maxFiles,
+    this.maxAge,
+  }) {
+    if (!isValidName(name)) {
+      throw ArgumentError.value(name, 'name', 'Letters, digits, - and _');
+    }
+  }
+
+  static bool isValidName(String name) =>
+      RegExp(r'^[A-Za-z0-9_-]+$').hasMatch(name);
+
+  /// Folder of the collection when the collections folder is [root]
+  String directoryIn(String root) => directory ?? p.join(root, name);
+
+  /// Files to delete from [files] to respect the limits at [now], oldest
+  /// first
+  List<CollectionFile> overLimits(List<CollectionFile> files, DateTime now) {
+    final byAge = [...files]..sort((a, b) => a.modified.compareTo(b.modified));
+    if (byAge.isEmpty) return const [];
+    final newest = byAge.removeLast();
+
+    final doomed = <CollectionFile>[];
+    var bytes = files.fold(0, (sum, f) => sum + f.size);
+    var count = files.length;
+    for (final file in byAge) {
+      final tooOld =
+          maxAge != null && now.difference(file.modified) > maxAge!;
+      final tooBig = maxBytes != null && bytes > maxBytes!;
+      final tooMany = maxFiles != null && count > maxFiles!;
+      if (!tooOld && !tooBig && !tooMany) continue;
+      doomed.add(file);
+      bytes -= file.size;
+      count--;
+    }
+    if (maxAge != null && now.difference(newest.modified) > maxAge!) {
+      doomed.add(newest);
+    }
+    return doomed;
+  }
+
+  /// Files of the collection in [directory], sidecars left out
+  static Future<List<CollectionFile>> list(String directory) async {
+    final dir = Directory(directory);
+    if (!await dir.exists()) return [];
+    final files = <CollectionFile>[];
+    await for (final entity in dir.list(followLinks: false)) {
+      if (entity is! File || _isSidecar(entity.path)) continue;
+      try {
+        final stat = await entity.stat();
+        files.add(CollectionFile(entity.path, stat.size, stat.modified));
+      } on FileSystemException {
+        continue; // Deleted meanwhile
+      }
+    }
+    return files;
+  }
+
+  static bool _isSidecar(String path) =>
+      path.endsWith('.done') ||
+      path.endsWith('.part') ||
+      p.basename(path).startsWith('.');
+
+  Map<String, dynamic> toJson() => {
+    'name': name,
+    if (directory != null) 'directory': directory,
+    if (maxBytes != null) 'maxBytes': maxBytes,
+    if (maxFiles != null) 'maxFiles': maxFiles,
+    if (maxAge != null) 'maxAgeSeconds': maxAge!.inSeconds,
+  };
+
+  factory Collection.fromJson(Map<String, dynamic> json) => Collection(
+    json['name'] as String,
+    directory: json['directory'] as String?,
+    maxBytes: json['maxBytes'] as int?,
+    maxFiles: json['maxFiles'] as int?,
+    maxAge: json['maxAgeSeconds'] == null
+        ? null
+        : Duration(seconds: json['maxAgeSeconds'] as int),
+  );
+}
+
+/// A file in a [Collection]
+class CollectionFile {
+  final String path;
+  final int size;
+  final DateTime modified;
+
+  const CollectionFile(this.path, this.size, this.modified);
+
+  Map<String, dynamic> toJson() => {
+    'name': p.basename(path),
+    'path': path,
+    'size': size,
+    'modified': modified.toIso8601String(),
+  };
+}
@@ -0,0 +1,119 @@
+import 'dart:async';
+
+/// Whether a completed download leaves the cache for the collection
+enum CompletionMode {
+  /// Move the cached file into place; the cache no longer holds it
+  move,
+
+  /// Write a copy into place and keep the cached file, which stays
+  /// servable and evictable like any other
+  copy,
+}
+
+/// How a completed download's file is named in the collection
+enum CompletionNaming {
+  /// The file ID and the extension of its type (or the name set with
+  /// `oname`)
+  fileId,
+
+  /// The origin's name: `Content-Disposition`, else the last segment of
+  /// the URL; the file ID when neither gives one. A name already taken
+  /// gets a ` (2)`, ` (3)` … suffix.
+  origin,
+}
+
+/// A completed download once it is in place
+class CompletedFile {
+  final String fileId;
+  final String? url;
+
+  /// Path (or document URI) of the file in the collection
+  final String path;
+  final int size;
+  final String? mimeType;
+
+  /// SHA-256 (hex) when known, see [CompletionConfig.checksum]
+  final String? sha256;
+
+  const CompletedFile(
+    this.fileId,
+    this.path, {
+    this.url,
+    required this.size,
+    this.mimeType,
+    this.sha256,
+  });
+}
+
+/// Called once a completed download is in place, in the order added;
+/// a hook that throws is logged and does not stop the others
+typedef CompletionHook = FutureOr<void> Function(CompletedFile file);
+
+/// What happens to a download once all of it is cached
+class CompletionConfig {
+  final CompletionMode mode;
+  final CompletionNaming naming;
+
+  /// Folder for completed files; null keeps the one set with `odir`, else
+  /// the collections folder next to the cache. A download's own target
+  /// path always wins.
+  final String? directory;
+
+  /// Hash every completed file, not only those with an expected checksum
+  /// or a `DuplicatePolicy`; the digest goes to hooks and events
+  final bool checksum;
+
+  final List<CompletionHook> hooks;
+
+  const CompletionConfig({
+    this.mode = CompletionMode.move,
+    this.naming = CompletionNaming.fileId,
+    this.directory,
+    this.checksum = false,
+    this.hooks = const [],
+  });
+
+  CompletionConfig copyWith({
+    CompletionMode? mode,
+    CompletionNaming? naming,
+    String? directory,
+    bool? checksum,
+    List<CompletionHook>? hooks,
+  }) => CompletionConfig(
+    mode: mode ?? this.mode,
+    naming: naming ?? this.naming,
+    directory: directory ?? this.directory,
+    checksum: checksum ?? this.checksum,
+    hooks: hooks ?? this.hooks,
+  );
+
+  /// File name for [fileId], [ext] being the extension of its type
+  ///
+  /// [originName] is what the origin called it; [url] is used when that
+  /// is unknown. [fallback] replaces the file ID when naming by ID.
+  String fileNameFor(
+    String fileId,
+    String ext, {
+    String? originName,
+    String? url,
+    String? fallback,
+  }) {
+    final byId = '${fallback ?? fileId}.$ext';
+    if (naming == CompletionNaming.fileId) return byId;
+
+    var name = originName;
+    if (name == null && url != null) {
+      final segments = Uri.tryParse(url)?.pathSegments ?? const [];
+      name = segments.lastWhere((s) => s.isNotEmpty, orElse: () => '');
+    }
+    name = sanitizeFileName(name ?? '');
+    if (name.isEmpty) return byId;
+    return name.contains('.') ? name : '$name.$ext';
+  }
+
+  /// [name] without path separators, characters Windows and Android
+  /// storage reject, and leading or trailing dots and spaces
+  static String sanitizeFileName(String name) => name
+      .replaceAll(RegExp(r'[\x00-\x1f<>:"/\\|?*]'), '_')
+      .replaceAll(RegExp(r'^[\s.]+|[\s.]+$'), '');
+}
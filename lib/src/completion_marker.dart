@@ -0,0 +1,98 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:typed_data';
+
+import 'cache_reader.dart';
+import 'integrity.dart';
+import 'media_probe.dart';
+
+/// Sidecar `.done` file written next to a completed download, for library
+/// scanners that don't talk to the proxy
+class CompletionMarker {
+  final String? url;
+  final String fileName;
+  final String? mimeType;
+  final int size;
+
+  /// SHA-256 of the file, hex
+  final String sha256;
+
+  /// Media duration, when the container declares one
+  final Duration? duration;
+
+  final DateTime completedAt;
+
+  CompletionMarker({
+    required this.url,
+    required this.fileName,
+    required this.size,
+    required this.sha256,
+    this.mimeType,
+    this.duration,
+    DateTime? completedAt,
+  }) : completedAt = completedAt ?? DateTime.now();
+
+  /// Marker path for a collection file
+  static String pathFor(String filePath) => '$filePath.done';
+
+  /// Hash and probe the completed file at [path]
+  static Future<CompletionMarker> forFile(
+    String path, {
+    String? url,
+    String? mimeType,
+  }) async {
+    final file = File(path);
+    final digest = BodyDigest();
+    await for (final chunk in file.openRead()) {
+      digest.add(chunk);
+    }
+
+    final raf = await file.open();
+    Duration? duration;
+    try {
+      duration = await MediaProbe.mp4Duration(_FileReader(raf, digest.length));
+    } finally {
+      await raf.close();
+    }
+
+    return CompletionMarker(
+      url: url,
+      fileName: file.uri.pathSegments.last,
+      mimeType: mimeType,
+      size: digest.length,
+      sha256: digest.close(),
+      duration: duration,
+    );
+  }
+
+  /// Write the marker next to [filePath]
+  Future<void> write(String filePath) =>
+      File(pathFor(filePath)).writeAsString(jsonEncode(toJson()));
+
+  Map<String, Object?> toJson() => {
+    'url': url,
+    'fileName': fileName,
+    'mimeType': mimeType,
+    'size': size,
+    'sha256': sha256,
+    'durationMs': duration?.inMilliseconds,
+    'completedAt': completedAt.toUtc().toIso8601String(),
+  };
+}
+
+/// [CacheReader] over a complete local file
+class _FileReader implements CacheReader {
+  final RandomAccessFile _raf;
+
+  @override
+  final int length;
+
+  _FileReader(this._raf, this.length);
+
+  @override
+  Future<Uint8List> readAt(int offset, int count) async {
+    if (offset >= length || count <= 0) return Uint8List(0);
+    await _raf.setPosition(offset);
+    return _raf.read(count);
+  }
+}
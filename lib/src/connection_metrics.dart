@@ -0,0 +1,250 @@
+import 'dart:io';
+import 'dart:math';
+
+/// Circuit breaker state of an origin host
+enum CircuitState {
+  /// Requests go to the host as usual
+  closed,
+
+  /// The host failed over and over; its mirrors are tried first until the
+  /// cooldown ends
+  open,
+
+  /// The cooldown ended: the next request tells whether the host is back
+  halfOpen,
+}
+
+/// Connection statistics for one origin host
+///
+/// A response arriving on a local port not seen before for the host is
+/// counted as a new connection. Handshake cost and RTT are estimated from
+/// time-to-headers, since `dart:io` does not expose TLS timings.
+class HostConnectionStats {
+  final String host;
+
+  /// Responses received, whatever their status
+  int requests = 0;
+  int newConnections = 0;
+  int reusedConnections = 0;
+  Duration _newLatency = Duration.zero;
+  Duration _reusedLatency = Duration.zero;
+  Duration? minReusedLatency;
+
+  /// 5xx responses
+  int serverErrors = 0;
+
+  /// Requests that got no response or whose body was cut off
+  int connectionErrors = 0;
+
+  /// Of [connectionErrors], those that timed out
+  int timeouts = 0;
+
+  /// Attempts repeated after an error
+  int retries = 0;
+
+  /// Failures in a row that open the circuit
+  final int breakerThreshold;
+
+  /// How long an open circuit stays open after the last failure
+  final Duration breakerCooldown;
+
+  int _failuresInRow = 0;
+  DateTime? _lastFailure;
+
+  // Cut-off bodies, whose response is counted in [requests] too
+  int _bodyFailures = 0;
+
+  // Recently seen local ports (oldest first)
+  final List<int> _ports = [];
+  static const int _maxPorts = 64;
+
+  HostConnectionStats(
+    this.host, {
+    this.breakerThreshold = 5,
+    this.breakerCooldown = const Duration(seconds: 30),
+  });
+
+  /// Share of attempts that failed (5xx or no response); 0 before any
+  double get errorRate {
+    final attempts = requests + connectionErrors - _bodyFailures;
+    return attempts <= 0 ? 0 : (serverErrors + connectionErrors) / attempts;
+  }
+
+  /// State of the host's circuit breaker at [now]
+  CircuitState circuitAt(DateTime now) {
+    final last = _lastFailure;
+    if (_failuresInRow < breakerThreshold || last == null) {
+      return CircuitState.closed;
+    }
+    return now.difference(last) < breakerCooldown
+        ? CircuitState.open
+        : CircuitState.halfOpen;
+  }
+
+  CircuitState get circuit => circuitAt(DateTime.now());
+
+  void _failed() {
+    _failuresInRow++;
+    _lastFailure = DateTime.now();
+  }
+
+  /// Average time to response headers on a fresh connection
+  Duration? get avgNewLatency =>
+      newConnections == 0 ? null : _newLatency ~/ newConnections;
+
+  /// Average time to response headers on a reused connection
+  Duration? get avgReusedLatency =>
+      reusedConnections == 0 ? null : _reusedLatency ~/ reusedConnections;
+
+  /// Extra time a fresh connection costs (TCP connect + TLS handshake)
+  Duration? get handshakeEstimate {
+    final fresh = avgNewLatency;
+    final reused = avgReusedLatency;
+    if (fresh == null || reused == null) return null;
+    final diff = fresh - reused;
+    return diff.isNegative ? Duration.zero : diff;
+  }
+
+  /// Round-trip estimate: the fastest request on a warm connection
+  Duration? get rttEstimate => minReusedLatency;
+
+  /// Fraction of requests that reused a connection
+  double get reuseRatio => requests == 0 ? 0 : reusedConnections / requests;
+
+  void _record(int? localPort, Duration latency) {
+    requests++;
+    final reused = localPort != null && _ports.contains(localPort);
+    if (reused) {
+      reusedConnections++;
+      _reusedLatency += latency;
+      final best = minReusedLatency;
+      minReusedLatency = best == null || latency < best ? latency : best;
+      return;
+    }
+
+    newConnections++;
+    _newLatency += latency;
+    if (localPort != null) {
+      _ports.add(localPort);
+      if (_ports.length > _maxPorts) _ports.removeAt(0);
+    }
+  }
+
+  Map<String, Object?> toJson() => {
+    'host': host,
+    'requests': requests,
+    'serverErrors': serverErrors,
+    'connectionErrors': connectionErrors,
+    'timeouts': timeouts,
+    'retries': retries,
+    'errorRate': double.parse(errorRate.toStringAsFixed(3)),
+    'circuit': circuit.name,
+    'newConnections': newConnections,
+    'reusedConnections': reusedConnections,
+    'reuseRatio': double.parse(reuseRatio.toStringAsFixed(3)),
+    'avgNewLatencyMs': avgNewLatency?.inMilliseconds,
+    'avgReusedLatencyMs': avgReusedLatency?.inMilliseconds,
+    'handshakeEstimateMs': handshakeEstimate?.inMilliseconds,
+    'rttEstimateMs': rttEstimate?.inMilliseconds,
+  };
+}
+
+/// Per-origin connection reuse and error metrics for upstream requests
+///
+/// Also a circuit breaker per host: after [breakerThreshold] failures in a
+/// row (5xx, no response, a stalled body) the host is
+/// [CircuitState.open] for [breakerCooldown], and data sources try its
+/// mirrors first meanwhile.
+class ConnectionMetrics {
+  final Map<String, HostConnectionStats> _hosts = {};
+
+  final int breakerThreshold;
+  final Duration breakerCooldown;
+
+  ConnectionMetrics({
+    this.breakerThreshold = 5,
+    this.breakerCooldown = const Duration(seconds: 30),
+  });
+
+  /// Upstream responses by status code
+  final Map<int, int> statusCodes = {};
+
+  /// Upstream requests that failed without a response (connect, TLS,
+  /// timeout, cut off)
+  int connectionErrors = 0;
+
+  /// Record a response and the time from opening the request to headers
+  void record(Uri uri, HttpClientResponse response, Duration latency) {
+    statusCodes.update(response.statusCode, (n) => n + 1, ifAbsent: () => 1);
+    recordConnection(
+      keyOf(uri),
+      response.connectionInfo?.localPort,
+      latency,
+    );
+    final stats = _statsOf(keyOf(uri));
+    if (response.statusCode >= 500) {
+      stats
+        ..serverErrors++
+        .._failed();
+    } else {
+      stats._failuresInRow = 0;
+    }
+  }
+
+  /// Record a request to [host] answered on local port [localPort]
+  void recordConnection(String host, int? localPort, Duration latency) {
+    _statsOf(host)._record(localPort, latency);
+  }
+
+  /// Record a request to [uri] that got no response, or whose body was
+  /// cut off after the response ([afterResponse]); [timeout] when it was
+  /// given up on for silence
+  void recordError(
+    Uri uri, {
+    bool timeout = false,
+    bool afterResponse = false,
+  }) {
+    connectionErrors++;
+    final stats = _statsOf(keyOf(uri))
+      ..connectionErrors++
+      .._failed();
+    if (timeout) stats.timeouts++;
+    if (afterResponse) stats._bodyFailures++;
+  }
+
+  /// Record that a request to [uri] is attempted again
+  void recordRetry(Uri uri) => _statsOf(keyOf(uri)).retries++;
+
+  /// Circuit breaker state of the host of [uri]
+  CircuitState circuitOf(Uri uri) =>
+      _hosts[keyOf(uri)]?.circuit ?? CircuitState.closed;
+
+  /// Key of the host of [uri] in these metrics: `host:port`
+  static String keyOf(Uri uri) => '${uri.host}:${uri.port}';
+
+  HostConnectionStats _statsOf(String host) => _hosts.putIfAbsent(
+    host,
+    () => HostConnectionStats(
+      host,
+      breakerThreshold: breakerThreshold,
+      breakerCooldown: breakerCooldown,
+    ),
+  );
+
+  HostConnectionStats? operator [](String host) => _hosts[host];
+
+  List<HostConnectionStats> get hosts => List.unmodifiable(_hosts.values);
+
+  Map<String, Object> toJson() => {
+    'hosts': [for (final stats in _hosts.values) stats.toJson()],
+    'totalRequests': _hosts.values.fold(0, (sum, s) => sum + s.requests),
+    'totalNewConnections': _hosts.values.fold(
+      0,
+      (sum, s) => sum + s.newConnections,
+    ),
+    'maxHandshakeEstimateMs': _hosts.values.fold(
+      0,
+      (m, s) => max(m, s.handshakeEstimate?.inMilliseconds ?? 0),
+    ),
+  };
+}
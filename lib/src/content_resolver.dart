@@ -0,0 +1,37 @@
+import 'dart:async';
+
+/// Where the content behind an opaque ID is fetched from
+class ResolvedContent {
+  /// Upstream URL; it also names the cache entry, so the same content
+  /// should resolve to the same URL (put expiring credentials in
+  /// [headers], not in the URL)
+  final String url;
+
+  /// Headers sent with every upstream request for the content, e.g. a
+  /// short-lived token
+  final Map<String, String> headers;
+
+  const ResolvedContent(this.url, {this.headers = const {}});
+}
+
+/// Maps opaque content IDs (database keys, catalog IDs) to upstream
+/// sources at request time
+///
+/// Set as `StreamProxyBridge.contentResolver`; players then request
+/// `/stream/<id>` and never see, or choose, the upstream URL. Resolved
+/// on every request, so a changed source or a renewed token is picked
+/// up without restarting playback.
+abstract class ContentResolver {
+  /// Source of [id]; null when there is no such content
+  FutureOr<ResolvedContent?> resolve(String id);
+}
+
+/// A [ContentResolver] backed by a function
+class CallbackResolver implements ContentResolver {
+  final FutureOr<ResolvedContent?> Function(String id) _resolve;
+
+  CallbackResolver(this._resolve);
+
+  @override
+  FutureOr<ResolvedContent?> resolve(String id) => _resolve(id);
+}
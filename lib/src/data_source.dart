@@ -1,6 +1,11 @@
 import 'dart:async';
 import 'dart:io';
 
+import 'certificate_pins.dart';
+import 'client_config.dart';
+import 'connection_metrics.dart';
+import 'logger.dart';
+
 /// File statistics for preview
 class FileStat {
   final String? fileName;
@@ -8,11 +13,29 @@ class FileStat {
   final String? mimeType;
   final String? extension;
 
+  /// Validators of the version probed, for `If-Range`
+  final String? etag;
+  final String? lastModified;
+
+  /// Whether the origin serves byte ranges; null when it did not say
+  final bool? acceptsRanges;
+
+  /// Whether HEAD answered with the size; null when it was not tried
+  final bool? headSupported;
+
+  /// Every header of the probe response, names in lower case
+  final Map<String, String> headers;
+
   FileStat({
     this.fileName,
     this.totalSize,
     this.mimeType,
     this.extension,
+    this.etag,
+    this.lastModified,
+    this.acceptsRanges,
+    this.headSupported,
+    this.headers = const {},
   });
 
   @override
@@ -35,19 +58,60 @@ class ProxyConfig {
     this.username,
     this.password,
   });
+
+  /// Route the requests of [client] through this proxy
+  void applyTo(HttpClient client) {
+    final host = this.host;
+    if (host == null) return;
+    final port = this.port ?? (type == ProxyType.http ? 80 : 1080);
+    final proxyUrl = type == ProxyType.http
+        ? 'PROXY $host:$port'
+        : 'SOCKS5 $host:$port';
+    client.findProxy = (uri) => proxyUrl;
+
+    // Set authentication if provided
+    if (username != null && password != null) {
+      client.addProxyCredentials(
+        host,
+        port,
+        '',
+        HttpClientBasicCredentials(username!, password!),
+      );
+    }
+  }
 }
 
 enum ProxyType { http, socks5 }
 
+/// Adjusts each upstream request before it is sent (add a token, sign the
+/// URL's query); `request.uri` tells which file and host it is for
+typedef RequestDecorator = FutureOr<void> Function(HttpClientRequest request);
+
+/// The origin serves another version of the file than the one cached
+class UpstreamChangedException extends HttpException {
+  const UpstreamChangedException(Uri uri)
+    : super('Upstream file changed', uri: uri);
+}
+
 /// Abstract data source for fetching remote content
 abstract class DataSource {
   /// Get file statistics (emitted as soon as headers are received)
   Stream<FileStat> get fileStats;
 
+  /// Latest file statistics, or null before the first probe
+  FileStat? get lastStat;
+
   /// Fetch data for a specific byte range
   Future<HttpClientResponse> fetchRange(int start, int end);
 
-  /// Get total content length via HEAD request
+  /// Fetch the whole resource without a Range header
+  ///
+  /// [headers] are added to the request (e.g. `Icy-MetaData: 1`).
+  Future<HttpClientResponse> fetchAll({Map<String, String>? headers});
+
+  /// Get total content length via HEAD request (or a 1-byte ranged GET)
+  ///
+  /// Returns 0 for an empty file and -1 when the size is unknown.
   Future<int> getContentLength();
 
   /// Cancel any ongoing operations
@@ -64,6 +128,71 @@ class HttpDataSource implements DataSource {
   final ProxyConfig? proxyConfig;
   final Map<String, String>? customHeaders;
 
+  /// Records connection reuse and latency of every upstream request
+  final ConnectionMetrics? metrics;
+
+  /// Extra attempts per host after a connection error or 5xx response
+  final int maxRetries;
+
+  /// Delay before the first retry, growing linearly with each attempt
+  final Duration retryDelay;
+
+  /// Hosts serving the same paths, tried in order when [url] fails
+  final List<String> mirrors;
+
+  /// Reorders the origin host and [mirrors] before each request, e.g. to
+  /// try the hosts that served the file reliably first
+  final List<String> Function(List<String> hosts)? rankHosts;
+
+  /// Runs on every request after [customHeaders] are set
+  final RequestDecorator? decorator;
+
+  /// Validator of the cached version (a strong ETag, else Last-Modified)
+  ///
+  /// Sent as `If-Range` with every range request; taken from the first
+  /// probe when not given. A response of another version (or size) throws
+  /// an [UpstreamChangedException] after calling [onChanged].
+  String? ifRange;
+
+  /// Called when a range request finds that the file changed
+  final void Function()? onChanged;
+
+  /// Certificate pins by host (the origin and its mirrors)
+  ///
+  /// Pinned hosts are trusted by their pins alone, so self-signed
+  /// certificates work; with any pins set, unpinned hosts are refused.
+  /// A mismatch throws a [CertificatePinException] without retrying.
+  final Map<String, List<String>> certificatePins;
+
+  /// Called with the host and the presented `sha256/` pin on a mismatch
+  final void Function(String host, String? presented)? onPinMismatch;
+
+  /// Probe the size with HEAD first; origins known to reject HEAD go
+  /// straight to the one-byte range probe
+  final bool useHead;
+
+  /// Keep [customHeaders] from redirect targets on another origin
+  final bool isolateHeaders;
+
+  /// Redirects followed per request at most
+  final int maxRedirects;
+
+  /// Settings of the client, and the response header timeout of each
+  /// request
+  final ClientConfig clientConfig;
+
+  // Shared between data sources when given, so never closed here
+  final HttpClient? _sharedClient;
+
+  // Requests in flight on the shared client, aborted by [cancel]
+  final List<WeakReference<HttpClientRequest>> _requests = [];
+
+  // Host each response came from, see [sourceOf]
+  final Expando<String> _sources = Expando();
+
+  // Pin of the last certificate each host presented and we refused
+  final Map<String, String> _refusedPins = {};
+
   final StreamController<FileStat> _fileStatsController =
       StreamController<FileStat>.broadcast();
   
@@ -76,34 +205,47 @@ class HttpDataSource implements DataSource {
     this.userAgent,
     this.proxyConfig,
     this.customHeaders,
-  }) {
+    this.metrics,
+    this.maxRetries = 0,
+    this.retryDelay = const Duration(seconds: 1),
+    this.mirrors = const [],
+    this.rankHosts,
+    this.decorator,
+    this.ifRange,
+    this.onChanged,
+    this.certificatePins = const {},
+    this.onPinMismatch,
+    this.useHead = true,
+    this.isolateHeaders = true,
+    this.maxRedirects = 5,
+    this.clientConfig = const ClientConfig(),
+    HttpClient? client,
+  }) : _sharedClient = certificatePins.isEmpty ? client : null {
     _initClient();
   }
 
   void _initClient() {
-    _client = HttpClient();
-    
-    // Configure proxy if provided
-    if (proxyConfig != null && proxyConfig!.host != null) {
-      final proxyUrl = proxyConfig!.type == ProxyType.http
-          ? 'PROXY ${proxyConfig!.host}:${proxyConfig!.port ?? 80}'
-          : 'SOCKS5 ${proxyConfig!.host}:${proxyConfig!.port ?? 1080}';
-      
-      _client!.findProxy = (uri) => proxyUrl;
-      
-      // Set authentication if provided
-      if (proxyConfig!.username != null && proxyConfig!.password != null) {
-        _client!.addProxyCredentials(
-          proxyConfig!.host!,
-          proxyConfig!.port ?? (proxyConfig!.type == ProxyType.http ? 80 : 1080),
-          '',
-          HttpClientBasicCredentials(
-            proxyConfig!.username!,
-            proxyConfig!.password!,
-          ),
-        );
-      }
+    if (_sharedClient != null) {
+      _client = _sharedClient;
+      return;
+    }
+    if (certificatePins.isEmpty) {
+      _client = clientConfig.createClient();
+    } else {
+      // Without trusted roots every certificate reaches the callback,
+      // before any request is sent
+      _client = HttpClient(context: SecurityContext(withTrustedRoots: false))
+        ..badCertificateCallback = (cert, host, port) {
+          final pins = certificatePins[host];
+          if (pins != null && CertificatePins.matches(pins, cert)) return true;
+          _refusedPins[host] = CertificatePins.pinsOf(cert.der).first;
+          return false;
+        }
+        ..connectionTimeout = clientConfig.connectTimeout
+        ..idleTimeout = clientConfig.idleTimeout;
+      clientConfig.proxy?.applyTo(_client!);
     }
+    proxyConfig?.applyTo(_client!);
   }
 
   @override
@@ -117,65 +259,349 @@ class HttpDataSource implements DataSource {
       return _cachedStat!.totalSize!;
     }
 
-    final request = await _client!.headUrl(Uri.parse(url));
-    _addHeaders(request);
-    
-    final response = await request.close();
-    final contentLength = response.contentLength;
+    // HEAD first; origins that reject it or report no length get a
+    // 1-byte ranged GET, whose Content-Range carries the size
+    HttpClientResponse? response;
+    int? contentLength;
+    bool? acceptsRanges;
+    if (useHead) {
+      final stopwatch = Stopwatch()..start();
+      response = _record(await _open('HEAD', Uri.parse(url)), stopwatch);
+      contentLength = response.statusCode < 300 && response.contentLength > 0
+          ? response.contentLength
+          : null;
+      acceptsRanges = switch (response.headers.value('accept-ranges')) {
+        'none' => false,
+        'bytes' => true,
+        _ => null,
+      };
+    }
+    final headSupported = useHead ? contentLength != null : null;
+
+    if (response == null || contentLength == null) {
+      response = await fetchRange(0, 0);
+      // Don't download the body if the origin ignored the Range
+      await response.listen(null).cancel();
+      acceptsRanges = switch (response.statusCode) {
+        HttpStatus.ok => false,
+        HttpStatus.partialContent => true,
+        _ => acceptsRanges,
+      };
+      contentLength = switch (response.statusCode) {
+        HttpStatus.partialContent ||
+        HttpStatus.requestedRangeNotSatisfiable => _sizeFromContentRange(
+          response.headers.value('content-range'),
+        ),
+        HttpStatus.ok when response.contentLength >= 0 =>
+          response.contentLength,
+        _ => null,
+      };
+    }
     
     // Extract file info from headers
     final contentType = response.headers.value('content-type');
     final contentDisposition = response.headers.value('content-disposition');
     final fileName = _extractFileName(contentDisposition) ?? _extractFileNameFromUrl();
+    final etag = response.headers.value(HttpHeaders.etagHeader);
+    final lastModified = response.headers.value(
+      HttpHeaders.lastModifiedHeader,
+    );
     
     _cachedStat = FileStat(
       fileName: fileName,
-      totalSize: contentLength > 0 ? contentLength : null,
+      totalSize: contentLength,
       mimeType: contentType,
       extension: fileName?.split('.').last,
+      etag: etag,
+      lastModified: lastModified,
+      acceptsRanges: acceptsRanges,
+      headSupported: headSupported,
+      headers: headersOf(response),
     );
+    // Weak ETags cannot be used with If-Range
+    ifRange ??= etag != null && !etag.startsWith('W/') ? etag : lastModified;
     
     _fileStatsController.add(_cachedStat!);
     
-    return contentLength;
+    return contentLength ?? -1;
+  }
+
+  /// Headers of [response] by lower-case name, repeated ones joined
+  static Map<String, String> headersOf(HttpClientResponse response) {
+    final headers = <String, String>{};
+    response.headers.forEach(
+      (name, values) => headers[name.toLowerCase()] = values.join(', '),
+    );
+    return headers;
+  }
+
+  /// Total size from `Content-Range: bytes 0-0/1234` (or `bytes */0`)
+  int? _sizeFromContentRange(String? contentRange) {
+    if (contentRange == null) return null;
+    final match = RegExp(r'/(\d+)\s*$').firstMatch(contentRange);
+    return match == null ? null : int.parse(match.group(1)!);
   }
 
+  @override
+  FileStat? get lastStat => _cachedStat;
+
   @override
   Future<HttpClientResponse> fetchRange(int start, int end) async {
-    if (_cancelled) throw StateError('Operation cancelled');
-    
-    final request = await _client!.getUrl(Uri.parse(url));
-    _addHeaders(request);
-    request.headers.add('Range', 'bytes=$start-$end');
-    
-    return await request.close();
+    final validator = ifRange;
+    final response = await _get((request) {
+      request.headers.add('Range', 'bytes=$start-$end');
+      if (validator != null) request.headers.set('If-Range', validator);
+    });
+    if (_hasChanged(validator, response)) {
+      // Don't download the new version's body
+      await response.listen(null).cancel();
+      onChanged?.call();
+      throw UpstreamChangedException(Uri.parse(url));
+    }
+    return response;
+  }
+
+  /// Whether [response] is of another version than [validator] (or the
+  /// size probed) describes
+  bool _hasChanged(String? validator, HttpClientResponse response) {
+    if (validator != null) {
+      final current = validator.startsWith('"')
+          ? response.headers.value(HttpHeaders.etagHeader)
+          : response.headers.value(HttpHeaders.lastModifiedHeader);
+      if (current != null && current != validator) return true;
+    }
+    final size = _cachedStat?.totalSize;
+    if (size == null || response.statusCode != HttpStatus.partialContent) {
+      return false;
+    }
+    final current = _sizeFromContentRange(
+      response.headers.value('content-range'),
+    );
+    return current != null && current != size;
+  }
+
+  @override
+  Future<HttpClientResponse> fetchAll({Map<String, String>? headers}) =>
+      _get((request) => headers?.forEach(request.headers.set));
+
+  /// GET from [url], retrying and falling back to [mirrors] on connection
+  /// errors and 5xx responses; the last attempt's response is returned
+  Future<HttpClientResponse> _get(
+    void Function(HttpClientRequest request) configure,
+  ) async {
+    final origin = Uri.parse(url);
+    final configured = [origin.host, ...mirrors];
+    final ranked = rankHosts?.call(configured) ?? configured;
+    // Hosts whose circuit is open go last, however they rank
+    bool open(String host) =>
+        metrics?.circuitOf(origin.replace(host: host)) == CircuitState.open;
+    final hosts = [
+      ...ranked.where((host) => !open(host)),
+      ...ranked.where(open),
+    ];
+    Object? lastError;
+
+    for (final host in hosts) {
+      final uri = origin.replace(host: host);
+      for (int attempt = 0; attempt <= maxRetries; attempt++) {
+        if (_cancelled) throw StateError('Operation cancelled');
+        if (attempt > 0) {
+          metrics?.recordRetry(uri);
+          await Future.delayed(retryDelay * attempt);
+        }
+
+        final last = host == hosts.last && attempt == maxRetries;
+        try {
+          final stopwatch = Stopwatch()..start();
+          final response = await _open('GET', uri, configure);
+          metrics?.record(uri, response, stopwatch.elapsed);
+          _sources[response] = host;
+          Logger.debug(
+            'Upstream response',
+            fields: {
+              'host': host,
+              'status': response.statusCode,
+              'ms': stopwatch.elapsedMilliseconds,
+              'attempt': attempt,
+            },
+          );
+          if (response.statusCode < 500 || last) return response;
+
+          Logger.warn(
+            'Upstream error, retrying',
+            fields: {'host': host, 'status': response.statusCode},
+          );
+          await response.drain<void>();
+          lastError = HttpException(
+            'Status ${response.statusCode}',
+            uri: uri,
+          );
+        } on IOException catch (e) {
+          metrics?.recordError(uri, timeout: e is _Timeout);
+          if (last || _cancelled) rethrow;
+          Logger.warn(
+            'Upstream connection failed, retrying',
+            fields: {'host': host},
+            error: e,
+          );
+          lastError = e;
+        }
+      }
+    }
+    throw lastError!;
+  }
+
+  /// Send a [method] request to [uri], following redirects here rather
+  /// than in the client
+  ///
+  /// The client would copy every header to the next hop, whatever its
+  /// host. Here each hop gets its headers anew: with [isolateHeaders],
+  /// [customHeaders] only go to the origin [uri] shares scheme, host and
+  /// port with. [configure] (the range) applies to every hop.
+  Future<HttpClientResponse> _open(
+    String method,
+    Uri uri, [
+    void Function(HttpClientRequest request)? configure,
+  ]) async {
+    var target = uri;
+    for (int hop = 0; ; hop++) {
+      _checkPinnedScheme(target);
+      final HttpClientResponse response;
+      try {
+        final request = await _client!.openUrl(method, target)
+          ..followRedirects = false;
+        await _addHeaders(
+          request,
+          withCustom: !isolateHeaders || _sameOrigin(target, uri),
+        );
+        configure?.call(request);
+        response = await _send(request, target);
+      } on HandshakeException {
+        _checkRefusedPin(target);
+        rethrow;
+      }
+
+      final location = response.headers.value(HttpHeaders.locationHeader);
+      if (!response.isRedirect || location == null) return response;
+      await response.drain<void>();
+      if (hop == maxRedirects) {
+        throw const RedirectException('Too many redirects', []);
+      }
+      target = target.resolve(location);
+    }
   }
 
-  void _addHeaders(HttpClientRequest request) {
+  /// The host (origin or mirror) [response] was requested from; null for
+  /// responses of another data source
+  String? sourceOf(HttpClientResponse response) => _sources[response];
+
+  static bool _sameOrigin(Uri a, Uri b) =>
+      a.scheme == b.scheme && a.host == b.host && a.port == b.port;
+
+  /// Send [request] and wait for its response headers, at most
+  /// [ClientConfig.responseHeaderTimeout]; its body then fails when it
+  /// stalls for [ClientConfig.readTimeout]
+  Future<HttpClientResponse> _send(
+    HttpClientRequest request,
+    Uri uri,
+  ) async {
+    if (_sharedClient != null) {
+      _requests
+        ..removeWhere((r) => r.target == null)
+        ..add(WeakReference(request));
+    }
+    final timeout = clientConfig.responseHeaderTimeout;
+    final response = await request.close().timeout(
+      timeout,
+      onTimeout: () {
+        request.abort();
+        throw _Timeout(
+          'No response headers within ${timeout.inSeconds} s',
+          uri: uri,
+        );
+      },
+    );
+    return _ReadDeadline(
+      response,
+      request,
+      clientConfig.readTimeout,
+      uri,
+      onError: (error) {
+        if (_cancelled) return;
+        metrics?.recordError(
+          uri,
+          timeout: error is _Timeout,
+          afterResponse: true,
+        );
+      },
+    );
+  }
+
+  /// Pinned hosts are only reached over TLS
+  void _checkPinnedScheme(Uri uri) {
+    if (certificatePins.isEmpty || uri.scheme == 'https') return;
+    onPinMismatch?.call(uri.host, null);
+    throw CertificatePinException(uri.host);
+  }
+
+  /// Turn a handshake failure caused by a pin mismatch into a
+  /// [CertificatePinException]
+  void _checkRefusedPin(Uri uri) {
+    final presented = _refusedPins.remove(uri.host);
+    if (presented == null) return;
+    onPinMismatch?.call(uri.host, presented);
+    throw CertificatePinException(uri.host, presented);
+  }
+
+  HttpClientResponse _record(HttpClientResponse response, Stopwatch stopwatch) {
+    metrics?.record(Uri.parse(url), response, stopwatch.elapsed);
+    return response;
+  }
+
+  Future<void> _addHeaders(
+    HttpClientRequest request, {
+    bool withCustom = true,
+  }) async {
     if (userAgent != null) {
       request.headers.set('User-Agent', userAgent!);
     }
     
-    if (customHeaders != null) {
+    if (withCustom && customHeaders != null) {
       customHeaders!.forEach((key, value) {
         request.headers.set(key, value);
       });
     }
+
+    await decorator?.call(request);
   }
 
   String? _extractFileName(String? contentDisposition) {
     if (contentDisposition == null) return null;
-    
-    // Try to extract filename from Content-Disposition header
-    final match = RegExp(r'filename[^;=\n]*=(([\"]).*?\2|[^;\n]*)').firstMatch(contentDisposition);
-    if (match != null) {
-      var fileName = match.group(1);
-      if (fileName != null) {
-        fileName = fileName.replaceAll(RegExp(r'^[^;=\n]*=(([\"])*?\2|[^;\n]*)'),'');
-        return fileName;
+
+    // RFC 5987 `filename*=UTF-8''name` wins over the plain `filename`
+    final extended = RegExp(
+      r"filename\*\s*=\s*([\w-]+)'[^']*'([^;\s]+)",
+      caseSensitive: false,
+    ).firstMatch(contentDisposition);
+    String? fileName;
+    if (extended != null) {
+      try {
+        fileName = Uri.decodeComponent(extended.group(2)!);
+      } catch (_) {
+        // Malformed encoding: fall back to the plain name
       }
     }
-    return null;
+    final plain = RegExp(
+      r'filename\s*=\s*(?:"((?:[^"\\]|\\.)*)"|([^;\s]+))',
+      caseSensitive: false,
+    ).firstMatch(contentDisposition);
+    fileName ??=
+        plain?.group(1)?.replaceAllMapped(RegExp(r'\\(.)'), (m) => m[1]!) ??
+        plain?.group(2);
+
+    // Never let the origin pick a directory
+    fileName = fileName?.split(RegExp(r'[/\\]')).last.trim();
+    return fileName == null || fileName.isEmpty ? null : fileName;
   }
 
   String? _extractFileNameFromUrl() {
@@ -194,13 +620,20 @@ class HttpDataSource implements DataSource {
   @override
   Future<void> cancel() async {
     _cancelled = true;
-    _client?.close(force: true);
+    if (_sharedClient == null) {
+      _client?.close(force: true);
+      return;
+    }
+    for (final request in _requests) {
+      request.target?.abort();
+    }
+    _requests.clear();
   }
 
   @override
   Future<void> dispose() async {
     await _fileStatsController.close();
-    _client?.close();
+    if (_sharedClient == null) _client?.close();
   }
 }
 
@@ -211,9 +644,112 @@ class CustomHeaderDataSource extends HttpDataSource {
     super.userAgent,
     super.proxyConfig,
     super.customHeaders,
+    super.metrics,
+    super.maxRetries,
+    super.retryDelay,
+    super.mirrors,
+    super.rankHosts,
+    super.decorator,
+    super.ifRange,
+    super.onChanged,
+    super.certificatePins,
+    super.onPinMismatch,
+    super.useHead,
+    super.isolateHeaders,
+    super.maxRedirects,
+    super.clientConfig,
+    super.client,
   });
 }
 
+/// An upstream request given up on because the origin went silent
+class _Timeout extends HttpException {
+  const _Timeout(super.message, {super.uri});
+}
+
+/// A response whose body fails when no bytes arrive for [timeout]
+///
+/// The timer is stopped while the reader pauses, so only the origin's
+/// silence counts. The request is aborted, closing its connection.
+/// [onError] sees every error of the body, the timeout among them.
+class _ReadDeadline extends StreamView<List<int>>
+    implements HttpClientResponse {
+  final HttpClientResponse _response;
+
+  _ReadDeadline(
+    this._response,
+    HttpClientRequest request,
+    Duration timeout,
+    Uri uri, {
+    void Function(Object error)? onError,
+  }) : super(
+        _response
+            .timeout(
+              timeout,
+              onTimeout: (sink) {
+                request.abort();
+                sink
+                  ..addError(
+                    _Timeout('No data for ${timeout.inSeconds} s', uri: uri),
+                  )
+                  ..close();
+              },
+            )
+            .transform(
+              StreamTransformer<List<int>, List<int>>.fromHandlers(
+                handleError: (error, stackTrace, sink) {
+                  onError?.call(error);
+                  sink.addError(error, stackTrace);
+                },
+              ),
+            ),
+      );
+
+  @override
+  int get statusCode => _response.statusCode;
+
+  @override
+  String get reasonPhrase => _response.reasonPhrase;
+
+  @override
+  int get contentLength => _response.contentLength;
+
+  @override
+  HttpClientResponseCompressionState get compressionState =>
+      _response.compressionState;
+
+  @override
+  bool get persistentConnection => _response.persistentConnection;
+
+  @override
+  bool get isRedirect => _response.isRedirect;
+
+  @override
+  List<RedirectInfo> get redirects => _response.redirects;
+
+  @override
+  Future<HttpClientResponse> redirect([
+    String? method,
+    Uri? url,
+    bool? followLoops,
+  ]) => _response.redirect(method, url, followLoops);
+
+  @override
+  HttpHeaders get headers => _response.headers;
+
+  @override
+  Future<Socket> detachSocket() => _response.detachSocket();
+
+  @override
+  List<Cookie> get cookies => _response.cookies;
+
+  @override
+  X509Certificate? get certificate => _response.certificate;
+
+  @override
+  HttpConnectionInfo? get connectionInfo => _response.connectionInfo;
+}
+
 /// Detect MIME type from file content (first few bytes)
 class MimeTypeDetector {
   static String? detectFromBytes(List<int> bytes) {
@@ -225,6 +761,10 @@ class MimeTypeDetector {
       // Check for common MP4 brands: isom, mp41, mp42, avc1, iso2, etc.
       if (bytes.length >= 12) {
         final brand = String.fromCharCodes(bytes.sublist(8, 12));
+        if (brand.startsWith('M4A') || brand.startsWith('M4B')) {
+          return 'audio/mp4';
+        }
+        if (brand == 'qt  ') return 'video/quicktime';
         if (brand.startsWith('iso') || brand.startsWith('mp4') || 
             brand.startsWith('avc') || brand.startsWith('M4V') ||
             brand.startsWith('qt')) {
@@ -235,11 +775,41 @@ class MimeTypeDetector {
       return 'video/mp4';
     }
     if (_matchesSignature(bytes, [0x1A, 0x45, 0xDF, 0xA3])) {
-      return 'video/webm';
+      // EBML: the DocType tells Matroska from its WebM subset
+      final header = String.fromCharCodes(bytes.take(64));
+      return header.contains('matroska') ? 'video/x-matroska' : 'video/webm';
     }
     if (_matchesSignature(bytes, [0x46, 0x4C, 0x56])) {
       return 'video/x-flv';
     }
+    if (bytes.length > 188 && bytes[0] == 0x47 && bytes[188] == 0x47) {
+      return 'video/mp2t'; // MPEG-TS: a sync byte every 188 bytes
+    }
+    if (_matchesSignature(bytes, [0x52, 0x49, 0x46, 0x46])) {
+      final form = String.fromCharCodes(bytes.sublist(8, 12));
+      if (form == 'WAVE') return 'audio/wav';
+      if (form == 'AVI ') return 'video/x-msvideo';
+    }
+
+    // Audio formats
+    if (_matchesSignature(bytes, [0x4F, 0x67, 0x67, 0x53])) {
+      final header = String.fromCharCodes(bytes.take(64));
+      if (header.contains('OpusHead')) return 'audio/opus';
+      if (header.contains('theora')) return 'video/ogg';
+      return 'audio/ogg';
+    }
+    if (_matchesSignature(bytes, [0x66, 0x4C, 0x61, 0x43])) {
+      return 'audio/flac';
+    }
+    if (_matchesSignature(bytes, [0x49, 0x44, 0x33])) {
+      return 'audio/mpeg'; // ID3 tag
+    }
+    if (bytes[0] == 0xFF && (bytes[1] & 0xF6) == 0xF0) {
+      return 'audio/aac'; // ADTS
+    }
+    if (bytes[0] == 0xFF && (bytes[1] & 0xE0) == 0xE0) {
+      return 'audio/mpeg'; // MPEG audio frame
+    }
     
     // Image formats
     if (_matchesSignature(bytes, [0xFF, 0xD8, 0xFF])) {
@@ -268,6 +838,61 @@ class MimeTypeDetector {
     return null;
   }
   
+  /// Sniff the first bytes of the file at [path]
+  static Future<String?> detectFromFile(String path) async {
+    final raf = await File(path).open();
+    try {
+      return detectFromBytes(await raf.read(4096));
+    } finally {
+      await raf.close();
+    }
+  }
+
+  /// File extension (without the dot) for [mimeType], ignoring parameters
+  /// such as `; codecs=...`; null for unknown or generic types
+  static String? extensionFor(String? mimeType) {
+    final type = mimeType?.split(';').first.trim().toLowerCase();
+    return switch (type) {
+      'video/mp4' => 'mp4',
+      'video/webm' => 'webm',
+      'video/x-matroska' => 'mkv',
+      'video/x-flv' => 'flv',
+      'video/quicktime' => 'mov',
+      'video/mp2t' => 'ts',
+      'video/x-msvideo' => 'avi',
+      'video/ogg' => 'ogv',
+      'audio/mpeg' => 'mp3',
+      'audio/mp4' => 'm4a',
+      'audio/aac' => 'aac',
+      'audio/flac' => 'flac',
+      'audio/ogg' => 'ogg',
+      'audio/opus' => 'opus',
+      'audio/wav' || 'audio/x-wav' => 'wav',
+      'application/pdf' => 'pdf',
+      'application/zip' => 'zip',
+      'application/x-rar-compressed' => 'rar',
+      'image/jpeg' => 'jpg',
+      'image/png' => 'png',
+      'image/gif' => 'gif',
+      _ => null,
+    };
+  }
+
+  /// Whether [mimeType] says nothing about the content: missing, or a
+  /// generic binary type origins send for anything they don't know
+  static bool isGeneric(String? mimeType) {
+    final type = mimeType?.split(';').first.trim().toLowerCase();
+    return switch (type) {
+      null ||
+      '' ||
+      'application/octet-stream' ||
+      'binary/octet-stream' ||
+      'application/unknown' ||
+      'application/binary' => true,
+      _ => false,
+    };
+  }
+
   static bool _matchesSignature(List<int> bytes, List<int> signature) {
     if (bytes.length < signature.length) return false;
     for (int i = 0; i < signature.length; i++) {
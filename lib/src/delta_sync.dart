@@ -0,0 +1,261 @@
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+
+import 'scrubber.dart';
+
+/// rsync's weak checksum over a window, updated a byte at a time
+class RollingChecksum {
+  final int length;
+  int _a = 0;
+  int _b = 0;
+
+  RollingChecksum(List<int> window) : length = window.length {
+    for (int i = 0; i < length; i++) {
+      _a += window[i];
+      _b += (length - i) * window[i];
+    }
+    _a &= 0xFFFF;
+    _b &= 0xFFFF;
+  }
+
+  int get value => _a | (_b << 16);
+
+  /// Slide the window one byte: drop [out], append [incoming]
+  void roll(int out, int incoming) {
+    _a = (_a - out + incoming) & 0xFFFF;
+    _b = (_b - length * out + _a) & 0xFFFF;
+  }
+}
+
+/// Weak and strong checksum of one block
+class BlockSignature {
+  final int weak;
+  final String strong;
+
+  const BlockSignature(this.weak, this.strong);
+
+  factory BlockSignature.of(List<int> bytes) =>
+      BlockSignature(RollingChecksum(bytes).value, Scrubber.checksum(bytes));
+}
+
+/// Per-block checksums of the current version of a file
+///
+/// Published next to the file by the origin (or a companion service) so a
+/// cache holding an older version can find which blocks it still has.
+class BlockManifest {
+  final int blockSize;
+  final int totalSize;
+  final List<BlockSignature> blocks;
+
+  BlockManifest(this.blockSize, this.totalSize, this.blocks);
+
+  /// Compute the manifest of the file at [path]
+  static Future<BlockManifest> forFile(
+    String path, {
+    int blockSize = 1024 * 1024,
+  }) async {
+    final raf = await File(path).open();
+    try {
+      final totalSize = await raf.length();
+      final blocks = <BlockSignature>[];
+      for (int pos = 0; pos < totalSize; pos += blockSize) {
+        blocks.add(
+          BlockSignature.of(await raf.read(min(blockSize, totalSize - pos))),
+        );
+      }
+      return BlockManifest(blockSize, totalSize, blocks);
+    } finally {
+      await raf.close();
+    }
+  }
+
+  factory BlockManifest.fromJson(Map<String, dynamic> json) => BlockManifest(
+    json['blockSize'] as int,
+    json['totalSize'] as int,
+    [
+      for (final block in json['blocks'] as List)
+        BlockSignature(block[0] as int, block[1] as String),
+    ],
+  );
+
+  Map<String, Object> toJson() => {
+    'blockSize': blockSize,
+    'totalSize': totalSize,
+    'blocks': [
+      for (final block in blocks) [block.weak, block.strong],
+    ],
+  };
+
+  /// First and last byte of block [index]
+  (int, int) rangeOf(int index) {
+    final start = index * blockSize;
+    return (start, min(start + blockSize, totalSize) - 1);
+  }
+}
+
+/// How to rebuild the new version of a file from the old cached copy
+class DeltaPlan {
+  /// (start, end, from): new bytes start..end equal old bytes at from
+  final List<(int, int, int)> copies;
+
+  /// New byte ranges that must be fetched
+  final List<(int, int)> fetches;
+
+  const DeltaPlan(this.copies, this.fetches);
+
+  int get reusedBytes => copies.fold(0, (sum, c) => sum + c.$2 - c.$1 + 1);
+
+  int get fetchBytes => fetches.fold(0, (sum, f) => sum + f.$2 - f.$1 + 1);
+
+  Map<String, Object> toJson() => {
+    'reusedBytes': reusedBytes,
+    'fetchBytes': fetchBytes,
+    'fetches': [for (final (s, e) in fetches) 'bytes=$s-$e'],
+  };
+}
+
+/// Finds the blocks of a changed file that an old cached copy still has
+///
+/// Blocks are matched at their own offset first (appended or patched
+/// files), then anywhere in the cached ranges with a rolling checksum, so
+/// content that moved (a re-muxed header, an inserted chunk) is reused
+/// too. The short last block is only matched at its own offset.
+class DeltaSync {
+  /// Plan the new version described by [remote] from the old file at
+  /// [localPath], of which only the [cached] ranges are valid
+  ///
+  /// [decode] turns bytes read at an offset of an encrypted file into its
+  /// content.
+  static Future<DeltaPlan> plan(
+    BlockManifest remote,
+    String localPath,
+    List<(int, int)> cached, {
+    int readSize = 8 * 1024 * 1024,
+    Uint8List Function(int offset, Uint8List bytes) decode = _asIs,
+  }) async {
+    final found = <int, int>{};
+    bool isCached(int start, int end) =>
+        cached.any((r) => r.$1 <= start && r.$2 >= end);
+
+    final raf = await File(localPath).open();
+    try {
+      for (int i = 0; i < remote.blocks.length; i++) {
+        final (start, end) = remote.rangeOf(i);
+        if (!isCached(start, end)) continue;
+        await raf.setPosition(start);
+        final bytes = decode(start, await raf.read(end - start + 1));
+        if (Scrubber.checksum(bytes) == remote.blocks[i].strong) {
+          found[i] = start;
+        }
+      }
+
+      if (found.length < remote.blocks.length) {
+        final byWeak = <int, List<int>>{};
+        for (int i = 0; i < remote.blocks.length; i++) {
+          if (found.containsKey(i)) continue;
+          final (start, end) = remote.rangeOf(i);
+          if (end - start + 1 != remote.blockSize) continue;
+          byWeak.putIfAbsent(remote.blocks[i].weak, () => []).add(i);
+        }
+        for (final (start, end) in cached) {
+          if (byWeak.isEmpty) break;
+          await _scan(
+            raf,
+            start,
+            end,
+            remote,
+            byWeak,
+            found,
+            max(readSize, 2 * remote.blockSize),
+            decode,
+          );
+        }
+      }
+    } finally {
+      await raf.close();
+    }
+
+    final copies = <(int, int, int)>[];
+    final fetches = <(int, int)>[];
+    for (int i = 0; i < remote.blocks.length; i++) {
+      final (start, end) = remote.rangeOf(i);
+      final from = found[i];
+      if (from == null) {
+        if (fetches.isNotEmpty && fetches.last.$2 + 1 == start) {
+          fetches.last = (fetches.last.$1, end);
+        } else {
+          fetches.add((start, end));
+        }
+      } else if (copies.isNotEmpty &&
+          copies.last.$2 + 1 == start &&
+          copies.last.$3 + start - copies.last.$1 == from) {
+        copies.last = (copies.last.$1, end, copies.last.$3);
+      } else {
+        copies.add((start, end, from));
+      }
+    }
+    return DeltaPlan(copies, fetches);
+  }
+
+  static Uint8List _asIs(int offset, Uint8List bytes) => bytes;
+
+  /// Slide a block-sized window over old bytes [start]..[end], recording
+  /// in [found] where unmatched remote blocks occur
+  static Future<void> _scan(
+    RandomAccessFile raf,
+    int start,
+    int end,
+    BlockManifest remote,
+    Map<int, List<int>> byWeak,
+    Map<int, int> found,
+    int readSize,
+    Uint8List Function(int offset, Uint8List bytes) decode,
+  ) async {
+    final blockSize = remote.blockSize;
+    var bufferStart = start;
+    var buffer = Uint8List(0);
+
+    // Make old bytes [from]..[to] addressable in [buffer]
+    Future<void> load(int from, int to) async {
+      if (from >= bufferStart && to < bufferStart + buffer.length) return;
+      await raf.setPosition(from);
+      buffer = decode(from, await raf.read(min(readSize, end - from + 1)));
+      bufferStart = from;
+    }
+
+    var pos = start;
+    RollingChecksum? rolling;
+    while (pos + blockSize - 1 <= end && byWeak.isNotEmpty) {
+      await load(pos, pos + blockSize - 1);
+      final offset = pos - bufferStart;
+      rolling ??= RollingChecksum(
+        Uint8List.sublistView(buffer, offset, offset + blockSize),
+      );
+
+      final candidates = byWeak[rolling.value];
+      if (candidates != null) {
+        final strong = Scrubber.checksum(
+          Uint8List.sublistView(buffer, offset, offset + blockSize),
+        );
+        final match = candidates.indexWhere(
+          (i) => remote.blocks[i].strong == strong,
+        );
+        if (match >= 0) {
+          found[candidates.removeAt(match)] = pos;
+          if (candidates.isEmpty) byWeak.remove(rolling.value);
+          // Blocks rarely overlap: continue after this one
+          pos += blockSize;
+          rolling = null;
+          continue;
+        }
+      }
+
+      if (pos + blockSize > end) break;
+      await load(pos, pos + blockSize);
+      final at = pos - bufferStart;
+      rolling.roll(buffer[at], buffer[at + blockSize]);
+      pos++;
+    }
+  }
+}
@@ -0,0 +1,67 @@
+import 'dart:typed_data';
+
+/// Whether [path] names a content URI rather than a file system path
+bool isContentUri(String path) => path.startsWith('content://');
+
+/// Document tree the proxy cannot open by path, written through the host
+/// app (e.g. an Android Storage Access Framework tree on an SD card)
+///
+/// The sparse cache itself stays in app storage; completed files and
+/// exports whose target is a content URI are written through the store.
+abstract class DocumentStore {
+  /// Create a document named [name] in [treeUri] and return its URI
+  Future<String> createDocument(
+    String treeUri,
+    String name,
+    String mimeType,
+  );
+
+  /// Write [data] to a document created by [createDocument]
+  Future<void> write(String documentUri, Stream<List<int>> data);
+
+  /// Delete a document (used to clean up after a failed write)
+  Future<void> delete(String documentUri);
+}
+
+/// [DocumentStore] backed by host-app callbacks, e.g. a method channel to
+/// `DocumentsContract` / `ContentResolver` on Android
+class CallbackDocumentStore implements DocumentStore {
+  final Future<String> Function(String treeUri, String name, String mimeType)
+  onCreate;
+
+  /// Append [bytes] to the document (chunks arrive in order)
+  final Future<void> Function(String documentUri, Uint8List bytes) onAppend;
+
+  /// Flush and close the document after the last chunk
+  final Future<void> Function(String documentUri)? onClose;
+
+  final Future<void> Function(String documentUri) onDelete;
+
+  CallbackDocumentStore({
+    required this.onCreate,
+    required this.onAppend,
+    required this.onDelete,
+    this.onClose,
+  });
+
+  @override
+  Future<String> createDocument(
+    String treeUri,
+    String name,
+    String mimeType,
+  ) => onCreate(treeUri, name, mimeType);
+
+  @override
+  Future<void> write(String documentUri, Stream<List<int>> data) async {
+    await for (final chunk in data) {
+      await onAppend(
+        documentUri,
+        chunk is Uint8List ? chunk : Uint8List.fromList(chunk),
+      );
+    }
+    await onClose?.call(documentUri);
+  }
+
+  @override
+  Future<void> delete(String documentUri) => onDelete(documentUri);
+}
@@ -13,29 +13,87 @@ class DownStream {
   DownStream._();
 
   /// Initialize DownStream
+  ///
+  /// Same as [start] with a [ProxyOptions] of these values.
   static Future<DownStream> init({
     int port = 8080,
     String? storageDir,
     String? userAgent,
     ProxyConfig? proxyConfig,
+    ClientConfig clientConfig = const ClientConfig(),
+    HttpClient? httpClient,
+    Map<String, String>? requestHeaders,
+    Iterable<String> forwardHeaders = const [],
+    Iterable<String> passThroughHeaders = const [],
+    RequestDecorator? requestDecorator,
+    bool bodyDigest = false,
+    List<int>? metadataKey,
+    List<int>? cacheKey,
+    List<int>? signingKey,
+    SecretStore? secrets,
+    bool resumeDownloads = true,
+    bool journal = true,
+    LogSink? logSink,
+    LogLevel? logLevel,
+    String? apiToken,
+    bool takeOver = false,
+    Duration handoffTimeout = const Duration(seconds: 30),
+    CallContext? context,
+  }) => start(
+    ProxyOptions(
+      port: port,
+      storageDir: storageDir,
+      userAgent: userAgent,
+      proxyConfig: proxyConfig,
+      clientConfig: clientConfig,
+      httpClient: httpClient,
+      requestHeaders: {...?requestHeaders},
+      forwardHeaders: forwardHeaders,
+      passThroughHeaders: passThroughHeaders,
+      requestDecorator: requestDecorator,
+      bodyDigest: bodyDigest,
+      metadataKey: metadataKey,
+      cacheKey: cacheKey,
+      signingKey: signingKey,
+      secrets: secrets,
+      resumeDownloads: resumeDownloads,
+      journal: journal,
+      logSink: logSink,
+      logLevel: logLevel,
+      apiToken: apiToken,
+      takeOver: takeOver,
+      handoffTimeout: handoffTimeout,
+    ),
+    context: context,
+  );
+
+  /// Initialize DownStream with [options], checked before anything is
+  /// opened (see [ProxyOptions.validate])
+  static Future<DownStream> start(
+    ProxyOptions options, {
+    CallContext? context,
   }) async {
+    options.validate();
     if (_instance == null) {
       _instance = DownStream._();
 
       final dir =
-          storageDir ?? '${Directory.systemTemp.path}/down_stream_cache';
+          options.storageDir ??
+          '${Directory.systemTemp.path}/down_stream_cache';
       _instance!.storageDir = dir;
       _instance!.collectionsDir = '$dir/collections';
 
-      await Directory(dir).create(recursive: true);
-      await Directory(_instance!.collectionsDir!).create(recursive: true);
-
-      _proxy = await StreamProxyBridge.getInstance(
-        port: port,
-        storageDir: dir,
-        userAgent: userAgent,
-        proxyConfig: proxyConfig,
-      );
+      try {
+        // The proxy checks the cache itself
+        await StorageCheck.run(_instance!.collectionsDir!);
+        _proxy = await StreamProxyBridge.start(
+          options.copyWith(storageDir: dir),
+          context: context,
+        );
+      } catch (_) {
+        _instance = null;
+        rethrow;
+      }
 
       // Validate existing files on startup
       await _instance!._validateFiles();
@@ -53,12 +111,112 @@ class DownStream {
     return _instance!;
   }
 
+  /// Where the proxy listens, e.g. `http://127.0.0.1:8080`, with the
+  /// port it picked when started on port 0
+  Uri get baseUrl {
+    if (_proxy == null) {
+      throw StateError('DownStream not initialized');
+    }
+    return _proxy!.baseUrl;
+  }
+
   /// Cache a URL and return the local proxy URL for playback
-  Uri cache(String remoteUrl) {
+  ///
+  /// With [ephemeral] nothing is persisted: the data is discarded when the
+  /// playback session ends.
+  /// [namespace] selects the profile whose [NamespacePolicy] applies.
+  /// Use [ServingProfile.audio] for music. [nextUrl] is the next playlist
+  /// item, whose start is cached ahead (see also [setPlaylist]).
+  /// [session] is a token whose playback position survives proxy restarts.
+  /// [quality] picks a variant registered with [registerVariants].
+  /// [client] names the device for fair scheduling. [sha256] is the
+  /// checksum the completed file is verified against. [ttl] deletes it
+  /// that long after it is first played. [previewBytes] and
+  /// [previewDuration] limit playback to the file's start (see [preview]).
+  /// The returned URL is signed and valid until [expires] (forever when
+  /// null).
+  Uri cache(
+    String remoteUrl, {
+    bool ephemeral = false,
+    String? namespace,
+    ServingProfile profile = ServingProfile.video,
+    String? nextUrl,
+    String? session,
+    String? quality,
+    String? client,
+    String? sha256,
+    Duration? ttl,
+    int? previewBytes,
+    Duration? previewDuration,
+    DateTime? expires,
+  }) {
     if (_proxy == null) {
       throw StateError('DownStream not initialized');
     }
-    return _proxy!.getProxyUrl(remoteUrl);
+    return _proxy!.getProxyUrl(
+      remoteUrl,
+      ephemeral: ephemeral,
+      namespace: namespace,
+      profile: profile,
+      nextUrl: nextUrl,
+      session: session,
+      quality: quality,
+      client: client,
+      sha256: sha256,
+      ttl: ttl,
+      previewBytes: previewBytes,
+      previewDuration: previewDuration,
+      expires: expires,
+    );
+  }
+
+  /// A URL playing only the first [maxBytes] or [duration] of [remoteUrl]
+  ///
+  /// Only that much is fetched and cached; seeking past it fails with
+  /// `416`. Without a bitrate (see `StreamProxyBridge.setBitrate`) a
+  /// duration assumes 5 Mbit/s. Caching the same URL normally later
+  /// reuses the bytes.
+  Uri preview(String remoteUrl, {int? maxBytes, Duration? duration}) {
+    if (maxBytes == null && duration == null) {
+      throw ArgumentError('A preview needs maxBytes or duration');
+    }
+    return cache(remoteUrl, previewBytes: maxBytes, previewDuration: duration);
+  }
+
+  /// Register the upstream URLs of each quality of [item]
+  ///
+  /// `cache(item, quality: '720p')` then streams the 720p URL. Variants are
+  /// cached separately but reported under [item] in [getAllDownloads].
+  void registerVariants(
+    String item,
+    Map<String, String> urls, {
+    String? defaultVariant,
+  }) {
+    _proxy?.variants.register(item, urls, defaultVariant: defaultVariant);
+  }
+
+  /// Progress of each variant of [item] (0.0 to 100.0), by variant name
+  Map<String, double> getVariantProgress(String item) =>
+      _proxy?.getVariantProgress(item) ?? const {};
+
+  /// Play order of [urls]; the next item is prefetched near the end of
+  /// the current one
+  void setPlaylist(List<String> urls) {
+    _proxy?.setPlaylist(urls);
+  }
+
+  /// Version, commit and enabled features, for bug reports
+  BuildInfo get buildInfo => _proxy?.buildInfo ?? const BuildInfo();
+
+  /// Set blocked hosts, daily byte budget and allowed hours for a profile
+  void setNamespacePolicy(String namespace, NamespacePolicy policy) {
+    _proxy?.setNamespacePolicy(namespace, policy);
+  }
+
+  /// End an ephemeral playback session and discard its data
+  Future<void> endEphemeralSession(String url) async {
+    if (_proxy == null) return;
+    await _proxy!.endEphemeralSession(url);
   }
 
   /// Get download progress for a URL (0.0 to 100.0)
@@ -71,10 +229,17 @@ class DownStream {
   /// Emits (url, progress) tuples
   Stream<(String, double)>? get progressStream => _proxy?.progressStream;
 
+  /// Proxy event log (digests, failures, policy decisions, ...)
+  Stream<ProxyEvent>? get events => _proxy?.events;
+
+  /// Events of the given [types] only (progress, completion, ...)
+  Stream<ProxyEvent>? subscribe([Set<ProxyEventType>? types]) =>
+      _proxy?.subscribe(types);
+
   /// Cancel a download task
-  Future<void> cancelDownload(String url) async {
+  Future<void> cancelDownload(String url, {CallContext? context}) async {
     if (_proxy == null) return;
-    await _proxy!.cancelDownload(url);
+    await _proxy!.cancelDownload(url, context: context);
   }
 
   /// Get file statistics (preview info) for a URL
@@ -85,6 +250,17 @@ class DownStream {
 
   // ============== CACHE MANAGEMENT ==============
 
+  /// Move the cache to [newDir] (e.g. external storage) without stopping
+  /// downloads or losing progress; returns the number of files moved
+  ///
+  /// The collection folder is not moved.
+  Future<int> moveStorage(String newDir, {CallContext? context}) async {
+    if (_proxy == null) return 0;
+    final moved = await _proxy!.moveStorage(newDir, context: context);
+    storageDir = _proxy!.storageDir;
+    return moved;
+  }
+
   /// Clear ALL cache (files + metadata). Fixes ghost downloads from crashed sessions.
   Future<void> clearAllCache() async {
     if (_proxy == null) return;
@@ -93,15 +269,34 @@ class DownStream {
   }
 
   /// Resume/complete ALL incomplete downloads in background
-  Future<void> resumeAllDownloads() async {
+  Future<void> resumeAllDownloads({CallContext? context}) async {
     if (_proxy == null) return;
-    await _proxy!.resumeAllDownloads();
+    await _proxy!.resumeAllDownloads(context: context);
   }
 
   /// Start background download for a URL (completes file even when player pauses)
-  Future<void> startBackgroundDownload(String url) async {
+  ///
+  /// Ending [context] stops the download. [ttl] deletes the file that
+  /// long after it is first enqueued. [collection] names the collection
+  /// (see [defineCollection]) the file moves into once complete.
+  Future<void> startBackgroundDownload(
+    String url, {
+    Duration? ttl,
+    String? collection,
+    CallContext? context,
+  }) async {
     if (_proxy == null) return;
-    await _proxy!.startBackgroundDownload(url);
+    await _proxy!.startBackgroundDownload(
+      url,
+      ttl: ttl,
+      collection: collection,
+      context: context,
+    );
+  }
+
+  /// Add a named collection, with its own folder, quota and retention
+  void defineCollection(Collection collection) {
+    _proxy?.defineCollection(collection);
   }
 
   /// Stop background download for a URL
@@ -110,6 +305,30 @@ class DownStream {
     await _proxy!.stopBackgroundDownload(url);
   }
 
+  /// Pause the download of [fileId]: fetches in flight are interrupted and
+  /// nothing is fetched in the background until [resume]
+  Future<void> pause(String fileId) async {
+    await _proxy?.pause(fileId);
+  }
+
+  /// Restart a paused or failed download
+  Future<void> resume(String fileId) async {
+    await _proxy?.resume(fileId);
+  }
+
+  /// Stop the download of [fileId], deleting its cached bytes if
+  /// [deleteData] is set
+  Future<void> cancel(String fileId, {bool deleteData = false}) async {
+    await _proxy?.cancel(fileId, deleteData: deleteData);
+  }
+
+  /// State of the download of [fileId] (see [DownloadState])
+  DownloadState? getDownloadState(String fileId) =>
+      _proxy?.getDownload(fileId)?.state;
+
+  /// Download state changes
+  Stream<Download>? get downloadStates => _proxy?.downloadStates;
+
   /// Check if a URL is currently being downloaded
   bool isDownloading(String url) {
     if (_proxy == null) return false;
@@ -131,6 +350,8 @@ class DownStream {
 
       if (await file.exists()) {
         final stat = await file.stat();
+        final url = meta?.originalUrl;
+        final variant = url == null ? null : _proxy!.variants.lookup(url);
         downloads.add(
           DownloadInfo(
             id: id,
@@ -140,6 +361,9 @@ class DownStream {
             progress: meta?.progress ?? 100.0,
             fileName: meta?.suggestedFileName,
             originalUrl: meta?.originalUrl,
+            pinned: _proxy!.isPinned(id),
+            item: variant?.$1,
+            variant: variant?.$2,
           ),
         );
       }
@@ -169,6 +393,7 @@ class DownStream {
                 isComplete: true,
                 progress: 100.0,
                 fileName: fileName,
+                pinned: _proxy!.isPinned(id),
               ),
             );
           }
@@ -179,15 +404,26 @@ class DownStream {
     return downloads;
   }
 
+  /// Protect a file from eviction (e.g. a user favorite)
+  Future<void> pin(String fileId) async {
+    await _proxy?.pin(fileId);
+  }
+
+  /// Make a pinned file evictable again
+  Future<void> unpin(String fileId) async {
+    await _proxy?.unpin(fileId);
+  }
+
   /// Remove cached file and metadata by URL
-  Future<void> removeCache(String url) async {
+  Future<void> removeCache(String url, {CallContext? context}) async {
     if (_proxy == null) return;
-    await _proxy!.clearCache(url);
+    await _proxy!.clearCache(url, context: context);
   }
 
   /// Remove cached file and metadata by file ID
   Future<void> removeCacheById(String fileId) async {
     if (storageDir == null) return;
+    await _proxy?.unpin(fileId);
 
     final videoPath = '$storageDir/$fileId.video';
     final metaPath = '$storageDir/$fileId.meta';
@@ -221,46 +457,89 @@ class DownStream {
 
   // ============== FILE EXPORT ==============
 
+  /// Publish completed downloads as a static site in [outDir] (see
+  /// [StaticSiteExporter]); returns the number of files written
+  Future<int> publishStatic(
+    String outDir, {
+    String title = 'DownStream Collection',
+    bool symlink = false,
+  }) async {
+    final exporter = StaticSiteExporter(
+      outDir,
+      title: title,
+      symlink: symlink,
+    );
+    return exporter.publish(await getAllDownloads());
+  }
+
   /// Export a completed file to a target path (copy)
-  Future<bool> exportFile(String url, String targetPath) async {
+  Future<bool> exportFile(
+    String url,
+    String targetPath, {
+    CallContext? context,
+  }) async {
     if (_proxy == null) return false;
-    return _proxy!.exportFile(url, targetPath);
+    return _proxy!.exportFile(url, targetPath, context: context);
   }
 
   /// Export a completed file by ID to a target path (copy)
-  Future<bool> exportFileById(String fileId, String targetPath) async {
+  Future<bool> exportFileById(
+    String fileId,
+    String targetPath, {
+    CallContext? context,
+  }) async {
     if (_proxy == null) return false;
-    return _proxy!.exportFileById(fileId, targetPath);
+    return _proxy!.exportFileById(fileId, targetPath, context: context);
   }
 
   /// Move a completed file to a target path (removes from cache)
-  Future<bool> moveFile(String url, String targetPath) async {
+  Future<bool> moveFile(
+    String url,
+    String targetPath, {
+    CallContext? context,
+  }) async {
     if (_proxy == null) return false;
-    return _proxy!.moveFile(url, targetPath);
+    return _proxy!.moveFile(url, targetPath, context: context);
   }
 
   /// Move a completed file by ID to a target path (removes from cache)
-  Future<bool> moveFileById(String fileId, String targetPath) async {
+  Future<bool> moveFileById(
+    String fileId,
+    String targetPath, {
+    CallContext? context,
+  }) async {
     if (_proxy == null) return false;
-    return _proxy!.moveFileById(fileId, targetPath);
+    return _proxy!.moveFileById(fileId, targetPath, context: context);
   }
 
   /// Export with automatic filename based on URL/headers
   /// Returns the full path where file was saved, or null if failed
-  Future<String?> exportWithAutoName(String url, String targetDir) async {
+  Future<String?> exportWithAutoName(
+    String url,
+    String targetDir, {
+    CallContext? context,
+  }) async {
     if (_proxy == null) return null;
 
     final fileName = _proxy!.getSuggestedFileName(url);
     if (fileName == null) return null;
 
     final targetPath = p.join(targetDir, fileName);
-    final success = await _proxy!.exportFile(url, targetPath);
+    final success = await _proxy!.exportFile(
+      url,
+      targetPath,
+      context: context,
+    );
     return success ? targetPath : null;
   }
 
   /// Move with automatic filename based on URL/headers
   /// Returns the full path where file was moved, or null if failed
-  Future<String?> moveWithAutoName(String url, String targetDir) async {
+  Future<String?> moveWithAutoName(
+    String url,
+    String targetDir, {
+    CallContext? context,
+  }) async {
     if (_proxy == null) return null;
 
     final fileName = _proxy!.getSuggestedFileName(url);
@@ -271,7 +550,11 @@ class DownStream {
     final finalName = fileName.contains('.') ? fileName : '$fileName.$ext';
 
     final targetPath = p.join(targetDir, finalName);
-    final success = await _proxy!.moveFile(url, targetPath);
+    final success = await _proxy!.moveFile(
+      url,
+      targetPath,
+      context: context,
+    );
     return success ? targetPath : null;
   }
 
@@ -326,7 +609,11 @@ class DownStream {
           Logger.success('Validated complete file: $id');
           // Optionally move to collections
           if (collectionsDir != null) {
-            final targetPath = '$collectionsDir/$id.mp4';
+            final mimeType = await MimeTypeDetector.detectFromFile(
+              entity.path,
+            );
+            final ext = MimeTypeDetector.extensionFor(mimeType) ?? 'mp4';
+            final targetPath = '$collectionsDir/$id.$ext';
             if (!await File(targetPath).exists()) {
               try {
                 await entity.rename(targetPath);
@@ -342,8 +629,11 @@ class DownStream {
   }
 
   /// Shutdown DownStream
-  Future<void> dispose() async {
-    await _proxy?.dispose();
+  ///
+  /// In-flight requests get until [context] ends to finish (see
+  /// [StreamProxyBridge.stop]).
+  Future<void> dispose({CallContext? context}) async {
+    await _proxy?.stop(context: context);
     _proxy = null;
     _instance = null;
   }
@@ -359,6 +649,14 @@ class DownloadInfo {
   final String? fileName;
   final String? originalUrl;
 
+  /// Protected from eviction (see [DownStream.pin])
+  final bool pinned;
+
+  /// Logical item this file is a variant of (see
+  /// [DownStream.registerVariants]), and the variant's name
+  final String? item;
+  final String? variant;
+
   DownloadInfo({
     required this.id,
     required this.localPath,
@@ -367,6 +665,9 @@ class DownloadInfo {
     required this.progress,
     this.fileName,
     this.originalUrl,
+    this.pinned = false,
+    this.item,
+    this.variant,
   });
 
   /// Format file size for display
@@ -3,6 +3,12 @@ import 'dart:convert';
 import 'dart:math';
 import 'dart:typed_data';
 
+import 'data_source.dart';
+import 'logger.dart';
+import 'meta_cipher.dart';
+import 'range_set.dart';
+import 'range_sources.dart';
+
 /// Represents a byte range [start, end] inclusive
 class ByteRange {
   int start;
@@ -23,16 +29,38 @@ class ByteRange {
 class DownloadMeta {
   final String id;
   final int totalSize;
-  final String localPath;
-  final String metaPath;
+  String localPath; // Changed when the cache moves (see moveStorage)
+  String metaPath;
   final String? originalUrl; // Store original URL for reverse lookup
   String? mimeType; // Detected MIME type
   String? fileName; // Extracted filename from URL or headers
   String? targetPath; // Final target path for file after download completes
+  String? etag; // Validators of the cached version, from the first probe
+  String? lastModified;
+  String? expectedSha256; // Checksum the complete file must match
+  String? sha256; // Checksum of the complete file, once verified
+  final bool ephemeral; // Session-only cache, never persisted
+  final MetaCipher? cipher; // Encrypts the .meta file when set
+
+  /// Nonce the cached bytes are encrypted with (see `CacheCipher`); null
+  /// for a plaintext file
+  List<int>? cacheNonce;
+
+  /// Checksums of verified blocks (block index -> digest), see `Scrubber`
+  final Map<int, String> checksums = {};
+
+  /// Which host supplied each cached range
+  RangeSources sources = RangeSources();
+
+  /// Upstream response headers passed to players, by lower-case name
+  final Map<String, String> responseHeaders = {};
+
+  /// What `If-Range` needs: a strong [etag], else [lastModified]
+  String? get validator =>
+      etag != null && !etag!.startsWith('W/') ? etag : lastModified;
 
-  List<ByteRange> _ranges = [];
-  bool _needsMerge =
-      false; // Track if merge is needed (performance optimization)
+  // Cached ranges of small files, kept sorted and merged
+  RangeSet _ranges = RangeSet();
 
   // For large files (>100MB), use bitmap instead
   Uint8List? _bitmap;
@@ -47,6 +75,8 @@ class DownloadMeta {
     this.originalUrl,
     this.mimeType,
     this.fileName,
+    this.ephemeral = false,
+    this.cipher,
   }) {
     // Use bitmap for files larger than 100MB
     if (totalSize > 100 * 1024 * 1024) {
@@ -76,23 +106,13 @@ class DownloadMeta {
             return ext;
           }
         }
-      } catch (_) {}
+      } on FormatException catch (e) {
+        Logger.debug('Unparsable URL of $id: ${e.message}');
+      }
     }
 
     // Fallback from MIME type
-    return switch (mimeType) {
-      'video/mp4' => 'mp4',
-      'video/webm' => 'webm',
-      'video/x-matroska' => 'mkv',
-      'video/x-flv' => 'flv',
-      'video/quicktime' => 'mov',
-      'audio/mpeg' => 'mp3',
-      'audio/mp4' => 'm4a',
-      'application/pdf' => 'pdf',
-      'image/jpeg' => 'jpg',
-      'image/png' => 'png',
-      _ => 'mp4', // Default
-    };
+    return MimeTypeDetector.extensionFor(mimeType) ?? 'mp4';
   }
 
   /// Get suggested filename for export
@@ -114,7 +134,9 @@ class DownloadMeta {
             return decoded;
           }
         }
-      } catch (_) {}
+      } on FormatException catch (e) {
+        Logger.debug('Unparsable URL of $id: ${e.message}');
+      }
     }
 
     return '$id.$extension';
@@ -130,14 +152,22 @@ class DownloadMeta {
   }
 
   void _addRangeToList(int start, int end) {
-    _ranges.add(ByteRange(start, end));
-    _needsMerge = true;
+    _ranges.add(start, end);
+  }
 
-    // Only merge if we have many fragments (performance optimization)
-    // Otherwise, defer merging to save() to avoid O(n log n) on every chunk
-    if (_ranges.length > 100) {
-      _mergeRanges();
+  /// Forget a range (e.g. corrupt bytes) so it is fetched again
+  ///
+  /// With bitmap tracking every block touched by the range is dropped.
+  void removeRange(int start, int end) {
+    sources.remove(start, end);
+    if (_useBitmap) {
+      final endBlock = end ~/ _blockSize;
+      for (int block = start ~/ _blockSize; block <= endBlock; block++) {
+        _bitmap![block ~/ 8] &= ~(1 << (block % 8));
+      }
+      return;
     }
+    _ranges.remove(start, end);
   }
 
   void _addRangeToBitmap(int start, int end) {
@@ -151,53 +181,12 @@ class DownloadMeta {
     }
   }
 
-  /// Merge overlapping/adjacent ranges (O(n log n))
-  void _mergeRanges() {
-    if (_ranges.length <= 1) {
-      _needsMerge = false;
-      return;
-    }
-
-    // Sort by start position
-    _ranges.sort((a, b) => a.start.compareTo(b.start));
-
-    List<ByteRange> merged = [];
-    ByteRange current = _ranges[0];
-
-    for (int i = 1; i < _ranges.length; i++) {
-      if (_ranges[i].start <= current.end + 1) {
-        // Merge: extend current range
-        current.end = max(current.end, _ranges[i].end);
-      } else {
-        // No overlap: save current and move to next
-        merged.add(current);
-        current = _ranges[i];
-      }
-    }
-    merged.add(current);
-    _ranges = merged;
-    _needsMerge = false;
-  }
-
   /// Check if a specific range is fully cached
   bool hasRange(int start, int end) {
     if (_useBitmap) {
       return _hasRangeInBitmap(start, end);
     }
-    return _hasRangeInList(start, end);
-  }
-
-  bool _hasRangeInList(int start, int end) {
-    // Merge if needed before checking
-    if (_needsMerge) {
-      _mergeRanges();
-    }
-    for (final range in _ranges) {
-      if (start >= range.start && end <= range.end) {
-        return true;
-      }
-    }
-    return false;
+    return _ranges.contains(start, end);
   }
 
   bool _hasRangeInBitmap(int start, int end) {
@@ -227,13 +216,14 @@ class DownloadMeta {
       }
       return true;
     }
-    return _ranges.length == 1 &&
-        _ranges[0].start == 0 &&
-        _ranges[0].end >= totalSize - 1;
+    return _ranges.contains(0, totalSize - 1);
   }
 
   /// Get download progress (0.0 to 100.0)
-  double get progress {
+  double get progress => (downloadedBytes / totalSize) * 100;
+
+  /// Bytes cached so far (whole blocks for bitmap-tracked files)
+  int get downloadedBytes {
     if (_useBitmap) {
       int downloaded = 0;
       final numBlocks = (totalSize / _blockSize).ceil();
@@ -244,23 +234,35 @@ class DownloadMeta {
           downloaded += _blockSize;
         }
       }
-      return min(100.0, (downloaded / totalSize) * 100);
+      return min(totalSize, downloaded);
     }
 
-    int downloaded = 0;
-    for (final range in _ranges) {
-      downloaded += range.end - range.start + 1;
-    }
-    return (downloaded / totalSize) * 100;
+    return _ranges.coveredBytes;
   }
 
-  /// Save metadata to disk
-  Future<void> save() async {
-    // Merge ranges before saving (performance optimization)
-    if (_needsMerge && !_useBitmap) {
-      _mergeRanges();
-    }
+  /// Bytes of [start]..[end] cached (whole blocks for bitmap-tracked
+  /// files)
+  int cachedBytesIn(int start, int end) {
+    if (!_useBitmap) return _ranges.coveredIn(start, end);
+    final missing = getGapsIn(start, end);
+    return end - start + 1 - missing.fold(0, (sum, g) => sum + g.$2 - g.$1 + 1);
+  }
 
+  // The save running or queued last; saves share one temp file
+  Future<void> _lastSave = Future.value();
+
+  /// Save metadata to disk (no-op for ephemeral downloads)
+  ///
+  /// Saves run one after another, each writing the state as of when it
+  /// starts, so two never interleave in the temp file.
+  Future<void> save() {
+    if (ephemeral) return Future.value();
+    final next = _lastSave.then((_) => _save());
+    _lastSave = next.catchError((Object _) {});
+    return next;
+  }
+
+  Future<void> _save() async {
     final file = File(metaPath);
 
     if (_useBitmap) {
@@ -272,6 +274,14 @@ class DownloadMeta {
         'mimeType': mimeType,
         'fileName': fileName,
         'targetPath': targetPath,
+        'etag': etag,
+        'lastModified': lastModified,
+        'expectedSha256': expectedSha256,
+        'sha256': sha256,
+        'checksums': _checksumsJson(),
+        'sources': sources.toJson(),
+        'responseHeaders': responseHeaders,
+        'cacheNonce': _nonceJson(),
         'bitmapOffset': 0, // Placeholder
       });
       final headerBytes = utf8.encode(header);
@@ -287,7 +297,7 @@ class DownloadMeta {
       ]);
       buffer.add(headerBytes);
       buffer.add(_bitmap!);
-      await file.writeAsBytes(buffer.takeBytes());
+      await _write(file, buffer.takeBytes());
     } else {
       // Save JSON
       final json = jsonEncode({
@@ -297,21 +307,130 @@ class DownloadMeta {
         'mimeType': mimeType,
         'fileName': fileName,
         'targetPath': targetPath,
-        'ranges': _ranges.map((r) => r.toJson()).toList(),
+        'etag': etag,
+        'lastModified': lastModified,
+        'expectedSha256': expectedSha256,
+        'sha256': sha256,
+        'checksums': _checksumsJson(),
+        'sources': sources.toJson(),
+        'responseHeaders': responseHeaders,
+        'cacheNonce': _nonceJson(),
+        'ranges': [
+          for (final (start, end) in _ranges.ranges)
+            ByteRange(start, end).toJson(),
+        ],
       });
-      await file.writeAsString(json);
+      await _write(file, utf8.encode(json));
+    }
+  }
+
+  Map<String, String> _checksumsJson() =>
+      checksums.map((block, digest) => MapEntry('$block', digest));
+
+  String? _nonceJson() {
+    final nonce = cacheNonce;
+    return nonce == null ? null : base64Encode(nonce);
+  }
+
+  void _loadNonce(Object? json) {
+    cacheNonce = json is String ? base64Decode(json) : null;
+  }
+
+  void _loadChecksums(Object? json) {
+    checksums.clear();
+    if (json is! Map<String, dynamic>) return;
+    json.forEach((block, digest) {
+      checksums[int.parse(block)] = digest as String;
+    });
+  }
+
+  void _loadSources(Object? json) {
+    sources = json is Map<String, dynamic>
+        ? RangeSources.fromJson(json)
+        : RangeSources();
+  }
+
+  void _loadResponseHeaders(Object? json) {
+    responseHeaders.clear();
+    if (json is! Map<String, dynamic>) return;
+    responseHeaders.addAll(json.cast<String, String>());
+  }
+
+  /// Write atomically: a crash mid-save leaves the previous .meta intact
+  Future<void> _write(File file, List<int> bytes) async {
+    final temp = File('${file.path}.tmp');
+    await temp.writeAsBytes(cipher?.seal(bytes) ?? bytes, flush: true);
+    await temp.rename(file.path);
+  }
+
+  /// Read the .meta file, decrypting it when sealed
+  Future<Uint8List> _read(File file) async {
+    final bytes = await file.readAsBytes();
+    if (MetaCipher.isSealed(bytes)) {
+      if (cipher == null) {
+        throw MetaCipherException('Metadata is encrypted but no key is set');
+      }
+      return cipher!.open(bytes);
+    }
+    // Plaintext from before encryption was enabled; sealed on next save
+    return bytes;
+  }
+
+  /// Total size recorded in an existing .meta file, without loading it
+  ///
+  /// Lets a restarted proxy skip the origin probe for known files.
+  /// Returns null when the file is missing or unreadable.
+  static Future<int?> peekTotalSize(
+    String metaPath, {
+    MetaCipher? cipher,
+  }) async {
+    final header = await readHeader(metaPath, cipher: cipher);
+    return header?['totalSize'] as int?;
+  }
+
+  /// File fields (id, totalSize, originalUrl, ...) of an existing .meta
+  /// file without its range data, or null when missing or unreadable
+  static Future<Map<String, dynamic>?> readHeader(
+    String metaPath, {
+    MetaCipher? cipher,
+  }) async {
+    try {
+      final file = File(metaPath);
+      if (!await file.exists()) return null;
+      var bytes = await file.readAsBytes();
+      if (MetaCipher.isSealed(bytes)) {
+        if (cipher == null) return null;
+        bytes = cipher.open(bytes);
+      }
+
+      // Plain JSON, or [4 bytes header length][header json][bitmap]
+      String json;
+      if (bytes.isNotEmpty && bytes[0] == 0x7B) {
+        json = utf8.decode(bytes);
+      } else {
+        if (bytes.length < 4) return null;
+        final headerLen =
+            (bytes[0] << 24) | (bytes[1] << 16) | (bytes[2] << 8) | bytes[3];
+        if (bytes.length < 4 + headerLen) return null;
+        json = utf8.decode(bytes.sublist(4, 4 + headerLen));
+      }
+      return jsonDecode(json) as Map<String, dynamic>;
+    } catch (_) {
+      return null;
     }
   }
 
   /// Load metadata from disk
   Future<void> load() async {
+    if (ephemeral) return;
+
     final file = File(metaPath);
     if (!await file.exists()) return;
 
     try {
       if (_useBitmap) {
         // Load bitmap with header
-        final bytes = await file.readAsBytes();
+        final bytes = await _read(file);
         if (bytes.length < 4) return;
 
         final headerLen =
@@ -324,21 +443,43 @@ class DownloadMeta {
         mimeType = data['mimeType'] as String?;
         fileName = data['fileName'] as String?;
         targetPath = data['targetPath'] as String?;
+        etag = data['etag'] as String?;
+        lastModified = data['lastModified'] as String?;
+        expectedSha256 = data['expectedSha256'] as String?;
+        sha256 = data['sha256'] as String?;
+        _loadChecksums(data['checksums']);
+        _loadSources(data['sources']);
+        _loadResponseHeaders(data['responseHeaders']);
+        _loadNonce(data['cacheNonce']);
 
         _bitmap = Uint8List.fromList(bytes.sublist(4 + headerLen));
       } else {
-        final content = await file.readAsString();
+        final content = utf8.decode(await _read(file));
         final data = jsonDecode(content) as Map<String, dynamic>;
-        _ranges = (data['ranges'] as List)
-            .map((r) => ByteRange.fromJson(r))
-            .toList();
+        _ranges = RangeSet.of(
+          (data['ranges'] as List).map((r) {
+            final range = ByteRange.fromJson(r);
+            return (range.start, range.end);
+          }),
+        );
         mimeType = data['mimeType'] as String?;
         fileName = data['fileName'] as String?;
         targetPath = data['targetPath'] as String?;
-        _needsMerge = false; // Data from disk is already merged
+        etag = data['etag'] as String?;
+        lastModified = data['lastModified'] as String?;
+        expectedSha256 = data['expectedSha256'] as String?;
+        sha256 = data['sha256'] as String?;
+        _loadChecksums(data['checksums']);
+        _loadSources(data['sources']);
+        _loadResponseHeaders(data['responseHeaders']);
+        _loadNonce(data['cacheNonce']);
       }
     } catch (e) {
-      print('Warning: Could not load metadata: $e');
+      Logger.warn(
+        'Could not load metadata',
+        fields: {'fileId': id, 'path': metaPath},
+        error: e,
+      );
     }
   }
 
@@ -351,49 +492,29 @@ class DownloadMeta {
     return _getGapsFromList();
   }
 
-  List<(int, int)> _getGapsFromList() {
-    // Ensure ranges are merged before finding gaps
-    if (_needsMerge) {
-      _mergeRanges();
-    }
-
-    final gaps = <(int, int)>[];
-
-    if (_ranges.isEmpty) {
-      // No data at all - entire file is a gap
-      gaps.add((0, totalSize - 1));
-      return gaps;
-    }
-
-    // Check gap at the start
-    if (_ranges.first.start > 0) {
-      gaps.add((0, _ranges.first.start - 1));
-    }
-
-    // Check gaps between ranges
-    for (int i = 0; i < _ranges.length - 1; i++) {
-      final gapStart = _ranges[i].end + 1;
-      final gapEnd = _ranges[i + 1].start - 1;
-      if (gapStart <= gapEnd) {
-        gaps.add((gapStart, gapEnd));
-      }
-    }
-
-    // Check gap at the end
-    if (_ranges.last.end < totalSize - 1) {
-      gaps.add((_ranges.last.end + 1, totalSize - 1));
-    }
-
-    return gaps;
+  /// Missing sub-ranges of [start]..[end], in order
+  List<(int, int)> getGapsIn(int start, int end) {
+    if (!_useBitmap) return _ranges.gaps(start, end);
+    return [
+      for (final (gapStart, gapEnd) in _getGapsFromBitmap(start, end))
+        (max(gapStart, start), min(gapEnd, end)),
+    ];
   }
 
-  List<(int, int)> _getGapsFromBitmap() {
+  List<(int, int)> _getGapsFromList() => _ranges.gaps(0, totalSize - 1);
+
+  /// Gaps of whole blocks, from the block holding [start] to the one
+  /// holding [end] (the whole file by default)
+  List<(int, int)> _getGapsFromBitmap([int start = 0, int? end]) {
     final gaps = <(int, int)>[];
     final numBlocks = (totalSize / _blockSize).ceil();
+    final lastBlock = end == null
+        ? numBlocks - 1
+        : min(end ~/ _blockSize, numBlocks - 1);
 
     int? gapStart;
 
-    for (int block = 0; block < numBlocks; block++) {
+    for (int block = start ~/ _blockSize; block <= lastBlock; block++) {
       final byteIndex = block ~/ 8;
       final bitIndex = block % 8;
       final isComplete = (_bitmap![byteIndex] & (1 << bitIndex)) != 0;
@@ -411,7 +532,7 @@ class DownloadMeta {
 
     // Handle gap at the end
     if (gapStart != null) {
-      gaps.add((gapStart, totalSize - 1));
+      gaps.add((gapStart, min((lastBlock + 1) * _blockSize, totalSize) - 1));
     }
 
     return gaps;
@@ -434,16 +555,6 @@ class DownloadMeta {
       return null;
     }
 
-    // For list-based tracking
-    if (_needsMerge) {
-      _mergeRanges();
-    }
-
-    for (final range in _ranges) {
-      if (range.end >= position) {
-        return max(range.start, position);
-      }
-    }
-    return null;
+    return _ranges.nextCovered(position);
   }
 }
@@ -0,0 +1,60 @@
+/// Lifecycle of a cached download (see [Download])
+enum DownloadState {
+  /// Known to the proxy, waiting for a background fetch to start
+  queued,
+
+  /// A background fetch is running
+  downloading,
+
+  /// Stopped by the app; nothing is fetched in the background until it is
+  /// resumed (player requests are still served)
+  paused,
+
+  /// Every byte is cached
+  completed,
+
+  /// The last background fetch failed; resume to retry
+  failed;
+
+  /// States this one may move to
+  Set<DownloadState> get next => switch (this) {
+    queued => const {downloading, paused, completed, failed},
+    downloading => const {queued, paused, completed, failed},
+    paused => const {queued, completed},
+    failed => const {queued, paused, completed},
+    completed => const {},
+  };
+}
+
+/// A cached file's download, keyed by file ID
+class Download {
+  final String fileId;
+  final String url;
+
+  DownloadState _state = DownloadState.queued;
+  Object? _error;
+
+  Download(this.fileId, this.url);
+
+  DownloadState get state => _state;
+
+  /// Why the download is [DownloadState.failed]
+  Object? get error => _error;
+
+  /// Whether [moveTo] would accept [state]
+  bool canMoveTo(DownloadState state) =>
+      state == _state || _state.next.contains(state);
+
+  /// Move to [state]; throws a [StateError] for a transition
+  /// [DownloadState.next] does not allow
+  void moveTo(DownloadState state, {Object? error}) {
+    if (!canMoveTo(state)) {
+      throw StateError('Download $fileId cannot go from $_state to $state');
+    }
+    _state = state;
+    _error = state == DownloadState.failed ? error : null;
+  }
+
+  @override
+  String toString() => 'Download($fileId, ${_state.name})';
+}
@@ -0,0 +1,93 @@
+import 'dart:convert';
+import 'dart:io';
+
+/// Player-facing failures of a stream request
+enum ProxyFailure {
+  /// Missing or malformed request parameters
+  badRequest(HttpStatus.badRequest),
+
+  /// Origin unreachable or its size could not be determined
+  upstreamUnavailable(HttpStatus.badGateway),
+
+  /// Refused by a namespace policy
+  policyDenied(HttpStatus.forbidden),
+
+  /// Missing, forged or expired URL signature (see `UrlSigner`)
+  unauthorized(HttpStatus.forbidden),
+
+  /// Client refused by the `AccessPolicy`: address, API key or hook
+  accessDenied(HttpStatus.forbidden),
+
+  /// Content ID the `ContentResolver` does not know
+  notFound(HttpStatus.notFound),
+
+  /// Refused under memory/CPU pressure
+  overloaded(HttpStatus.serviceUnavailable),
+
+  /// Unexpected error while serving
+  internal(HttpStatus.internalServerError);
+
+  final int defaultStatus;
+
+  const ProxyFailure(this.defaultStatus);
+}
+
+/// Body written with an error status
+enum ErrorBodyFormat {
+  /// Status only
+  none,
+
+  /// `{"error": "<failure>", ...details}`
+  json,
+
+  /// [ErrorPageConfig.slate] bytes, e.g. a short MP4 saying "unavailable"
+  slate,
+}
+
+/// How failures are reported to players
+///
+/// Some players retry forever on 5xx but give up cleanly on 404, or show
+/// a clip better than an error dialog; [statusCodes] and [format] let the
+/// app pick what works for its player.
+class ErrorPageConfig {
+  final ErrorBodyFormat format;
+
+  /// Status overrides per failure
+  final Map<ProxyFailure, int> statusCodes;
+
+  /// Body for [ErrorBodyFormat.slate]
+  final List<int>? slate;
+  final String slateContentType;
+
+  const ErrorPageConfig({
+    this.format = ErrorBodyFormat.json,
+    this.statusCodes = const {},
+    this.slate,
+    this.slateContentType = 'video/mp4',
+  });
+
+  int statusFor(ProxyFailure failure) =>
+      statusCodes[failure] ?? failure.defaultStatus;
+
+  /// Set status, headers and body of [response] for [failure]
+  void write(
+    HttpResponse response,
+    ProxyFailure failure, {
+    Map<String, Object?> details = const {},
+  }) {
+    response.statusCode = statusFor(failure);
+    switch (format) {
+      case ErrorBodyFormat.none:
+        break;
+      case ErrorBodyFormat.json:
+        response.headers.contentType = ContentType.json;
+        response.write(jsonEncode({'error': failure.name, ...details}));
+      case ErrorBodyFormat.slate:
+        final body = slate;
+        if (body == null) break;
+        response.headers.set(HttpHeaders.contentTypeHeader, slateContentType);
+        response.headers.set(HttpHeaders.contentLengthHeader, '${body.length}');
+        response.add(body);
+    }
+  }
+}
@@ -0,0 +1,198 @@
+import 'dart:async';
+
+/// Kinds of events emitted by the proxy
+enum ProxyEventType {
+  /// SHA-256 of a response body, computed after the last byte was sent
+  bodyDigest,
+
+  /// Client pushed cached bytes through `/upload`
+  backfill,
+
+  /// Request refused by a namespace policy (see `NamespacePolicy`)
+  policyDenied,
+
+  /// Uncached request refused with 503 under memory/CPU pressure
+  loadShed,
+
+  /// Ranges prefetched from access history when a file was reopened
+  cacheWarm,
+
+  /// Scrubber found cached bytes that no longer match their checksum
+  corruption,
+
+  /// A completed file did not match its expected SHA-256 (`expected`,
+  /// `actual`, the suspect `ranges`, `attempt`, and `retry`: whether they
+  /// are fetched again or the download failed)
+  verificationFailed,
+
+  /// First-request setup of a file failed (`reason`: `unknownLength` or
+  /// `error`); the next request retries it
+  initFailed,
+
+  /// A file was deleted to keep the cache under its quota, or a
+  /// collection file (`collection`, `path`) for its collection's limits
+  evicted,
+
+  /// A file outlived its `CacheLifetime` and was deleted (`expiresAt`,
+  /// and the collection `path` when it was complete)
+  expired,
+
+  /// Download progress (`percent`, `bytes`, `totalSize`,
+  /// `bytesPerSecond`), at most every `ProgressTracker.interval` per file
+  progress,
+
+  /// Contiguous bytes `start`..`end` were written to the cache
+  rangeAdded,
+
+  /// Every byte of a file is cached (`path`: where it ended up)
+  downloadCompleted,
+
+  /// A background download stopped with an `error`; resume to retry
+  downloadFailed,
+
+  /// A changed file was rebuilt from its old copy (`reusedBytes`,
+  /// `fetchBytes`)
+  deltaSync,
+
+  /// The origin's copy changed under the cache (new validator or size);
+  /// the old bytes were dropped or delta-synced
+  upstreamChanged,
+
+  /// An origin's TLS certificate matched none of its pins (`host`,
+  /// `presented` pin, null when the host was reached without TLS)
+  pinMismatch,
+
+  /// A media server was asked to scan new files (`service`, `paths`, and
+  /// `error` when it failed)
+  libraryRefreshed,
+
+  /// An origin host was probed on first contact (`host` and what it
+  /// supports, see `HostCapabilities`)
+  hostProbed,
+
+  /// An item of a take-offline request changed readiness or progress
+  /// (see `OfflineItemStatus.toJson`)
+  offlineStatus,
+
+  /// A complete file moved between storage tiers (`tier`: `fast` or
+  /// `cold`, and `bytes`)
+  tierMoved,
+
+  /// A completed download has the same content as a collection file
+  /// (`existing`, `path`, `sha256`, and the `policy` applied)
+  duplicateFound,
+
+  /// The storage directory became unusable (`path`, `reason`); requests
+  /// pass through to their origins uncached until it is back
+  storageLost,
+
+  /// The storage directory is usable again (`path`, and `downtimeMs`)
+  storageRestored,
+}
+
+/// A single entry in the proxy event log
+class ProxyEvent {
+  final ProxyEventType type;
+  final String? fileId;
+  final String? url;
+  final Map<String, Object?> data;
+  final DateTime timestamp;
+
+  ProxyEvent(
+    this.type, {
+    this.fileId,
+    this.url,
+    this.data = const {},
+    DateTime? timestamp,
+  }) : timestamp = timestamp ?? DateTime.now();
+
+  Map<String, Object?> toJson() => {
+    'type': type.name,
+    'fileId': fileId,
+    'url': url,
+    'timestamp': timestamp.toIso8601String(),
+    ...data,
+  };
+
+  @override
+  String toString() => 'ProxyEvent(${type.name}, $fileId, $data)';
+}
+
+/// Lets through at most one `progress` event per file every [interval],
+/// the latest one; other events pass at once
+///
+/// For listeners slower than the proxy's own progress interval, such as a
+/// platform channel to the UI. A held progress event is sent when its
+/// interval ends, or right before the next other event of its file, so a
+/// `downloadCompleted` never overtakes the progress leading up to it.
+class ProgressThrottle extends StreamTransformerBase<ProxyEvent, ProxyEvent> {
+  final Duration interval;
+
+  const ProgressThrottle(this.interval);
+
+  @override
+  Stream<ProxyEvent> bind(Stream<ProxyEvent> stream) {
+    late final StreamController<ProxyEvent> controller;
+    StreamSubscription<ProxyEvent>? subscription;
+    final held = <String?, ProxyEvent>{};
+    final windows = <String?, Timer>{};
+
+    void open(String? fileId) {
+      windows[fileId] = Timer(interval, () {
+        windows.remove(fileId);
+        final event = held.remove(fileId);
+        if (event == null) return;
+        controller.add(event);
+        open(fileId);
+      });
+    }
+
+    void onData(ProxyEvent event) {
+      final fileId = event.fileId;
+      if (event.type != ProxyEventType.progress) {
+        final pending = held.remove(fileId);
+        if (pending != null) {
+          windows.remove(fileId)?.cancel();
+          controller.add(pending);
+          open(fileId);
+        }
+        controller.add(event);
+      } else if (windows.containsKey(fileId)) {
+        held[fileId] = event;
+      } else {
+        controller.add(event);
+        open(fileId);
+      }
+    }
+
+    void cancelWindows() {
+      for (final timer in windows.values) {
+        timer.cancel();
+      }
+      windows.clear();
+    }
+
+    controller = StreamController<ProxyEvent>(
+      onListen: () {
+        subscription = stream.listen(
+          onData,
+          onError: controller.addError,
+          onDone: () {
+            cancelWindows();
+            held.values.forEach(controller.add);
+            held.clear();
+            controller.close();
+          },
+        );
+      },
+      onPause: () => subscription?.pause(),
+      onResume: () => subscription?.resume(),
+      onCancel: () {
+        cancelWindows();
+        held.clear();
+        return subscription?.cancel();
+      },
+    );
+    return controller.stream;
+  }
+}
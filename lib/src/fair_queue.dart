@@ -0,0 +1,164 @@
+import 'dart:async';
+import 'dart:collection';
+import 'dart:math';
+
+/// How urgently an upstream fetch is needed, most urgent first
+enum DownloadPriority {
+  /// A player is waiting for the bytes
+  foreground,
+
+  /// Bytes a player will likely want soon: read-ahead, the next playlist
+  /// item, cache warming
+  prefetch,
+
+  /// Whole-file downloads nobody is watching yet
+  background,
+}
+
+/// Settings for sharing upstream connections between clients
+class FairnessConfig {
+  /// Upstream fetches in flight at once, across all clients
+  final int maxConcurrent;
+
+  /// Fetches in flight for one client; null means only [maxConcurrent]
+  /// applies
+  final int? maxPerClient;
+
+  /// Slots of [maxConcurrent] only [DownloadPriority.foreground] fetches
+  /// may take, so a player never waits for prefetches to finish; at
+  /// least one slot stays open to the others
+  final int foregroundReserve;
+
+  const FairnessConfig({
+    this.maxConcurrent = 6,
+    this.maxPerClient = 4,
+    this.foregroundReserve = 1,
+  });
+}
+
+class _Waiter {
+  final String client;
+  final String? key;
+  final Completer<void> turn = Completer<void>();
+
+  _Waiter(this.client, this.key);
+}
+
+/// Admits upstream fetches round-robin across clients, most urgent first
+///
+/// Each client (a device, a session token) has its own queue; when a slot
+/// frees up the next client in turn gets it, so a client with hundreds of
+/// queued prefetches waits behind one playback request of another client
+/// at most once. Within that, fetches go by [DownloadPriority]: a player
+/// waiting for bytes before prefetches, prefetches before background
+/// downloads.
+class FairQueue {
+  final FairnessConfig config;
+
+  int _running = 0;
+  final Map<String, int> _perClient = {};
+
+  // One lane per priority; insertion order is the round-robin order and
+  // a served client moves to the back
+  final Map<DownloadPriority, LinkedHashMap<String, Queue<_Waiter>>> _lanes = {
+    for (final priority in DownloadPriority.values) priority: LinkedHashMap(),
+  };
+
+  FairQueue([this.config = const FairnessConfig()]);
+
+  /// Fetches running now
+  int get running => _running;
+
+  /// Fetches waiting for a slot
+  int get waiting => _lanes.values
+      .expand((lane) => lane.values)
+      .fold(0, (sum, queue) => sum + queue.length);
+
+  /// Wait for a slot for [client]
+  ///
+  /// [priority] defaults to foreground when [urgent], else background.
+  /// [key] names the file fetched, for [promote]. Call the returned
+  /// function when the fetch is done (or abandoned).
+  Future<void Function()> acquire(
+    String client, {
+    bool urgent = false,
+    DownloadPriority? priority,
+    String? key,
+  }) async {
+    final waiter = _Waiter(client, key);
+    priority ??= urgent
+        ? DownloadPriority.foreground
+        : DownloadPriority.background;
+    _lanes[priority]!.putIfAbsent(client, () => Queue()).add(waiter);
+    _dispatch();
+    await waiter.turn.future;
+
+    var released = false;
+    return () {
+      if (released) return;
+      released = true;
+      _running--;
+      final count = _perClient[client]! - 1;
+      if (count == 0) {
+        _perClient.remove(client);
+      } else {
+        _perClient[client] = count;
+      }
+      _dispatch();
+    };
+  }
+
+  /// Move the fetches of [key] still waiting up to [priority], e.g. the
+  /// prefetches of a file a player just opened
+  ///
+  /// Returns how many were moved.
+  int promote(
+    String key, [
+    DownloadPriority priority = DownloadPriority.foreground,
+  ]) {
+    var moved = 0;
+    for (final lower in DownloadPriority.values.skip(priority.index + 1)) {
+      final lane = _lanes[lower]!;
+      for (final client in lane.keys.toList()) {
+        final queue = lane[client]!;
+        final promoted = queue.where((w) => w.key == key).toList();
+        if (promoted.isEmpty) continue;
+        queue.removeWhere((w) => w.key == key);
+        if (queue.isEmpty) lane.remove(client);
+        _lanes[priority]!.putIfAbsent(client, () => Queue()).addAll(promoted);
+        moved += promoted.length;
+      }
+    }
+    if (moved > 0) _dispatch();
+    return moved;
+  }
+
+  void _dispatch() {
+    final others = max(1, config.maxConcurrent - config.foregroundReserve);
+    while (_running < config.maxConcurrent) {
+      var waiter = _next(_lanes[DownloadPriority.foreground]!);
+      if (waiter == null && _running < others) {
+        waiter =
+            _next(_lanes[DownloadPriority.prefetch]!) ??
+            _next(_lanes[DownloadPriority.background]!);
+      }
+      if (waiter == null) return;
+      _running++;
+      _perClient[waiter.client] = (_perClient[waiter.client] ?? 0) + 1;
+      waiter.turn.complete();
+    }
+  }
+
+  /// First waiter of the first client in turn that is under its limit
+  _Waiter? _next(LinkedHashMap<String, Queue<_Waiter>> lanes) {
+    final limit = config.maxPerClient;
+    for (final client in lanes.keys) {
+      if (limit != null && (_perClient[client] ?? 0) >= limit) continue;
+      final queue = lanes.remove(client)!;
+      final waiter = queue.removeFirst();
+      if (queue.isNotEmpty) lanes[client] = queue;
+      return waiter;
+    }
+    return null;
+  }
+}
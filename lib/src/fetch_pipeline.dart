@@ -0,0 +1,76 @@
+import 'data_source.dart';
+import 'download_meta.dart';
+import 'work_units.dart';
+
+/// The proxy's fetch path as separate stages, for schedulers that pick
+/// what to fetch and from where themselves
+///
+/// `resolve → reserve → fetch → write → record`. Bytes recorded here are
+/// served to players like any others, and reserved ranges are left alone
+/// by the proxy's background download. [fetchUnit] runs the stages for
+/// one unit; replace any of them (e.g. fetch from a peer instead of
+/// [fetch]) and keep the rest.
+///
+/// ```dart
+/// final meta = await proxy.pipeline.resolve(url);
+/// for (final unit in proxy.pipeline.reserve(meta!, maxUnits: 2)) {
+///   await fetchUnit(proxy.pipeline, meta, unit);
+/// }
+/// ```
+abstract class FetchPipeline {
+  /// Metadata (size, cached ranges) of [url], probing the origin the
+  /// first time; null when its size cannot be determined
+  Future<DownloadMeta?> resolve(String url);
+
+  /// Lease missing ranges of [meta] so no other fetcher takes them
+  List<WorkUnit> reserve(
+    DownloadMeta meta, {
+    int maxUnits = 4,
+    int unitSize = 4 * 1024 * 1024,
+    Duration leaseDuration = const Duration(minutes: 2),
+  });
+
+  /// Upstream bytes of [unit], admitted by the host's policy
+  ///
+  /// Uses the file's own data source unless [source] is given (e.g. a
+  /// mirror). The host's slot is held until the stream is done or
+  /// cancelled, so always listen to it. Throws an `HttpException` when the
+  /// origin ignores Range.
+  Future<Stream<List<int>>> fetch(WorkUnit unit, {DataSource? source});
+
+  /// Write [bytes] at [offset] of the sparse file, under the file's lock
+  Future<void> write(DownloadMeta meta, int offset, List<int> bytes);
+
+  /// Mark [start]..[end] cached and report progress; the file completes
+  /// when it was the last gap
+  Future<void> record(DownloadMeta meta, int start, int end);
+
+  /// End the lease of [unit], whether or not it was fetched
+  void release(WorkUnit unit);
+}
+
+/// Fetch [unit] through [pipeline], writing and recording each chunk
+///
+/// The lease is released even when the fetch fails.
+Future<void> fetchUnit(
+  FetchPipeline pipeline,
+  DownloadMeta meta,
+  WorkUnit unit, {
+  DataSource? source,
+}) async {
+  try {
+    final upstream = await pipeline.fetch(unit, source: source);
+    var pos = unit.start;
+    await for (final chunk in upstream) {
+      // A widened request may return more than the unit
+      final length = chunk.length.clamp(0, unit.end - pos + 1);
+      if (length <= 0) break;
+      final bytes = length == chunk.length ? chunk : chunk.sublist(0, length);
+      await pipeline.write(meta, pos, bytes);
+      await pipeline.record(meta, pos, pos + length - 1);
+      pos += length;
+    }
+  } finally {
+    pipeline.release(unit);
+  }
+}
@@ -0,0 +1,147 @@
+import 'dart:io';
+
+import 'package:path/path.dart' as p;
+
+import 'completion_marker.dart';
+import 'integrity.dart';
+
+/// What happens to a completed download whose content is already in the
+/// collection (the same film fetched from two sources)
+enum DuplicatePolicy {
+  /// Keep both copies; duplicates are not looked for
+  keep,
+
+  /// Discard the new copy and report the existing file as its path
+  skip,
+
+  /// Move the new copy in and delete the existing one
+  replace,
+
+  /// Discard the new copy and hard-link its path to the existing file,
+  /// so both names share one copy on disk; kept as a copy where links
+  /// are unsupported
+  hardLink,
+}
+
+/// SHA-256 fingerprints of collection files, so a completed download can
+/// be matched against what is already there
+///
+/// Only files of the same size as the new one are hashed, once each:
+/// fingerprints are remembered by path, size and modification time.
+class FingerprintIndex {
+  final Map<String, _Fingerprint> _byPath = {};
+
+  FingerprintIndex();
+
+  /// Number of files whose fingerprint is known
+  int get length => _byPath.length;
+
+  /// Remember [sha256] as the content of [path]
+  Future<void> remember(String path, String sha256) async {
+    final stat = await File(path).stat();
+    if (stat.type != FileSystemEntityType.file) return;
+    _byPath[path] = _Fingerprint(stat.size, stat.modified, sha256);
+  }
+
+  /// Forget [path], e.g. once it was deleted
+  void forget(String path) => _byPath.remove(path);
+
+  /// SHA-256 of [path], hashed when it changed since last seen
+  Future<String> fingerprintOf(String path) async {
+    final stat = await File(path).stat();
+    final known = _byPath[path];
+    if (known != null &&
+        known.size == stat.size &&
+        known.modified == stat.modified) {
+      return known.sha256;
+    }
+    final sha256 = await sha256OfFile(path);
+    _byPath[path] = _Fingerprint(stat.size, stat.modified, sha256);
+    return sha256;
+  }
+
+  /// A file in [directory] with the same content as [path], whose hash
+  /// is [sha256]; null when there is none
+  Future<String?> findDuplicate(
+    String path,
+    String sha256,
+    String directory,
+  ) async {
+    final dir = Directory(directory);
+    if (!await dir.exists()) return null;
+    final size = await File(path).length();
+
+    await for (final entity in dir.list(followLinks: false)) {
+      if (entity is! File || p.equals(entity.path, path)) continue;
+      if (_isSidecar(entity.path)) continue;
+      final FileStat stat;
+      try {
+        stat = await entity.stat();
+      } on FileSystemException {
+        continue;
+      }
+      if (stat.size != size) continue;
+      if (await fingerprintOf(entity.path) == sha256) return entity.path;
+    }
+    return null;
+  }
+
+  // Files written next to collection files, never duplicates of them
+  static bool _isSidecar(String path) =>
+      path.endsWith('.done') ||
+      path.endsWith('.meta') ||
+      p.basename(path).startsWith('.');
+
+  /// Give [path] the content of [existing] without a second copy on disk
+  ///
+  /// Returns false when the filesystem or platform has no hard links;
+  /// [path] is then left untouched.
+  static Future<bool> hardLink(String existing, String path) async {
+    try {
+      final result = Platform.isWindows
+          ? await Process.run('cmd', ['/c', 'mklink', '/H', path, existing])
+          : await Process.run('ln', [existing, path]);
+      return result.exitCode == 0;
+    } on ProcessException {
+      return false;
+    }
+  }
+
+  /// Delete [path] and its completion marker
+  Future<void> delete(String path) async {
+    forget(path);
+    for (final file in [File(path), File(CompletionMarker.pathFor(path))]) {
+      if (await file.exists()) await file.delete();
+    }
+  }
+
+  Map<String, dynamic> toJson() => {
+    for (final MapEntry(:key, :value) in _byPath.entries)
+      key: {
+        'size': value.size,
+        'modified': value.modified.toIso8601String(),
+        'sha256': value.sha256,
+      },
+  };
+
+  factory FingerprintIndex.fromJson(Map<String, dynamic> json) {
+    final index = FingerprintIndex();
+    json.forEach((path, value) {
+      final entry = value as Map<String, dynamic>;
+      index._byPath[path] = _Fingerprint(
+        entry['size'] as int,
+        DateTime.parse(entry['modified'] as String),
+        entry['sha256'] as String,
+      );
+    });
+    return index;
+  }
+}
+
+class _Fingerprint {
+  final int size;
+  final DateTime modified;
+  final String sha256;
+
+  const _Fingerprint(this.size, this.modified, this.sha256);
+}
@@ -0,0 +1,155 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+
+import 'access_control.dart';
+import 'journal.dart';
+import 'rate_limit.dart';
+
+/// Runtime state a proxy hands to the process replacing it
+///
+/// Cached ranges, queued downloads and sessions are already on disk once
+/// the old process has stopped; this carries what only lived in memory.
+class HandoffState {
+  /// Names the takeover this state answers
+  final String nonce;
+
+  final BandwidthLimits limits;
+  final Duration progressInterval;
+
+  /// Last position each file was played to, and when
+  final Map<String, (int, DateTime)> playheads;
+
+  /// URLs being downloaded in the background when the proxy stopped
+  final List<String> downloading;
+
+  /// How the old process stopped
+  final ShutdownReport report;
+
+  HandoffState({
+    required this.nonce,
+    this.limits = BandwidthLimits.unlimited,
+    this.progressInterval = const Duration(milliseconds: 500),
+    this.playheads = const {},
+    this.downloading = const [],
+    required this.report,
+  });
+
+  /// File the state is written to in the storage directory
+  static const fileName = '.handoff.json';
+
+  /// A random nonce for a takeover request
+  static String newNonce() {
+    final random = Random.secure();
+    return base64Url
+        .encode(List.generate(16, (_) => random.nextInt(256)))
+        .replaceAll('=', '');
+  }
+
+  Map<String, dynamic> toJson() => {
+    'nonce': nonce,
+    'limits': limits.toJson(),
+    'progressIntervalMs': progressInterval.inMilliseconds,
+    'playheads': {
+      for (final MapEntry(key: fileId, value: (position, at))
+          in playheads.entries)
+        fileId: {'position': position, 'at': at.toIso8601String()},
+    },
+    'downloading': downloading,
+    'report': report.toJson(),
+  };
+
+  factory HandoffState.fromJson(Map<String, dynamic> json) => HandoffState(
+    nonce: json['nonce'] as String,
+    limits: BandwidthLimits.fromJson(
+      json['limits'] as Map<String, dynamic>? ?? const {},
+    ),
+    progressInterval: Duration(
+      milliseconds: json['progressIntervalMs'] as int? ?? 500,
+    ),
+    playheads: {
+      for (final MapEntry(:key, :value)
+          in (json['playheads'] as Map<String, dynamic>? ?? {}).entries)
+        key: (
+          value['position'] as int,
+          DateTime.parse(value['at'] as String),
+        ),
+    },
+    downloading: (json['downloading'] as List? ?? const []).cast<String>(),
+    report: ShutdownReport.fromJson(
+      json['report'] as Map<String, dynamic>? ?? const {},
+    ),
+  );
+
+  /// Write atomically to [dir], so the new process never reads half of it
+  Future<void> write(String dir) async {
+    final temp = File('$dir/$fileName.tmp');
+    await temp.writeAsString(jsonEncode(toJson()), flush: true);
+    await temp.rename('$dir/$fileName');
+  }
+
+  /// Wait until the state of takeover [nonce] appears in [dir]; null when
+  /// [timeout] passes first
+  static Future<HandoffState?> waitFor(
+    String dir,
+    String nonce, {
+    Duration timeout = const Duration(seconds: 30),
+    Duration poll = const Duration(milliseconds: 50),
+  }) async {
+    final file = File('$dir/$fileName');
+    final deadline = DateTime.now().add(timeout);
+    while (DateTime.now().isBefore(deadline)) {
+      if (await file.exists()) {
+        try {
+          final json = jsonDecode(await file.readAsString());
+          final state = HandoffState.fromJson(json as Map<String, dynamic>);
+          if (state.nonce == nonce) {
+            await file.delete();
+            return state;
+          }
+        } on FormatException {
+          // A stale or foreign file; the old process overwrites it
+        }
+      }
+      await Future.delayed(poll);
+    }
+    return null;
+  }
+
+  /// Ask the proxy at [base] to hand over to this process
+  ///
+  /// Returns false when nothing listens there (nothing to take over);
+  /// throws an [HttpException] when the proxy refuses. An `https` proxy
+  /// is trusted by [context]; [key] passes its [AccessPolicy].
+  static Future<bool> request(
+    Uri base,
+    String nonce, {
+    String? token,
+    String? key,
+    SecurityContext? context,
+  }) async {
+    final client = HttpClient(context: context);
+    try {
+      final request = await client.postUrl(
+        base.replace(path: '/api/handoff'),
+      );
+      if (token != null) {
+        request.headers.set(HttpHeaders.authorizationHeader, 'Bearer $token');
+      }
+      if (key != null) request.headers.set(AccessPolicy.keyHeader, key);
+      request.headers.contentType = ContentType.json;
+      request.write(jsonEncode({'nonce': nonce}));
+      final response = await request.close();
+      await response.drain<void>();
+      if (response.statusCode != HttpStatus.accepted) {
+        throw HttpException('Handoff refused (${response.statusCode})');
+      }
+      return true;
+    } on SocketException {
+      return false;
+    } finally {
+      client.close();
+    }
+  }
+}
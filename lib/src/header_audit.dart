@@ -0,0 +1,97 @@
+/// Upstream requests that sent the same header names to the same host for
+/// the same file
+class HeaderAuditEntry {
+  final String host;
+  final String? fileId;
+
+  /// Header names, lower case and sorted
+  final List<String> headers;
+
+  /// Whether the host is outside the file's origin (a redirect target)
+  final bool crossOrigin;
+
+  int count = 1;
+  DateTime lastSent;
+
+  HeaderAuditEntry({
+    required this.host,
+    this.fileId,
+    required this.headers,
+    this.crossOrigin = false,
+    DateTime? lastSent,
+  }) : lastSent = lastSent ?? DateTime.now();
+
+  Map<String, dynamic> toJson() => {
+    'host': host,
+    'fileId': fileId,
+    'headers': headers,
+    'crossOrigin': crossOrigin,
+    'count': count,
+    'lastSent': lastSent.toIso8601String(),
+  };
+}
+
+/// Which headers went to which host, by name only
+///
+/// Values are never kept: they are the secrets being audited. Repeated
+/// requests are counted on one entry; the least recently seen entries go
+/// beyond [capacity].
+class HeaderAudit {
+  final int capacity;
+
+  // Insertion order is recency order
+  final Map<String, HeaderAuditEntry> _entries = {};
+
+  HeaderAudit({this.capacity = 500});
+
+  /// Entries, least recently seen first
+  List<HeaderAuditEntry> get entries => List.unmodifiable(_entries.values);
+
+  /// Record a request of [fileId] to [host] carrying [headers]
+  void record(
+    String host,
+    Iterable<String> headers, {
+    String? fileId,
+    bool crossOrigin = false,
+    DateTime? now,
+  }) {
+    final names = {for (final name in headers) name.toLowerCase()}.toList()
+      ..sort();
+    final key = '$fileId|$host|${names.join(',')}';
+    final entry = _entries.remove(key);
+    if (entry != null) {
+      entry
+        ..count += 1
+        ..lastSent = now ?? DateTime.now();
+      _entries[key] = entry;
+      return;
+    }
+    _entries[key] = HeaderAuditEntry(
+      host: host,
+      fileId: fileId,
+      headers: names,
+      crossOrigin: crossOrigin,
+      lastSent: now,
+    );
+    if (_entries.length > capacity) _entries.remove(_entries.keys.first);
+  }
+
+  /// Every header name sent to each host
+  Map<String, Set<String>> get byHost {
+    final hosts = <String, Set<String>>{};
+    for (final entry in _entries.values) {
+      hosts.putIfAbsent(entry.host, () => {}).addAll(entry.headers);
+    }
+    return hosts;
+  }
+
+  void clear() => _entries.clear();
+
+  Map<String, dynamic> toJson() => {
+    'hosts': {
+      for (final MapEntry(:key, :value) in byHost.entries)
+        key: (value.toList()..sort()),
+    },
+    'entries': [for (final entry in _entries.values) entry.toJson()],
+  };
+}
@@ -0,0 +1,111 @@
+import 'dart:io';
+
+import 'data_source.dart';
+
+/// What an origin host was found to support, learned on first contact
+///
+/// A null field was not determined (the probe could not tell); the proxy
+/// then behaves as it would without a profile.
+class HostCapabilities {
+  /// HEAD answers with the size
+  final bool? supportsHead;
+
+  /// Range requests are answered with `206 Partial Content`
+  final bool? acceptsRanges;
+
+  /// Responses carry an ETag or Last-Modified to validate resumes with
+  final bool? hasValidators;
+
+  /// Two requests at once are both served
+  final bool? parallel;
+
+  final DateTime probedAt;
+
+  HostCapabilities({
+    this.supportsHead,
+    this.acceptsRanges,
+    this.hasValidators,
+    this.parallel,
+    DateTime? probedAt,
+  }) : probedAt = probedAt ?? DateTime.now();
+
+  /// Whether the profile is older than [maxAge] and should be probed again
+  bool isStale(DateTime now, Duration maxAge) =>
+      now.difference(probedAt) > maxAge;
+
+  Map<String, dynamic> toJson() => {
+    'supportsHead': supportsHead,
+    'acceptsRanges': acceptsRanges,
+    'hasValidators': hasValidators,
+    'parallel': parallel,
+    'probedAt': probedAt.toIso8601String(),
+  };
+
+  factory HostCapabilities.fromJson(Map<String, dynamic> json) =>
+      HostCapabilities(
+        supportsHead: json['supportsHead'] as bool?,
+        acceptsRanges: json['acceptsRanges'] as bool?,
+        hasValidators: json['hasValidators'] as bool?,
+        parallel: json['parallel'] as bool?,
+        probedAt: DateTime.tryParse(json['probedAt'] as String? ?? ''),
+      );
+
+  /// Probe the origin behind [source], a file of [totalSize] bytes whose
+  /// size was already probed (so [DataSource.lastStat] tells about HEAD
+  /// and validators)
+  ///
+  /// Asks for bytes 0 and 1 over two connections at once: a 206 to both
+  /// means ranges and parallel connections work, a 200 that Range is
+  /// ignored, and a refusal (429, 503, a reset) of only one of them that
+  /// the host wants one connection at a time. Returns null when neither
+  /// request got an answer.
+  static Future<HostCapabilities?> probe(
+    DataSource source,
+    int totalSize,
+  ) async {
+    final stat = source.lastStat;
+    final statuses = await Future.wait([
+      _status(source, 0),
+      if (totalSize > 1) _status(source, 1),
+    ]);
+    final answered = statuses.whereType<int>().toList();
+    if (answered.isEmpty) return null;
+
+    final ranged = answered.contains(HttpStatus.partialContent);
+    final plain = answered.contains(HttpStatus.ok);
+    final refused = statuses.length - answered.where(_served).length;
+    return HostCapabilities(
+      supportsHead: stat?.headSupported,
+      acceptsRanges: ranged ? true : (plain ? false : stat?.acceptsRanges),
+      hasValidators: stat == null
+          ? null
+          : stat.etag != null || stat.lastModified != null,
+      parallel: statuses.length < 2
+          ? null
+          : switch (refused) {
+              0 => true,
+              1 => false,
+              _ => null,
+            },
+    );
+  }
+
+  static bool _served(int status) => status >= 200 && status < 300;
+
+  /// Status of a one-byte request at [offset]; null when it failed
+  static Future<int?> _status(DataSource source, int offset) async {
+    try {
+      final response = await source.fetchRange(offset, offset);
+      // Don't download the body if the origin ignored the Range
+      await response.listen(null).cancel();
+      return response.statusCode;
+    } on IOException {
+      return null;
+    }
+  }
+
+  @override
+  String toString() =>
+      'HostCapabilities(head: $supportsHead, ranges: $acceptsRanges, '
+      'validators: $hasValidators, parallel: $parallel)';
+}
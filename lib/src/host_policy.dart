@@ -0,0 +1,168 @@
+import 'dart:async';
+import 'dart:collection';
+import 'dart:math';
+
+/// Everything the proxy does differently for one origin
+///
+/// Request shaping for origins that ban aggressive clients (minimum size,
+/// spacing, concurrency, alignment) plus headers, auth, retries and
+/// mirrors, configured as one unit per host pattern (see
+/// [HostPolicyTable]).
+class HostPolicy {
+  /// Range requests are widened to at least this many bytes
+  final int minRequestSize;
+
+  /// Minimum time between the starts of two requests
+  final Duration minInterval;
+
+  /// Requests in flight at once; null means unlimited
+  final int? maxConcurrent;
+
+  /// Range ends are rounded up to a multiple of this many bytes (CDNs
+  /// that cache fixed-size slices); 0 disables alignment
+  final int alignment;
+
+  /// Headers added to every upstream request
+  final Map<String, String> headers;
+
+  /// Sent as `Authorization: Bearer <token>`
+  final String? bearerToken;
+
+  /// Extra attempts after a connection error or 5xx response
+  final int maxRetries;
+
+  /// Delay before the first retry, growing linearly with each attempt
+  final Duration retryDelay;
+
+  /// Hosts serving the same paths, tried in order when the origin fails
+  final List<String> mirrors;
+
+  /// TLS certificate pins (`sha256/<base64>` of the public key, or
+  /// `cert-sha256/<base64>`, see `CertificatePins`); when set the host
+  /// must present a matching certificate and is trusted by it alone
+  final List<String> pins;
+
+  const HostPolicy({
+    this.minRequestSize = 0,
+    this.minInterval = Duration.zero,
+    bool sequential = false,
+    int? maxConcurrent,
+    this.alignment = 0,
+    this.headers = const {},
+    this.bearerToken,
+    this.maxRetries = 0,
+    this.retryDelay = const Duration(seconds: 1),
+    this.mirrors = const [],
+    this.pins = const [],
+  }) : maxConcurrent = sequential ? 1 : maxConcurrent;
+
+  /// Allow one request in flight at a time
+  bool get sequential => maxConcurrent == 1;
+
+  /// [headers] plus the authorization header, if any
+  Map<String, String> get requestHeaders => {
+    ...headers,
+    if (bearerToken != null) 'Authorization': 'Bearer $bearerToken',
+  };
+}
+
+/// [HostPolicy] per host pattern
+///
+/// Patterns are an exact host (`cdn.example.com`), a wildcard for every
+/// subdomain (`*.example.com`, which also matches `example.com`) or `*`
+/// for every host. The most specific pattern wins.
+class HostPolicyTable {
+  final Map<String, HostPolicy> _policies = {};
+
+  /// Set the policy for [pattern]
+  void operator []=(String pattern, HostPolicy policy) {
+    _policies[pattern.toLowerCase()] = policy;
+  }
+
+  /// Remove the policy for [pattern]
+  HostPolicy? remove(String pattern) =>
+      _policies.remove(pattern.toLowerCase());
+
+  bool get isEmpty => _policies.isEmpty;
+
+  /// All patterns and their policies
+  Map<String, HostPolicy> get policies => UnmodifiableMapView(_policies);
+
+  /// Policy for [host], or null when no pattern matches
+  HostPolicy? match(String host) {
+    host = host.toLowerCase();
+    final exact = _policies[host];
+    if (exact != null) return exact;
+
+    // Longest matching suffix first: a.b.example.com, b.example.com, ...
+    var domain = host;
+    while (true) {
+      final policy = _policies['*.$domain'];
+      if (policy != null) return policy;
+      final dot = domain.indexOf('.');
+      if (dot < 0) break;
+      domain = domain.substring(dot + 1);
+    }
+    return _policies['*'];
+  }
+}
+
+/// Admits upstream requests to one host according to its [HostPolicy]
+class HostGate {
+  final HostPolicy policy;
+
+  DateTime _nextSlot = DateTime.fromMillisecondsSinceEpoch(0);
+  int _inFlight = 0;
+  final Queue<Completer<void>> _waiting = Queue();
+
+  HostGate(this.policy);
+
+  /// Wait for a turn to send a request
+  ///
+  /// Call the returned function once the response body has been consumed
+  /// (or abandoned) to let the next queued request through.
+  Future<void Function()> acquire() async {
+    void Function() release = () {};
+    final limit = policy.maxConcurrent;
+    if (limit != null) {
+      if (_inFlight >= limit) {
+        final turn = Completer<void>();
+        _waiting.add(turn);
+        await turn.future;
+      } else {
+        _inFlight++;
+      }
+      var released = false;
+      release = () {
+        if (released) return;
+        released = true;
+        // Hand the slot straight to the next waiter
+        if (_waiting.isNotEmpty) {
+          _waiting.removeFirst().complete();
+        } else {
+          _inFlight--;
+        }
+      };
+    }
+
+    // Reserve the next start slot synchronously so waiters don't race
+    final now = DateTime.now();
+    final slot = _nextSlot.isAfter(now) ? _nextSlot : now;
+    _nextSlot = slot.add(policy.minInterval);
+    if (slot.isAfter(now)) {
+      await Future.delayed(slot.difference(now));
+    }
+    return release;
+  }
+
+  /// End of a request for [start]..[end] widened to the minimum size and
+  /// aligned
+  int widen(int start, int end, int totalSize) {
+    end = max(end, min(start + policy.minRequestSize, totalSize) - 1);
+    final alignment = policy.alignment;
+    if (alignment > 0) {
+      end = min((end ~/ alignment + 1) * alignment - 1, totalSize - 1);
+    }
+    return end;
+  }
+}
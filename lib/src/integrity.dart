@@ -0,0 +1,67 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:isolate';
+
+import 'package:crypto/crypto.dart';
+
+/// Rolling SHA-256 over the bytes sent to a client
+///
+/// dart:io cannot write HTTP trailers, so the digest is published through
+/// the event log and the `/digest` endpoint once the body is complete.
+class BodyDigest {
+  final _DigestSink _output = _DigestSink();
+  late final ByteConversionSink _input = sha256.startChunkedConversion(
+    _output,
+  );
+  int _length = 0;
+  String? _hex;
+
+  /// Number of bytes hashed so far
+  int get length => _length;
+
+  /// Feed bytes that were just written to the client
+  void add(List<int> data) {
+    if (_hex != null) return;
+    _input.add(data);
+    _length += data.length;
+  }
+
+  /// Finish hashing and return the hex digest
+  String close() {
+    if (_hex == null) {
+      _input.close();
+      _hex = _output.value.toString();
+    }
+    return _hex!;
+  }
+}
+
+/// SHA-256 of the file at [path], hex
+///
+/// Hashed on a background isolate, so a large file does not hold up
+/// serving.
+Future<String> sha256OfFile(String path) => Isolate.run(() async {
+  final digest = BodyDigest();
+  await for (final chunk in File(path).openRead()) {
+    digest.add(chunk);
+  }
+  return digest.close();
+});
+
+/// [value] as a lowercase hex SHA-256; null when it is not one
+String? parseSha256(String value) {
+  final hex = value.trim().toLowerCase();
+  return RegExp(r'^[0-9a-f]{64}$').hasMatch(hex) ? hex : null;
+}
+
+class _DigestSink implements Sink<Digest> {
+  late Digest value;
+
+  @override
+  void add(Digest data) {
+    value = data;
+  }
+
+  @override
+  void close() {}
+}
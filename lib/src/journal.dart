@@ -0,0 +1,203 @@
+import 'dart:convert';
+import 'dart:io';
+
+import 'package:synchronized/synchronized.dart';
+
+import 'range_set.dart';
+
+/// Write-ahead journal of cache accounting between metadata saves
+///
+/// `.meta` files are saved when a gap finishes or a second after the
+/// last write, so a power loss mid-download forgets everything cached
+/// since. Range additions and queue changes (pause, resume) are appended
+/// here as JSON lines instead; each [flush] makes them durable
+/// and [replay] applies them on the next start. Pending ranges of a file
+/// are merged before they are written, so the journal grows with the
+/// number of flushes, not of writes.
+class CacheJournal {
+  final String path;
+
+  /// Makes the cached bytes of files durable before the journal claims
+  /// them
+  final Future<void> Function(Iterable<String> fileIds)? syncData;
+
+  // Changes not yet written, merged per file
+  final Map<String, RangeSet> _ranges = {};
+  final List<(String, String)> _states = [];
+  RandomAccessFile? _file;
+  int _length = 0;
+  final Lock _lock = Lock();
+
+  CacheJournal(this.path, {this.syncData});
+
+  /// Whether anything awaits a [flush]
+  bool get hasPending => _ranges.isNotEmpty || _states.isNotEmpty;
+
+  /// Bytes written since the last [checkpoint]
+  int get length => _length;
+
+  /// [start]..[end] of [fileId] was written to the cache
+  void addRange(String fileId, int start, int end) {
+    _ranges.putIfAbsent(fileId, RangeSet.new).add(start, end);
+  }
+
+  /// The download of [fileId] moved to [state] (a `DownloadState` name)
+  void setState(String fileId, String state) {
+    _states.add((fileId, state));
+  }
+
+  /// Append pending changes and sync them to disk
+  Future<void> flush() => _lock.synchronized(_write);
+
+  Future<void> _write() async {
+    if (!hasPending) return;
+    final ranges = Map.of(_ranges);
+    final states = List.of(_states);
+    _ranges.clear();
+    _states.clear();
+    // Ranges added from here on wait for the next flush
+    if (ranges.isNotEmpty) await syncData?.call(ranges.keys);
+
+    final lines = StringBuffer();
+    ranges.forEach((fileId, set) {
+      for (final (start, end) in set.ranges) {
+        lines.writeln(jsonEncode({'id': fileId, 's': start, 'e': end}));
+      }
+    });
+    for (final (fileId, state) in states) {
+      lines.writeln(jsonEncode({'id': fileId, 'state': state}));
+    }
+    final bytes = utf8.encode(lines.toString());
+    final file = _file ??= await File(path).open(mode: FileMode.append);
+    await file.writeFrom(bytes);
+    await file.flush();
+    _length += bytes.length;
+  }
+
+  /// Start over once every `.meta` file holds what was journaled,
+  /// keeping the queue [states] that are stored nowhere else
+  ///
+  /// Changes still pending are written after [states]: replaying a range
+  /// the `.meta` already has does no harm.
+  Future<void> checkpoint(Map<String, String> states) =>
+      _lock.synchronized(() async {
+        final file = _file ??= await File(path).open(mode: FileMode.append);
+        await file.truncate(0);
+        await file.setPosition(0);
+        _length = 0;
+        _states.insertAll(0, [
+          for (final MapEntry(:key, :value) in states.entries) (key, value),
+        ]);
+        await _write();
+      });
+
+  Future<void> close() => _lock.synchronized(() async {
+    await _file?.close();
+    _file = null;
+  });
+
+  /// What the journal at [path] holds; empty when there is none
+  ///
+  /// A line torn by the power loss ends the replay: everything before it
+  /// was synced in order.
+  static Future<JournalReplay> replay(String path) async {
+    final replay = JournalReplay();
+    final file = File(path);
+    if (!await file.exists()) return replay;
+    for (final line in await file.readAsLines()) {
+      final Map<String, dynamic> entry;
+      try {
+        entry = jsonDecode(line) as Map<String, dynamic>;
+      } on FormatException {
+        break;
+      }
+      final fileId = entry['id'] as String;
+      final state = entry['state'] as String?;
+      if (state != null) {
+        replay.states[fileId] = state;
+      } else {
+        replay.ranges
+            .putIfAbsent(fileId, RangeSet.new)
+            .add(entry['s'] as int, entry['e'] as int);
+      }
+      replay.entries++;
+    }
+    return replay;
+  }
+}
+
+/// Changes read back from a [CacheJournal]
+class JournalReplay {
+  /// Cached ranges by file ID
+  final Map<String, RangeSet> ranges = {};
+
+  /// Last queue state by file ID
+  final Map<String, String> states = {};
+
+  /// Number of entries read
+  int entries = 0;
+
+  bool get isEmpty => entries == 0;
+}
+
+/// What `StreamProxyBridge.stop` did, saved for the next start
+class ShutdownReport {
+  /// Requests still running when the server closed
+  final int requestsInFlight;
+
+  /// Of those, the ones cut off when the stop context ended
+  final int requestsAborted;
+
+  /// Background downloads stopped
+  final int downloadsStopped;
+
+  /// `.meta` files saved
+  final int filesSaved;
+
+  /// Files whose save failed, with the error
+  final Map<String, String> saveErrors;
+
+  final DateTime stoppedAt;
+  final Duration took;
+
+  ShutdownReport({
+    this.requestsInFlight = 0,
+    this.requestsAborted = 0,
+    this.downloadsStopped = 0,
+    this.filesSaved = 0,
+    this.saveErrors = const {},
+    DateTime? stoppedAt,
+    this.took = Duration.zero,
+  }) : stoppedAt = stoppedAt ?? DateTime.now();
+
+  /// Whether every file's state was saved
+  bool get clean => saveErrors.isEmpty;
+
+  Map<String, dynamic> toJson() => {
+    'requestsInFlight': requestsInFlight,
+    'requestsAborted': requestsAborted,
+    'downloadsStopped': downloadsStopped,
+    'filesSaved': filesSaved,
+    'saveErrors': saveErrors,
+    'stoppedAt': stoppedAt.toIso8601String(),
+    'tookMs': took.inMilliseconds,
+  };
+
+  factory ShutdownReport.fromJson(Map<String, dynamic> json) =>
+      ShutdownReport(
+        requestsInFlight: json['requestsInFlight'] as int? ?? 0,
+        requestsAborted: json['requestsAborted'] as int? ?? 0,
+        downloadsStopped: json['downloadsStopped'] as int? ?? 0,
+        filesSaved: json['filesSaved'] as int? ?? 0,
+        saveErrors: (json['saveErrors'] as Map<String, dynamic>? ?? {})
+            .cast<String, String>(),
+        stoppedAt: DateTime.tryParse(json['stoppedAt'] as String? ?? ''),
+        took: Duration(milliseconds: json['tookMs'] as int? ?? 0),
+      );
+
+  @override
+  String toString() =>
+      'ShutdownReport(saved: $filesSaved, errors: ${saveErrors.length}, '
+      'aborted: $requestsAborted/$requestsInFlight, '
+      'downloads: $downloadsStopped, took: ${took.inMilliseconds} ms)';
+}
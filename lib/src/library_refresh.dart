@@ -0,0 +1,240 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+
+import 'package:path/path.dart' as p;
+
+/// A media server that should rescan its library when files arrive
+abstract class LibraryService {
+  /// Shown in logs and events, e.g. `jellyfin`
+  String get name;
+
+  /// Ask the server to pick up [paths] (as the server sees them)
+  Future<void> refresh(HttpClient client, List<String> paths);
+}
+
+/// Jellyfin or Emby, authenticated with an API key
+///
+/// Reports each path through `/Library/Media/Updated`, which scans only
+/// the affected folders instead of the whole library.
+class JellyfinLibrary implements LibraryService {
+  final Uri baseUrl;
+  final String apiKey;
+
+  JellyfinLibrary(this.baseUrl, this.apiKey);
+
+  @override
+  String get name => 'jellyfin';
+
+  @override
+  Future<void> refresh(HttpClient client, List<String> paths) async {
+    final request = await client.postUrl(
+      _resolve(baseUrl, 'Library/Media/Updated'),
+    );
+    request.headers.set('X-Emby-Token', apiKey);
+    request.headers.contentType = ContentType.json;
+    request.write(
+      jsonEncode({
+        'Updates': [
+          for (final path in paths) {'Path': path, 'UpdateType': 'Created'},
+        ],
+      }),
+    );
+    await _send(request);
+  }
+}
+
+/// Plex, authenticated with an `X-Plex-Token`
+///
+/// Refreshes the folder of each path in library section [sectionId], or in
+/// every section when it is null.
+class PlexLibrary implements LibraryService {
+  final Uri baseUrl;
+  final String token;
+  final String? sectionId;
+
+  PlexLibrary(this.baseUrl, this.token, {this.sectionId});
+
+  @override
+  String get name => 'plex';
+
+  @override
+  Future<void> refresh(HttpClient client, List<String> paths) async {
+    final section = sectionId ?? 'all';
+    for (final folder in paths.map(p.dirname).toSet()) {
+      final uri = _resolve(baseUrl, 'library/sections/$section/refresh');
+      final request = await client.getUrl(
+        uri.replace(queryParameters: {'path': folder}),
+      );
+      request.headers.set('X-Plex-Token', token);
+      await _send(request);
+    }
+  }
+}
+
+/// Kodi's JSON-RPC interface (web server enabled), with optional basic
+/// authentication
+class KodiLibrary implements LibraryService {
+  final Uri baseUrl;
+  final String? username;
+  final String? password;
+
+  KodiLibrary(this.baseUrl, {this.username, this.password});
+
+  @override
+  String get name => 'kodi';
+
+  @override
+  Future<void> refresh(HttpClient client, List<String> paths) async {
+    for (final folder in paths.map(p.dirname).toSet()) {
+      final request = await client.postUrl(_resolve(baseUrl, 'jsonrpc'));
+      if (username != null) {
+        final credentials = base64.encode(
+          utf8.encode('$username:${password ?? ''}'),
+        );
+        request.headers.set('Authorization', 'Basic $credentials');
+      }
+      request.headers.contentType = ContentType.json;
+      request.write(
+        jsonEncode({
+          'jsonrpc': '2.0',
+          'id': 1,
+          'method': 'VideoLibrary.Scan',
+          // Kodi matches sources by prefix and wants the trailing slash
+          'params': {'directory': '$folder/', 'showdialogs': false},
+        }),
+      );
+      final body = await _send(request);
+      final error = (jsonDecode(body) as Map<String, dynamic>)['error'];
+      if (error != null) {
+        throw HttpException('Kodi refused scan: ${jsonEncode(error)}');
+      }
+    }
+  }
+}
+
+Uri _resolve(Uri base, String path) => base.path.endsWith('/')
+    ? base.resolve(path)
+    : base.replace(path: '${base.path}/$path');
+
+/// Send [request] and return the body; throws on a non-2xx status
+Future<String> _send(HttpClientRequest request) async {
+  final response = await request.close();
+  final body = await utf8.decodeStream(response);
+  if (response.statusCode < 200 || response.statusCode >= 300) {
+    throw HttpException('Status ${response.statusCode}', uri: request.uri);
+  }
+  return body;
+}
+
+/// Outcome of one service's refresh; [error] is null on success
+typedef LibraryRefreshCallback =
+    void Function(LibraryService service, List<String> paths, Object? error);
+
+/// Settings for refreshing media libraries when files are completed
+class LibraryRefreshConfig {
+  final List<LibraryService> services;
+
+  /// Local path prefixes and what the media servers call them, e.g.
+  /// `{'/data/collections': '/media/downloads'}` when a server runs in a
+  /// container
+  final Map<String, String> pathMap;
+
+  /// Quiet time before a refresh, so a batch of completions is one scan
+  final Duration delay;
+
+  /// Also refresh for files that appear in the collection folder by other
+  /// means (copied in, moved by a script), through file system events
+  final bool watchCollection;
+
+  const LibraryRefreshConfig({
+    required this.services,
+    this.pathMap = const {},
+    this.delay = const Duration(seconds: 10),
+    this.watchCollection = false,
+  });
+}
+
+/// Collects new files and asks each [LibraryService] to scan them
+///
+/// Files added within [LibraryRefreshConfig.delay] of each other are sent
+/// in one refresh. A failing service does not hold up the others; each
+/// outcome is reported to `onResult` (error null on success).
+class LibraryRefresher {
+  final LibraryRefreshConfig config;
+  final LibraryRefreshCallback? onResult;
+
+  final HttpClient _client = HttpClient()
+    ..connectionTimeout = const Duration(seconds: 10);
+  final Set<String> _pending = {};
+  final List<StreamSubscription<FileSystemEvent>> _watches = [];
+  Timer? _timer;
+
+  LibraryRefresher(this.config, {this.onResult});
+
+  /// [path] landed in the collection
+  void fileAdded(String path) {
+    _pending.add(mapPath(path));
+    _timer?.cancel();
+    _timer = Timer(config.delay, () => unawaited(flush()));
+  }
+
+  /// [path] as the media servers see it
+  String mapPath(String path) {
+    final local = p.normalize(p.absolute(path));
+    for (final MapEntry(:key, :value) in config.pathMap.entries) {
+      final prefix = p.normalize(p.absolute(key));
+      if (local == prefix || p.isWithin(prefix, local)) {
+        return p.join(value, p.relative(local, from: prefix));
+      }
+    }
+    return local;
+  }
+
+  /// Refresh now for everything added so far
+  Future<void> flush() async {
+    _timer?.cancel();
+    _timer = null;
+    if (_pending.isEmpty) return;
+    final paths = _pending.toList();
+    _pending.clear();
+    await Future.wait([
+      for (final service in config.services)
+        service.refresh(_client, paths).then(
+          (_) => onResult?.call(service, paths, null),
+          onError: (Object e) => onResult?.call(service, paths, e),
+        ),
+    ]);
+  }
+
+  /// Report files that appear in [directory] (inotify on Linux)
+  ///
+  /// Sidecars (`.done`) and hidden files are ignored.
+  void watch(String directory) {
+    final events = Directory(directory).watch(
+      events: FileSystemEvent.create | FileSystemEvent.move,
+    );
+    _watches.add(
+      events.listen((event) {
+        final path = event is FileSystemMoveEvent
+            ? event.destination
+            : event.path;
+        if (path == null || event.isDirectory) return;
+        final name = p.basename(path);
+        if (name.startsWith('.') || name.endsWith('.done')) return;
+        fileAdded(path);
+      }, onError: (_) {}),
+    );
+  }
+
+  /// Stop watching and drop pending refreshes
+  Future<void> close() async {
+    _timer?.cancel();
+    _pending.clear();
+    for (final watch in _watches) {
+      await watch.cancel();
+    }
+    _watches.clear();
+    _client.close(force: true);
+  }
+}
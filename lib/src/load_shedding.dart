@@ -0,0 +1,112 @@
+import 'dart:async';
+import 'dart:io';
+
+/// Thresholds for [LoadShedder]; null disables a check
+class LoadSheddingConfig {
+  /// Resident set size above which new upstream fetches are refused
+  final int? maxRssBytes;
+
+  /// Concurrent upstream fetches above which new ones are refused
+  final int? maxActiveFetches;
+
+  /// Event-loop lag (CPU saturation) above which new fetches are refused
+  final Duration? maxEventLoopLag;
+
+  /// Value of the Retry-After header on 503 responses
+  final Duration retryAfter;
+
+  /// How often memory and lag are sampled
+  final Duration sampleInterval;
+
+  const LoadSheddingConfig({
+    this.maxRssBytes,
+    this.maxActiveFetches,
+    this.maxEventLoopLag,
+    this.retryAfter = const Duration(seconds: 5),
+    this.sampleInterval = const Duration(seconds: 1),
+  });
+}
+
+/// Tracks runtime pressure and decides when to shed uncached work
+///
+/// Cached bytes are always served; only requests that would need a new
+/// upstream fetch are refused while [reason] is non-null.
+class LoadShedder {
+  final LoadSheddingConfig config;
+
+  /// Reads the resident set size; tests pass a fake
+  final int Function() readRss;
+
+  Timer? _timer;
+  DateTime? _lastTick;
+  int _rss = 0;
+  Duration _lag = Duration.zero;
+  int _activeFetches = 0;
+
+  LoadShedder(this.config, {this.readRss = _currentRss});
+
+  /// Start sampling
+  void start() {
+    _timer?.cancel();
+    _lastTick = null;
+    sample();
+    _timer = Timer.periodic(config.sampleInterval, (_) => sample());
+  }
+
+  /// Stop sampling
+  void stop() {
+    _timer?.cancel();
+    _timer = null;
+  }
+
+  /// Read memory, and the lag from how late this comes after the last
+  /// sample; [start] samples every [LoadSheddingConfig.sampleInterval]
+  void sample({DateTime? now}) {
+    now ??= DateTime.now();
+    final last = _lastTick;
+    _lastTick = now;
+    if (last != null) {
+      // A busy isolate fires periodic timers late
+      final lag = now.difference(last) - config.sampleInterval;
+      _lag = lag.isNegative ? Duration.zero : lag;
+    }
+    _rss = readRss();
+  }
+
+  static int _currentRss() {
+    try {
+      return ProcessInfo.currentRss;
+    } catch (_) {
+      return 0; // Not available on this platform
+    }
+  }
+
+  /// Latest resident set size
+  int get rss => _rss;
+
+  /// Latest event-loop lag
+  Duration get eventLoopLag => _lag;
+
+  /// Upstream fetches in flight
+  int get activeFetches => _activeFetches;
+
+  void fetchStarted() => _activeFetches++;
+
+  void fetchFinished() {
+    if (_activeFetches > 0) _activeFetches--;
+  }
+
+  /// Why new fetches should be refused, or null when healthy
+  String? get reason {
+    final maxRss = config.maxRssBytes;
+    if (maxRss != null && _rss > maxRss) return 'memory';
+    final maxFetches = config.maxActiveFetches;
+    if (maxFetches != null && _activeFetches >= maxFetches) return 'fetches';
+    final maxLag = config.maxEventLoopLag;
+    if (maxLag != null && _lag > maxLag) return 'cpu';
+    return null;
+  }
+
+  /// Check whether new uncached fetches should be refused
+  bool get underPressure => reason != null;
+}
@@ -1,41 +1,160 @@
-/// Simple logging abstraction for DownStream
+import 'dart:convert';
+
+/// Severity of a [LogRecord], least severe first
+enum LogLevel { debug, info, warn, error }
+
+/// One log event: a message plus structured fields
+class LogRecord {
+  final LogLevel level;
+  final String message;
+  final DateTime time;
+
+  /// Structured context, e.g. `fileId`, `host`, `bytes`
+  final Map<String, Object?> fields;
+
+  final Object? error;
+  final StackTrace? stackTrace;
+
+  LogRecord(
+    this.level,
+    this.message, {
+    this.fields = const {},
+    this.error,
+    this.stackTrace,
+    DateTime? time,
+  }) : time = time ?? DateTime.now();
+
+  Map<String, Object?> toJson() => {
+    'time': time.toIso8601String(),
+    'level': level.name,
+    'message': message,
+    ...fields,
+    if (error != null) 'error': '$error',
+    if (stackTrace != null) 'stackTrace': '$stackTrace',
+  };
+
+  @override
+  String toString() {
+    final buffer = StringBuffer(message);
+    for (final MapEntry(:key, :value) in fields.entries) {
+      buffer.write(' $key=$value');
+    }
+    if (error != null) buffer.write(' error=$error');
+    return buffer.toString();
+  }
+}
+
+/// Where log records go; set one with [Logger.sink]
+abstract interface class LogSink {
+  void log(LogRecord record);
+}
+
+/// Prints `[DownStream] message key=value ...` lines (the default)
+class PrintLogSink implements LogSink {
+  const PrintLogSink();
+
+  @override
+  void log(LogRecord record) {
+    final tag = switch (record.level) {
+      LogLevel.debug => 'DownStream DEBUG',
+      LogLevel.info => 'DownStream',
+      LogLevel.warn => 'DownStream WARN',
+      LogLevel.error => 'DownStream ERROR',
+    };
+    // ignore: avoid_print
+    print('[$tag] $record');
+    if (record.stackTrace != null) {
+      // ignore: avoid_print
+      print(record.stackTrace);
+    }
+  }
+}
+
+/// Writes each record as one JSON line, for log collectors
+class JsonLogSink implements LogSink {
+  final void Function(String line) write;
+
+  JsonLogSink(this.write);
+
+  @override
+  void log(LogRecord record) =>
+      write(jsonEncode(record.toJson(), toEncodable: (value) => '$value'));
+}
+
+/// Logging for DownStream
+///
+/// Records at or above [level] go to [sink]; apps route them to their own
+/// logging by setting a sink of their own.
 class Logger {
   static bool _enabled = true;
-  
+
+  /// Where records go
+  static LogSink sink = const PrintLogSink();
+
+  /// Records below this level are dropped
+  static LogLevel level = LogLevel.info;
+
   /// Enable or disable logging
   static void setEnabled(bool enabled) {
     _enabled = enabled;
   }
-  
-  /// Log an info message
-  static void info(String message) {
-    if (_enabled) {
-      // ignore: avoid_print
-      print('[DownStream] $message');
-    }
+
+  /// Whether records of [level] are logged, to skip building costly ones
+  static bool isEnabled(LogLevel level) =>
+      _enabled && level.index >= Logger.level.index;
+
+  /// Log a record of [level]
+  static void log(
+    LogLevel level,
+    String message, {
+    Map<String, Object?> fields = const {},
+    Object? error,
+    StackTrace? stackTrace,
+  }) {
+    if (!isEnabled(level)) return;
+    sink.log(
+      LogRecord(
+        level,
+        message,
+        fields: fields,
+        error: error,
+        stackTrace: stackTrace,
+      ),
+    );
   }
-  
+
+  /// Log a debug message: per-request and per-fetch detail
+  static void debug(String message, {Map<String, Object?> fields = const {}}) =>
+      log(LogLevel.debug, message, fields: fields);
+
+  /// Log an info message
+  static void info(String message, {Map<String, Object?> fields = const {}}) =>
+      log(LogLevel.info, message, fields: fields);
+
+  /// Log a warning: something failed but was recovered from
+  static void warn(
+    String message, {
+    Map<String, Object?> fields = const {},
+    Object? error,
+  }) => log(LogLevel.warn, message, fields: fields, error: error);
+
   /// Log an error message
-  static void error(String message) {
-    if (_enabled) {
-      // ignore: avoid_print
-      print('[DownStream ERROR] $message');
-    }
-  }
-  
+  static void error(
+    String message, {
+    Map<String, Object?> fields = const {},
+    Object? error,
+    StackTrace? stackTrace,
+  }) => log(
+    LogLevel.error,
+    message,
+    fields: fields,
+    error: error,
+    stackTrace: stackTrace,
+  );
+
   /// Log a success message
-  static void success(String message) {
-    if (_enabled) {
-      // ignore: avoid_print
-      print('[DownStream ✅] $message');
-    }
-  }
-  
+  static void success(String message) => info('✅ $message');
+
   /// Log a cancel message
-  static void cancel(String message) {
-    if (_enabled) {
-      // ignore: avoid_print
-      print('[DownStream ❌] $message');
-    }
-  }
+  static void cancel(String message) => info('❌ $message');
 }
@@ -0,0 +1,74 @@
+import 'dart:typed_data';
+
+import 'cache_reader.dart';
+
+/// Reads playback facts from a media file's container
+///
+/// Only box headers and the movie header are read, so probing a cached or
+/// remote file through a [CacheReader] costs a few small range fetches.
+class MediaProbe {
+  /// Duration of an MP4/MOV file from its `mvhd` box, or null if not found
+  static Future<Duration?> mp4Duration(CacheReader reader) async {
+    final moov = await _findBox(reader, 'moov', 0, reader.length);
+    if (moov == null) return null;
+    final mvhd = await _findBox(reader, 'mvhd', moov.$1, moov.$2);
+    if (mvhd == null) return null;
+
+    final box = await reader.readAt(mvhd.$1, 32);
+    if (box.isEmpty) return null;
+    final version = box[0];
+    final int timescale;
+    final int duration;
+    if (version == 1) {
+      if (box.length < 32) return null;
+      timescale = _u32(box, 20);
+      duration = _u32(box, 24) * 0x100000000 + _u32(box, 28);
+    } else {
+      if (box.length < 20) return null;
+      timescale = _u32(box, 12);
+      duration = _u32(box, 16);
+    }
+    if (timescale == 0 || duration == 0) return null;
+    return Duration(microseconds: duration * 1000000 ~/ timescale);
+  }
+
+  /// Average bitrate in bits per second for a file of [totalSize] bytes
+  static int? bitrate(int totalSize, Duration? duration) {
+    if (duration == null || duration.inMicroseconds <= 0) return null;
+    return totalSize * 8 * 1000000 ~/ duration.inMicroseconds;
+  }
+
+  /// Find a child box; returns its payload (start, end exclusive)
+  static Future<(int, int)?> _findBox(
+    CacheReader reader,
+    String type,
+    int start,
+    int end,
+  ) async {
+    int pos = start;
+    while (pos + 8 <= end) {
+      final header = await reader.readAt(pos, 16);
+      if (header.length < 8) return null;
+
+      int size = _u32(header, 0);
+      int headerSize = 8;
+      if (size == 1) {
+        if (header.length < 16) return null;
+        size = _u32(header, 8) * 0x100000000 + _u32(header, 12);
+        headerSize = 16;
+      } else if (size == 0) {
+        size = end - pos; // Box extends to the end of its parent
+      }
+      if (size < headerSize) return null;
+
+      if (String.fromCharCodes(header, 4, 8) == type) {
+        return (pos + headerSize, pos + size);
+      }
+      pos += size;
+    }
+    return null;
+  }
+
+  static int _u32(Uint8List b, int i) =>
+      (b[i] << 24) | (b[i + 1] << 16) | (b[i + 2] << 8) | b[i + 3];
+}
@@ -0,0 +1,110 @@
+import 'dart:convert';
+import 'dart:math';
+import 'dart:typed_data';
+
+import 'package:crypto/crypto.dart';
+import 'package:pointycastle/export.dart';
+
+import 'utils.dart';
+
+/// Thrown when sealed data fails authentication or is malformed
+class MetaCipherException implements Exception {
+  final String message;
+
+  MetaCipherException(this.message);
+
+  @override
+  String toString() => 'MetaCipherException: $message';
+}
+
+/// Encrypts and authenticates metadata files with a user-supplied key
+///
+/// AES-256-CTR for confidentiality, HMAC-SHA256 over the whole sealed
+/// record (encrypt-then-MAC). Both keys are derived from the user key.
+///
+/// Format: `DSM1` | 16-byte nonce | ciphertext | 32-byte tag
+class MetaCipher {
+  static const List<int> _magic = [0x44, 0x53, 0x4D, 0x31]; // "DSM1"
+  static const int _nonceLength = 16;
+  static const int _tagLength = 32;
+
+  static final Random _random = Random.secure();
+
+  final Uint8List _encKey;
+  final Uint8List _macKey;
+
+  MetaCipher(List<int> key)
+    : _encKey = _derive(key, 'downstream-meta-enc'),
+      _macKey = _derive(key, 'downstream-meta-mac') {
+    if (key.isEmpty) {
+      throw ArgumentError.value(key, 'key', 'must not be empty');
+    }
+  }
+
+  /// Build a cipher from a passphrase
+  factory MetaCipher.fromPassphrase(String passphrase) =>
+      MetaCipher(utf8.encode(passphrase));
+
+  static Uint8List _derive(List<int> key, String label) => Uint8List.fromList(
+    Hmac(sha256, key).convert(utf8.encode(label)).bytes,
+  );
+
+  /// Check whether [bytes] look like a sealed record
+  static bool isSealed(List<int> bytes) {
+    if (bytes.length < _magic.length + _nonceLength + _tagLength) return false;
+    for (int i = 0; i < _magic.length; i++) {
+      if (bytes[i] != _magic[i]) return false;
+    }
+    return true;
+  }
+
+  /// Encrypt and authenticate [plaintext]
+  Uint8List seal(List<int> plaintext) {
+    final nonce = Uint8List(_nonceLength);
+    for (int i = 0; i < _nonceLength; i++) {
+      nonce[i] = _random.nextInt(256);
+    }
+
+    final ciphertext = _crypt(nonce, Uint8List.fromList(plaintext));
+
+    final body = BytesBuilder(copy: false)
+      ..add(_magic)
+      ..add(nonce)
+      ..add(ciphertext);
+    final header = body.takeBytes();
+    final tag = Hmac(sha256, _macKey).convert(header).bytes;
+
+    return (BytesBuilder(copy: false)
+          ..add(header)
+          ..add(tag))
+        .takeBytes();
+  }
+
+  /// Verify and decrypt a record produced by [seal]
+  Uint8List open(List<int> sealed) {
+    if (!isSealed(sealed)) {
+      throw MetaCipherException('Not a sealed metadata record');
+    }
+
+    final bytes = Uint8List.fromList(sealed);
+    final tagStart = bytes.length - _tagLength;
+    final expected = Hmac(
+      sha256,
+      _macKey,
+    ).convert(Uint8List.sublistView(bytes, 0, tagStart)).bytes;
+    final tag = bytes.sublist(tagStart);
+    if (!DownStreamUtils.constantTimeEquals(expected, tag)) {
+      throw MetaCipherException('Authentication failed');
+    }
+
+    final nonce = bytes.sublist(_magic.length, _magic.length + _nonceLength);
+    final ciphertext = bytes.sublist(_magic.length + _nonceLength, tagStart);
+    return _crypt(nonce, ciphertext);
+  }
+
+  Uint8List _crypt(Uint8List nonce, Uint8List input) {
+    final cipher = CTRStreamCipher(AESEngine())
+      ..init(true, ParametersWithIV(KeyParameter(_encKey), nonce));
+    return cipher.process(input);
+  }
+}
@@ -0,0 +1,190 @@
+import 'data_source.dart';
+
+/// When mirrors of a file are accepted and given up on
+class MirrorConfig {
+  /// Failed segment requests in a row before a mirror is dropped
+  final int maxFailures;
+
+  /// A mirror slower than this fraction of the fastest one is dropped,
+  /// once each has served [minSamples] segments
+  final double minRelativeSpeed;
+
+  final int minSamples;
+
+  /// Refuse a mirror whose strong ETag differs from the origin's; turn
+  /// off for mirrors run by different servers, which tag the same bytes
+  /// differently. The size always has to match.
+  final bool matchEtags;
+
+  const MirrorConfig({
+    this.maxFailures = 3,
+    this.minRelativeSpeed = 0.25,
+    this.minSamples = 2,
+    this.matchEtags = true,
+  });
+}
+
+/// One URL a file is fetched from, and how it has done
+class Mirror {
+  final String url;
+
+  /// Bytes fetched from it, and the time spent fetching them
+  int bytes = 0;
+  Duration elapsed = Duration.zero;
+
+  /// Segments it served, and failures since its last success
+  int served = 0;
+  int failures = 0;
+
+  /// Segment requests running on it now
+  int inFlight = 0;
+
+  /// Why it is no longer used; null while it is
+  String? droppedFor;
+
+  Mirror(this.url);
+
+  bool get dropped => droppedFor != null;
+
+  /// Bytes per second, once it served anything
+  double? get speed => elapsed == Duration.zero
+      ? null
+      : bytes / elapsed.inMicroseconds * Duration.microsecondsPerSecond;
+
+  Map<String, dynamic> toJson() => {
+    'url': url,
+    'bytes': bytes,
+    'served': served,
+    'failures': failures,
+    if (speed != null) 'bytesPerSecond': speed!.round(),
+    if (droppedFor != null) 'dropped': droppedFor,
+  };
+}
+
+/// The URLs one file is fetched from: its own and its mirrors
+///
+/// Segmented downloads take a URL per segment with [pick], the least busy
+/// first and the fastest among those, so every mirror is sampled. A
+/// mirror failing [MirrorConfig.maxFailures] times in a row, or far
+/// slower than the fastest, is dropped; the file's own URL never is.
+class MirrorSet {
+  final String primary;
+  MirrorConfig config;
+  final Map<String, Mirror> _byUrl = {};
+
+  MirrorSet(this.primary, {this.config = const MirrorConfig()}) {
+    _byUrl[primary] = Mirror(primary);
+  }
+
+  /// Every URL, the file's own first
+  List<Mirror> get all => _byUrl.values.toList();
+
+  /// URLs still in use
+  List<Mirror> get active => [
+    for (final mirror in _byUrl.values)
+      if (!mirror.dropped) mirror,
+  ];
+
+  /// Mirror URLs, the file's own left out
+  List<String> get urls => [
+    for (final url in _byUrl.keys)
+      if (url != primary) url,
+  ];
+
+  Mirror? operator [](String url) => _byUrl[url];
+
+  /// Add [url]; false when it is known already
+  bool add(String url) {
+    if (_byUrl.containsKey(url)) return false;
+    _byUrl[url] = Mirror(url);
+    return true;
+  }
+
+  /// Forget [url]; the file's own URL stays
+  bool remove(String url) => url != primary && _byUrl.remove(url) != null;
+
+  /// Why a mirror described by [mirror] cannot stand in for the origin
+  /// described by [origin]; null when it can
+  String? mismatch(FileStat origin, FileStat mirror) {
+    if (mirror.totalSize == null || mirror.totalSize != origin.totalSize) {
+      return 'size ${mirror.totalSize}, expected ${origin.totalSize}';
+    }
+    if (mirror.acceptsRanges == false) return 'ignores Range';
+    final (ours, theirs) = (origin.etag, mirror.etag);
+    if (config.matchEtags &&
+        ours != null &&
+        theirs != null &&
+        !ours.startsWith('W/') &&
+        !theirs.startsWith('W/') &&
+        ours != theirs) {
+      return 'ETag $theirs, expected $ours';
+    }
+    return null;
+  }
+
+  /// The URL to fetch the next segment from
+  Mirror pick() {
+    final candidates = active;
+    candidates.sort((a, b) {
+      final busy = a.inFlight.compareTo(b.inFlight);
+      if (busy != 0) return busy;
+      // Fastest first, unmeasured ones before all, so each gets sampled
+      final (x, y) = (a.speed ?? double.infinity, b.speed ?? double.infinity);
+      return y.compareTo(x);
+    });
+    return candidates.first;
+  }
+
+  void started(Mirror mirror) => mirror.inFlight++;
+
+  /// [mirror] fetched [bytes] in [elapsed]
+  void finished(Mirror mirror, int bytes, Duration elapsed) {
+    mirror
+      ..inFlight -= 1
+      ..bytes += bytes
+      ..elapsed += elapsed
+      ..served += 1
+      ..failures = 0;
+    _dropSlow();
+  }
+
+  /// [mirror] failed a segment
+  void failed(Mirror mirror, Object error) {
+    mirror
+      ..inFlight -= 1
+      ..failures += 1;
+    if (mirror.failures >= config.maxFailures) {
+      drop(mirror.url, 'failed ${mirror.failures} times: $error');
+    }
+  }
+
+  /// Stop using [url] for [reason]; the file's own URL stays in use
+  void drop(String url, String reason) {
+    final mirror = _byUrl[url];
+    if (url == primary || mirror == null || mirror.dropped) return;
+    mirror.droppedFor = reason;
+  }
+
+  void _dropSlow() {
+    final measured = [
+      for (final mirror in active)
+        if (mirror.served >= config.minSamples) mirror,
+    ];
+    if (measured.length < 2) return;
+    final fastest = measured
+        .map((mirror) => mirror.speed!)
+        .reduce((a, b) => a > b ? a : b);
+    for (final mirror in measured) {
+      if (mirror.speed! < fastest * config.minRelativeSpeed) {
+        drop(mirror.url, 'too slow');
+      }
+    }
+  }
+
+  Map<String, dynamic> toJson() => {
+    'url': primary,
+    'mirrors': [
+      for (final mirror in _byUrl.values) mirror.toJson(),
+    ],
+  };
+}
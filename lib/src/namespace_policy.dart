@@ -0,0 +1,79 @@
+/// Why a request was refused by a [NamespacePolicy]
+enum PolicyDenial { blockedHost, outsideAllowedHours, dailyBudgetExceeded }
+
+/// Restrictions for one namespace (profile), e.g. a kids profile
+class NamespacePolicy {
+  /// Hosts that may not be streamed; `*.example.com` matches subdomains
+  final Set<String> blockedHosts;
+
+  /// Bytes that may be served per local calendar day
+  final int? maxDailyBytes;
+
+  /// First allowed hour (0-23), local time
+  final int? allowedFromHour;
+
+  /// Hour at which access stops (1-24), local time. May be lower than
+  /// [allowedFromHour] for windows spanning midnight (e.g. 20 to 2).
+  final int? allowedUntilHour;
+
+  const NamespacePolicy({
+    this.blockedHosts = const {},
+    this.maxDailyBytes,
+    this.allowedFromHour,
+    this.allowedUntilHour,
+  });
+
+  /// Check whether [host] is blocked
+  bool isHostBlocked(String host) {
+    final h = host.toLowerCase();
+    for (final pattern in blockedHosts) {
+      final p = pattern.toLowerCase();
+      if (p.startsWith('*.')) {
+        final suffix = p.substring(1);
+        if (h.endsWith(suffix) || h == p.substring(2)) return true;
+      } else if (h == p) {
+        return true;
+      }
+    }
+    return false;
+  }
+
+  /// Check whether [time] falls inside the allowed hours
+  bool isWithinAllowedHours(DateTime time) {
+    if (allowedFromHour == null || allowedUntilHour == null) return true;
+    final from = allowedFromHour!;
+    final until = allowedUntilHour!;
+    final hour = time.hour;
+    if (from <= until) return hour >= from && hour < until;
+    return hour >= from || hour < until;
+  }
+
+  /// Evaluate a request, returning the denial reason or null if allowed
+  PolicyDenial? evaluate(Uri remote, DateTime now, int bytesUsedToday) {
+    if (isHostBlocked(remote.host)) return PolicyDenial.blockedHost;
+    if (!isWithinAllowedHours(now)) return PolicyDenial.outsideAllowedHours;
+    if (maxDailyBytes != null && bytesUsedToday >= maxDailyBytes!) {
+      return PolicyDenial.dailyBudgetExceeded;
+    }
+    return null;
+  }
+}
+
+/// Bytes served to a namespace on one local day
+class NamespaceUsage {
+  final String day; // yyyy-mm-dd
+  int bytes;
+
+  NamespaceUsage(this.day, [this.bytes = 0]);
+
+  /// Day key for [time]
+  static String dayOf(DateTime time) =>
+      '${time.year.toString().padLeft(4, '0')}-'
+      '${time.month.toString().padLeft(2, '0')}-'
+      '${time.day.toString().padLeft(2, '0')}';
+
+  Map<String, Object> toJson() => {'day': day, 'bytes': bytes};
+
+  factory NamespaceUsage.fromJson(Map<String, dynamic> json) =>
+      NamespaceUsage(json['day'] as String, json['bytes'] as int);
+}
@@ -0,0 +1,152 @@
+import 'dart:io';
+import 'dart:typed_data';
+
+/// Limits for [ObjectCache]
+class ObjectCacheConfig {
+  /// Total bytes kept in memory
+  final int maxBytes;
+
+  /// Larger responses are passed through uncached
+  final int maxObjectSize;
+
+  /// Freshness for responses without Cache-Control or Expires
+  final Duration defaultMaxAge;
+
+  const ObjectCacheConfig({
+    this.maxBytes = 8 * 1024 * 1024,
+    this.maxObjectSize = 1024 * 1024,
+    this.defaultMaxAge = Duration.zero,
+  });
+}
+
+/// A small upstream response (manifest, playlist, API JSON)
+class CachedObject {
+  final int statusCode;
+  final String? contentType;
+  final Uint8List body;
+  final String? etag;
+  final String? lastModified;
+  DateTime storedAt;
+  Duration maxAge;
+
+  CachedObject({
+    required this.statusCode,
+    required this.body,
+    required this.maxAge,
+    this.contentType,
+    this.etag,
+    this.lastModified,
+    DateTime? storedAt,
+  }) : storedAt = storedAt ?? DateTime.now();
+
+  Duration age(DateTime now) => now.difference(storedAt);
+
+  bool isFresh(DateTime now) => age(now) < maxAge;
+
+  /// Can be revalidated with a conditional request
+  bool get hasValidators => etag != null || lastModified != null;
+
+  /// Headers for a conditional revalidation request
+  Map<String, String> get validatorHeaders => {
+    if (etag != null) 'If-None-Match': etag!,
+    if (lastModified != null) 'If-Modified-Since': lastModified!,
+  };
+}
+
+/// Freshness rules from response headers (RFC 9111, simplified)
+class CachePolicy {
+  /// Response must not be stored
+  final bool noStore;
+
+  /// How long the response is fresh
+  final Duration maxAge;
+
+  const CachePolicy({required this.noStore, required this.maxAge});
+
+  /// Parse Cache-Control and Expires, falling back to [defaultMaxAge]
+  factory CachePolicy.fromHeaders(
+    HttpHeaders headers, {
+    Duration defaultMaxAge = Duration.zero,
+    DateTime? now,
+  }) {
+    final directives = <String, String?>{};
+    for (final value in headers[HttpHeaders.cacheControlHeader] ?? const []) {
+      for (final part in value.split(',')) {
+        final kv = part.trim().split('=');
+        if (kv[0].isEmpty) continue;
+        directives[kv[0].toLowerCase()] = kv.length > 1
+            ? kv[1].replaceAll('"', '')
+            : null;
+      }
+    }
+
+    if (directives.containsKey('no-store') ||
+        directives.containsKey('private')) {
+      return const CachePolicy(noStore: true, maxAge: Duration.zero);
+    }
+    if (directives.containsKey('no-cache')) {
+      return const CachePolicy(noStore: false, maxAge: Duration.zero);
+    }
+
+    final seconds = int.tryParse(
+      directives['s-maxage'] ?? directives['max-age'] ?? '',
+    );
+    if (seconds != null) {
+      return CachePolicy(noStore: false, maxAge: Duration(seconds: seconds));
+    }
+
+    final expires = headers.expires;
+    if (expires != null) {
+      final ttl = expires.difference(now ?? DateTime.now());
+      return CachePolicy(
+        noStore: false,
+        maxAge: ttl.isNegative ? Duration.zero : ttl,
+      );
+    }
+    return CachePolicy(noStore: false, maxAge: defaultMaxAge);
+  }
+}
+
+/// In-memory LRU cache of small upstream responses, keyed by URL
+class ObjectCache {
+  final ObjectCacheConfig config;
+
+  // Insertion order doubles as LRU order (oldest first)
+  final Map<String, CachedObject> _objects = {};
+  int _bytes = 0;
+
+  ObjectCache([this.config = const ObjectCacheConfig()]);
+
+  /// Total cached body bytes
+  int get bytes => _bytes;
+
+  int get length => _objects.length;
+
+  CachedObject? operator [](String url) {
+    final object = _objects.remove(url);
+    if (object != null) _objects[url] = object;
+    return object;
+  }
+
+  /// Store a response, evicting the least recently used ones if needed
+  void put(String url, CachedObject object) {
+    remove(url);
+    if (object.body.length > config.maxObjectSize) return;
+
+    _objects[url] = object;
+    _bytes += object.body.length;
+    while (_bytes > config.maxBytes && _objects.isNotEmpty) {
+      remove(_objects.keys.first);
+    }
+  }
+
+  void remove(String url) {
+    final object = _objects.remove(url);
+    if (object != null) _bytes -= object.body.length;
+  }
+
+  void clear() {
+    _objects.clear();
+    _bytes = 0;
+  }
+}
@@ -0,0 +1,142 @@
+import 'dart:math';
+
+/// How far an item of a take-offline request is from playing offline
+enum OfflineReadiness {
+  /// Waiting for its size or its turn
+  pending,
+
+  /// Being cached
+  downloading,
+
+  /// The whole file is cached
+  ready,
+
+  /// Its planned prefix is cached: it plays offline up to there
+  partial,
+
+  /// Did not fit in the budget
+  skipped,
+
+  /// Its size could not be found or its download failed
+  failed,
+}
+
+/// Bytes planned for one item, always a prefix (from byte 0)
+class OfflineTarget {
+  final String url;
+  final int totalSize;
+
+  /// Bytes to cache; 0 when the item was left out
+  final int bytes;
+
+  const OfflineTarget(this.url, this.totalSize, this.bytes);
+
+  /// Whether the whole file is planned
+  bool get whole => bytes >= totalSize;
+
+  @override
+  String toString() => 'OfflineTarget($url, $bytes/$totalSize)';
+}
+
+/// Chooses what of a list of items to cache within a byte budget
+///
+/// Items are taken in list order, which is their priority. Short items
+/// (up to [wholeLimit]) are taken whole while they fit: half a clip is
+/// rarely worth having. Long items then share what is left evenly, so
+/// each plays offline for a while; one whose share would be under
+/// [minPrefix] is left out, starting with the last.
+class OfflinePlanner {
+  /// Largest file that counts as short
+  final int wholeLimit;
+
+  /// Smallest prefix worth caching of a long item
+  final int minPrefix;
+
+  const OfflinePlanner({
+    this.wholeLimit = 256 * 1024 * 1024,
+    this.minPrefix = 64 * 1024 * 1024,
+  });
+
+  /// Plan [items] (url and size) into [budget] bytes, in item order
+  List<OfflineTarget> plan(List<(String, int)> items, int budget) {
+    final bytes = List.filled(items.length, 0);
+    var left = budget;
+
+    final long = <int>[];
+    for (int i = 0; i < items.length; i++) {
+      final size = items[i].$2;
+      if (size > wholeLimit) {
+        long.add(i);
+      } else if (size <= left) {
+        bytes[i] = size;
+        left -= size;
+      }
+    }
+
+    // Drop the lowest priority long items until the rest get enough
+    while (long.isNotEmpty && left ~/ long.length < minPrefix) {
+      long.removeLast();
+    }
+
+    // Smallest first, so what a small one does not need goes to the rest
+    long.sort((a, b) => items[a].$2.compareTo(items[b].$2));
+    for (int k = 0; k < long.length; k++) {
+      final i = long[k];
+      bytes[i] = min(items[i].$2, left ~/ (long.length - k));
+      left -= bytes[i];
+    }
+
+    return [
+      for (int i = 0; i < items.length; i++)
+        OfflineTarget(items[i].$1, items[i].$2, bytes[i]),
+    ];
+  }
+}
+
+/// Offline readiness of one item, for display
+class OfflineItemStatus {
+  final String url;
+  final OfflineReadiness readiness;
+
+  /// Size of the file; null until known
+  final int? totalSize;
+
+  /// Bytes planned, from the start of the file
+  final int plannedBytes;
+
+  /// Bytes of the planned prefix already cached
+  final int cachedBytes;
+
+  /// Seconds of playback cached, when the bitrate is known
+  final double? seconds;
+
+  /// Why the item [OfflineReadiness.failed]
+  final String? error;
+
+  const OfflineItemStatus(
+    this.url,
+    this.readiness, {
+    this.totalSize,
+    this.plannedBytes = 0,
+    this.cachedBytes = 0,
+    this.seconds,
+    this.error,
+  });
+
+  /// Share of the planned bytes cached, 0 to 1
+  double get progress => plannedBytes == 0 ? 0 : cachedBytes / plannedBytes;
+
+  Map<String, dynamic> toJson() => {
+    'url': url,
+    'readiness': readiness.name,
+    'totalSize': totalSize,
+    'plannedBytes': plannedBytes,
+    'cachedBytes': cachedBytes,
+    if (seconds != null) 'seconds': seconds,
+    if (error != null) 'error': error,
+  };
+
+  @override
+  String toString() =>
+      'OfflineItemStatus($url, ${readiness.name}, $cachedBytes/$plannedBytes)';
+}
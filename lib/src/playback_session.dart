@@ -0,0 +1,45 @@
+/// Where a player was in a file, kept across proxy restarts
+///
+/// Identified by a client-chosen token (`session` query parameter or
+/// `X-DownStream-Session` header), so a player reconnecting after a
+/// restart can continue from [offset] and the proxy can reuse [totalSize]
+/// instead of probing the origin again.
+class PlaybackSession {
+  final String token;
+  final String fileId;
+  final String url;
+  final int totalSize;
+  int offset;
+  DateTime updatedAt;
+
+  PlaybackSession({
+    required this.token,
+    required this.fileId,
+    required this.url,
+    required this.totalSize,
+    this.offset = 0,
+    DateTime? updatedAt,
+  }) : updatedAt = updatedAt ?? DateTime.now();
+
+  bool isExpired(DateTime now, Duration maxAge) =>
+      now.difference(updatedAt) > maxAge;
+
+  Map<String, Object> toJson() => {
+    'token': token,
+    'fileId': fileId,
+    'url': url,
+    'totalSize': totalSize,
+    'offset': offset,
+    'updatedAt': updatedAt.toIso8601String(),
+  };
+
+  factory PlaybackSession.fromJson(Map<String, dynamic> json) =>
+      PlaybackSession(
+        token: json['token'] as String,
+        fileId: json['fileId'] as String,
+        url: json['url'] as String,
+        totalSize: json['totalSize'] as int,
+        offset: json['offset'] as int,
+        updatedAt: DateTime.parse(json['updatedAt'] as String),
+      );
+}
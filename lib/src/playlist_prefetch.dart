@@ -0,0 +1,13 @@
+/// When and how much of the next playlist item to cache ahead
+class PlaylistPrefetchConfig {
+  /// Fraction of the current item after which the next one is prefetched
+  final double threshold;
+
+  /// Bytes of the next item to cache (its first minutes of playback)
+  final int bytes;
+
+  const PlaylistPrefetchConfig({
+    this.threshold = 0.9,
+    this.bytes = 16 * 1024 * 1024,
+  });
+}
@@ -0,0 +1,60 @@
+/// Ranges written to one file since the last report, and how fast
+class ProgressReport {
+  /// Contiguous runs of written bytes, in write order
+  final List<(int, int)> ranges;
+
+  /// Bytes written since the last report
+  final int written;
+
+  /// [written] over the time since the last report
+  final double bytesPerSecond;
+
+  const ProgressReport(this.ranges, this.written, this.bytesPerSecond);
+}
+
+/// Coalesces the cache writes of one file into periodic reports
+///
+/// Writes arrive a chunk at a time (often 64 KB); contiguous chunks are
+/// merged into one run and a report is due at most every [interval], so
+/// listeners see a handful of events per second per download.
+class ProgressTracker {
+  Duration interval;
+
+  final List<(int, int)> _runs = [];
+  int _written = 0;
+  DateTime _lastReport;
+
+  ProgressTracker({
+    this.interval = const Duration(milliseconds: 500),
+    DateTime? now,
+  }) : _lastReport = now ?? DateTime.now();
+
+  /// Record that [start]..[end] was written; true when a report is due
+  bool add(int start, int end, {DateTime? now}) {
+    _written += end - start + 1;
+    if (_runs.isNotEmpty && _runs.last.$2 + 1 == start) {
+      _runs.last = (_runs.last.$1, end);
+    } else {
+      _runs.add((start, end));
+    }
+    return (now ?? DateTime.now()).difference(_lastReport) >= interval;
+  }
+
+  /// Whether anything was written since the last report
+  bool get hasPending => _runs.isNotEmpty;
+
+  /// Take the writes since the last report
+  ProgressReport report({DateTime? now}) {
+    now ??= DateTime.now();
+    final elapsed = now.difference(_lastReport).inMicroseconds;
+    final report = ProgressReport(
+      List.unmodifiable(_runs),
+      _written,
+      elapsed > 0 ? _written * 1000000 / elapsed : 0,
+    );
+    _runs.clear();
+    _written = 0;
+    _lastReport = now;
+    return report;
+  }
+}
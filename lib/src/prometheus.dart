@@ -0,0 +1,120 @@
+/// Counts of observations up to fixed upper bounds (a Prometheus
+/// histogram)
+class Histogram {
+  /// Upper bounds of the buckets, ascending; `+Inf` is implied
+  final List<double> bounds;
+
+  final List<int> _buckets;
+  int _count = 0;
+  double _sum = 0;
+
+  Histogram(this.bounds) : _buckets = List.filled(bounds.length, 0);
+
+  /// Seconds from 10 ms to 30 s, for request durations
+  factory Histogram.latency() =>
+      Histogram(const [0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30]);
+
+  int get count => _count;
+  double get sum => _sum;
+
+  void observe(double value) {
+    _count++;
+    _sum += value;
+    for (int i = 0; i < bounds.length; i++) {
+      if (value <= bounds[i]) _buckets[i]++;
+    }
+  }
+
+  /// Observations up to [bounds] at [index], smaller ones included
+  int cumulativeCount(int index) => _buckets[index];
+}
+
+/// What the proxy served, counted for `/metrics`
+class ProxyMetrics {
+  /// Bytes sent to players from the cache
+  int bytesFromCache = 0;
+
+  /// Bytes sent to players as they arrived from upstream
+  int bytesFromUpstream = 0;
+
+  /// Time to handle each request, in seconds (event streams excluded)
+  final Histogram requestDuration = Histogram.latency();
+
+  /// Share of the bytes served that came from the cache; 0 before any
+  double get cacheHitRatio {
+    final total = bytesFromCache + bytesFromUpstream;
+    return total == 0 ? 0 : bytesFromCache / total;
+  }
+}
+
+/// Builds a page in the Prometheus text exposition format (0.0.4)
+class PrometheusText {
+  final StringBuffer _buffer = StringBuffer();
+
+  /// Content type of the page
+  static const contentType = 'text/plain; version=0.0.4; charset=utf-8';
+
+  /// A counter or gauge with one sample per label set
+  void metric(
+    String name,
+    String type,
+    String help,
+    Iterable<(Map<String, String>, num)> samples,
+  ) {
+    _header(name, type, help);
+    for (final (labels, value) in samples) {
+      _sample(name, labels, value);
+    }
+  }
+
+  /// A metric with a single unlabelled sample
+  void single(String name, String type, String help, num value) =>
+      metric(name, type, help, [(const {}, value)]);
+
+  void histogram(String name, String help, Histogram histogram) {
+    _header(name, 'histogram', help);
+    for (int i = 0; i < histogram.bounds.length; i++) {
+      _sample('${name}_bucket', {
+        'le': _number(histogram.bounds[i]),
+      }, histogram.cumulativeCount(i));
+    }
+    _sample('${name}_bucket', const {'le': '+Inf'}, histogram.count);
+    _sample('${name}_sum', const {}, histogram.sum);
+    _sample('${name}_count', const {}, histogram.count);
+  }
+
+  void _header(String name, String type, String help) {
+    _buffer
+      ..writeln('# HELP $name ${help.replaceAll('\\', r'\\')}')
+      ..writeln('# TYPE $name $type');
+  }
+
+  void _sample(String name, Map<String, String> labels, num value) {
+    _buffer.write(name);
+    if (labels.isNotEmpty) {
+      _buffer
+        ..write('{')
+        ..write([
+          for (final MapEntry(:key, :value) in labels.entries)
+            '$key="${_escape(value)}"',
+        ].join(','))
+        ..write('}');
+    }
+    _buffer.writeln(' ${_number(value)}');
+  }
+
+  static String _escape(String value) => value
+      .replaceAll('\\', r'\\')
+      .replaceAll('"', r'\"')
+      .replaceAll('\n', r'\n');
+
+  static String _number(num value) {
+    if (value is int) return '$value';
+    if (value.isNaN) return 'NaN';
+    if (value.isInfinite) return value > 0 ? '+Inf' : '-Inf';
+    return value == value.roundToDouble() ? '${value.toInt()}' : '$value';
+  }
+
+  @override
+  String toString() => _buffer.toString();
+}
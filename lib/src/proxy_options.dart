@@ -0,0 +1,303 @@
+import 'dart:io';
+
+import 'access_control.dart';
+import 'cache_quota.dart';
+import 'client_config.dart';
+import 'data_source.dart';
+import 'logger.dart';
+import 'read_ahead.dart';
+import 'request_deadlines.dart';
+import 'secret_store.dart';
+
+/// Everything a proxy is started with, checked by [validate] before
+/// anything is opened
+///
+/// `getInstance` and `DownStream.init` take the same settings as named
+/// parameters; an options object can be built once, kept in app config
+/// and adjusted with [copyWith].
+class ProxyOptions {
+  /// Interface to listen on; loopback by default, so only apps on the
+  /// device reach the proxy
+  final InternetAddress address;
+
+  /// Port to listen on; 0 picks a free one, read back from the proxy's
+  /// `port` once started
+  final int port;
+
+  /// Serve on this already-bound socket instead of binding [address] and
+  /// [port], e.g. one handed over by the platform or bound by the app to
+  /// learn its port first; closed when the proxy stops
+  final ServerSocket? socket;
+
+  /// Cache directory; a `video_cache` folder in the system temp by default
+  final String? storageDir;
+
+  /// Serve `https` with this certificate instead of plain `http`
+  final SecurityContext? tls;
+
+  /// PEM certificate chain and private key files to serve `https` with,
+  /// instead of building [tls] by hand
+  final String? tlsCertificate;
+  final String? tlsKey;
+  final String? tlsKeyPassword;
+
+  final String? userAgent;
+  final ProxyConfig? proxyConfig;
+
+  /// Upstream timeouts, outbound proxy and TLS trust
+  final ClientConfig clientConfig;
+
+  /// Client for upstream requests, built from [clientConfig] when null
+  final HttpClient? httpClient;
+
+  final Map<String, String> requestHeaders;
+  final Iterable<String> forwardHeaders;
+  final Iterable<String> passThroughHeaders;
+  final RequestDecorator? requestDecorator;
+  final bool bodyDigest;
+
+  /// Key encrypting `.meta` files
+  final List<int>? metadataKey;
+
+  /// Key encrypting cached media files (see `CacheCipher`)
+  final List<int>? cacheKey;
+
+  /// Key signing proxy URLs; kept in the cache directory when null
+  final List<int>? signingKey;
+
+  /// OS keychain (or app keystore) for the keys above and per-host
+  /// credentials: keys not given are read from it, and the signing key
+  /// is kept there instead of in the cache directory
+  final SecretStore? secrets;
+
+  final bool resumeDownloads;
+  final bool journal;
+
+  /// LRU eviction above a disk budget
+  final CacheQuotaConfig? cacheQuota;
+
+  /// How far ahead of the player to prefetch
+  final ReadAheadConfig? readAhead;
+
+  /// Time limits on player and API connections
+  final RequestDeadlines deadlines;
+
+  final LogSink? logSink;
+  final LogLevel? logLevel;
+
+  /// Bearer token required by the management API
+  final String? apiToken;
+
+  /// Who may use the proxy; only apps on this device when null
+  final AccessPolicy? access;
+
+  /// Take over the port from a running proxy (see `handOff`)
+  final bool takeOver;
+  final Duration handoffTimeout;
+
+  ProxyOptions({
+    InternetAddress? address,
+    this.port = 8080,
+    this.socket,
+    this.storageDir,
+    this.tls,
+    this.tlsCertificate,
+    this.tlsKey,
+    this.tlsKeyPassword,
+    this.userAgent,
+    this.proxyConfig,
+    this.clientConfig = const ClientConfig(),
+    this.httpClient,
+    this.requestHeaders = const {},
+    this.forwardHeaders = const [],
+    this.passThroughHeaders = const [],
+    this.requestDecorator,
+    this.bodyDigest = false,
+    this.metadataKey,
+    this.cacheKey,
+    this.signingKey,
+    this.secrets,
+    this.resumeDownloads = true,
+    this.journal = true,
+    this.cacheQuota,
+    this.readAhead,
+    this.deadlines = const RequestDeadlines(),
+    this.logSink,
+    this.logLevel,
+    this.apiToken,
+    this.access,
+    this.takeOver = false,
+    this.handoffTimeout = const Duration(seconds: 30),
+  }) : address = address ?? InternetAddress.loopbackIPv4;
+
+  /// Whether the proxy can be reached from other devices
+  bool get isExposed => !(socket?.address ?? address).isLoopback;
+
+  /// Whether the proxy serves `https`
+  bool get isSecure => tls != null || tlsCertificate != null;
+
+  /// [tls], or a context loaded from [tlsCertificate] and [tlsKey]; null
+  /// for plain `http`
+  SecurityContext? get securityContext {
+    if (tls != null || tlsCertificate == null) return tls;
+    return SecurityContext()
+      ..useCertificateChain(tlsCertificate!)
+      ..usePrivateKey(tlsKey!, password: tlsKeyPassword);
+  }
+
+  /// What is wrong with these options; empty when they can be used
+  List<String> problems() {
+    final problems = <String>[];
+    if (port < 0 || port > 65535) {
+      problems.add('port must be between 0 and 65535, got $port');
+    }
+    if ((tlsCertificate == null) != (tlsKey == null)) {
+      problems.add('tlsCertificate and tlsKey must be given together');
+    }
+    if (tls != null && tlsCertificate != null) {
+      problems.add('give either tls or tlsCertificate, not both');
+    }
+    for (final path in [tlsCertificate, tlsKey]) {
+      if (path != null && !File(path).existsSync()) {
+        problems.add('no TLS file at $path');
+      }
+    }
+    if (socket != null && isSecure) {
+      problems.add(
+        'TLS cannot be added to a provided socket; bind it with tls instead',
+      );
+    }
+    if (takeOver && (port == 0 || socket != null)) {
+      problems.add('takeOver needs a fixed port to take over');
+    }
+    if (storageDir != null && storageDir!.trim().isEmpty) {
+      problems.add('storageDir must not be empty');
+    }
+    if (metadataKey case final key? when key.isEmpty) {
+      problems.add('metadataKey must not be empty');
+    }
+    if (cacheKey case final key? when key.isEmpty) {
+      problems.add('cacheKey must not be empty');
+    }
+    if (signingKey case final key? when key.isEmpty) {
+      problems.add('signingKey must not be empty');
+    }
+    if (apiToken case final token? when token.length < 16) {
+      problems.add('apiToken must be at least 16 characters');
+    }
+    if (isExposed && apiToken == null) {
+      problems.add(
+        'listening on ${address.address} needs an apiToken, or anyone on '
+        'the network controls the proxy',
+      );
+    }
+    if (isExposed && (access?.isLoopbackOnly ?? true)) {
+      problems.add(
+        'listening on ${address.address} but access allows only loopback; '
+        'name the networks to serve in access.allow',
+      );
+    }
+    if (access?.key case final key? when key.length < 16) {
+      problems.add('access.key must be at least 16 characters');
+    }
+    if (cacheQuota case final quota?) {
+      if (quota.maxBytes <= 0) {
+        problems.add('cacheQuota.maxBytes must be positive');
+      }
+      if (quota.checkInterval <= Duration.zero) {
+        problems.add('cacheQuota.checkInterval must be positive');
+      }
+    }
+    if (readAhead case final config?
+        when config.window <= 0 ||
+            config.concurrency <= 0 ||
+            config.pieceSize <= 0) {
+      problems.add('readAhead window, concurrency and pieceSize must be > 0');
+    }
+    if (deadlines.writeIdle <= Duration.zero ||
+        (deadlines.maxDuration ?? deadlines.writeIdle) <= Duration.zero) {
+      problems.add('deadlines must be positive');
+    }
+    if (takeOver && handoffTimeout <= Duration.zero) {
+      problems.add('handoffTimeout must be positive');
+    }
+    if (clientConfig.connectTimeout <= Duration.zero ||
+        clientConfig.responseHeaderTimeout <= Duration.zero ||
+        clientConfig.readTimeout <= Duration.zero) {
+      problems.add('clientConfig timeouts must be positive');
+    }
+    try {
+      clientConfig.proxy;
+    } on ArgumentError catch (e) {
+      problems.add('clientConfig.proxyUrl: ${e.message}');
+    }
+    final token = RegExp(r"^[!#$%&'*+.^_`|~0-9A-Za-z-]+$");
+    for (final name in [
+      ...requestHeaders.keys,
+      ...forwardHeaders,
+      ...passThroughHeaders,
+    ]) {
+      if (!token.hasMatch(name)) problems.add('invalid header name "$name"');
+    }
+    return problems;
+  }
+
+  /// Throw an [ArgumentError] naming every problem (see [problems])
+  void validate() {
+    final found = problems();
+    if (found.isNotEmpty) {
+      throw ArgumentError('Invalid proxy options: ${found.join('; ')}');
+    }
+  }
+
+  ProxyOptions copyWith({
+    InternetAddress? address,
+    int? port,
+    ServerSocket? socket,
+    String? storageDir,
+    SecurityContext? tls,
+    ClientConfig? clientConfig,
+    HttpClient? httpClient,
+    CacheQuotaConfig? cacheQuota,
+    ReadAheadConfig? readAhead,
+    RequestDeadlines? deadlines,
+    LogSink? logSink,
+    LogLevel? logLevel,
+    String? apiToken,
+    AccessPolicy? access,
+    bool? takeOver,
+  }) => ProxyOptions(
+    address: address ?? this.address,
+    port: port ?? this.port,
+    socket: socket ?? this.socket,
+    storageDir: storageDir ?? this.storageDir,
+    tls: tls ?? this.tls,
+    tlsCertificate: tlsCertificate,
+    tlsKey: tlsKey,
+    tlsKeyPassword: tlsKeyPassword,
+    userAgent: userAgent,
+    proxyConfig: proxyConfig,
+    clientConfig: clientConfig ?? this.clientConfig,
+    httpClient: httpClient ?? this.httpClient,
+    requestHeaders: requestHeaders,
+    forwardHeaders: forwardHeaders,
+    passThroughHeaders: passThroughHeaders,
+    requestDecorator: requestDecorator,
+    bodyDigest: bodyDigest,
+    metadataKey: metadataKey,
+    cacheKey: cacheKey,
+    signingKey: signingKey,
+    secrets: secrets,
+    resumeDownloads: resumeDownloads,
+    journal: journal,
+    cacheQuota: cacheQuota ?? this.cacheQuota,
+    readAhead: readAhead ?? this.readAhead,
+    deadlines: deadlines ?? this.deadlines,
+    logSink: logSink ?? this.logSink,
+    logLevel: logLevel ?? this.logLevel,
+    apiToken: apiToken ?? this.apiToken,
+    access: access ?? this.access,
+    takeOver: takeOver ?? this.takeOver,
+    handoffTimeout: handoffTimeout,
+  );
+}
@@ -0,0 +1,156 @@
+import 'dart:convert';
+import 'dart:math';
+
+/// A syntactically valid Range header with no satisfiable range; answer
+/// 416 with `Content-Range: bytes */<totalSize>`
+class RangeNotSatisfiableException implements Exception {
+  final int totalSize;
+
+  RangeNotSatisfiableException(this.totalSize);
+
+  @override
+  String toString() => 'RangeNotSatisfiableException: size $totalSize';
+}
+
+/// `Range` request header parsing (RFC 7233)
+class RangeHeader {
+  /// Ranges beyond this count are refused as abusive (served whole)
+  static const int maxRanges = 64;
+
+  /// Byte ranges requested by [header] for a body of [totalSize] bytes,
+  /// sorted with overlapping and adjacent ranges merged
+  ///
+  /// Supports `a-b`, open-ended `a-` and suffix `-n` ranges, and lists of
+  /// them. Returns null when the body should be served whole with 200:
+  /// no header, another unit, or invalid syntax. Throws
+  /// [RangeNotSatisfiableException] when no range overlaps the body.
+  static List<(int, int)>? parse(String? header, int totalSize) {
+    if (header == null) return null;
+    final eq = header.indexOf('=');
+    if (eq < 0 || header.substring(0, eq).trim().toLowerCase() != 'bytes') {
+      return null;
+    }
+
+    final ranges = <(int, int)>[];
+    var specs = 0;
+    for (final raw in header.substring(eq + 1).split(',')) {
+      final spec = raw.trim();
+      if (spec.isEmpty) continue;
+      if (++specs > maxRanges) return null;
+
+      final dash = spec.indexOf('-');
+      if (dash < 0) return null;
+      final first = spec.substring(0, dash).trim();
+      final last = spec.substring(dash + 1).trim();
+
+      if (first.isEmpty) {
+        // Suffix: the final N bytes
+        final length = int.tryParse(last);
+        if (length == null || length < 0) return null;
+        if (length > 0 && totalSize > 0) {
+          ranges.add((max(0, totalSize - length), totalSize - 1));
+        }
+        continue;
+      }
+
+      final start = int.tryParse(first);
+      final end = last.isEmpty ? totalSize - 1 : int.tryParse(last);
+      if (start == null || start < 0 || end == null) return null;
+      if (last.isNotEmpty && end < start) return null;
+      if (start < totalSize) ranges.add((start, min(end, totalSize - 1)));
+    }
+    if (specs == 0) return null;
+    if (ranges.isEmpty) throw RangeNotSatisfiableException(totalSize);
+
+    ranges.sort((a, b) => a.$1.compareTo(b.$1));
+    final merged = [ranges.first];
+    for (final (start, end) in ranges.skip(1)) {
+      final (lastStart, lastEnd) = merged.last;
+      if (start <= lastEnd + 1) {
+        merged.last = (lastStart, max(end, lastEnd));
+      } else {
+        merged.add((start, end));
+      }
+    }
+    return merged;
+  }
+}
+
+/// A `Content-Range: bytes START-END/TOTAL` request header, naming where
+/// uploaded bytes go
+class ContentRange {
+  final int start;
+  final int end;
+
+  /// Size of the whole file; null for `*`
+  final int? total;
+
+  const ContentRange(this.start, this.end, [this.total]);
+
+  /// [header] parsed; null when malformed
+  ///
+  /// Malformed is anything but `bytes START-END/TOTAL` (or `/*`), numbers
+  /// too large for an int, and END before START or at or past TOTAL:
+  /// answer 400. A range the file's actual size cannot hold is the
+  /// caller's to answer 416.
+  static ContentRange? parse(String? header) {
+    final match = RegExp(
+      r'^bytes (\d+)-(\d+)/(\d+|\*)$',
+    ).firstMatch(header?.trim() ?? '');
+    if (match == null) return null;
+    final start = int.tryParse(match.group(1)!);
+    final end = int.tryParse(match.group(2)!);
+    final total = int.tryParse(match.group(3)!);
+    if (start == null || end == null || end < start) return null;
+    if (match.group(3) != '*' && (total == null || end >= total)) {
+      return null;
+    }
+    return ContentRange(start, end, total);
+  }
+
+  @override
+  String toString() => 'bytes $start-$end/${total ?? '*'}';
+}
+
+/// Framing of a `multipart/byteranges` response body
+class MultipartByteRanges {
+  final List<(int, int)> ranges;
+  final int totalSize;
+
+  /// Content type of each part
+  final String contentType;
+
+  final String boundary;
+
+  MultipartByteRanges(
+    this.ranges,
+    this.totalSize,
+    this.contentType,
+    this.boundary,
+  );
+
+  /// Value for the response's Content-Type header
+  String get mediaType => 'multipart/byteranges; boundary=$boundary';
+
+  /// Boundary and headers sent before part [index]
+  List<int> partHeader(int index) {
+    final (start, end) = ranges[index];
+    return utf8.encode(
+      '${index == 0 ? '' : '\r\n'}--$boundary\r\n'
+      'Content-Type: $contentType\r\n'
+      'Content-Range: bytes $start-$end/$totalSize\r\n\r\n',
+    );
+  }
+
+  /// Closing boundary sent after the last part
+  List<int> get trailer => utf8.encode('\r\n--$boundary--\r\n');
+
+  /// Exact body length, for the Content-Length header
+  int get contentLength {
+    int length = trailer.length;
+    for (int i = 0; i < ranges.length; i++) {
+      length += partHeader(i).length + ranges[i].$2 - ranges[i].$1 + 1;
+    }
+    return length;
+  }
+}
@@ -0,0 +1,142 @@
+import 'dart:math';
+
+/// Byte ranges kept sorted and merged
+///
+/// Ranges are inclusive (`start..end`). Adjacent and overlapping ranges
+/// are merged on insertion, so lookups are binary searches and gap queries
+/// only visit the ranges they return: with thousands of fragments (small
+/// prefetches scattered over a file) no operation sorts or scans them all.
+class RangeSet {
+  // Sorted by start, disjoint and non-adjacent
+  final List<int> _starts = [];
+  final List<int> _ends = [];
+  int _covered = 0;
+
+  RangeSet();
+
+  /// Ranges as (start, end) records, e.g. loaded from disk; they need not
+  /// be sorted or merged
+  RangeSet.of(Iterable<(int, int)> ranges) {
+    for (final (start, end) in ranges) {
+      add(start, end);
+    }
+  }
+
+  /// Number of separate ranges
+  int get length => _starts.length;
+
+  bool get isEmpty => _starts.isEmpty;
+
+  /// Bytes covered by all ranges
+  int get coveredBytes => _covered;
+
+  /// First covered byte; null when empty
+  int? get first => _starts.isEmpty ? null : _starts.first;
+
+  /// Last covered byte; null when empty
+  int? get last => _ends.isEmpty ? null : _ends.last;
+
+  /// All ranges in order
+  List<(int, int)> get ranges => [
+    for (int i = 0; i < _starts.length; i++) (_starts[i], _ends[i]),
+  ];
+
+  /// Index of the first range ending at or after [position]
+  int _firstEndingFrom(int position) {
+    var low = 0;
+    var high = _ends.length;
+    while (low < high) {
+      final mid = (low + high) >> 1;
+      if (_ends[mid] < position) {
+        low = mid + 1;
+      } else {
+        high = mid;
+      }
+    }
+    return low;
+  }
+
+  /// Cover [start]..[end], merging with what it touches
+  void add(int start, int end) {
+    if (end < start) return;
+    // Ranges ending right before start are adjacent and merge too
+    final from = _firstEndingFrom(start - 1);
+    var to = from;
+    var mergedStart = start;
+    var mergedEnd = end;
+    while (to < _starts.length && _starts[to] <= end + 1) {
+      mergedStart = min(mergedStart, _starts[to]);
+      mergedEnd = max(mergedEnd, _ends[to]);
+      _covered -= _ends[to] - _starts[to] + 1;
+      to++;
+    }
+    _starts.replaceRange(from, to, [mergedStart]);
+    _ends.replaceRange(from, to, [mergedEnd]);
+    _covered += mergedEnd - mergedStart + 1;
+  }
+
+  /// Uncover [start]..[end], splitting ranges that reach past it
+  void remove(int start, int end) {
+    if (end < start) return;
+    final from = _firstEndingFrom(start);
+    var to = from;
+    final keptStarts = <int>[];
+    final keptEnds = <int>[];
+    while (to < _starts.length && _starts[to] <= end) {
+      final (rangeStart, rangeEnd) = (_starts[to], _ends[to]);
+      _covered -= rangeEnd - rangeStart + 1;
+      if (rangeStart < start) {
+        keptStarts.add(rangeStart);
+        keptEnds.add(start - 1);
+        _covered += start - rangeStart;
+      }
+      if (rangeEnd > end) {
+        keptStarts.add(end + 1);
+        keptEnds.add(rangeEnd);
+        _covered += rangeEnd - end;
+      }
+      to++;
+    }
+    _starts.replaceRange(from, to, keptStarts);
+    _ends.replaceRange(from, to, keptEnds);
+  }
+
+  /// Whether every byte of [start]..[end] is covered
+  bool contains(int start, int end) {
+    final i = _firstEndingFrom(end);
+    return i < _starts.length && _starts[i] <= start;
+  }
+
+  /// Uncovered sub-ranges of [start]..[end], in order
+  List<(int, int)> gaps(int start, int end) {
+    final gaps = <(int, int)>[];
+    var pos = start;
+    for (int i = _firstEndingFrom(start); i < _starts.length; i++) {
+      if (_starts[i] > end) break;
+      if (_starts[i] > pos) gaps.add((pos, _starts[i] - 1));
+      pos = _ends[i] + 1;
+    }
+    if (pos <= end) gaps.add((pos, end));
+    return gaps;
+  }
+
+  /// Bytes of [start]..[end] that are covered
+  int coveredIn(int start, int end) {
+    var covered = 0;
+    for (int i = _firstEndingFrom(start); i < _starts.length; i++) {
+      if (_starts[i] > end) break;
+      covered += min(_ends[i], end) - max(_starts[i], start) + 1;
+    }
+    return covered;
+  }
+
+  /// First covered byte at or after [position]; null when there is none
+  int? nextCovered(int position) {
+    final i = _firstEndingFrom(position);
+    return i < _starts.length ? max(_starts[i], position) : null;
+  }
+
+  @override
+  String toString() =>
+      'RangeSet(${ranges.map((r) => '${r.$1}-${r.$2}').join(', ')})';
+}
@@ -0,0 +1,103 @@
+import 'range_set.dart';
+
+/// Which host supplied each cached range of a file, and how often each
+/// host's bytes turned out corrupt
+///
+/// A file fetched through mirrors may be stitched from several of them;
+/// when one mirror intermittently serves bad data this tells which, and
+/// [rank] steers later fetches of the file away from it. Bytes written
+/// without a known source (uploads, imports) are simply unattributed.
+class RangeSources {
+  final Map<String, RangeSet> _byHost = {};
+  final Map<String, int> _failures = {};
+
+  RangeSources();
+
+  /// Hosts that supplied cached bytes
+  Iterable<String> get hosts => _byHost.keys;
+
+  /// Corrupt ranges found per host
+  Map<String, int> get failures => Map.unmodifiable(_failures);
+
+  /// Cached bytes each host supplied
+  Map<String, int> get bytesByHost => {
+    for (final MapEntry(:key, :value) in _byHost.entries)
+      key: value.coveredBytes,
+  };
+
+  /// Attributed ranges in order, as (start, end, host)
+  List<(int, int, String)> get ranges => [
+    for (final MapEntry(key: host, value: set) in _byHost.entries)
+      for (final (start, end) in set.ranges) (start, end, host),
+  ]..sort((a, b) => a.$1.compareTo(b.$1));
+
+  /// Record that [host] supplied [start]..[end], replacing whatever
+  /// supplied those bytes before
+  void record(int start, int end, String host) {
+    if (end < start) return;
+    for (final MapEntry(key: other, value: set) in _byHost.entries) {
+      if (other != host) set.remove(start, end);
+    }
+    _byHost.putIfAbsent(host, RangeSet.new).add(start, end);
+    _byHost.removeWhere((_, set) => set.isEmpty);
+  }
+
+  /// Forget who supplied [start]..[end]
+  void remove(int start, int end) {
+    for (final set in _byHost.values) {
+      set.remove(start, end);
+    }
+    _byHost.removeWhere((_, set) => set.isEmpty);
+  }
+
+  /// Blame the hosts that supplied [start]..[end] for corrupt bytes and
+  /// forget the range; returns the hosts blamed
+  Set<String> corrupt(int start, int end) {
+    final blamed = {
+      for (final MapEntry(:key, :value) in _byHost.entries)
+        if (value.coveredIn(start, end) > 0) key,
+    };
+    for (final host in blamed) {
+      _failures[host] = (_failures[host] ?? 0) + 1;
+    }
+    remove(start, end);
+    return blamed;
+  }
+
+  /// [hosts] with the fewest corrupt ranges first; ties keep their order
+  List<String> rank(List<String> hosts) {
+    if (_failures.isEmpty) return hosts;
+    final order = [for (int i = 0; i < hosts.length; i++) i];
+    order.sort((a, b) {
+      final byFailures = (_failures[hosts[a]] ?? 0).compareTo(
+        _failures[hosts[b]] ?? 0,
+      );
+      return byFailures != 0 ? byFailures : a.compareTo(b);
+    });
+    return [for (final i in order) hosts[i]];
+  }
+
+  Map<String, dynamic> toJson() => {
+    'hosts': {
+      for (final MapEntry(:key, :value) in _byHost.entries)
+        key: [
+          for (final (start, end) in value.ranges) [start, end],
+        ],
+    },
+    'failures': _failures,
+  };
+
+  factory RangeSources.fromJson(Map<String, dynamic> json) {
+    final sources = RangeSources();
+    final hosts = json['hosts'] as Map<String, dynamic>? ?? const {};
+    hosts.forEach((host, ranges) {
+      sources._byHost[host] = RangeSet.of([
+        for (final range in ranges as List)
+          ((range as List)[0] as int, range[1] as int),
+      ]);
+    });
+    final failures = json['failures'] as Map<String, dynamic>? ?? const {};
+    failures.forEach((host, count) => sources._failures[host] = count as int);
+    return sources;
+  }
+}
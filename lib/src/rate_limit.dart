@@ -0,0 +1,79 @@
+/// Caps on transfer rates, in bytes per second; null is unlimited
+class BandwidthLimits {
+  /// Every upstream fetch together: player requests, downloads, prefetch
+  final int? upstream;
+
+  /// Each background download (prefetch and read-ahead included)
+  final int? perDownload;
+
+  /// What each client is served, cached bytes included; clients are told
+  /// apart as for fair scheduling
+  final int? perClient;
+
+  const BandwidthLimits({this.upstream, this.perDownload, this.perClient});
+
+  static const unlimited = BandwidthLimits();
+
+  Map<String, dynamic> toJson() => {
+    'upstream': upstream,
+    'perDownload': perDownload,
+    'perClient': perClient,
+  };
+
+  /// Throws a [FormatException] unless every limit is null or a positive
+  /// integer
+  factory BandwidthLimits.fromJson(Map<String, dynamic> json) {
+    int? limit(String key) {
+      final value = json[key];
+      if (value == null) return null;
+      if (value is! int || value <= 0) {
+        throw FormatException('Invalid $key limit: $value');
+      }
+      return value;
+    }
+
+    return BandwidthLimits(
+      upstream: limit('upstream'),
+      perDownload: limit('perDownload'),
+      perClient: limit('perClient'),
+    );
+  }
+
+  @override
+  String toString() =>
+      'BandwidthLimits(upstream: $upstream, perDownload: $perDownload, '
+      'perClient: $perClient)';
+}
+
+/// Paces a transfer to [bytesPerSecond]
+///
+/// Callers report each chunk with [take] and pause for the returned
+/// delay. Time spent idle earns no credit, so a transfer resuming after a
+/// pause does not burst above the rate.
+class RateLimiter {
+  /// The rate; null lets everything through. May change at any time.
+  int? bytesPerSecond;
+
+  final Stopwatch _clock = Stopwatch()..start();
+
+  // When the next byte may be moved
+  Duration _next = Duration.zero;
+
+  RateLimiter([this.bytesPerSecond]);
+
+  /// Whether nothing was moved recently enough to still be paid for
+  bool get idle => _next <= _clock.elapsed;
+
+  /// Account for [bytes] just moved and return how long to pause
+  Duration take(int bytes) {
+    final now = _clock.elapsed;
+    final rate = bytesPerSecond;
+    if (rate == null) {
+      _next = now;
+      return Duration.zero;
+    }
+    final from = _next > now ? _next : now;
+    _next = from + Duration(microseconds: bytes * 1000000 ~/ rate);
+    return _next - now;
+  }
+}
@@ -0,0 +1,59 @@
+/// Settings for background transfer-rate shaping
+class RateShapingConfig {
+  /// Download speed as a multiple of the media bitrate
+  final double factor;
+
+  /// Media time buffered ahead of the playhead below which fetching is not
+  /// throttled
+  final Duration safeBuffer;
+
+  /// A file counts as playing while player requests arrive this often
+  final Duration playbackIdle;
+
+  const RateShapingConfig({
+    this.factor = 1.5,
+    this.safeBuffer = const Duration(seconds: 30),
+    this.playbackIdle = const Duration(seconds: 15),
+  });
+}
+
+/// Paces one background download to [RateShapingConfig.factor] times
+/// real-time once the buffer ahead of the playhead is safe
+class RateShaper {
+  final RateShapingConfig config;
+
+  /// Media bitrate in bytes per second
+  final int bytesPerSecond;
+
+  final Stopwatch _clock = Stopwatch();
+  int _bytes = 0;
+
+  RateShaper(this.config, this.bytesPerSecond);
+
+  int get _safeBufferBytes =>
+      config.safeBuffer.inMicroseconds * bytesPerSecond ~/ 1000000;
+
+  /// Account for [bytes] just fetched and return how long to pause
+  ///
+  /// [bufferedAhead] is the media buffered ahead of the playhead, or null
+  /// when the fetch is not ahead of it.
+  Duration add(int bytes, {int? bufferedAhead}) {
+    if (bufferedAhead != null && bufferedAhead < _safeBufferBytes) {
+      // Buffer is short: burst and start pacing afresh once it is safe
+      _clock
+        ..stop()
+        ..reset();
+      _bytes = 0;
+      return Duration.zero;
+    }
+
+    _clock.start();
+    _bytes += bytes;
+    final due = Duration(
+      microseconds: (_bytes * 1000000 / (bytesPerSecond * config.factor))
+          .round(),
+    );
+    final wait = due - _clock.elapsed;
+    return wait.isNegative ? Duration.zero : wait;
+  }
+}
@@ -0,0 +1,41 @@
+import 'dart:math';
+
+import 'download_meta.dart';
+
+/// Settings for caching ahead of the playback position
+class ReadAheadConfig {
+  /// Bytes kept cached ahead of the last byte served
+  final int window;
+
+  /// Upstream requests per file at once
+  final int concurrency;
+
+  /// Speed cap in bytes per second; null means unlimited
+  final int? maxBytesPerSecond;
+
+  /// Read-ahead pauses once the player has been quiet this long
+  final Duration idleTimeout;
+
+  /// Size of each upstream request
+  final int pieceSize;
+
+  const ReadAheadConfig({
+    this.window = 16 * 1024 * 1024,
+    this.concurrency = 2,
+    this.maxBytesPerSecond,
+    this.idleTimeout = const Duration(seconds: 15),
+    this.pieceSize = 1024 * 1024,
+  });
+
+  /// Missing pieces of the window after [playhead], nearest first
+  List<(int, int)> pieces(DownloadMeta meta, int playhead) {
+    final start = playhead + 1;
+    final end = min(playhead + window, meta.totalSize - 1);
+    if (start > end) return const [];
+    return [
+      for (final (gapStart, gapEnd) in meta.getGapsIn(start, end))
+        for (int pos = gapStart; pos <= gapEnd; pos += pieceSize)
+          (pos, min(pos + pieceSize - 1, gapEnd)),
+    ];
+  }
+}
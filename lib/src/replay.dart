@@ -0,0 +1,388 @@
+import 'dart:async';
+import 'dart:collection';
+import 'dart:convert';
+import 'dart:io';
+
+import 'simulation.dart';
+import 'url_signing.dart';
+
+/// One player request as the proxy received it
+class RecordedRequest {
+  /// Time since the first recorded request
+  final Duration at;
+  final String url;
+
+  /// Device it came from (see `FairnessConfig`); requests of one client
+  /// are replayed one after the other
+  final String client;
+  final int start;
+  final int end;
+
+  /// How long the player kept the response open; null when unknown, and
+  /// the whole range is read on replay
+  Duration? held;
+
+  RecordedRequest(
+    this.at,
+    this.url,
+    this.start,
+    this.end, {
+    this.client = 'player',
+    this.held,
+  });
+
+  Map<String, dynamic> toJson() => {
+    'atMs': at.inMilliseconds,
+    'url': url,
+    'client': client,
+    'start': start,
+    'end': end,
+    if (held != null) 'heldMs': held!.inMilliseconds,
+  };
+
+  factory RecordedRequest.fromJson(Map<String, dynamic> json) =>
+      RecordedRequest(
+        Duration(milliseconds: json['atMs'] as int? ?? 0),
+        json['url'] as String,
+        json['start'] as int,
+        json['end'] as int,
+        client: json['client'] as String? ?? 'player',
+        held: json['heldMs'] == null
+            ? null
+            : Duration(milliseconds: json['heldMs'] as int),
+      );
+
+  /// Parse a request log: JSON lines as [RequestLog.toLog] writes them,
+  /// or the access log of [SimulatedRequest.parseLog], replayed back to
+  /// back by one client
+  static List<RecordedRequest> parseLog(String log) {
+    final lines = const LineSplitter()
+        .convert(log)
+        .map((line) => line.trim())
+        .where((line) => line.isNotEmpty && !line.startsWith('#'));
+    if (lines.every((line) => line.contains('"atMs"'))) {
+      return [
+        for (final line in lines)
+          RecordedRequest.fromJson(jsonDecode(line) as Map<String, dynamic>),
+      ];
+    }
+    return [
+      for (final request in SimulatedRequest.parseLog(log))
+        RecordedRequest(
+          Duration.zero,
+          request.url,
+          request.start,
+          request.end,
+        ),
+    ];
+  }
+}
+
+/// The last [capacity] player requests, for replaying them later
+class RequestLog {
+  final int capacity;
+  final Queue<RecordedRequest> _requests = Queue();
+  DateTime? _first;
+
+  RequestLog({this.capacity = 10000});
+
+  List<RecordedRequest> get requests => List.unmodifiable(_requests);
+
+  /// Record a request for [start]..[end] of [url]; set its
+  /// [RecordedRequest.held] once the response is done
+  RecordedRequest record(
+    String url,
+    int start,
+    int end, {
+    String client = 'player',
+    DateTime? now,
+  }) {
+    final time = now ?? DateTime.now();
+    final request = RecordedRequest(
+      time.difference(_first ??= time),
+      url,
+      start,
+      end,
+      client: client,
+    );
+    _requests.add(request);
+    while (_requests.length > capacity) {
+      _requests.removeFirst();
+    }
+    return request;
+  }
+
+  /// One JSON object per line, oldest first
+  String toLog() => [
+    for (final request in _requests) '${jsonEncode(request.toJson())}\n',
+  ].join();
+}
+
+/// Settings for a [RequestReplayer] run
+class ReplayConfig {
+  /// Base URL of the running proxy, e.g. `http://127.0.0.1:8080`
+  final Uri proxy;
+
+  /// Signs the stream URLs with the proxy's key; null sends raw `?url=`,
+  /// which the proxy only takes with `allowUnsignedUrls`
+  final UrlSigner? signer;
+
+  /// Proxy URL of each request instead of one built from [proxy] and
+  /// [signer]
+  final Uri Function(String url, String client)? streamUrl;
+
+  /// Wait for each request's recorded time, divided by [speed]; false
+  /// sends each client's requests back to back
+  final bool keepTiming;
+  final double speed;
+
+  /// Requests waiting longer than this for their first byte are stalls
+  final Duration stallThreshold;
+
+  const ReplayConfig({
+    required this.proxy,
+    this.signer,
+    this.streamUrl,
+    this.keepTiming = true,
+    this.speed = 1,
+    this.stallThreshold = const Duration(seconds: 1),
+  });
+}
+
+/// How one replayed request went
+class ReplayResult {
+  final RecordedRequest request;
+
+  /// Response status; null when the request failed
+  final int? status;
+  final String? error;
+  final int bytes;
+
+  /// Time to the response headers, to the first byte and to the end
+  final Duration headers;
+  final Duration? firstByte;
+  final Duration elapsed;
+
+  /// Sent late: the client was still busy with its previous request
+  final Duration lag;
+
+  const ReplayResult(
+    this.request, {
+    this.status,
+    this.error,
+    this.bytes = 0,
+    this.headers = Duration.zero,
+    this.firstByte,
+    this.elapsed = Duration.zero,
+    this.lag = Duration.zero,
+  });
+
+  Map<String, dynamic> toJson() => {
+    ...request.toJson(),
+    if (status != null) 'status': status,
+    if (error != null) 'error': error,
+    'bytes': bytes,
+    'headersMs': headers.inMicroseconds / 1000,
+    if (firstByte != null) 'firstByteMs': firstByte!.inMicroseconds / 1000,
+    'elapsedMs': elapsed.inMicroseconds / 1000,
+    'lagMs': lag.inMilliseconds,
+  };
+}
+
+/// Outcome of a [RequestReplayer] run, in the order of the log
+class ReplayReport {
+  final List<ReplayResult> results;
+  final Duration stallThreshold;
+  final Duration elapsed;
+
+  const ReplayReport(this.results, this.stallThreshold, this.elapsed);
+
+  int get errors => results.where((r) => r.error != null).length;
+
+  /// Requests whose first byte took longer than the stall threshold
+  List<ReplayResult> get stalls => [
+    for (final result in results)
+      if (result.error == null &&
+          (result.firstByte ?? result.elapsed) > stallThreshold)
+        result,
+  ];
+
+  /// Time to first byte at [percentile] (0-100)
+  Duration ttfb(double percentile) {
+    final times = [
+      for (final result in results)
+        if (result.firstByte != null) result.firstByte!,
+    ]..sort();
+    if (times.isEmpty) return Duration.zero;
+    return times[((times.length - 1) * percentile / 100).round()];
+  }
+
+  /// The [count] requests slowest to their first byte, slowest first
+  List<ReplayResult> slowest([int count = 10]) {
+    final sorted = [
+      for (final result in results)
+        if (result.error == null) result,
+    ];
+    Duration wait(ReplayResult r) => r.firstByte ?? r.elapsed;
+    sorted.sort((a, b) => wait(b).compareTo(wait(a)));
+    return sorted.take(count).toList();
+  }
+
+  Map<String, dynamic> toJson() => {
+    'requests': results.length,
+    'errors': errors,
+    'stalls': stalls.length,
+    'elapsedMs': elapsed.inMilliseconds,
+    'ttfbP50Ms': ttfb(50).inMicroseconds / 1000,
+    'ttfbP99Ms': ttfb(99).inMicroseconds / 1000,
+    'results': [for (final result in results) result.toJson()],
+  };
+
+  @override
+  String toString() {
+    final text = StringBuffer(
+      'ReplayReport(requests: ${results.length}, errors: $errors, '
+      'stalls: ${stalls.length}, ttfb p50: ${ttfb(50).inMilliseconds} ms, '
+      'p99: ${ttfb(99).inMilliseconds} ms, '
+      'elapsed: ${elapsed.inMilliseconds} ms)',
+    );
+    for (final result in slowest(5)) {
+      final request = result.request;
+      text.write(
+        '\n  ${(result.firstByte ?? result.elapsed).inMilliseconds} ms  '
+        '+${request.at.inMilliseconds} ms ${request.client} '
+        '${request.start}-${request.end} ${request.url}',
+      );
+    }
+    return '$text';
+  }
+}
+
+/// Sends a recorded sequence of player requests to a proxy again, to
+/// reproduce a stall a user reported against the cache as it is now
+///
+/// Each client's requests go one after the other, in their recorded
+/// order, at their recorded times (see [ReplayConfig.keepTiming]);
+/// clients run side by side. A request is read for as long as the player
+/// held it, or whole when that is unknown.
+class RequestReplayer {
+  final ReplayConfig config;
+
+  RequestReplayer(this.config);
+
+  Future<ReplayReport> run(List<RecordedRequest> requests) async {
+    final results = List<ReplayResult?>.filled(requests.length, null);
+    final byClient = <String, List<int>>{};
+    for (int i = 0; i < requests.length; i++) {
+      byClient.putIfAbsent(requests[i].client, () => []).add(i);
+    }
+    final client = HttpClient();
+    final clock = Stopwatch()..start();
+    try {
+      await Future.wait([
+        for (final indexes in byClient.values)
+          () async {
+            for (final i in indexes) {
+              results[i] = await _replay(client, requests[i], clock);
+            }
+          }(),
+      ]);
+    } finally {
+      client.close(force: true);
+    }
+    return ReplayReport(
+      results.cast<ReplayResult>(),
+      config.stallThreshold,
+      clock.elapsed,
+    );
+  }
+
+  Uri _uriOf(RecordedRequest request) {
+    final client = 'replay-${request.client}';
+    final custom = config.streamUrl;
+    if (custom != null) return custom(request.url, client);
+    final signer = config.signer;
+    return config.proxy.replace(
+      path: signer == null ? '/stream' : '/stream/${signer.sign(request.url)}',
+      queryParameters: {
+        if (signer == null) 'url': request.url,
+        'client': client,
+      },
+    );
+  }
+
+  Future<ReplayResult> _replay(
+    HttpClient client,
+    RecordedRequest request,
+    Stopwatch clock,
+  ) async {
+    var lag = Duration.zero;
+    if (config.keepTiming) {
+      final due = request.at * (1 / config.speed);
+      final wait = due - clock.elapsed;
+      if (wait > Duration.zero) {
+        await Future<void>.delayed(wait);
+      } else {
+        lag = -wait;
+      }
+    }
+
+    final held = request.held == null
+        ? null
+        : request.held! * (1 / config.speed);
+    final stopwatch = Stopwatch()..start();
+    var headers = Duration.zero;
+    Duration? firstByte;
+    var bytes = 0;
+    int? status;
+    Timer? leave;
+    try {
+      final httpRequest = await client.getUrl(_uriOf(request));
+      httpRequest.headers.set('Range', 'bytes=${request.start}-${request.end}');
+      final response = await httpRequest.close();
+      headers = stopwatch.elapsed;
+      status = response.statusCode;
+
+      final done = Completer<void>();
+      final subscription = response.listen(
+        (chunk) {
+          firstByte ??= stopwatch.elapsed;
+          bytes += chunk.length;
+        },
+        onError: done.completeError,
+        onDone: done.complete,
+        cancelOnError: true,
+      );
+      // Leave when the player did, however far the body got
+      if (held != null) {
+        leave = Timer(held - stopwatch.elapsed, () {
+          unawaited(subscription.cancel());
+          if (!done.isCompleted) done.complete();
+        });
+      }
+      await done.future;
+    } catch (e) {
+      return ReplayResult(
+        request,
+        status: status,
+        error: '$e',
+        bytes: bytes,
+        headers: headers,
+        firstByte: firstByte,
+        elapsed: stopwatch.elapsed,
+        lag: lag,
+      );
+    } finally {
+      leave?.cancel();
+    }
+    return ReplayResult(
+      request,
+      status: status,
+      bytes: bytes,
+      headers: headers,
+      firstByte: firstByte,
+      elapsed: stopwatch.elapsed,
+      lag: lag,
+    );
+  }
+}
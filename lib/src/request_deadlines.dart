@@ -0,0 +1,38 @@
+/// Time limits on player and API connections
+///
+/// A phone put to sleep mid-stream often leaves its connection open
+/// without reading from it; without limits each one holds a socket, an
+/// open file and buffered bytes until the OS gives up, hours later.
+/// Event streams (`/events`) are exempt: they are meant to stay open.
+class RequestDeadlines {
+  /// A response whose client accepts no data for this long is closed
+  ///
+  /// Also bounds how long a request may wait for its first byte. A
+  /// paused player that stopped reading is cut off too; players reopen
+  /// the stream with a `Range` when playback resumes.
+  final Duration writeIdle;
+
+  /// Longest any response may take, however steadily it is read; null
+  /// for no limit (a film streamed at playback pace takes hours)
+  final Duration? maxDuration;
+
+  const RequestDeadlines({
+    this.writeIdle = const Duration(minutes: 2),
+    this.maxDuration,
+  });
+
+  /// When a response begun at [startedAt] must next make progress by,
+  /// as a delay from [now]
+  Duration next(DateTime startedAt, DateTime now) {
+    final max = maxDuration;
+    if (max == null) return writeIdle;
+    final left = startedAt.add(max).difference(now);
+    if (left <= Duration.zero) return Duration.zero;
+    return left < writeIdle ? left : writeIdle;
+  }
+
+  Map<String, dynamic> toJson() => {
+    'writeIdleMs': writeIdle.inMilliseconds,
+    'maxDurationMs': maxDuration?.inMilliseconds,
+  };
+}
@@ -0,0 +1,43 @@
+import 'dart:math';
+
+/// When to retry an upstream body that failed mid-transfer
+///
+/// The n-th retry waits [initialDelay] * [multiplier]^(n-1), capped at
+/// [maxDelay], give or take [jitter] (a fraction) so that clients cut off
+/// together do not reconnect together. Attempts count from the last
+/// failure that made no progress: a body that keeps moving between
+/// hiccups is resumed for as long as it does.
+class RetryPolicy {
+  /// Reconnects after one failure before the error is passed on
+  final int maxAttempts;
+
+  final Duration initialDelay;
+  final Duration maxDelay;
+  final double multiplier;
+
+  /// Random spread of each delay, 0 to 1
+  final double jitter;
+
+  const RetryPolicy({
+    this.maxAttempts = 3,
+    this.initialDelay = const Duration(milliseconds: 500),
+    this.maxDelay = const Duration(seconds: 10),
+    this.multiplier = 2,
+    this.jitter = 0.2,
+  });
+
+  /// Never retry
+  static const none = RetryPolicy(maxAttempts: 0);
+
+  /// Delay before retry [attempt] (1-based)
+  Duration delayFor(int attempt, [Random? random]) {
+    final base = min(
+      initialDelay.inMicroseconds * pow(multiplier, attempt - 1),
+      maxDelay.inMicroseconds.toDouble(),
+    );
+    final spread = jitter * (2 * (random ?? _random).nextDouble() - 1);
+    return Duration(microseconds: (base * (1 + spread)).round());
+  }
+
+  static final _random = Random();
+}
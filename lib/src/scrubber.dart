@@ -0,0 +1,95 @@
+import 'dart:io';
+import 'dart:math';
+
+import 'package:crypto/crypto.dart';
+
+import 'download_meta.dart';
+
+/// Settings for the background integrity scrubber
+class ScrubberConfig {
+  /// How often the scrubber wakes up
+  final Duration interval;
+
+  /// Time without player requests before scrubbing runs
+  final Duration idleAfter;
+
+  /// Bytes verified per wake-up, to stay low priority
+  final int bytesPerRun;
+
+  const ScrubberConfig({
+    this.interval = const Duration(minutes: 1),
+    this.idleAfter = const Duration(seconds: 30),
+    this.bytesPerRun = 64 * 1024 * 1024,
+  });
+}
+
+/// Outcome of a scrub pass
+class ScrubReport {
+  int blocksVerified = 0;
+  int blocksRecorded = 0;
+
+  /// Corrupt byte ranges by file ID
+  final Map<String, List<(int, int)>> corrupt = {};
+
+  Map<String, Object> toJson() => {
+    'blocksVerified': blocksVerified,
+    'blocksRecorded': blocksRecorded,
+    'corrupt': corrupt.map(
+      (id, ranges) => MapEntry(id, [for (final (s, e) in ranges) '$s-$e']),
+    ),
+  };
+}
+
+/// Verifies cached blocks against checksums stored in [DownloadMeta]
+///
+/// A fully cached block without a checksum is hashed and recorded the
+/// first time it is scrubbed; later passes compare against that record.
+class Scrubber {
+  static const int blockSize = 1024 * 1024;
+
+  /// Checksum of one block
+  static String checksum(List<int> bytes) =>
+      sha256.convert(bytes).toString().substring(0, 32);
+
+  /// Scrub blocks of [meta] starting at block [fromBlock]
+  ///
+  /// Stops after [maxBytes] and returns the next block to scrub (0 once
+  /// the whole file was covered). Corrupt blocks are added to [report];
+  /// the caller repairs them.
+  static Future<int> scrubFile(
+    DownloadMeta meta,
+    ScrubReport report, {
+    int fromBlock = 0,
+    int maxBytes = 64 * 1024 * 1024,
+  }) async {
+    final blocks = (meta.totalSize + blockSize - 1) ~/ blockSize;
+    final raf = await File(meta.localPath).open(mode: FileMode.read);
+    try {
+      int scrubbed = 0;
+      for (int block = fromBlock; block < blocks; block++) {
+        if (scrubbed >= maxBytes) return block;
+
+        final start = block * blockSize;
+        final end = min(start + blockSize, meta.totalSize) - 1;
+        if (!meta.hasRange(start, end)) continue;
+
+        await raf.setPosition(start);
+        final digest = checksum(await raf.read(end - start + 1));
+        scrubbed += end - start + 1;
+
+        final recorded = meta.checksums[block];
+        if (recorded == null) {
+          meta.checksums[block] = digest;
+          report.blocksRecorded++;
+        } else if (recorded == digest) {
+          report.blocksVerified++;
+        } else {
+          report.corrupt.putIfAbsent(meta.id, () => []).add((start, end));
+        }
+      }
+      return 0;
+    } finally {
+      await raf.close();
+    }
+  }
+}
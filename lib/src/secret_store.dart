@@ -0,0 +1,325 @@
+import 'dart:async';
+import 'dart:convert';
+import 'dart:io';
+
+/// A secret store could not be read or written
+class SecretStoreException implements Exception {
+  final String message;
+
+  const SecretStoreException(this.message);
+
+  @override
+  String toString() => 'SecretStoreException: $message';
+}
+
+/// Where the proxy keeps keys and credentials instead of plaintext files
+///
+/// Secrets are strings by name; names are letters, digits, `.`, `-` and
+/// `_`. The proxy uses [signingKey], [metadataKey], [cacheKey] and
+/// [hostCredentials]. [platform] picks the OS keychain; on Android and
+/// iOS the app backs a [CallbackSecretStore] with its keystore.
+abstract class SecretStore {
+  /// Key signing proxy URLs, base64
+  static const signingKey = 'signing_key';
+
+  /// Key encrypting `.meta` files, base64
+  static const metadataKey = 'metadata_key';
+
+  /// Key encrypting cached media files, base64
+  static const cacheKey = 'cache_key';
+
+  /// Request headers by host, JSON (see `setHostCredentials`)
+  static const hostCredentials = 'host_credentials';
+
+  const SecretStore();
+
+  /// The OS keychain of this desktop platform under [service]; null on
+  /// other platforms
+  ///
+  /// macOS Keychain, the Linux secret service (`secret-tool`), or DPAPI
+  /// on Windows, whose encrypted blobs go to [directory]
+  /// (`%APPDATA%\<service>` by default).
+  static SecretStore? platform({
+    String service = 'genesmanproxy',
+    String? directory,
+  }) {
+    if (Platform.isMacOS) return KeychainSecretStore(service: service);
+    if (Platform.isLinux) return SecretServiceStore(service: service);
+    if (Platform.isWindows) {
+      final appData = Platform.environment['APPDATA'] ?? '.';
+      return DpapiSecretStore(directory ?? '$appData\\$service');
+    }
+    return null;
+  }
+
+  /// Whether written secrets outlive the process; a key the proxy
+  /// generates is only kept here when they do
+  bool get persistent => true;
+
+  /// Secret [name]; null when none is stored
+  Future<String?> read(String name);
+
+  Future<void> write(String name, String value);
+
+  Future<void> delete(String name);
+
+  /// Secret [name] as bytes (stored base64); null when none is stored
+  Future<List<int>?> readBytes(String name) async {
+    final value = await read(name);
+    if (value == null) return null;
+    try {
+      return base64.decode(value.trim());
+    } on FormatException {
+      throw SecretStoreException('$name is not base64');
+    }
+  }
+
+  Future<void> writeBytes(String name, List<int> value) =>
+      write(name, base64.encode(value));
+
+  static void checkName(String name) {
+    if (!RegExp(r'^[A-Za-z0-9._-]+$').hasMatch(name)) {
+      throw ArgumentError.value(name, 'name', 'Letters, digits, ., - and _');
+    }
+  }
+}
+
+/// Secrets held in memory, e.g. handed over by a native host at startup
+class MemorySecretStore extends SecretStore {
+  final Map<String, String> _secrets;
+
+  MemorySecretStore([Map<String, String> secrets = const {}])
+    : _secrets = {...secrets};
+
+  bool get isEmpty => _secrets.isEmpty;
+
+  @override
+  bool get persistent => false;
+
+  @override
+  Future<String?> read(String name) async => _secrets[name];
+
+  @override
+  Future<void> write(String name, String value) async {
+    SecretStore.checkName(name);
+    _secrets[name] = value;
+  }
+
+  @override
+  Future<void> delete(String name) async => _secrets.remove(name);
+}
+
+/// Secrets kept by the app, e.g. with a keystore plugin or a platform
+/// channel to the Android Keystore
+class CallbackSecretStore extends SecretStore {
+  final Future<String?> Function(String name) onRead;
+  final Future<void> Function(String name, String value) onWrite;
+  final Future<void> Function(String name) onDelete;
+
+  const CallbackSecretStore({
+    required this.onRead,
+    required this.onWrite,
+    required this.onDelete,
+  });
+
+  @override
+  Future<String?> read(String name) => onRead(name);
+
+  @override
+  Future<void> write(String name, String value) {
+    SecretStore.checkName(name);
+    return onWrite(name, value);
+  }
+
+  @override
+  Future<void> delete(String name) => onDelete(name);
+}
+
+/// Starts a process, as [Process.start] does; tests pass a fake
+typedef ProcessStarter =
+    Future<Process> Function(String executable, List<String> arguments);
+
+/// macOS Keychain generic passwords of [service], one account per name,
+/// through the `security` tool
+///
+/// Secrets are written on its stdin, never as arguments, so other
+/// processes listing command lines do not see them.
+class KeychainSecretStore extends SecretStore {
+  final String service;
+
+  /// Runs `security`
+  final ProcessStarter startProcess;
+
+  // Exit code of `security` for an item not found
+  static const _notFound = 44;
+
+  const KeychainSecretStore({
+    this.service = 'genesmanproxy',
+    this.startProcess = Process.start,
+  });
+
+  @override
+  Future<String?> read(String name) async {
+    final result = await _run('security', [
+      'find-generic-password',
+      '-s',
+      service,
+      '-a',
+      name,
+      '-w',
+    ], missing: _notFound, startProcess: startProcess);
+    return result == null ? null : _chomp(result);
+  }
+
+  @override
+  Future<void> write(String name, String value) async {
+    SecretStore.checkName(name);
+    if (value.contains('\n')) {
+      throw ArgumentError('Keychain secrets are a single line');
+    }
+    // A trailing -w prompts for the password, then again to confirm it
+    await _run(
+      'security',
+      ['add-generic-password', '-U', '-s', service, '-a', name, '-w'],
+      input: '$value\n$value\n',
+      startProcess: startProcess,
+    );
+  }
+
+  @override
+  Future<void> delete(String name) async {
+    await _run('security', [
+      'delete-generic-password',
+      '-s',
+      service,
+      '-a',
+      name,
+    ], missing: _notFound, startProcess: startProcess);
+  }
+}
+
+/// Secrets in the Linux secret service (GNOME Keyring, KWallet),
+/// attributed with [service] and the name, through `secret-tool`
+class SecretServiceStore extends SecretStore {
+  final String service;
+
+  const SecretServiceStore({this.service = 'genesmanproxy'});
+
+  @override
+  Future<String?> read(String name) async {
+    final result = await _run('secret-tool', [
+      'lookup',
+      'service',
+      service,
+      'name',
+      name,
+    ], missing: 1);
+    return result == null ? null : _chomp(result);
+  }
+
+  @override
+  Future<void> write(String name, String value) async {
+    SecretStore.checkName(name);
+    await _run('secret-tool', [
+      'store',
+      '--label=$service $name',
+      'service',
+      service,
+      'name',
+      name,
+    ], input: value);
+  }
+
+  @override
+  Future<void> delete(String name) async {
+    await _run('secret-tool', [
+      'clear',
+      'service',
+      service,
+      'name',
+      name,
+    ]);
+  }
+}
+
+/// Secrets encrypted with Windows DPAPI for the current user, one file
+/// per name in [directory], through PowerShell
+class DpapiSecretStore extends SecretStore {
+  final String directory;
+
+  const DpapiSecretStore(this.directory);
+
+  static const _protect =
+      r'ConvertTo-SecureString ([Console]::In.ReadToEnd()) -AsPlainText '
+      r'-Force | ConvertFrom-SecureString';
+
+  static const _unprotect =
+      r'$s = ConvertTo-SecureString ([Console]::In.ReadToEnd().Trim()); '
+      r'[Console]::Out.Write([Runtime.InteropServices.Marshal]::'
+      r'PtrToStringBSTR([Runtime.InteropServices.Marshal]::'
+      r'SecureStringToBSTR($s)))';
+
+  File _file(String name) => File('$directory\\$name.dpapi');
+
+  @override
+  Future<String?> read(String name) async {
+    SecretStore.checkName(name);
+    final file = _file(name);
+    if (!await file.exists()) return null;
+    return _powerShell(_unprotect, await file.readAsString());
+  }
+
+  @override
+  Future<void> write(String name, String value) async {
+    SecretStore.checkName(name);
+    final blob = await _powerShell(_protect, value);
+    await Directory(directory).create(recursive: true);
+    await _file(name).writeAsString(blob.trim());
+  }
+
+  @override
+  Future<void> delete(String name) async {
+    SecretStore.checkName(name);
+    final file = _file(name);
+    if (await file.exists()) await file.delete();
+  }
+
+  static Future<String> _powerShell(String script, String input) async =>
+      (await _run('powershell', [
+        '-NoProfile',
+        '-NonInteractive',
+        '-Command',
+        script,
+      ], input: input))!;
+}
+
+/// Output of [executable]; null when it exits with [missing] (the secret
+/// is not there), a [SecretStoreException] for any other failure
+Future<String?> _run(
+  String executable,
+  List<String> arguments, {
+  String? input,
+  int? missing,
+  ProcessStarter startProcess = Process.start,
+}) async {
+  final Process process;
+  try {
+    process = await startProcess(executable, arguments);
+  } on ProcessException catch (e) {
+    throw SecretStoreException('Cannot run $executable: ${e.message}');
+  }
+  final output = process.stdout.transform(utf8.decoder).join();
+  final errors = process.stderr.transform(utf8.decoder).join();
+  if (input != null) process.stdin.write(input);
+  await process.stdin.close();
+  final code = await process.exitCode;
+  if (code == 0) return await output;
+  if (code == missing) return null;
+  throw SecretStoreException(
+    '$executable ${arguments.first} failed ($code): ${(await errors).trim()}',
+  );
+}
+
+/// [output] without the line break tools end it with
+String _chomp(String output) =>
+    output.endsWith('\n') ? output.substring(0, output.length - 1) : output;
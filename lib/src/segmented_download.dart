@@ -0,0 +1,59 @@
+import 'dart:math';
+
+import 'download_meta.dart';
+
+/// Settings for downloading a file over parallel connections
+///
+/// Missing ranges are cut into [segmentSize] segments and fetched by
+/// [connections] workers at once, which keeps a fast link busy against a
+/// CDN that throttles each connection. Per-host limits
+/// (`HostPolicy.maxConcurrent`) still apply on top.
+class SegmentedDownloadConfig {
+  /// Parallel upstream connections per file
+  final int connections;
+
+  /// Size of each segment request
+  final int segmentSize;
+
+  const SegmentedDownloadConfig({
+    this.connections = 4,
+    this.segmentSize = 4 * 1024 * 1024,
+  });
+
+  /// Missing ranges of [meta] as segments, in file order
+  List<(int, int)> segments(DownloadMeta meta) => [
+    for (final (gapStart, gapEnd) in meta.getDownloadGaps())
+      for (int pos = gapStart; pos <= gapEnd; pos += segmentSize)
+        (pos, min(pos + segmentSize - 1, gapEnd)),
+  ];
+}
+
+/// Run [task] for every item with at most [workers] running at once
+///
+/// Items are taken in order as workers free up. Once [isCancelled]
+/// returns true no new item is started. A failed task does not stop the
+/// others; the first error is rethrown after all workers finish.
+Future<void> runPool<T>(
+  Iterable<T> items,
+  int workers,
+  Future<void> Function(T item) task, {
+  bool Function()? isCancelled,
+}) async {
+  final queue = items.iterator;
+  Object? error;
+  StackTrace? stack;
+
+  Future<void> worker() async {
+    while (!(isCancelled?.call() ?? false) && queue.moveNext()) {
+      try {
+        await task(queue.current);
+      } catch (e, s) {
+        error ??= e;
+        stack ??= s;
+      }
+    }
+  }
+
+  await Future.wait([for (var i = 0; i < max(1, workers); i++) worker()]);
+  if (error != null) Error.throwWithStackTrace(error!, stack!);
+}
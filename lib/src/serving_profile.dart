@@ -0,0 +1,26 @@
+import 'audio_profile.dart';
+
+/// How the proxy tunes serving for a request
+enum ServingProfile {
+  /// Default: 1 MB serving chunks, video MIME fallback
+  video,
+
+  /// Music: audio MIME types, ICY pass-through, small chunks, next-track
+  /// prefetch (see [AudioProfileConfig])
+  audio,
+
+  /// Images, documents and API responses: content type from the origin or
+  /// the file name, and the whole body is cached even without Range or
+  /// Content-Length support upstream
+  asset,
+
+  /// Playlists, manifests and API responses that are refreshed often:
+  /// kept in the in-memory `ObjectCache` and revalidated per HTTP caching
+  /// headers instead of being stored as sparse files
+  manifest,
+
+  /// A segment of an HLS or DASH stream: cached as its own file like an
+  /// asset, but never downloaded in the background nor moved into the
+  /// collection
+  segment,
+}
@@ -0,0 +1,92 @@
+import 'dart:math';
+
+import 'download_meta.dart';
+import 'simulation.dart';
+
+/// Alternative cache configuration evaluated alongside the live cache
+class ShadowConfig {
+  /// Fraction of files mirrored to the shadow (0..1)
+  final double sampleRate;
+
+  /// Serving chunk size to evaluate
+  final int chunkSize;
+
+  /// Storage quota to evaluate; null means unbounded
+  final int? quotaBytes;
+
+  const ShadowConfig({
+    this.sampleRate = 0.1,
+    this.chunkSize = 1024 * 1024,
+    this.quotaBytes,
+  });
+}
+
+/// Mirrors sampled player requests into a [CacheSimulator] running
+/// [ShadowConfig], recording hit rates for the live cache and the shadow
+/// on the same requests
+///
+/// Sampling is per file, so the shadow sees each sampled file's whole
+/// access pattern. Nothing is fetched or served from the shadow.
+class ShadowCache {
+  final ShadowConfig config;
+  final CacheSimulator _simulator;
+
+  /// Live cache results for the mirrored requests
+  final SimulationReport live = SimulationReport();
+
+  /// Shadow results for the same requests
+  final SimulationReport shadow = SimulationReport();
+
+  ShadowCache(this.config)
+    : _simulator = CacheSimulator(
+        chunkSize: config.chunkSize,
+        quotaBytes: config.quotaBytes,
+      );
+
+  /// Whether requests for [fileId] (a hex URL hash) are mirrored
+  bool isSampled(String fileId) {
+    final bucket = int.tryParse(
+      fileId.substring(0, min(8, fileId.length)),
+      radix: 16,
+    );
+    if (bucket == null) return false;
+    return bucket / 0xFFFFFFFF < config.sampleRate;
+  }
+
+  /// Mirror a player request for [start]..[end] of [meta]
+  ///
+  /// Call before the live cache serves it, so [meta] still reflects what
+  /// was cached when the request arrived. [liveChunkSize] is the size of
+  /// the live cache's upstream fetches.
+  void observe(
+    String fileId,
+    DownloadMeta meta,
+    int start,
+    int end, {
+    int liveChunkSize = 1024 * 1024,
+  }) {
+    if (!isSampled(fileId)) return;
+
+    final gaps = meta.getGapsIn(start, end);
+    live.requests++;
+    live.bytesRequested += end - start + 1;
+    for (final (gapStart, gapEnd) in gaps) {
+      live.bytesFromUpstream += gapEnd - gapStart + 1;
+      live.upstreamFetches += (gapEnd - gapStart) ~/ liveChunkSize + 1;
+    }
+    live.bytesFromCache = live.bytesRequested - live.bytesFromUpstream;
+    if (gaps.isEmpty) live.fullyCachedRequests++;
+
+    _simulator.run([
+      SimulatedRequest(fileId, meta.totalSize, start, end),
+    ], shadow);
+  }
+
+  Map<String, Object?> toJson() => {
+    'sampleRate': config.sampleRate,
+    'chunkSize': config.chunkSize,
+    'quotaBytes': config.quotaBytes,
+    'live': live.toJson(),
+    'shadow': shadow.toJson(),
+  };
+}
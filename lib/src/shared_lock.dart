@@ -0,0 +1,85 @@
+import 'dart:async';
+import 'dart:collection';
+
+/// A lock held either by any number of readers at once or by one writer
+///
+/// Guards a cache file: players reading cached bytes share it, so many
+/// viewers of one film do not queue behind each other's disk reads,
+/// while writes, moves and deletions hold it alone. Waiters are served
+/// in arrival order, so a steady stream of readers cannot starve a
+/// waiting writer.
+class SharedLock {
+  int _readers = 0;
+  bool _writing = false;
+  final Queue<_Waiter> _waiting = Queue();
+
+  /// Readers holding the lock now
+  int get readers => _readers;
+
+  /// Whether a writer holds the lock now
+  bool get isWriting => _writing;
+
+  /// Run [action] alongside other readers, once no writer holds the lock
+  Future<T> shared<T>(FutureOr<T> Function() action) async {
+    if (_writing || _waiting.isNotEmpty) {
+      await _wait(shared: true);
+    } else {
+      _readers++;
+    }
+    try {
+      return await action();
+    } finally {
+      _readers--;
+      _wake();
+    }
+  }
+
+  /// Run [action] holding the lock alone
+  ///
+  /// Named like `Lock.synchronized` of the synchronized package, which
+  /// this replaces for cache files.
+  Future<T> synchronized<T>(FutureOr<T> Function() action) async {
+    if (_writing || _readers > 0 || _waiting.isNotEmpty) {
+      await _wait(shared: false);
+    } else {
+      _writing = true;
+    }
+    try {
+      return await action();
+    } finally {
+      _writing = false;
+      _wake();
+    }
+  }
+
+  Future<void> _wait({required bool shared}) {
+    final waiter = _Waiter(shared);
+    _waiting.add(waiter);
+    return waiter.granted.future;
+  }
+
+  // Hand the lock to the waiters at the head of the queue: a writer
+  // alone, or every reader up to the next writer
+  void _wake() {
+    while (_waiting.isNotEmpty && !_writing) {
+      final next = _waiting.first;
+      if (!next.shared) {
+        if (_readers > 0) return;
+        _waiting.removeFirst();
+        _writing = true;
+        next.granted.complete();
+        return;
+      }
+      _waiting.removeFirst();
+      _readers++;
+      next.granted.complete();
+    }
+  }
+}
+
+class _Waiter {
+  final bool shared;
+  final Completer<void> granted = Completer();
+
+  _Waiter(this.shared);
+}
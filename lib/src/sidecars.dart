@@ -0,0 +1,93 @@
+import 'package:path/path.dart' as p;
+
+/// What a [Sidecar] is to its video
+enum SidecarKind {
+  subtitles('subs', 'vtt'),
+  audio('audio', 'm4a'),
+  thumbnail('thumbs', 'jpg');
+
+  /// Path segment of its proxy URL, `/stream/<file ID>/<segment>/<n>`
+  final String segment;
+
+  /// Extension when its URL has none
+  final String extension;
+
+  const SidecarKind(this.segment, this.extension);
+
+  static SidecarKind? fromSegment(String segment) {
+    for (final kind in values) {
+      if (kind.segment == segment) return kind;
+    }
+    return null;
+  }
+}
+
+/// A file played along with a video: a subtitle track, a separate audio
+/// track or a thumbnail
+///
+/// Cached under its own URL like any file, served under its video's
+/// file ID, and moved next to the video once that completes.
+class Sidecar {
+  final SidecarKind kind;
+  final String url;
+
+  /// BCP 47 language tag (e.g. `en`, `pt-BR`), which players read from
+  /// the file name
+  final String? language;
+
+  /// Name to show, e.g. `English (SDH)`
+  final String? label;
+
+  const Sidecar(this.kind, this.url, {this.language, this.label});
+
+  /// Extension of its URL's path, else its kind's
+  String get extension {
+    final ext = p.url.extension(Uri.tryParse(url)?.path ?? '');
+    return RegExp(r'^\.[A-Za-z0-9]{1,5}$').hasMatch(ext)
+        ? ext.substring(1).toLowerCase()
+        : kind.extension;
+  }
+
+  Map<String, dynamic> toJson() => {
+    'kind': kind.name,
+    'url': url,
+    if (language != null) 'language': language,
+    if (label != null) 'label': label,
+  };
+
+  factory Sidecar.fromJson(Map<String, dynamic> json) => Sidecar(
+    SidecarKind.values.byName(json['kind'] as String),
+    json['url'] as String,
+    language: json['language'] as String?,
+    label: json['label'] as String?,
+  );
+
+  /// File names for [sidecars] next to the video [videoPath], in order
+  ///
+  /// The video's name, then the language or the sidecar's index among
+  /// its kind, then its extension (`movie.en.srt`, `movie.1.m4a`), as
+  /// players and media servers look for them; a thumbnail without a
+  /// language is `movie.jpg`. Names taken twice get the index too.
+  static List<String> fileNames(String videoPath, List<Sidecar> sidecars) {
+    final stem = p.basenameWithoutExtension(videoPath);
+    final counts = <SidecarKind, int>{};
+    final taken = <String>{p.basename(videoPath)};
+    final names = <String>[];
+    for (final sidecar in sidecars) {
+      final index = counts[sidecar.kind] ?? 0;
+      counts[sidecar.kind] = index + 1;
+      final tag = sidecar.language ?? '$index';
+      final ext = sidecar.extension;
+      final plain =
+          sidecar.kind == SidecarKind.thumbnail &&
+              sidecar.language == null &&
+              index == 0
+          ? '$stem.$ext'
+          : '$stem.$tag.$ext';
+      final name = taken.add(plain) ? plain : '$stem.$tag.$index.$ext';
+      taken.add(name);
+      names.add(name);
+    }
+    return names;
+  }
+}
@@ -0,0 +1,246 @@
+import 'dart:convert';
+import 'dart:math';
+
+import 'download_meta.dart';
+
+/// One player request replayed by [CacheSimulator]
+class SimulatedRequest {
+  final String url;
+  final int totalSize;
+  final int start;
+  final int end;
+
+  SimulatedRequest(this.url, this.totalSize, this.start, this.end);
+
+  /// Parse an access log
+  ///
+  /// One request per line, either JSON
+  /// (`{"url": ..., "size": ..., "start": ..., "end": ...}`) or
+  /// whitespace separated (`URL SIZE START-END`). Blank lines and lines
+  /// starting with `#` are skipped.
+  static List<SimulatedRequest> parseLog(String log) {
+    final requests = <SimulatedRequest>[];
+    for (final raw in const LineSplitter().convert(log)) {
+      final line = raw.trim();
+      if (line.isEmpty || line.startsWith('#')) continue;
+
+      if (line.startsWith('{')) {
+        final json = jsonDecode(line) as Map<String, dynamic>;
+        requests.add(
+          SimulatedRequest(
+            json['url'] as String,
+            json['size'] as int,
+            json['start'] as int,
+            json['end'] as int,
+          ),
+        );
+        continue;
+      }
+
+      final parts = line.split(RegExp(r'\s+'));
+      final range = parts.length == 3 ? parts[2].split('-') : const [];
+      if (range.length != 2) {
+        throw FormatException('Invalid access log line', line);
+      }
+      requests.add(
+        SimulatedRequest(
+          parts[0],
+          int.parse(parts[1]),
+          int.parse(range[0]),
+          int.parse(range[1]),
+        ),
+      );
+    }
+    return requests;
+  }
+}
+
+/// Synthetic playback patterns for [CacheSimulator]
+class SyntheticPlayback {
+  /// Linear playback from start to end in [requestSize] steps
+  static List<SimulatedRequest> linear(
+    String url,
+    int totalSize, {
+    int requestSize = 2 * 1024 * 1024,
+  }) {
+    final requests = <SimulatedRequest>[];
+    for (int pos = 0; pos < totalSize; pos += requestSize) {
+      requests.add(
+        SimulatedRequest(
+          url,
+          totalSize,
+          pos,
+          min(pos + requestSize - 1, totalSize - 1),
+        ),
+      );
+    }
+    return requests;
+  }
+
+  /// Playback with [seeks] random jumps, each followed by [readsPerSeek]
+  /// sequential requests. Deterministic for a given [seed].
+  static List<SimulatedRequest> seeking(
+    String url,
+    int totalSize, {
+    int seeks = 10,
+    int readsPerSeek = 5,
+    int requestSize = 2 * 1024 * 1024,
+    int seed = 1,
+  }) {
+    final random = Random(seed);
+    final requests = <SimulatedRequest>[];
+    for (int s = 0; s < seeks; s++) {
+      int pos = s == 0 ? 0 : random.nextInt(totalSize);
+      for (int r = 0; r < readsPerSeek && pos < totalSize; r++) {
+        final end = min(pos + requestSize - 1, totalSize - 1);
+        requests.add(SimulatedRequest(url, totalSize, pos, end));
+        pos = end + 1;
+      }
+    }
+    return requests;
+  }
+}
+
+/// Outcome of a [CacheSimulator] run
+class SimulationReport {
+  int requests = 0;
+  int fullyCachedRequests = 0;
+  int bytesRequested = 0;
+  int bytesFromCache = 0;
+  int bytesFromUpstream = 0;
+  int upstreamFetches = 0;
+  int evictions = 0;
+  int peakStorageBytes = 0;
+  int finalStorageBytes = 0;
+
+  /// Fraction of requested bytes served from cache
+  double get byteHitRatio =>
+      bytesRequested == 0 ? 0 : bytesFromCache / bytesRequested;
+
+  /// Fraction of requests served entirely from cache
+  double get requestHitRatio =>
+      requests == 0 ? 0 : fullyCachedRequests / requests;
+
+  Map<String, Object> toJson() => {
+    'requests': requests,
+    'fullyCachedRequests': fullyCachedRequests,
+    'bytesRequested': bytesRequested,
+    'bytesFromCache': bytesFromCache,
+    'bytesFromUpstream': bytesFromUpstream,
+    'upstreamFetches': upstreamFetches,
+    'evictions': evictions,
+    'peakStorageBytes': peakStorageBytes,
+    'finalStorageBytes': finalStorageBytes,
+    'byteHitRatio': byteHitRatio,
+    'requestHitRatio': requestHitRatio,
+  };
+
+  @override
+  String toString() =>
+      'SimulationReport(requests: $requests, '
+      'hit: ${(byteHitRatio * 100).toStringAsFixed(1)}%, '
+      'upstream: $bytesFromUpstream B in $upstreamFetches fetches, '
+      'peak storage: $peakStorageBytes B, evictions: $evictions)';
+}
+
+/// Dry-run of the serving logic for capacity planning
+///
+/// Replays requests against in-memory [DownloadMeta] range tracking the
+/// same way the proxy serves them (cached sub-ranges from disk, each gap
+/// fetched in [chunkSize] requests), with LRU eviction above [quotaBytes].
+/// No network or disk I/O is performed.
+class CacheSimulator {
+  /// Serving chunk size (the proxy uses 1 MB)
+  final int chunkSize;
+
+  /// Storage quota; null means unbounded
+  final int? quotaBytes;
+
+  // Insertion order doubles as LRU order (oldest first)
+  final Map<String, DownloadMeta> _files = {};
+
+  CacheSimulator({this.chunkSize = 1024 * 1024, this.quotaBytes});
+
+  /// Replay [requests] and report the outcome
+  ///
+  /// Cache state carries over between runs; pass [report] to keep adding
+  /// to the same totals.
+  SimulationReport run(
+    Iterable<SimulatedRequest> requests, [
+    SimulationReport? report,
+  ]) {
+    report ??= SimulationReport();
+
+    for (final request in requests) {
+      final meta = _touch(request);
+      final end = min(request.end, request.totalSize - 1);
+      if (request.start > end) continue;
+
+      report.requests++;
+      report.bytesRequested += end - request.start + 1;
+
+      // Each fetch fills a whole chunk, past the request's end too
+      int missed = 0;
+      final gaps = meta.getGapsIn(request.start, end);
+      for (final (gapStart, gapEnd) in gaps) {
+        missed += gapEnd - gapStart + 1;
+        for (
+          int chunkStart = gapStart;
+          chunkStart <= gapEnd;
+          chunkStart += chunkSize
+        ) {
+          final chunkEnd = min(chunkStart + chunkSize, request.totalSize) - 1;
+          for (final (from, to) in meta.getGapsIn(chunkStart, chunkEnd)) {
+            report.bytesFromUpstream += to - from + 1;
+          }
+          report.upstreamFetches++;
+          meta.addRange(chunkStart, chunkEnd);
+        }
+      }
+      report.bytesFromCache += end - request.start + 1 - missed;
+      if (gaps.isEmpty) report.fullyCachedRequests++;
+
+      report.evictions += _evict(request.url);
+      report.peakStorageBytes = max(report.peakStorageBytes, _storageBytes());
+    }
+
+    report.finalStorageBytes = _storageBytes();
+    return report;
+  }
+
+  DownloadMeta _touch(SimulatedRequest request) {
+    var meta = _files.remove(request.url);
+    meta ??= DownloadMeta(
+      id: request.url,
+      totalSize: request.totalSize,
+      localPath: '',
+      metaPath: '',
+      ephemeral: true,
+    );
+    _files[request.url] = meta;
+    return meta;
+  }
+
+  int _cachedBytes(DownloadMeta meta) =>
+      (meta.progress / 100 * meta.totalSize).round();
+
+  int _storageBytes() =>
+      _files.values.fold(0, (sum, meta) => sum + _cachedBytes(meta));
+
+  int _evict(String currentUrl) {
+    final quota = quotaBytes;
+    if (quota == null) return 0;
+
+    int evicted = 0;
+    while (_storageBytes() > quota) {
+      final victim = _files.keys.firstWhere(
+        (url) => url != currentUrl,
+        orElse: () => '',
+      );
+      if (victim.isEmpty) break;
+      _files.remove(victim);
+      evicted++;
+    }
+    return evicted;
+  }
+}
@@ -0,0 +1,125 @@
+import 'dart:convert';
+import 'dart:io';
+
+import 'completion_marker.dart';
+import 'down_stream.dart';
+
+/// Publishes completed downloads as a static directory that nginx or an
+/// object store can serve as-is
+///
+/// Layout:
+/// - `media/<name>`: the files
+/// - `index.json`: machine-readable listing
+/// - `playlist.m3u8`: the files as one playlist
+/// - `index.html`: human-readable listing
+///
+/// Publishing again only copies new or changed files; nothing is deleted.
+class StaticSiteExporter {
+  final String outDir;
+  final String title;
+
+  /// Symlink media instead of copying (same volume, served by nginx)
+  final bool symlink;
+
+  StaticSiteExporter(
+    this.outDir, {
+    this.title = 'DownStream Collection',
+    this.symlink = false,
+  });
+
+  /// Publish the complete items of [downloads]; returns files written
+  Future<int> publish(Iterable<DownloadInfo> downloads) async {
+    await Directory('$outDir/media').create(recursive: true);
+
+    int written = 0;
+    final used = <String>{};
+    final entries = <Map<String, Object?>>[];
+    for (final item in downloads) {
+      if (!item.isComplete) continue;
+
+      var name = _safeName(item.fileName ?? '${item.id}.mp4');
+      if (!used.add(name)) {
+        name = '${item.id}_$name';
+        used.add(name);
+      }
+      if (await _publishFile(item.localPath, '$outDir/media/$name')) {
+        written++;
+      }
+
+      final marker = await _readMarker(item.localPath);
+      entries.add({
+        'id': item.id,
+        'name': name,
+        'path': 'media/${Uri.encodeComponent(name)}',
+        'size': item.totalSize,
+        'url': item.originalUrl ?? marker?['url'],
+        'sha256': marker?['sha256'],
+        'durationMs': marker?['durationMs'],
+      });
+    }
+
+    await File(
+      '$outDir/index.json',
+    ).writeAsString(const JsonEncoder.withIndent('  ').convert(entries));
+    await File('$outDir/playlist.m3u8').writeAsString(_playlist(entries));
+    await File('$outDir/index.html').writeAsString(_html(entries));
+    return written;
+  }
+
+  Future<bool> _publishFile(String source, String target) async {
+    final existing = await FileStat.stat(target);
+    if (symlink) {
+      if (existing.type != FileSystemEntityType.notFound) return false;
+      await Link(target).create(File(source).absolute.path);
+      return true;
+    }
+    if (existing.type == FileSystemEntityType.file &&
+        existing.size == (await File(source).length())) {
+      return false; // Already published
+    }
+    await File(source).copy(target);
+    return true;
+  }
+
+  Future<Map<String, dynamic>?> _readMarker(String path) async {
+    final file = File(CompletionMarker.pathFor(path));
+    if (!await file.exists()) return null;
+    try {
+      return jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+    } catch (_) {
+      return null;
+    }
+  }
+
+  String _playlist(List<Map<String, Object?>> entries) {
+    final buffer = StringBuffer('#EXTM3U\n');
+    for (final entry in entries) {
+      final ms = entry['durationMs'] as int?;
+      buffer
+        ..writeln('#EXTINF:${ms == null ? -1 : ms ~/ 1000},${entry['name']}')
+        ..writeln(entry['path']);
+    }
+    return buffer.toString();
+  }
+
+  String _html(List<Map<String, Object?>> entries) {
+    const escape = HtmlEscape();
+    final buffer = StringBuffer()
+      ..writeln('<!DOCTYPE html>')
+      ..writeln('<meta charset="utf-8">')
+      ..writeln('<title>${escape.convert(title)}</title>')
+      ..writeln('<h1>${escape.convert(title)}</h1>')
+      ..writeln('<p><a href="playlist.m3u8">Playlist</a></p>')
+      ..writeln('<ul>');
+    for (final entry in entries) {
+      final name = escape.convert(entry['name'] as String);
+      buffer.writeln('<li><a href="${entry['path']}">$name</a></li>');
+    }
+    buffer.writeln('</ul>');
+    return buffer.toString();
+  }
+
+  /// File name safe for URLs and any file system
+  static String _safeName(String name) =>
+      name.replaceAll(RegExp(r'[\\/:*?"<>|\x00-\x1F]'), '_');
+}
@@ -0,0 +1,162 @@
+import 'dart:async';
+import 'dart:io';
+
+/// A cache directory cannot be used; [message] says what to change
+class StorageException implements Exception {
+  final String path;
+  final String message;
+
+  const StorageException(this.path, this.message);
+
+  @override
+  String toString() => 'StorageException: $message ($path)';
+}
+
+/// What [StorageCheck.run] found about a directory
+class StorageReport {
+  final String path;
+
+  /// Filesystem type, e.g. `ext4`; null where it cannot be read (only
+  /// Linux and Android expose it)
+  final String? fileSystem;
+
+  /// Problems that do not stop the proxy but make it slow or wasteful
+  final List<String> warnings;
+
+  const StorageReport(this.path, {this.fileSystem, this.warnings = const []});
+
+  /// Whether files written out of order stay sparse; false on FAT, where
+  /// a write far into a file first fills everything before it with zeros
+  bool get sparseFiles => !StorageCheck.denseFileSystems.contains(fileSystem);
+
+  Map<String, dynamic> toJson() => {
+    'path': path,
+    'fileSystem': fileSystem,
+    'sparseFiles': sparseFiles,
+    'warnings': warnings,
+  };
+}
+
+/// Startup check of a cache directory, so a misconfigured one fails once
+/// with a clear error instead of as a 500 on every request
+class StorageCheck {
+  StorageCheck._();
+
+  /// Filesystems without sparse files
+  static const denseFileSystems = {'vfat', 'msdos', 'exfat', 'fat'};
+
+  /// Create [path] when missing and make sure files can be created,
+  /// written out of order, read and deleted in it
+  ///
+  /// Throws a [StorageException] when it cannot be used.
+  static Future<StorageReport> run(String path) async {
+    final dir = Directory(path);
+    try {
+      await dir.create(recursive: true);
+    } on FileSystemException catch (e) {
+      throw StorageException(
+        path,
+        'Cannot create the cache directory '
+        '(${e.osError?.message ?? e.message}); pass a storageDir the app '
+        'may write, such as its support or cache directory',
+      );
+    }
+
+    final probe = File('${dir.path}/.storage_probe');
+    try {
+      final raf = await probe.open(mode: FileMode.write);
+      try {
+        await raf.setPosition(4096);
+        await raf.writeFrom(const [1, 2, 3, 4]);
+        await raf.setPosition(4096);
+        final read = await raf.read(4);
+        if (read.length != 4 || read[3] != 4) {
+          throw const FileSystemException('bytes read back differ');
+        }
+      } finally {
+        await raf.close();
+      }
+      await probe.delete();
+    } on FileSystemException catch (e) {
+      throw StorageException(
+        path,
+        'The cache directory is not writable '
+        '(${e.osError?.message ?? e.message}); check its permissions, or '
+        'that the volume is mounted read-write',
+      );
+    }
+
+    final fileSystem = await _fileSystemOf(dir);
+    return StorageReport(
+      path,
+      fileSystem: fileSystem,
+      warnings: [
+        if (denseFileSystems.contains(fileSystem))
+          'The cache is on $fileSystem, which has no sparse files: seeking '
+              'far into a file writes zeros up to that point first, and a '
+              'file over 4 GB cannot be stored',
+      ],
+    );
+  }
+
+  /// Whether [path], checked by [run] before, still exists and takes
+  /// writes; false once its volume is unmounted or its share dropped
+  ///
+  /// Never creates [path]: on an unmounted volume that would write to
+  /// the mount point's own disk. A share that hangs past [timeout] counts
+  /// as gone.
+  static Future<bool> isAvailable(
+    String path, {
+    Duration timeout = const Duration(seconds: 5),
+  }) async {
+    Future<bool> probe() async {
+      if (!await Directory(path).exists()) return false;
+      final file = File('$path/.storage_probe');
+      await file.writeAsBytes(const [1], flush: true);
+      await file.delete();
+      return true;
+    }
+
+    try {
+      return await probe().timeout(timeout);
+    } on FileSystemException {
+      return false;
+    } on TimeoutException {
+      return false;
+    }
+  }
+
+  /// Type of the filesystem [dir] is on, from `/proc/mounts`
+  static Future<String?> _fileSystemOf(Directory dir) async {
+    if (!Platform.isLinux && !Platform.isAndroid) return null;
+    try {
+      final path = await dir.resolveSymbolicLinks();
+      final mounts = await File('/proc/mounts').readAsLines();
+      String? best;
+      int bestLength = -1;
+      for (final line in mounts) {
+        final fields = line.split(' ');
+        if (fields.length < 3) continue;
+        final mountPoint = _unescape(fields[1]);
+        final contains =
+            path == mountPoint ||
+            mountPoint == '/' ||
+            path.startsWith('$mountPoint/');
+        // Later mounts over the same point hide earlier ones
+        if (contains && mountPoint.length >= bestLength) {
+          best = fields[2];
+          bestLength = mountPoint.length;
+        }
+      }
+      return best;
+    } on FileSystemException {
+      return null;
+    }
+  }
+
+  // Mount points escape spaces and the like as octal, e.g. `\040`
+  static String _unescape(String field) => field.replaceAllMapped(
+    RegExp(r'\\([0-7]{3})'),
+    (match) => String.fromCharCode(int.parse(match[1]!, radix: 8)),
+  );
+}
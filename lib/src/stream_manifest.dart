@@ -0,0 +1,308 @@
+import 'dart:convert';
+
+/// Adaptive streaming manifest formats
+enum ManifestKind {
+  /// HTTP Live Streaming playlist (`.m3u8`)
+  hls,
+
+  /// MPEG-DASH media presentation description (`.mpd`)
+  dash,
+}
+
+/// What an URI in an HLS playlist points at
+enum HlsUriKind {
+  /// Another playlist (variant, rendition, I-frame playlist)
+  playlist,
+
+  /// Media: a segment, partial segment or initialization section
+  segment,
+
+  /// A decryption key
+  key,
+}
+
+/// A variant stream of an HLS master playlist
+class HlsVariant {
+  final Uri uri;
+
+  /// Peak bits per second
+  final int bandwidth;
+
+  /// Playlists of the alternative renditions (audio, subtitles) it uses
+  final List<Uri> renditions;
+
+  const HlsVariant(this.uri, this.bandwidth, [this.renditions = const []]);
+}
+
+/// Reads and rewrites HLS playlists and DASH manifests
+///
+/// Players resolve the URIs in a manifest against the manifest's URL, so
+/// a manifest served through the proxy must have them rewritten, or
+/// segments would be fetched from the origin directly.
+class StreamManifest {
+  static const _hlsTypes = {
+    'application/vnd.apple.mpegurl',
+    'application/x-mpegurl',
+    'audio/mpegurl',
+    'audio/x-mpegurl',
+  };
+
+  /// Manifest format of a response, from its type, its first bytes or its
+  /// URL; null when it is none
+  static ManifestKind? detect({
+    String? contentType,
+    String? url,
+    List<int>? body,
+  }) {
+    final type = contentType?.split(';').first.trim().toLowerCase();
+    if (_hlsTypes.contains(type)) return ManifestKind.hls;
+    if (type == 'application/dash+xml') return ManifestKind.dash;
+
+    if (body != null && body.isNotEmpty) {
+      final head = utf8
+          .decode(body.take(1024).toList(), allowMalformed: true)
+          .replaceFirst('\uFEFF', '')
+          .trimLeft();
+      if (head.startsWith('#EXTM3U')) return ManifestKind.hls;
+      if (head.contains('<MPD')) return ManifestKind.dash;
+    }
+
+    final path = url == null ? null : Uri.tryParse(url)?.path.toLowerCase();
+    if (path == null) return null;
+    if (path.endsWith('.m3u8')) return ManifestKind.hls;
+    if (path.endsWith('.mpd')) return ManifestKind.dash;
+    return null;
+  }
+
+  /// Whether [text] is an HLS master playlist (it lists variants)
+  static bool isHlsMaster(String text) => text.contains('#EXT-X-STREAM-INF');
+
+  /// [text], an HLS playlist fetched from [base], with every http(s) URI
+  /// replaced by [route]
+  static String rewriteHls(
+    String text,
+    Uri base,
+    Uri Function(Uri target, HlsUriKind kind) route,
+  ) {
+    final master = isHlsMaster(text);
+    final lines = const LineSplitter().convert(text);
+    final out = StringBuffer();
+    for (final line in lines) {
+      final trimmed = line.trim();
+      if (trimmed.isEmpty) {
+        out.writeln(line);
+      } else if (trimmed.startsWith('#')) {
+        final kind = _tagUriKind(trimmed);
+        out.writeln(
+          kind == null
+              ? line
+              : line.replaceAllMapped(_uriAttribute, (m) {
+                  final target = _resolve(base, m[1]!);
+                  return target == null
+                      ? m[0]!
+                      : 'URI="${route(target, kind)}"';
+                }),
+        );
+      } else {
+        final target = _resolve(base, trimmed);
+        final kind = master ? HlsUriKind.playlist : HlsUriKind.segment;
+        out.writeln(target == null ? line : '${route(target, kind)}');
+      }
+    }
+    return out.toString();
+  }
+
+  /// Variant streams of an HLS master playlist fetched from [base]
+  static List<HlsVariant> hlsVariants(String text, Uri base) {
+    final groups = <String, List<Uri>>{};
+    for (final line in const LineSplitter().convert(text)) {
+      if (!line.startsWith('#EXT-X-MEDIA:')) continue;
+      final attributes = _attributes(line);
+      final uri = attributes['URI'];
+      final group = attributes['GROUP-ID'];
+      final target = uri == null ? null : _resolve(base, uri);
+      if (group != null && target != null) {
+        groups.putIfAbsent(group, () => []).add(target);
+      }
+    }
+
+    final variants = <HlsVariant>[];
+    Map<String, String>? pending;
+    for (final line in const LineSplitter().convert(text)) {
+      final trimmed = line.trim();
+      if (trimmed.startsWith('#EXT-X-STREAM-INF:')) {
+        pending = _attributes(trimmed);
+      } else if (pending != null &&
+          trimmed.isNotEmpty &&
+          !trimmed.startsWith('#')) {
+        final target = _resolve(base, trimmed);
+        if (target != null) {
+          final renditions = [
+            for (final name in const ['AUDIO', 'SUBTITLES'])
+              ...?groups[pending[name]],
+          ];
+          variants.add(
+            HlsVariant(
+              target,
+              int.tryParse(pending['BANDWIDTH'] ?? '') ?? 0,
+              renditions,
+            ),
+          );
+        }
+        pending = null;
+      }
+    }
+    return variants;
+  }
+
+  /// [text], an HLS master playlist fetched from [base], listing only the
+  /// variant at [keep]; I-frame playlists are dropped too
+  static String keepHlsVariant(String text, Uri base, Uri keep) {
+    final out = StringBuffer();
+    String? streamInf;
+    for (final line in const LineSplitter().convert(text)) {
+      final trimmed = line.trim();
+      if (trimmed.startsWith('#EXT-X-I-FRAME-STREAM-INF')) continue;
+      if (trimmed.startsWith('#EXT-X-STREAM-INF:')) {
+        streamInf = line;
+      } else if (streamInf != null &&
+          trimmed.isNotEmpty &&
+          !trimmed.startsWith('#')) {
+        if (_resolve(base, trimmed) == keep) {
+          out
+            ..writeln(streamInf)
+            ..writeln(line);
+        }
+        streamInf = null;
+      } else {
+        out.writeln(line);
+      }
+    }
+    return out.toString();
+  }
+
+  /// Everything an HLS media playlist fetched from [base] plays:
+  /// initialization sections, keys and segments, in order, without
+  /// duplicates
+  static List<Uri> hlsSegments(String text, Uri base) {
+    final found = <Uri>{};
+    for (final line in const LineSplitter().convert(text)) {
+      final trimmed = line.trim();
+      if (trimmed.isEmpty) continue;
+      if (trimmed.startsWith('#')) {
+        final kind = _tagUriKind(trimmed);
+        if (kind == null || kind == HlsUriKind.playlist) continue;
+        // Parts repeat what the full segments carry
+        if (trimmed.startsWith('#EXT-X-PART') ||
+            trimmed.startsWith('#EXT-X-PRELOAD-HINT')) {
+          continue;
+        }
+        for (final m in _uriAttribute.allMatches(trimmed)) {
+          final target = _resolve(base, m[1]!);
+          if (target != null) found.add(target);
+        }
+      } else {
+        final target = _resolve(base, trimmed);
+        if (target != null) found.add(target);
+      }
+    }
+    return found.toList();
+  }
+
+  /// [text], a DASH manifest fetched from [base], with its base URLs and
+  /// absolute segment URLs replaced by [route]
+  ///
+  /// [route] gets directories (ending in `/`) and files; since segment
+  /// addresses are resolved against the base URL, routing it through a
+  /// path-based proxy URL routes every segment, templates included.
+  static String rewriteDash(
+    String text,
+    Uri base,
+    Uri Function(Uri target) route,
+  ) {
+    final periodAt = text.indexOf('<Period');
+    var topLevelBase = false;
+    var rewritten = text.replaceAllMapped(_baseUrlElement, (m) {
+      final value = m[2]!.trim();
+      final topLevel = periodAt < 0 || m.start < periodAt;
+      topLevelBase = topLevelBase || topLevel;
+      // Relative ones below the top level resolve against a routed parent
+      final absolute = Uri.tryParse(value)?.hasScheme ?? false;
+      if (!absolute && !topLevel) return m[0]!;
+      final target = _resolve(base, value);
+      if (target == null) return m[0]!;
+      return '<BaseURL${m[1]}>${_escapeXml('${route(target)}')}</BaseURL>';
+    });
+
+    rewritten = rewritten.replaceAllMapped(_absoluteSegmentAttribute, (m) {
+      final target = Uri.tryParse(_unescapeXml(m[3]!));
+      if (target == null) return m[0]!;
+      return '${m[1]}=${m[2]}${_escapeXml('${route(target)}')}${m[2]}';
+    });
+
+    if (topLevelBase) return rewritten;
+    // Without a base URL segments resolve against the manifest's own
+    // (proxy) URL: give them the manifest's directory, routed
+    final mpd = RegExp(r'<MPD\b[^>]*>').firstMatch(rewritten);
+    if (mpd == null) return rewritten;
+    final element = '<BaseURL>${_escapeXml('${route(base.resolve('.'))}')}'
+        '</BaseURL>';
+    return rewritten.replaceRange(mpd.end, mpd.end, '\n  $element');
+  }
+
+  static final _uriAttribute = RegExp(r'URI="([^"]*)"');
+  static final _baseUrlElement = RegExp(
+    r'<BaseURL([^>]*)>([^<]*)</BaseURL>',
+  );
+  static final _absoluteSegmentAttribute = RegExp(
+    r'''\b(media|initialization|sourceURL|index)=(["'])(https?://[^"']*)\2''',
+  );
+
+  /// What the URI attributes of an HLS tag point at; null for tags
+  /// without URIs
+  static HlsUriKind? _tagUriKind(String tag) {
+    final name = tag.split(':').first;
+    return switch (name) {
+      '#EXT-X-KEY' || '#EXT-X-SESSION-KEY' => HlsUriKind.key,
+      '#EXT-X-MAP' ||
+      '#EXT-X-PART' ||
+      '#EXT-X-PRELOAD-HINT' => HlsUriKind.segment,
+      '#EXT-X-MEDIA' ||
+      '#EXT-X-I-FRAME-STREAM-INF' ||
+      '#EXT-X-RENDITION-REPORT' => HlsUriKind.playlist,
+      _ => null,
+    };
+  }
+
+  /// [reference] resolved against [base]; null unless it is http(s), so
+  /// `data:` and DRM scheme URIs (`skd://`) are left alone
+  static Uri? _resolve(Uri base, String reference) {
+    final Uri target;
+    try {
+      target = base.resolve(reference);
+    } on FormatException {
+      return null;
+    }
+    return target.isScheme('http') || target.isScheme('https')
+        ? target
+        : null;
+  }
+
+  /// Attributes of an HLS tag (`#EXT-X-...:NAME=value,NAME="value"`)
+  static Map<String, String> _attributes(String tag) {
+    final colon = tag.indexOf(':');
+    if (colon < 0) return const {};
+    return {
+      for (final m in RegExp(
+        r'([A-Z0-9-]+)=("[^"]*"|[^,]*)',
+      ).allMatches(tag.substring(colon + 1)))
+        m[1]!: m[2]!.replaceAll('"', ''),
+    };
+  }
+
+  static String _escapeXml(String value) =>
+      value.replaceAll('&', '&amp;').replaceAll('<', '&lt;');
+
+  static String _unescapeXml(String value) =>
+      value.replaceAll('&lt;', '<').replaceAll('&amp;', '&');
+}
@@ -1,9 +1,11 @@
 import 'dart:async';
+import 'dart:convert';
 import 'dart:io';
 import 'dart:math';
+import 'dart:typed_data';
 
 import 'package:genesmanproxy/genesmanproxy.dart';
-import 'package:synchronized/synchronized.dart';
+import 'package:path/path.dart' as p;
 
 /// Callback for download progress updates
 typedef ProgressCallback = void Function(String url, double progress);
@@ -11,22 +13,129 @@ typedef ProgressCallback = void Function(String url, double progress);
 /// Callback for download completion
 typedef CompletionCallback = void Function(String url, String localPath);
 
+/// Handler of one proxy endpoint
+typedef _Route = FutureOr<void> Function(HttpRequest request);
+
 /// Flutter bridge to Go proxy server
 class StreamProxyBridge {
   static const int _defaultPort = 8080;
   static StreamProxyBridge? _instance;
 
-  final int port;
-  final String storageDir;
+  /// Port the server listens on; the one picked when started on port 0
+  int get port => _server?.port ?? _port;
+  final int _port;
+
+  /// Interface the server listens on
+  InternetAddress get address => _server?.address ?? _address;
+  final InternetAddress _address;
+
+  // Certificate the server is bound with; null for plain http
+  final SecurityContext? _tls;
+
+  /// Where players and tools reach the proxy, e.g.
+  /// `http://127.0.0.1:8080`
+  Uri get baseUrl => _baseUrl(address, port, secure: _tls != null);
+
+  /// Cache directory (changed by [moveStorage])
+  String get storageDir => _storageDir;
+  String _storageDir;
+
+  /// What the startup check found about [storageDir]: its filesystem and
+  /// anything that makes it a poor cache
+  StorageReport get storageReport => _storageReport;
+  late StorageReport _storageReport;
   final String? userAgent;
   final ProxyConfig? proxyConfig;
 
+  /// Timeouts, outbound proxy and TLS settings of upstream requests
+  final ClientConfig clientConfig;
+
+  /// Client shared by every upstream request, so connections to an origin
+  /// are reused across files (pinned hosts get their own)
+  final HttpClient httpClient;
+
+  // Whether [httpClient] was built here and is closed by [dispose]
+  final bool _ownsClient;
+
+  /// Headers added to every upstream request
+  final Map<String, String> requestHeaders;
+
+  /// Inbound headers passed upstream with the file's requests (e.g.
+  /// `authorization`, `cookie`, `referer`); the player's latest request
+  /// for a file supplies them
+  final Set<String> forwardHeaders;
+
+  /// Upstream response headers passed on to players (e.g.
+  /// `x-content-duration`), kept with the file so cached bytes carry them
+  /// too; names in lower case. Files probed before a name is added do not
+  /// have it.
+  final Set<String> passThroughHeaders;
+
+  /// Runs last on every upstream request, to attach per-URL tokens
+  RequestDecorator? requestDecorator;
+
+  /// Keep origin-bound headers (host policy and forwarded ones) from
+  /// redirect targets on another origin; applies to files opened after a
+  /// change
+  bool isolateOriginHeaders = true;
+
+  /// Header names sent to each upstream host (see [HeaderAudit])
+  final HeaderAudit headerAudit = HeaderAudit();
+
+  /// Hash every response body and publish the digest (see [BodyDigest])
+  bool bodyDigestEnabled;
+
+  /// Encrypts and authenticates .meta files when set
+  final MetaCipher? metaCipher;
+
+  /// Encrypts cached media files when set (see [CacheCipher])
+  final CacheCipher? cacheCipher;
+
+  /// Signs the upstream URLs in proxy URLs (see [getProxyUrl])
+  final UrlSigner urlSigner;
+
+  /// Also accept the raw `?url=` form, unsigned: anyone who can reach the
+  /// port can then make the proxy download arbitrary URLs
+  bool allowUnsignedUrls = false;
+
+  /// Bearer token the API and admin endpoints require (`Authorization:
+  /// Bearer <token>`), on top of [access]; without one they are open to
+  /// anything [access] lets in
+  String? apiToken;
+
+  /// Who may use any endpoint: client networks, API key and the app's
+  /// own check; only apps on this device by default. Checked before
+  /// [apiToken] (see [AccessPolicy])
+  AccessPolicy access = AccessPolicy();
+
   final Map<String, DownloadMeta> _metadata = {};
+
+  // First-request initializations in flight, shared by concurrent requests
+  final Map<String, Future<DownloadMeta?>> _metaInits = {};
+
+  // Files the origin reports as zero bytes long (served without a cache)
+  final Set<String> _emptyFiles = {};
+
+  // Files whose origin sends no length (live or chunked): passed through
+  final Set<String> _liveStreams = {};
+
+  // Whitelisted headers of the latest player request for each file
+  final Map<String, Map<String, String>> _forwardedHeaders = {};
+
+  // Files whose origin ignores Range: the background download fetches
+  // them whole from the start and player requests wait for its writes
+  final Set<String> _rangeless = {};
+  final Map<String, Completer<void>> _arrivals = {};
+
+  // Upstream fetches in flight per file, so overlapping requests share one
+  // download instead of fetching the same bytes twice (see [_claim])
+  final Map<String, List<_Flight>> _flights = {};
   final Map<String, DataSource> _dataSources = {};
   final Map<String, Timer> _saveTimers = {};
 
-  // File locking using synchronized package (thread-safe async mutex)
-  final Map<String, Lock> _fileLocks = {};
+  // Per-file locks: shared while cached bytes are read, exclusive for
+  // writes, moves and deletions (see [SharedLock])
+  final Map<String, SharedLock> _fileLocks = {};
 
   // Track active download sessions to prevent ghost downloads
   final Set<String> _activeDownloads = {};
@@ -40,465 +149,7747 @@ class StreamProxyBridge {
   // Progress stream for UI updates
   final StreamController<(String, double)> _progressController =
       StreamController<(String, double)>.broadcast();
+
+  // Event log for the host app
+  final StreamController<ProxyEvent> _eventController =
+      StreamController<ProxyEvent>.broadcast();
+
+  // Cache writes per file, coalesced into progress/rangeAdded events, and
+  // the reports due once writes pause
+  final Map<String, ProgressTracker> _progressTrackers = {};
+  final Map<String, Timer> _progressTimers = {};
+  Duration _progressInterval = const Duration(milliseconds: 500);
+
+  // Download lifecycle per file, and its changes for the UI
+  final Map<String, Download> _downloads = {};
+  final StreamController<Download> _downloadController =
+      StreamController<Download>.broadcast();
+
+  // Ephemeral (session-only) files and their idle discard timers
+  final Set<String> _ephemeralIds = {};
+  final Map<String, Timer> _ephemeralTimers = {};
+
+  /// Idle time after which an ephemeral session's data is discarded
+  Duration ephemeralIdleTimeout = const Duration(minutes: 2);
+
+  // Per-namespace (profile) policies and today's usage
+  final Map<String, NamespacePolicy> _policies = {};
+  final Map<String, NamespaceUsage> _namespaceUsage = {};
+
+  // Missing ranges leased to external downloaders
+  final WorkCoordinator _workCoordinator = WorkCoordinator();
+
+  // Refuses new upstream fetches under memory/CPU pressure when enabled
+  LoadShedder? _loadShedder;
+
+  // Replays sampled requests against an alternative cache configuration
+  ShadowCache? _shadow;
+
+  // Latest access plan per file; a replaced plan stops at its next range
+  final Map<String, AccessPlan> _plans = {};
+
+  // Parallel background downloads when enabled
+  SegmentedDownloadConfig? _segmented;
+
+  // Shares upstream slots between clients when enabled; work for a file
+  // is charged to the client that last requested it
+  FairQueue? _fairQueue;
+  final Map<String, String> _fileClients = {};
+
+  // Player requests in flight per file; work for these files runs at
+  // foreground priority
+  final Map<String, int> _watching = {};
+
+  // Holds background transfers back for playback when enabled
+  BandwidthGuard? _bandwidthGuard;
+
+  // Rate caps (see [setBandwidthLimits]); client and download limiters
+  // are kept while they have something to pay for
+  BandwidthLimits _limits = BandwidthLimits.unlimited;
+  final RateLimiter _upstreamLimiter = RateLimiter();
+  final Map<String, RateLimiter> _downloadLimiters = {};
+  final Map<String, RateLimiter> _clientLimiters = {};
+
+  // Tells media servers about completed files when enabled
+  LibraryRefresher? _libraryRefresher;
+
+  // Readiness of the items of the last takeOffline call, by URL
+  final Map<String, OfflineItemStatus> _offline = {};
+
+  // Subtitle tracks being extracted (fileId.track -> WebVTT)
+  final Map<String, Future<String>> _subtitleExtractions = {};
+
+  // Keeps a window cached ahead of each playhead when enabled
+  ReadAheadConfig? _readAhead;
+  final Set<String> _readingAhead = {};
+
+  // Paces background downloads to the media bitrate when enabled
+  RateShapingConfig? _rateShaping;
+  final Map<String, int> _bitrates = {}; // fileId -> bits per second
+  final Set<String> _bitrateProbes = {};
+
+  // Idle-time integrity scrubbing (fileId -> next block to scrub)
+  ScrubberConfig? _scrubberConfig;
+  Timer? _scrubTimer;
+  bool _scrubbing = false;
+  final Map<String, int> _scrubCursors = {};
+  DateTime _lastPlayerRequest = DateTime.now();
+
+  // LRU eviction above a disk budget when enabled
+  CacheQuotaConfig? _quota;
+  Timer? _quotaTimer;
+  bool _enforcingQuota = false;
+
+  // Complete files demoted to the large tier, by ID, with their paths
+  TieredStorage? _tiers;
+  Timer? _tierTimer;
+  bool _retiering = false;
+  final Map<String, String> _coldPaths = {};
+  final Set<String> _promoting = {};
+
+  /// Status codes and bodies sent to players when a stream fails
+  ErrorPageConfig errorPages = const ErrorPageConfig();
+
+  /// Connection reuse and latency per origin host
+  final ConnectionMetrics connectionMetrics = ConnectionMetrics();
+
+  /// Bytes served by source and request durations (see [prometheusMetrics])
+  final ProxyMetrics proxyMetrics = ProxyMetrics();
+
+  /// Writes completed files and exports to content URIs (Android SAF)
+  DocumentStore? documentStore;
+
+  /// Document tree completed downloads go to instead of the collections
+  /// folder; requires [documentStore]
+  String? collectionTree;
+
+  /// Write a `.done` sidecar (see [CompletionMarker]) next to files moved
+  /// into the collection
+  bool completionMarkers = false;
+
+  /// Hash every completed file, not only those with an expected checksum;
+  /// the digest is stored in its metadata and the completion event
+  bool verifyCompletions = false;
+
+  /// Re-downloads of a file that keeps failing verification before it is
+  /// marked failed
+  int verifyRetries = 2;
+
+  // Checksums set before a file's metadata exists, and failed attempts
+  final Map<String, String> _expectedChecksums = {};
+  final Map<String, int> _verifyFailures = {};
+
+  /// Rewrite HLS playlists and DASH manifests so the player fetches every
+  /// playlist, segment and key through the proxy
+  ///
+  /// `.m3u8` and `.mpd` URLs are then served as [ServingProfile.manifest]
+  /// without asking; segments are cached one file each
+  /// ([ServingProfile.segment]). See also [downloadStream].
+  bool manifestAware = false;
+
+  /// Small-object cache for [ServingProfile.manifest] responses
+  final ObjectCache objectCache = ObjectCache();
+
+  // Player sessions by client token, persisted to .sessions.json
+  final Map<String, PlaybackSession> _sessions = {};
+  Timer? _sessionSaveTimer;
+
+  /// Sessions not touched for this long are forgotten
+  Duration sessionMaxAge = const Duration(days: 1);
+
+  // Files protected from eviction, persisted to .pins.json
+  final Set<String> _pinnedIds = {};
+
+  // Lifetimes by file ID, swept by the janitor; persisted to
+  // .lifetimes.json
+  final Map<String, CacheLifetime> _lifetimes = {};
+  Timer? _janitorTimer;
+  bool _sweeping = false;
+
+  /// Per-origin settings by host pattern (see [setHostPolicy])
+  final HostPolicyTable hostPolicies = HostPolicyTable();
+
+  /// Renditions of logical items, selected with `quality=` (see
+  /// [getProxyUrl])
+  final VariantRegistry variants = VariantRegistry();
+
+  // Request gates for hosts with a policy (host -> gate)
+  final Map<String, HostGate> _hostGates = {};
+
+  /// Probe each new origin host for Range, HEAD, validator and parallel
+  /// connection support, and pick fetch strategies from what it finds
+  /// (see [HostCapabilities])
+  bool hostProbing = true;
+
+  /// Host profiles older than this are probed again
+  Duration hostCapabilitiesMaxAge = const Duration(days: 7);
+
+  // What each origin host supports, persisted to .hosts.json
+  final Map<String, HostCapabilities> _hostCapabilities = {};
+  final Set<String> _probingHosts = {};
+
+  // Last byte served to the player and when (fileId -> (end, time))
+  final Map<String, (int, DateTime)> _playheads = {};
+
+  /// Settings for requests served with [ServingProfile.audio]
+  AudioProfileConfig audioProfile = const AudioProfileConfig();
+
+  /// Prefetch of the next item in a playlist set with [setPlaylist]
+  PlaylistPrefetchConfig playlistPrefetch = const PlaylistPrefetchConfig();
+
+  // Next playlist item by fileId, and prefetches already started
+  final Map<String, String> _nextUrls = {};
+  final Set<String> _prefetchedNext = {};
+
+  /// Prefetch the ranges a file is usually opened with (see [AccessHistory])
+  bool cacheWarmingEnabled = true;
+
+  // Access histograms by fileId, persisted to .access_history.json
+  final Map<String, AccessHistory> _accessHistory = {};
+  static const int _maxAccessHistory = 500;
+  Timer? _accessHistorySaveTimer;
+
+  // Recent body digests (requestId -> event), oldest first
+  final Map<String, ProxyEvent> _bodyDigests = {};
+  static const int _maxBodyDigests = 256;
   String? _outDir;
   String odir(String d) => _outDir = d;
   String? _outname;
   String oname(String n) => _outname = n;
   HttpServer? _server;
 
+  // Requests being handled, drained by [stop]
+  final Set<Future<void>> _inFlight = {};
+
+  // Completed by [stop] to end long-lived /events connections
+  final Completer<void> _stopping = Completer<void>();
+
+  /// Comment sent on idle `/events` streams so intermediaries keep them
+  /// open (and dropped clients are noticed)
+  Duration eventsKeepAlive = const Duration(seconds: 15);
+
+  // Write-ahead journal of ranges and queue changes, and what it held
+  // at startup (consumed by [recoverState])
+  CacheJournal? _journal;
+  Timer? _journalTimer;
+  JournalReplay? _journalReplay;
+  static const int _journalCheckpointBytes = 1024 * 1024;
+
+  /// How the previous run stopped; null when it did not stop cleanly
+  /// (a crash or power loss: the journal was replayed instead)
+  ShutdownReport? get previousShutdown => _previousShutdown;
+  ShutdownReport? _previousShutdown;
+
+  /// How an upstream body cut off mid-transfer is resumed: the Range
+  /// request is reissued from the first byte not yet received, and the
+  /// player's response continues as if nothing happened
+  RetryPolicy retryPolicy = const RetryPolicy();
+
+  /// Bytes of a requested range still cached after the player disconnects
+  /// (seeks away, closes), counted from where it left; 0 stops fetching
+  /// with the player
+  ///
+  /// A seek back into the range is then served from the cache. Detached
+  /// fetches run like background ones: fair scheduling, the bandwidth
+  /// guarantee and [BandwidthLimits] apply.
+  int detachedFetchLimit = 0;
+
+  /// Keep the next chunk's upstream request in flight while a player is
+  /// served the current one, so consecutive range requests do not each
+  /// wait a round trip to the origin; a slow player drains from the cache
+  /// meanwhile. Off, only the bytes being served are fetched.
+  bool pipelineFetches = true;
+
+  /// Bytes read from the cache file at once while serving cached bytes
+  ///
+  /// Each read is handed to the socket as is, without copying; larger
+  /// reads mean fewer system calls for big files, smaller ones less
+  /// memory per player. dart:io has no `sendfile`, so this is the knob.
+  int diskReadBufferSize = 256 * 1024;
+
   StreamProxyBridge._({
-    required this.port,
-    required this.storageDir,
+    required int port,
+    required InternetAddress address,
+    SecurityContext? tls,
+    required String storageDir,
     this.userAgent,
     this.proxyConfig,
-  });
-
+    required this.clientConfig,
+    required this.httpClient,
+    required bool ownsClient,
+    required this.requestHeaders,
+    required this.forwardHeaders,
+    required this.passThroughHeaders,
+    this.requestDecorator,
+    this.bodyDigestEnabled = false,
+    this.metaCipher,
+    this.cacheCipher,
+    required this.urlSigner,
+  }) : _port = port,
+       _address = address,
+       _storageDir = storageDir,
+       _tls = tls,
+       _ownsClient = ownsClient;
+
+  /// Start the proxy with the given settings, or return the running one
+  ///
+  /// Same as [start] with a [ProxyOptions] of these values.
   static Future<StreamProxyBridge> getInstance({
     int port = _defaultPort,
     String? storageDir,
     String? userAgent,
     ProxyConfig? proxyConfig,
+    ClientConfig clientConfig = const ClientConfig(),
+    HttpClient? httpClient,
+    Map<String, String>? requestHeaders,
+    Iterable<String> forwardHeaders = const [],
+    Iterable<String> passThroughHeaders = const [],
+    RequestDecorator? requestDecorator,
+    bool bodyDigest = false,
+    List<int>? metadataKey,
+    List<int>? cacheKey,
+    List<int>? signingKey,
+    SecretStore? secrets,
+    bool resumeDownloads = true,
+    bool journal = true,
+    LogSink? logSink,
+    LogLevel? logLevel,
+    String? apiToken,
+    bool takeOver = false,
+    Duration handoffTimeout = const Duration(seconds: 30),
+    CallContext? context,
+  }) => start(
+    ProxyOptions(
+      port: port,
+      storageDir: storageDir,
+      userAgent: userAgent,
+      proxyConfig: proxyConfig,
+      clientConfig: clientConfig,
+      httpClient: httpClient,
+      requestHeaders: {...?requestHeaders},
+      forwardHeaders: forwardHeaders,
+      passThroughHeaders: passThroughHeaders,
+      requestDecorator: requestDecorator,
+      bodyDigest: bodyDigest,
+      metadataKey: metadataKey,
+      cacheKey: cacheKey,
+      signingKey: signingKey,
+      secrets: secrets,
+      resumeDownloads: resumeDownloads,
+      journal: journal,
+      logSink: logSink,
+      logLevel: logLevel,
+      apiToken: apiToken,
+      takeOver: takeOver,
+      handoffTimeout: handoffTimeout,
+    ),
+    context: context,
+  );
+
+  /// Start the proxy with [options], or return the running one
+  ///
+  /// Throws an [ArgumentError] listing every problem with [options] (see
+  /// [ProxyOptions.validate]) before anything is opened.
+  static Future<StreamProxyBridge> start(
+    ProxyOptions options, {
+    CallContext? context,
   }) async {
+    options.validate();
+    if (options.logSink case final sink?) Logger.sink = sink;
+    if (options.logLevel case final level?) Logger.level = level;
     if (_instance == null) {
-      final dir = storageDir ?? '${(Directory.systemTemp).path}/video_cache';
-      await Directory(dir).create(recursive: true);
+      context?.throwIfDone();
+      final dir =
+          options.storageDir ?? '${(Directory.systemTemp).path}/video_cache';
+      final storage = await StorageCheck.run(dir);
+      for (final warning in storage.warnings) {
+        Logger.warn(warning, fields: {'dir': dir});
+      }
+      final port = options.port;
+      final tls = options.securityContext;
+
+      // A proxy already on the port saves its state and releases the
+      // port; ours binds it on the next poll, and connections waiting in
+      // its backlog are answered once the state is loaded. No socket is
+      // handed over: the few that arrive between the two are refused
+      HttpServer? server;
+      HandoffState? handoff;
+      if (options.takeOver) {
+        final nonce = HandoffState.newNonce();
+        final running = await HandoffState.request(
+          _baseUrl(options.address, port, secure: tls != null),
+          nonce,
+          token: options.apiToken,
+          key: options.access?.key,
+        );
+        if (running) {
+          server = await _bindWhenFree(options, tls, options.handoffTimeout);
+          handoff = await HandoffState.waitFor(
+            dir,
+            nonce,
+            timeout: options.handoffTimeout,
+          );
+          if (handoff == null) {
+            Logger.warn('No handoff state received, starting from disk');
+          }
+        }
+      }
 
+      // Ephemeral data never survives a restart
+      final ephemeralDir = Directory('$dir/.ephemeral');
+      if (await ephemeralDir.exists()) {
+        await ephemeralDir.delete(recursive: true);
+      }
+
+      final clientConfig = options.clientConfig;
+      final secrets = options.secrets;
+      final metadataKey =
+          options.metadataKey ??
+          await secrets?.readBytes(SecretStore.metadataKey);
+      final cacheKey =
+          options.cacheKey ?? await secrets?.readBytes(SecretStore.cacheKey);
       _instance = StreamProxyBridge._(
         port: port,
+        address: options.address,
+        tls: tls,
         storageDir: dir,
-        userAgent: userAgent,
-        proxyConfig: proxyConfig,
-      );
-      await _instance!._startServer();
+        userAgent: options.userAgent,
+        proxyConfig: options.proxyConfig,
+        clientConfig: clientConfig,
+        httpClient:
+            options.httpClient ??
+            _createClient(clientConfig, options.proxyConfig),
+        ownsClient: options.httpClient == null,
+        requestHeaders: {...options.requestHeaders},
+        forwardHeaders: {
+          for (final name in options.forwardHeaders) name.toLowerCase(),
+        },
+        passThroughHeaders: {
+          for (final name in options.passThroughHeaders) name.toLowerCase(),
+        },
+        requestDecorator: options.requestDecorator,
+        bodyDigestEnabled: options.bodyDigest,
+        metaCipher: metadataKey == null ? null : MetaCipher(metadataKey),
+        cacheCipher: cacheKey == null ? null : CacheCipher(cacheKey),
+        urlSigner: UrlSigner(
+          options.signingKey ?? await _loadSigningKey(dir, secrets),
+        ),
+      )..apiToken = options.apiToken
+        .._secrets = secrets
+        ..deadlines = options.deadlines
+        .._storageReport = storage;
+      if (options.access case final access?) _instance!.access = access;
+      await _instance!._loadNamespaceUsage();
+      await _instance!._loadAccessHistory();
+      await _instance!._loadPins();
+      await _instance!._loadSessions();
+      await _instance!._loadHostCapabilities();
+      await _instance!._loadColdPaths();
+      await _instance!._loadLifetimes();
+      await _instance!._loadFingerprints();
+      await _instance!._loadRegistry();
+      await _instance!._loadCollected();
+      await _instance!._loadFileCollections();
+      await _instance!._loadMirrors();
+      await _instance!._loadSidecars();
+      await _instance!._loadHostCredentials();
+      await _instance!._loadJournal();
+      await _instance!.recoverState(resume: options.resumeDownloads);
+      if (handoff != null) await _instance!._resumeFrom(handoff);
+      await _instance!._startJournal(enabled: options.journal);
+      _instance!._startJanitor();
+      if (options.cacheQuota case final quota?) _instance!.enableQuota(quota);
+      if (options.readAhead case final readAhead?) {
+        _instance!.enableReadAhead(readAhead);
+      }
+      if (options.socket case final socket?) {
+        server = HttpServer.listenOn(socket);
+      }
+      final instance = _instance!;
+      final starting = instance._startServer(server);
+      try {
+        await (context?.guard(starting) ?? starting);
+      } catch (_) {
+        // Leave no half-open singleton behind
+        _instance = null;
+        unawaited(
+          starting.then(
+            (_) => instance._server?.close(force: true),
+            onError: (_) {},
+          ),
+        );
+        rethrow;
+      }
     }
     return _instance!;
   }
 
-  /// Get proxy URL for a remote video
-  Uri getProxyUrl(String remoteUrl) {
-    final encoded = Uri.encodeComponent(remoteUrl);
-    return Uri.parse('http://127.0.0.1:$port/stream?url=$encoded');
+  /// URL of a proxy on [address] and [port]; one listening on every
+  /// interface is reached on loopback
+  static Uri _baseUrl(
+    InternetAddress address,
+    int port, {
+    bool secure = false,
+  }) {
+    final host = address == InternetAddress.anyIPv6
+        ? InternetAddress.loopbackIPv6.address
+        : address == InternetAddress.anyIPv4
+        ? InternetAddress.loopbackIPv4.address
+        : address.address;
+    return Uri(scheme: secure ? 'https' : 'http', host: host, port: port);
   }
 
-  /// Get progress stream for UI updates
-  Stream<(String, double)> get progressStream => _progressController.stream;
+  static HttpClient _createClient(ClientConfig config, ProxyConfig? proxy) {
+    final client = config.createClient();
+    proxy?.applyTo(client);
+    return client;
+  }
 
-  /// Start the local HTTP proxy server
-  Future<void> _startServer() async {
-    _server = await HttpServer.bind(InternetAddress.loopbackIPv4, port);
-    Logger.info('Stream Proxy running on http://127.0.0.1:$port');
+  /// Key kept in [secrets], else in [dir], so proxy URLs stay valid
+  /// across restarts
+  ///
+  /// A key file left in [dir] moves into [secrets] when they persist.
+  static Future<List<int>> _loadSigningKey(
+    String dir,
+    SecretStore? secrets,
+  ) async {
+    final stored = await secrets?.readBytes(SecretStore.signingKey);
+    if (stored != null) return stored;
 
-    _server!.listen(_handleRequest);
+    final file = File('$dir/.signing_key');
+    List<int>? key;
+    if (await file.exists()) {
+      try {
+        key = base64.decode((await file.readAsString()).trim());
+      } on FormatException {
+        Logger.error('Unreadable signing key, generating a new one');
+      }
+    }
+    key ??= UrlSigner.generateKey();
+    if (secrets != null && secrets.persistent) {
+      await secrets.writeBytes(SecretStore.signingKey, key);
+      if (await file.exists()) await file.delete();
+    } else {
+      await file.writeAsString(base64.encode(key));
+    }
+    return key;
   }
 
-  /// Handle incoming player requests with HYBRID streaming (Phase 3)
-  Future<void> _handleRequest(HttpRequest request) async {
+  /// Get proxy URL for a remote video
+  ///
+  /// The URL is `/stream/<token>`, [remoteUrl] signed by [urlSigner] and
+  /// valid until [expires] (forever when null): the proxy only fetches
+  /// what the app handed out.
+  ///
+  /// With [ephemeral] the data is only kept for the playback session.
+  /// [namespace] selects the profile whose policy applies. [profile]
+  /// tunes serving for the media kind. [nextUrl] is the next playlist
+  /// item, whose start is cached ahead (see also [setPlaylist]).
+  /// [session] is a client token whose position survives proxy restarts
+  /// (see [PlaybackSession]). [quality] picks a variant of an item
+  /// registered in [variants]; without it the default variant is served.
+  /// [client] names the device for fair scheduling (see [enableFairness]).
+  /// [sha256] is the checksum the completed file must match (see
+  /// [setExpectedChecksum]). [ttl] deletes the file that long after it
+  /// is first played (see [setLifetime]). [previewBytes] and
+  /// [previewDuration] make it a preview of the file's start (see
+  /// [previewBitrate]). [mirrors] are other URLs of the same file (see
+  /// [addMirrors]).
+  Uri getProxyUrl(
+    String remoteUrl, {
+    bool ephemeral = false,
+    String? namespace,
+    ServingProfile profile = ServingProfile.video,
+    String? nextUrl,
+    String? session,
+    String? quality,
+    String? client,
+    String? sha256,
+    Duration? ttl,
+    int? previewBytes,
+    Duration? previewDuration,
+    Iterable<String> mirrors = const [],
+    DateTime? expires,
+  }) {
+    final query = <String, Object>{
+      if (ephemeral) 'ephemeral': '1',
+      if (namespace != null) 'ns': namespace,
+      if (profile != ServingProfile.video) 'profile': profile.name,
+      if (nextUrl != null) 'next': urlSigner.sign(nextUrl, expires: expires),
+      if (session != null) 'session': session,
+      if (quality != null) 'quality': quality,
+      if (client != null) 'client': client,
+      if (sha256 != null) 'sha256': sha256,
+      if (ttl != null) 'ttl': '${ttl.inSeconds}',
+      if (previewBytes != null) 'preview': '$previewBytes',
+      if (previewDuration != null)
+        'previewSeconds': '${previewDuration.inSeconds}',
+      if (mirrors.isNotEmpty)
+        'mirror': [
+          for (final mirror in mirrors)
+            urlSigner.sign(mirror, expires: expires),
+        ],
+      if (access.key case final key?) AccessPolicy.keyParameter: key,
+    };
+    return baseUrl.replace(
+      path: '/stream/${urlSigner.sign(remoteUrl, expires: expires)}',
+      queryParameters: query.isEmpty ? null : query,
+    );
+  }
+
+  /// Proxy URL of the content [id], looked up by [contentResolver] on
+  /// each request; [namespace] and [profile] as in [getProxyUrl]
+  Uri getContentUrl(
+    String id, {
+    String? namespace,
+    ServingProfile profile = ServingProfile.video,
+  }) {
+    final query = {
+      if (namespace != null) 'ns': namespace,
+      if (profile != ServingProfile.video) 'profile': profile.name,
+      if (access.key case final key?) AccessPolicy.keyParameter: key,
+    };
+    return baseUrl.replace(
+      pathSegments: ['stream', id],
+      queryParameters: query.isEmpty ? null : query,
+    );
+  }
+
+  /// Looks up `/stream/<id>` requests whose ID is not a signed URL, so
+  /// players ask for content by ID and the app picks the upstream
+  ContentResolver? contentResolver;
+
+  // Upstream headers the resolver gave for each file, refreshed on each
+  // request for it
+  final Map<String, Map<String, String>> _resolvedHeaders = {};
+
+  /// Content ID a `/stream/<id>` request names, when [contentResolver]
+  /// is set; null for signed URL tokens
+  String? _contentIdOf(Uri uri) {
+    final segments = uri.pathSegments;
+    if (contentResolver == null ||
+        segments.length != 2 ||
+        segments.first != 'stream') {
+      return null;
+    }
     try {
-      final remoteUrl = request.uri.queryParameters['url'];
-      if (remoteUrl == null) {
-        request.response.statusCode = HttpStatus.badRequest;
-        await request.response.close();
-        return;
-      }
+      urlSigner.verify(segments[1]);
+      return null;
+    } on SignedUrlException {
+      return segments[1];
+    }
+  }
 
-      final fileId = _hashUrl(remoteUrl);
-      final localPath = '$storageDir/$fileId.video';
-      final metaPath = '$storageDir/$fileId.meta';
+  /// Upstream URL a stream request names: `/stream/<token>` signed by
+  /// [urlSigner], or the raw `?url=` when [allowUnsignedUrls] is set
+  ///
+  /// Null when it names none; throws a [SignedUrlException] for a bad
+  /// token or a refused raw URL.
+  String? _streamTarget(Uri uri) {
+    final segments = uri.pathSegments;
+    if (segments.length == 2 && segments.first == 'stream') {
+      return urlSigner.verify(segments[1]);
+    }
+    return _queryTarget(uri, 'url');
+  }
 
-      // Store URL for reverse lookup
-      _urlLookup[fileId] = remoteUrl;
+  /// Upstream URL in the query parameter [name]: a token from
+  /// [urlSigner], or a raw URL when [allowUnsignedUrls] is set
+  String? _queryTarget(Uri uri, String name) {
+    final value = uri.queryParameters[name];
+    return value == null ? null : _verifyTarget(value);
+  }
 
-      // Get or create data source
-      var dataSource = _dataSources[fileId];
-      if (dataSource == null) {
-        dataSource = HttpDataSource(
-          url: remoteUrl,
-          userAgent: userAgent,
-          proxyConfig: proxyConfig,
-        );
-        _dataSources[fileId] = dataSource;
-        // Log file stats when received
-        dataSource.fileStats.listen((stat) => Logger.info('File stats: $stat'));
+  /// Upstream URLs of every query parameter [name], as [_queryTarget]
+  List<String> _queryTargets(Uri uri, String name) => [
+    for (final value in uri.queryParametersAll[name] ?? const <String>[])
+      _verifyTarget(value),
+  ];
+
+  /// Upstream URL an admin API call names: a token from [urlSigner], or
+  /// a raw URL when [allowUnsignedUrls] is set or [apiToken] authorized
+  /// the call
+  ///
+  /// Without an [apiToken] anyone reaching the port passes
+  /// [_checkAuthorized], so raw URLs would make the proxy fetch for them.
+  String _adminTarget(String value) {
+    if (apiToken != null && (Uri.tryParse(value)?.hasScheme ?? false)) {
+      return value;
+    }
+    return _verifyTarget(value);
+  }
+
+  String _verifyTarget(String value) {
+    try {
+      return urlSigner.verify(value);
+    } on SignedUrlException {
+      if (allowUnsignedUrls) return value;
+      // Tokens have no scheme
+      if (Uri.tryParse(value)?.hasScheme ?? false) {
+        throw const SignedUrlException('Unsigned URLs are not allowed');
       }
+      rethrow;
+    }
+  }
 
-      // Get or create metadata
-      var meta = _metadata[fileId];
-      if (meta == null) {
-        final totalSize = await dataSource.getContentLength();
-        if (totalSize <= 0) {
-          request.response.statusCode = HttpStatus.badGateway;
-          await request.response.close();
-          return;
-        }
+  /// Get progress stream for UI updates, at most every [progressInterval]
+  /// per file
+  Stream<(String, double)> get progressStream => _progressController.stream;
 
-        // Create sparse file
-        final file = File(localPath);
-        final raf = await file.open(mode: FileMode.write);
-        await raf.truncate(totalSize);
-        await raf.close();
+  /// How often progress is reported per file at most, on [progressStream]
+  /// and as `progress` events; writes in between are coalesced
+  Duration get progressInterval => _progressInterval;
 
-        meta = DownloadMeta(
-          id: fileId,
-          totalSize: totalSize,
-          localPath: localPath,
-          metaPath: metaPath,
-          originalUrl: remoteUrl, // Store original URL in metadata
-        );
-        await meta.load(); // Load existing progress if any
-        _metadata[fileId] = meta;
+  set progressInterval(Duration interval) {
+    _progressInterval = interval;
+    for (final tracker in _progressTrackers.values) {
+      tracker.interval = interval;
+    }
+  }
 
-        // AUTO-START background download after first request!
-        // This ensures file completes even if player pauses
-        unawaited(startBackgroundDownload(remoteUrl));
+  /// Event log stream
+  Stream<ProxyEvent> get events => _eventController.stream;
+
+  /// Every download state change
+  Stream<Download> get downloadStates => _downloadController.stream;
+
+  /// Events of the given [types] (all when null), e.g. to drive a UI
+  ///
+  /// ```dart
+  /// proxy.subscribe({ProxyEventType.progress}).listen((event) {
+  ///   setState(() => percent[event.fileId!] = event.data['percent']);
+  /// });
+  /// ```
+  Stream<ProxyEvent> subscribe([Set<ProxyEventType>? types]) => types == null
+      ? events
+      : events.where((event) => types.contains(event.type));
+
+  /// Events an `/events` client asked for: `types=progress,evicted` and
+  /// `url=` narrow the stream; current progress of matching files comes
+  /// first so a dashboard joining late starts with a full picture.
+  /// `interval=<ms>` thins progress further (see [ProgressThrottle]).
+  Stream<ProxyEvent> _eventsFor(HttpRequest request) async* {
+    final params = request.uri.queryParameters;
+    final names = ProxyEventType.values.asNameMap();
+    final types = params['types']
+        ?.split(',')
+        .map((name) => names[name.trim()])
+        .whereType<ProxyEventType>()
+        .toSet();
+    final url = params['url'];
+    final fileId = url == null ? null : _hashUrl(url);
+    bool wanted(ProxyEvent event) => fileId == null || event.fileId == fileId;
+
+    if (types == null || types.contains(ProxyEventType.progress)) {
+      for (final meta in _metadata.values.toList()) {
+        if (fileId != null && meta.id != fileId) continue;
+        yield _progressEvent(meta, 0);
       }
+    }
+    final stream = subscribe(types).where(wanted);
+    final interval = int.tryParse(params['interval'] ?? '');
+    yield* interval == null || interval <= 0
+        ? stream
+        : stream.transform(
+            ProgressThrottle(Duration(milliseconds: interval)),
+          );
+  }
 
-      // Parse Range header
-      final rangeHeader = request.headers.value('range') ?? 'bytes=0-';
-      final (start, end) = _parseRange(rangeHeader, meta.totalSize);
+  /// GET /events - [events] as Server-Sent Events
+  ///
+  /// Each event is sent as `event: <type>` with its JSON in `data:`, so
+  /// browsers subscribe with `EventSource.addEventListener('progress')`.
+  Future<void> _handleEventsRequest(HttpRequest request) async {
+    final response = request.response;
+    response.headers.contentType = ContentType(
+      'text',
+      'event-stream',
+      charset: 'utf-8',
+    );
+    response.headers.set(HttpHeaders.cacheControlHeader, 'no-cache');
+    response.bufferOutput = false;
 
-      // HYBRID STREAMING HEADERS 🎯
-      request.response.statusCode = HttpStatus.partialContent;
-      request.response.headers.set(HttpHeaders.acceptRangesHeader, 'bytes');
-      request.response.headers.set(
-        HttpHeaders.contentTypeHeader,
-        meta.mimeType ?? 'video/mp4',
-      );
-      request.response.headers.set(
-        HttpHeaders.contentLengthHeader,
-        '${end - start + 1}',
-      );
-      request.response.headers.set(
-        'Content-Range',
-        'bytes $start-$end/${meta.totalSize}',
-      );
+    final closed = Completer<void>();
+    void end() {
+      if (!closed.isCompleted) closed.complete();
+    }
 
-      // HYBRID SERVE: Pipe cached + missing seamlessly
-      await _hybridServe(
-        request.response,
-        localPath,
-        start,
-        end,
-        meta,
-        dataSource,
-        remoteUrl,
+    final subscription = _eventsFor(request).listen((event) {
+      response.write(
+        'event: ${event.type.name}\n'
+        'data: ${jsonEncode(event.toJson())}\n\n',
       );
-    } catch (e, stack) {
-      Logger.error('Proxy error: $e\n$stack');
-      request.response.statusCode = HttpStatus.internalServerError;
-    } finally {
-      await request.response.close();
+    }, onDone: end);
+    final keepAlive = Timer.periodic(eventsKeepAlive, (_) {
+      response.write(': keep-alive\n\n');
+    });
+    // Fails once a write hits a connection the client dropped
+    unawaited(response.done.then((_) => end(), onError: (_) => end()));
+
+    await Future.any([closed.future, _stopping.future]);
+    keepAlive.cancel();
+    await subscription.cancel();
+  }
+
+  /// GET /events with a WebSocket upgrade - one JSON text message per event
+  Future<void> _handleEventsSocket(HttpRequest request) async {
+    final WebSocket socket;
+    try {
+      socket = await WebSocketTransformer.upgrade(request);
+    } catch (e) {
+      Logger.error('Events WebSocket upgrade failed: $e');
+      return;
     }
+    socket.pingInterval = eventsKeepAlive;
+    final subscription = _eventsFor(request).listen(
+      (event) => socket.add(jsonEncode(event.toJson())),
+      onDone: socket.close,
+    );
+    // Incoming messages are ignored; the stream ends when the client leaves
+    final left = socket.drain<void>().catchError((_) {});
+    await Future.any([left, _stopping.future]);
+    await subscription.cancel();
+    await socket.close();
   }
 
-  /// HYBRID SERVE: Serve cached portions + fetch missing gaps seamlessly
-  Future<void> _hybridServe(
-    HttpResponse response,
-    String localPath,
-    int start,
-    int end,
+  /// Mark [start]..[end] of [meta] cached and report it to subscribers;
+  /// [source] is the host that supplied the bytes, when known
+  void _recordRange(
     DownloadMeta meta,
-    DataSource dataSource,
-    String remoteUrl,
-  ) async {
-    final fileId = meta.id;
+    int start,
+    int end, {
+    String? source,
+  }) {
+    meta.addRange(start, end);
+    if (source != null) meta.sources.record(start, end, source);
+    if (!meta.ephemeral) _journal?.addRange(meta.id, start, end);
+    _migrationDeltas?[meta.id]?.add((start, end));
+    final tracker = _progressTrackers.putIfAbsent(
+      meta.id,
+      () => ProgressTracker(interval: _progressInterval),
+    );
+    if (tracker.add(start, end)) {
+      _reportProgress(meta);
+    } else {
+      // Report the last writes even if no more follow
+      _progressTimers[meta.id] ??= Timer(tracker.interval, () {
+        _progressTimers.remove(meta.id);
+        _reportProgress(meta);
+      });
+    }
+  }
 
-    // Get or create lock for this file
-    _fileLocks.putIfAbsent(fileId, () => Lock());
+  /// Emit the writes to [meta] since its last report
+  void _reportProgress(DownloadMeta meta) {
+    _progressTimers.remove(meta.id)?.cancel();
+    final tracker = _progressTrackers[meta.id];
+    if (tracker == null || !tracker.hasPending) return;
+    final report = tracker.report();
+    final url = _urlLookup[meta.id] ?? meta.originalUrl;
+    Logger.debug(
+      'Ranges cached',
+      fields: {
+        'fileId': meta.id,
+        'added': report.ranges.length,
+        'cachedBytes': meta.downloadedBytes,
+        'totalSize': meta.totalSize,
+      },
+    );
+    if (url != null && !_progressController.isClosed) {
+      _progressController.add((url, meta.progress));
+    }
+    for (final (start, end) in report.ranges) {
+      _emit(
+        ProxyEvent(
+          ProxyEventType.rangeAdded,
+          fileId: meta.id,
+          url: url,
+          data: {'start': start, 'end': end},
+        ),
+      );
+    }
+    _emit(_progressEvent(meta, report.bytesPerSecond.round()));
+  }
 
-    // We must acquire the lock to read, but we do it per-chunk logic
-    // inside the loop or surrounding the read ops.
-    // However, for simplicity and safety, we lock the serving session
-    // BUT we rely on the background downloader to be "polite" and yield.
-    await _fileLocks[fileId]!.synchronized(() async {
-      final raf = await File(localPath).open(mode: FileMode.read);
-      _activeDownloads.add(fileId);
+  void _forgetProgress(String fileId) {
+    _progressTrackers.remove(fileId);
+    _progressTimers.remove(fileId)?.cancel();
+  }
 
-      try {
-        int pos = start;
-        const chunkSize = 1024 * 1024; // 1MB chunks for serving
-
-        while (pos <= end) {
-          // Check if this position is cached
-          if (meta.hasRange(pos, min(pos + chunkSize - 1, end))) {
-            // SERVE FROM CACHE
-            final cacheEnd = min(pos + chunkSize - 1, end);
-            await raf.setPosition(pos);
-            final cachedData = await raf.read(cacheEnd - pos + 1);
-            response.add(cachedData);
-            pos = cacheEnd + 1;
-          } else {
-            // FETCH MISSING GAP and serve simultaneously
-            // We temporarily close RAF to let _fetchGapAndServe open it for writing
-            await raf.close();
+  ProxyEvent _progressEvent(DownloadMeta meta, int bytesPerSecond) {
+    final bytes = meta.downloadedBytes;
+    return ProxyEvent(
+      ProxyEventType.progress,
+      fileId: meta.id,
+      url: _urlLookup[meta.id] ?? meta.originalUrl,
+      data: {
+        'percent': bytes / meta.totalSize * 100,
+        'bytes': bytes,
+        'totalSize': meta.totalSize,
+        'bytesPerSecond': bytesPerSecond,
+      },
+    );
+  }
 
-            final gapEnd = min(pos + chunkSize - 1, end);
-            await _fetchGapAndServe(
-              response,
-              // We don't pass RAF because we closed it
-              dataSource,
-              pos,
-              gapEnd,
-              meta,
-              localPath,
-            );
+  void _emit(ProxyEvent event) {
+    if (!_eventController.isClosed) {
+      _eventController.add(event);
+    }
+  }
 
-            // Re-open for next iteration
-            // (In a real production app, you'd keep one RAF open and upgrade locks,
-            // but this is safer for cross-platform file systems)
-            final newRaf = await File(localPath).open(mode: FileMode.read);
-            // We can't assign to 'raf' because it's final, so we recurse or loop differently.
-            // Simplified approach: Return from this function and let player re-request?
-            // No, player expects stream.
-            // Fix: Refactor loop to open/close RAF inside the 'if' block.
-            await newRaf.close();
-
-            // Re-entering loop logic properly:
-            // The simplest way to handle R/W switching in a simple server
-            // is to NOT hold the read RAF open during the fetch.
-            pos = gapEnd + 1;
-          }
+  /// Digest event recorded for a request ID, if still retained
+  ProxyEvent? getBodyDigest(String requestId) => _bodyDigests[requestId];
+
+  /// Start the local HTTP proxy server
+  ///
+  /// Serve on [bound] (taken over from a previous process, or on a socket
+  /// the app provided) or a new socket on [address] and [port]
+  Future<void> _startServer([HttpServer? bound]) async {
+    _server = bound ?? await _bind(address, port, _tls);
+    Logger.info('Stream Proxy running on $baseUrl');
+
+    _server!.listen((request) {
+      final stopwatch = Stopwatch()..start();
+      if (request.uri.path != '/events') _startDeadline(request.response);
+      Logger.debug(
+        'Request',
+        fields: {
+          'method': request.method,
+          'path': request.uri.path,
+          'range': request.headers.value(HttpHeaders.rangeHeader),
+        },
+      );
+      final handling = _handleRequest(request);
+      _inFlight.add(handling);
+      handling.whenComplete(() {
+        _inFlight.remove(handling);
+        // Event streams stay open for as long as their client does
+        if (request.uri.path != '/events') {
+          proxyMetrics.requestDuration.observe(
+            stopwatch.elapsedMicroseconds / 1000000,
+          );
         }
-      } finally {
-        // raf is closed inside loop if we hit the 'else', need to handle that.
-        // To fix the "raf closed" issue in this simplified snippet:
-        // We will assume _hybridServe has exclusive access via the lock,
-        // so we can read freely. The issue is purely if we want to WRITE.
-        // Actually, _fetchGapAndServe DOES writes.
-        // So we are inside a LOCK. We can just open for READ/WRITE?
-        // 'mode: FileMode.append' is bad. 'mode: FileMode.write' allows reading?
-        // No, RandomAccessFile doesn't support RW update mode easily in Dart cross-platform.
-        // So we will stick to: Open Read -> Read -> Close. Open Write -> Write -> Close.
-      }
-      // Re-implementation of the loop with proper open/close to allow mixed RW
+        Logger.debug(
+          'Response',
+          fields: {
+            'path': request.uri.path,
+            'status': request.response.statusCode,
+            'ms': stopwatch.elapsedMilliseconds,
+          },
+        );
+      });
     });
+  }
 
-    // Correct Implementation of the Serving Loop with Lock
-    await _fileLocks[fileId]!.synchronized(() async {
-      _activeDownloads.add(fileId);
-      try {
-        int pos = start;
-        const chunkSize = 1024 * 1024;
-
-        while (pos <= end) {
-          final currentEnd = min(pos + chunkSize - 1, end);
-
-          if (meta.hasRange(pos, currentEnd)) {
-            // READ
-            final raf = await File(localPath).open(mode: FileMode.read);
-            await raf.setPosition(pos);
-            final data = await raf.read(currentEnd - pos + 1);
-            await raf.close();
-            response.add(data);
-          } else {
-            // FETCH & WRITE & SERVE
-            await _fetchGapAndServe(
-              response,
-              dataSource,
-              pos,
-              currentEnd,
-              meta,
-              localPath,
-            );
-          }
-          pos = currentEnd + 1;
-        }
-      } finally {
-        _activeDownloads.remove(fileId);
-      }
+  /// Paths the stream handler serves, after every route below
+  static const _streamRoutes = ['/stream', '/dash/'];
+
+  /// Endpoints answering a whole subtree, e.g. `/api/downloads/<id>`
+  late final Map<String, _Route> _prefixRoutes = {
+    '/api/downloads': _handleDownloadsApi,
+    '/api/collections': _handleCollectionsApi,
+  };
+
+  /// Endpoints answering one path; [capabilities] lists these too, so
+  /// a route added here is advertised
+  late final Map<String, _Route> _routes = {
+    '/events': _authorized(_handleEventsRequest),
+    '/digest': _authorized(_handleDigestRequest),
+    '/upload': _handleUploadRequest,
+    '/work': _handleWorkRequest,
+    '/archive': _handleArchiveRequest,
+    '/subtitles': _handleSubtitlesRequest,
+    '/capabilities': _handleCapabilitiesRequest,
+    '/version': (request) => _writeJson(request.response, buildInfo.toJson()),
+    '/session': _handleSessionRequest,
+    '/connections': _authorized(
+      (request) => _writeJson(request.response, connectionMetrics.toJson()),
+    ),
+    '/shadow': (request) => _writeJson(request.response, _shadow?.toJson()),
+    '/plan': _handlePlanRequest,
+    '/offline': (request) => _writeJson(request.response, offlineStatus),
+    '/api/limits': _handleLimitsRequest,
+    '/api/audit': _authorized(
+      (request) => _writeJson(request.response, headerAudit.toJson()),
+    ),
+    '/api/registry': _authorized(
+      (request) =>
+          _writeJson(request.response, {'entries': _registry.toJson()}),
+    ),
+    '/api/requests': _authorized(_handleRequestLog),
+    '/api/replay': _authorized(_handleReplayRequest),
+    '/api/handoff': _handleHandoffRequest,
+    '/metrics': _authorized(_handleMetricsRequest),
+  };
+
+  /// [route] behind [_checkAuthorized]
+  _Route _authorized(_Route route) =>
+      (request) => _checkAuthorized(request) ? route(request) : null;
+
+  void _handleMetricsRequest(HttpRequest request) {
+    request.response.headers.set(
+      HttpHeaders.contentTypeHeader,
+      PrometheusText.contentType,
+    );
+    request.response.write(prometheusMetrics());
+  }
 
-      _scheduleDebouncedSave(fileId, meta);
-      _progressController.add((remoteUrl, meta.progress));
-    });
+  void _handleRequestLog(HttpRequest request) {
+    final log = _requestLog;
+    if (log == null) {
+      request.response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    request.response.headers.contentType = ContentType.text;
+    request.response.write(log.toLog());
   }
 
-  /// Fetch a gap from remote and serve to player while caching
-  Future<void> _fetchGapAndServe(
-    HttpResponse response,
-    DataSource dataSource,
-    int gapStart,
-    int gapEnd,
-    DownloadMeta meta,
-    String localPath,
-  ) async {
-    final upstream = await dataSource.fetchRange(gapStart, gapEnd);
-    int currentPos = gapStart;
+  /// Handle incoming player requests with HYBRID streaming (Phase 3)
+  Future<void> _handleRequest(HttpRequest request) async {
+    if (!await _checkAccess(request)) return;
 
-    // We open/close file per chunk to ensure we don't hold handle too long?
-    // No, inside this function we are already inside the main Lock, so we own the file.
-    // We can keep it open.
-    final raf = await File(localPath).open(mode: FileMode.write);
+    // A WebSocket takes over the connection: there is no response to close
+    if (request.uri.path == '/events' &&
+        WebSocketTransformer.isUpgradeRequest(request)) {
+      if (!_checkAuthorized(request)) {
+        await request.response.close();
+        return;
+      }
+      await _handleEventsSocket(request);
+      return;
+    }
 
     try {
-      await for (final chunk in upstream) {
-        response.add(chunk);
-        await raf.setPosition(currentPos);
-        await raf.writeFrom(chunk);
-        meta.addRange(currentPos, currentPos + chunk.length - 1);
-        currentPos += chunk.length;
+      final segments = request.uri.pathSegments;
+      final prefixed = _prefixRoutes['/${segments.take(2).join('/')}'];
+      final route = prefixed ?? _routes[request.uri.path];
+      if (route != null) {
+        await route(request);
+        return;
       }
-    } finally {
-      await raf.close();
-    }
-  }
 
-  /// Schedule a debounced save for metadata
+      switch (request.method) {
+        case 'GET' || 'HEAD':
+          break;
+        case 'OPTIONS':
+          _answerPreflight(request);
+          return;
+        default:
+          request.response.statusCode = HttpStatus.methodNotAllowed;
+          request.response.headers.set(
+            HttpHeaders.allowHeader,
+            _streamMethods,
+          );
+          return;
+      }
+      final head = request.method == 'HEAD';
+      _allowCrossOrigin(request.response);
+
+      // Segments of a rewritten DASH manifest: /dash/<directory>/<path>
+      final dashTarget = manifestAware ? _dashTarget(request.uri) : null;
+
+      // Content IDs are looked up, never taken from the client as URLs
+      final contentId = dashTarget == null ? _contentIdOf(request.uri) : null;
+      final resolved = contentId == null
+          ? null
+          : await contentResolver!.resolve(contentId);
+      if (contentId != null && resolved == null) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.notFound,
+          details: {'message': 'Unknown content: $contentId'},
+        );
+        return;
+      }
+      // Sidecars of a file: /stream/<file ID>/<kind>/<n>
+      final sidecarPath = dashTarget == null && _isSidecarPath(request.uri);
+      final sidecarTarget = sidecarPath ? _sidecarTarget(request.uri) : null;
+      if (sidecarPath && sidecarTarget == null) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.notFound,
+          details: {'message': 'Unknown sidecar: ${request.uri.path}'},
+        );
+        return;
+      }
+      final itemUrl =
+          dashTarget ??
+          sidecarTarget ??
+          resolved?.url ??
+          _streamTarget(request.uri);
+      final nextTarget = _queryTarget(request.uri, 'next');
+      if (itemUrl == null) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.badRequest,
+          details: {'message': 'Missing url parameter'},
+        );
+        return;
+      }
+
+      // An item with registered variants is served in the asked quality,
+      // each variant cached under its own URL
+      final group = variants[itemUrl];
+      final quality = request.uri.queryParameters['quality'];
+      final remoteUrl = group == null ? itemUrl : group.resolve(quality);
+      if (remoteUrl == null) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.badRequest,
+          details: {'message': 'Unknown variant: $quality'},
+        );
+        return;
+      }
+
+      // Namespace (profile) policy
+      final namespace = request.uri.queryParameters['ns'];
+      final denial = _checkNamespacePolicy(namespace, remoteUrl);
+      if (denial != null) {
+        _denyByPolicy(request, namespace!, remoteUrl, denial);
+        return;
+      }
+
+      final fileId = _hashUrl(remoteUrl);
+
+      // Nothing can be cached without storage: the origin answers
+      if (!storageAvailable) {
+        await _servePassThrough(
+          request,
+          _getDataSource(fileId, remoteUrl),
+          remoteUrl,
+        );
+        return;
+      }
+      _lastPlayerRequest = DateTime.now();
+
+      // Store URL for reverse lookup
+      _urlLookup[fileId] = remoteUrl;
+      if (resolved != null) _resolvedHeaders[fileId] = resolved.headers;
+      _fileClients[fileId] = _clientOf(request);
+      if (forwardHeaders.isNotEmpty) {
+        _forwardedHeaders[fileId] = _forwardedFrom(request);
+      }
+
+      if (request.uri.queryParameters['ephemeral'] == '1') {
+        _ephemeralIds.add(fileId);
+      }
+
+      // Expired content is never served; a fresh copy starts over
+      if (_lifetimes[fileId]?.isExpired(DateTime.now()) ?? false) {
+        await _expire(fileId);
+        _urlLookup[fileId] = remoteUrl;
+      }
+      final ttl = int.tryParse(request.uri.queryParameters['ttl'] ?? '');
+      if (request.uri.queryParameters.containsKey('ttl') &&
+          (ttl == null || ttl <= 0)) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.badRequest,
+          details: {'message': 'Invalid ttl, expected seconds'},
+        );
+        return;
+      }
+      if (ttl != null) _keepFor(fileId, Duration(seconds: ttl));
+
+      // Probed on first use, once the file's size is known
+      final mirrors = _queryTargets(request.uri, 'mirror');
+      if (_registerMirrors(fileId, remoteUrl, mirrors).isNotEmpty) {
+        unawaited(_saveMirrors());
+      }
+
+      final (preview, previewValid) = _previewOf(request.uri);
+      if (!previewValid) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.badRequest,
+          details: {'message': 'Invalid preview, expected bytes or seconds'},
+        );
+        return;
+      }
+
+      final sha256 = request.uri.queryParameters['sha256'];
+      if (sha256 != null && !_expectChecksum(fileId, sha256)) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.badRequest,
+          details: {'message': 'Invalid sha256: $sha256'},
+        );
+        return;
+      }
+
+      // A new file needs an upstream probe: shed it under pressure
+      final shedReason = _loadShedder?.reason;
+      if (shedReason != null && _metadata[fileId] == null) {
+        _shedRequest(request, fileId, remoteUrl, shedReason);
+        return;
+      }
+
+      // Manifest-aware mode recognizes playlists by their URL
+      final playlist =
+          manifestAware && StreamManifest.detect(url: remoteUrl) != null;
+      final profileName = request.uri.queryParameters['profile'];
+      final profile = dashTarget != null
+          ? ServingProfile.segment
+          : ServingProfile.values.asNameMap()[profileName] ??
+                (playlist ? ServingProfile.manifest : ServingProfile.video);
+      final audio = profile == ServingProfile.audio;
+
+      if (profile == ServingProfile.manifest) {
+        final dataSource = _getDataSource(fileId, remoteUrl);
+        await _serveObject(request, remoteUrl, dataSource);
+        return;
+      }
+
+      // A known session skips the origin probe after a restart
+      final sessionToken =
+          request.uri.queryParameters['session'] ??
+          request.headers.value('x-downstream-session');
+      final session = sessionToken == null ? null : _sessions[sessionToken];
+
+      final dataSource = _getDataSource(fileId, remoteUrl);
+      final segment = profile == ServingProfile.segment;
+      var meta = await _getOrCreateMeta(
+        fileId,
+        remoteUrl,
+        knownSize: session?.fileId == fileId ? session!.totalSize : null,
+        // Segments stay in the cache instead of moving to the collection;
+        // previews never download past their budget, and a HEAD only
+        // asks for the size
+        autoDownload: !segment && preview == null && !head,
+      );
+      if (meta == null && _emptyFiles.contains(fileId)) {
+        _serveEmpty(request);
+        return;
+      }
+      if (meta == null && (profile == ServingProfile.asset || segment)) {
+        // No length or no HEAD support (typical for APIs): cache it whole
+        meta = await _cacheWholeBody(fileId, remoteUrl, dataSource);
+      }
+      if (meta == null && (audio || _liveStreams.contains(fileId))) {
+        // Unknown length: a live or chunked stream, passed through
+        await _serveLive(
+          request,
+          dataSource,
+          fileId,
+          remoteUrl,
+          audio: audio,
+          record:
+              recordLive || request.uri.queryParameters['record'] == '1',
+        );
+        return;
+      }
+      if (meta == null) {
+        errorPages.write(
+          request.response,
+          ProxyFailure.upstreamUnavailable,
+          details: {'url': remoteUrl},
+        );
+        return;
+      }
+
+      // Parse Range header (none means the full body with a 200)
+      List<(int, int)>? ranges;
+      try {
+        ranges = RangeHeader.parse(
+          request.headers.value('range'),
+          meta.totalSize,
+        );
+      } on RangeNotSatisfiableException {
+        _rejectRange(request.response, meta.totalSize);
+        return;
+      }
+
+      // A preview is the file's first bytes and nothing past them
+      final budget = preview == null
+          ? null
+          : _previewBudget(fileId, meta.totalSize, preview);
+      if (budget != null) {
+        ranges = _clipToBudget(ranges ?? [(0, meta.totalSize - 1)], budget);
+        if (ranges == null) {
+          _rejectRange(request.response, meta.totalSize);
+          return;
+        }
+        request.response.headers.set('X-DownStream-Preview', '$budget');
+      }
+      final parts = ranges ?? [(0, meta.totalSize - 1)];
+      final start = parts.first.$1;
+      final end = parts.last.$2;
+      final bytes = parts.fold(0, (sum, r) => sum + r.$2 - r.$1 + 1);
+
+      // Cached ranges are always served; uncached ones may be shed
+      if (shedReason != null &&
+          !head &&
+          !parts.every((r) => meta.hasRange(r.$1, r.$2))) {
+        _shedRequest(request, fileId, remoteUrl, shedReason);
+        return;
+      }
+
+      if (sessionToken != null) {
+        _updateSession(sessionToken, meta, remoteUrl, start);
+      }
+
+      // HYBRID STREAMING HEADERS 🎯
+      final contentType = switch (profile) {
+        ServingProfile.audio => _audioMimeType(meta),
+        ServingProfile.asset || ServingProfile.segment =>
+          meta.mimeType ?? mimeTypeForName(meta.suggestedFileName),
+        ServingProfile.video ||
+        ServingProfile.manifest => await _videoMimeType(meta, dataSource),
+      };
+      final multipart = parts.length > 1
+          ? MultipartByteRanges(
+              parts,
+              meta.totalSize,
+              contentType,
+              DownStreamUtils.randomId(),
+            )
+          : null;
+      request.response.statusCode = ranges == null
+          ? HttpStatus.ok
+          : HttpStatus.partialContent;
+      request.response.headers.set(HttpHeaders.acceptRangesHeader, 'bytes');
+      request.response.headers.set(
+        HttpHeaders.contentTypeHeader,
+        multipart?.mediaType ?? contentType,
+      );
+      request.response.headers.set(
+        HttpHeaders.contentLengthHeader,
+        '${multipart?.contentLength ?? bytes}',
+      );
+      if (ranges != null && multipart == null) {
+        request.response.headers.set(
+          'Content-Range',
+          'bytes $start-$end/${meta.totalSize}',
+        );
+      }
+      final fileName = meta.fileName;
+      if (fileName != null && fileName.isNotEmpty) {
+        request.response.headers.set(
+          'Content-Disposition',
+          DownStreamUtils.contentDisposition(fileName),
+        );
+      }
+      _passHeaders(request.response, meta);
+
+      // The headers are the whole answer: nothing is fetched or recorded
+      if (head) return;
+
+      // Optional body digest, published after the last byte is sent
+      BodyDigest? digest;
+      String? requestId;
+      final wantDigest = request.uri.queryParameters['digest'] == '1';
+      if (bodyDigestEnabled || wantDigest) {
+        digest = BodyDigest();
+        requestId = DownStreamUtils.randomId();
+        request.response.headers.set('X-DownStream-Request-Id', requestId);
+      }
+
+      _recordRequest(request, remoteUrl, start, end);
+      final chunkSize = audio ? audioProfile.chunkSize : 1024 * 1024;
+      for (final (partStart, partEnd) in parts) {
+        _shadow?.observe(
+          fileId,
+          meta,
+          partStart,
+          partEnd,
+          liveChunkSize: chunkSize,
+        );
+      }
+
+      // HYBRID SERVE: Pipe cached + missing seamlessly
+      final connection = _Connection(request.response);
+      for (int i = 0; i < parts.length; i++) {
+        if (connection.closed) break;
+        if (multipart != null) {
+          final header = multipart.partHeader(i);
+          request.response.add(header);
+          digest?.add(header);
+        }
+        await _hybridServe(
+          request.response,
+          meta.localPath,
+          parts[i].$1,
+          parts[i].$2,
+          meta,
+          dataSource,
+          remoteUrl,
+          digest: digest,
+          chunkSize: chunkSize,
+          limiter: _clientLimiter(_clientOf(request)),
+          connection: connection,
+        );
+      }
+      if (multipart != null) {
+        request.response.add(multipart.trailer);
+        digest?.add(multipart.trailer);
+      }
+
+      final nextUrl = budget == null ? nextTarget ?? _nextUrls[fileId] : null;
+      if (nextUrl != null) {
+        _maybePrefetchNext(
+          meta,
+          end,
+          nextUrl,
+          threshold: audio
+              ? audioProfile.prefetchThreshold
+              : playlistPrefetch.threshold,
+          bytes: audio
+              ? audioProfile.nextTrackPrefetchBytes
+              : playlistPrefetch.bytes,
+        );
+      }
+
+      if (digest != null) {
+        _recordBodyDigest(requestId!, fileId, remoteUrl, start, end, digest);
+      }
+      _playheads[fileId] = (end, DateTime.now());
+      if (budget == null) _maybeReadAhead(meta, dataSource);
+      if (sessionToken != null) {
+        _updateSession(sessionToken, meta, remoteUrl, end + 1);
+      }
+      if (meta.ephemeral) {
+        _touchEphemeral(fileId);
+      } else {
+        _recordAccess(fileId, start, end);
+      }
+      if (namespace != null) {
+        await _recordNamespaceUsage(namespace, bytes);
+      }
+    } on SignedUrlException catch (e) {
+      errorPages.write(
+        request.response,
+        ProxyFailure.unauthorized,
+        details: {'message': e.message},
+      );
+    } catch (e, stack) {
+      Logger.error(
+        'Proxy error',
+        fields: {'path': request.uri.path},
+        error: e,
+        stackTrace: stack,
+      );
+      // An unmounted card or a dropped share fails every file operation
+      if (e is FileSystemException) unawaited(_checkStorage(e));
+      try {
+        errorPages.write(
+          request.response,
+          ProxyFailure.internal,
+          details: {'message': '$e'},
+        );
+      } on StateError {
+        // Headers already sent: the player sees a truncated body
+      }
+    } finally {
+      await request.response.close();
+    }
+  }
+
+  /// Get or create the data source for a file
+  DataSource _getDataSource(String fileId, String remoteUrl) {
+    var dataSource = _dataSources[fileId];
+    if (dataSource == null) {
+      dataSource = _newDataSource(fileId, remoteUrl);
+      _dataSources[fileId] = dataSource;
+      // Log file stats when received
+      dataSource.fileStats.listen((stat) => Logger.info('File stats: $stat'));
+    }
+    return dataSource;
+  }
+
+  /// Data source fetching [fileId] from [url]: its own URL, or one of its
+  /// mirrors when [mirror]
+  ///
+  /// A mirror keeps its own validator; when it changes, only the mirror
+  /// is dropped.
+  HttpDataSource _newDataSource(
+    String fileId,
+    String url, {
+    bool mirror = false,
+  }) {
+    final host = Uri.parse(url).host;
+    final policy = hostPolicies.match(host);
+    final capabilities = _hostCapabilities[host.toLowerCase()];
+    return HttpDataSource(
+      url: url,
+      userAgent: userAgent,
+      proxyConfig: proxyConfig,
+      customHeaders: _headersFor(host, policy),
+      metrics: connectionMetrics,
+      maxRetries: policy?.maxRetries ?? 0,
+      retryDelay: policy?.retryDelay ?? const Duration(seconds: 1),
+      mirrors: policy?.mirrors ?? const [],
+      rankHosts: (hosts) => _metadata[fileId]?.sources.rank(hosts) ?? hosts,
+      decorator: (request) => _decorateUpstream(fileId, url, request),
+      ifRange: mirror ? null : _metadata[fileId]?.validator,
+      onChanged: mirror
+          ? () => _mirrors[fileId]?.drop(url, 'changed upstream')
+          : () => unawaited(_upstreamChanged(fileId, url)),
+      certificatePins: {
+        for (final pinned in [host, ...?policy?.mirrors])
+          if (hostPolicies.match(pinned)?.pins case final pins?
+              when pins.isNotEmpty)
+            pinned: pins,
+      },
+      onPinMismatch: (host, presented) =>
+          _pinMismatch(fileId, url, host, presented),
+      useHead: capabilities?.supportsHead != false,
+      isolateHeaders: isolateOriginHeaders,
+      clientConfig: clientConfig,
+      client: httpClient,
+    );
+  }
+
+  // Never passed upstream: they describe the player's own connection
+  // and request, which the proxy makes differently
+  static const _hopHeaders = {
+    'host',
+    'range',
+    'if-range',
+    'connection',
+    'content-length',
+    'transfer-encoding',
+    'accept-encoding',
+  };
+
+  // Describe the bytes the proxy sends, so never taken from upstream
+  static const _ownResponseHeaders = {
+    'content-length',
+    'content-range',
+    'content-type',
+    'content-encoding',
+    'transfer-encoding',
+    'accept-ranges',
+    'connection',
+    'keep-alive',
+  };
+
+  /// Keep the [passThroughHeaders] among upstream [headers] with [meta]
+  void _keepPassedHeaders(DownloadMeta meta, Map<String, String> headers) {
+    for (final name in passThroughHeaders.difference(_ownResponseHeaders)) {
+      if (headers[name] case final value?) meta.responseHeaders[name] = value;
+    }
+  }
+
+  /// Send the kept upstream headers of [meta] that are still passed
+  void _passHeaders(HttpResponse response, DownloadMeta meta) {
+    for (final MapEntry(key: name, :value) in meta.responseHeaders.entries) {
+      if (passThroughHeaders.contains(name) &&
+          !_ownResponseHeaders.contains(name)) {
+        response.headers.set(name, value);
+      }
+    }
+  }
+
+  Map<String, String> _forwardedFrom(HttpRequest request) => {
+    for (final name in forwardHeaders.difference(_hopHeaders))
+      if (request.headers[name] case final values?)
+        name: values.join(name == 'cookie' ? '; ' : ', '),
+  };
+
+  /// Host policy headers are set first, then [requestHeaders], then the
+  /// forwarded ones, then [requestDecorator]; later ones win
+  ///
+  /// A redirect to another origin than [remoteUrl]'s (and its mirrors)
+  /// gets that host's own policy headers and no forwarded ones, unless
+  /// [isolateOriginHeaders] is off. What was sent lands in [headerAudit].
+  Future<void> _decorateUpstream(
+    String fileId,
+    String remoteUrl,
+    HttpClientRequest request,
+  ) async {
+    final home = _isHomeOrigin(request.uri, Uri.parse(remoteUrl));
+    final isolated = !home && isolateOriginHeaders;
+    if (isolated) {
+      hostPolicies
+          .match(request.uri.host)
+          ?.requestHeaders
+          .forEach(request.headers.set);
+    }
+    requestHeaders.forEach(request.headers.set);
+    if (!isolated) {
+      _forwardedHeaders[fileId]?.forEach(request.headers.set);
+      _resolvedHeaders[fileId]?.forEach(request.headers.set);
+    }
+    await requestDecorator?.call(request);
+
+    final names = <String>[];
+    request.headers.forEach((name, _) => names.add(name));
+    headerAudit.record(
+      request.uri.host,
+      names,
+      fileId: fileId,
+      crossOrigin: !home,
+    );
+  }
+
+  /// Whether [uri] is on the origin of [origin] or one of its mirrors
+  bool _isHomeOrigin(Uri uri, Uri origin) {
+    if (uri.scheme != origin.scheme || uri.port != origin.port) return false;
+    if (uri.host == origin.host) return true;
+    final mirrors = hostPolicies.match(origin.host)?.mirrors ?? const [];
+    return mirrors.contains(uri.host);
+  }
+
+  void _pinMismatch(
+    String fileId,
+    String remoteUrl,
+    String host,
+    String? presented,
+  ) {
+    Logger.error(
+      presented == null
+          ? 'Certificate pinning: $host reached without TLS'
+          : 'Certificate pinning: $host presented $presented, not pinned',
+    );
+    _emit(
+      ProxyEvent(
+        ProxyEventType.pinMismatch,
+        fileId: fileId,
+        url: remoteUrl,
+        data: {'host': host, 'presented': presented},
+      ),
+    );
+  }
+
+  /// Get or create metadata (and the sparse file) for a file
+  ///
+  /// [knownSize] skips the HEAD probe when the caller already knows the
+  /// total size. Returns null when the size cannot be determined.
+  ///
+  /// Concurrent first requests for a file share one initialization; a
+  /// failed one is not cached, so the next request retries it.
+  Future<DownloadMeta?> _getOrCreateMeta(
+    String fileId,
+    String remoteUrl, {
+    int? knownSize,
+    bool autoDownload = true,
+  }) async {
+    final meta = _metadata[fileId] ?? await _collectedMeta(fileId, remoteUrl);
+    if (meta != null) return meta;
+
+    final pending = _metaInits[fileId];
+    if (pending != null) return pending;
+
+    final init = _initMeta(
+      fileId,
+      remoteUrl,
+      knownSize: knownSize,
+      autoDownload: autoDownload,
+    );
+    _metaInits[fileId] = init;
+    try {
+      return await init;
+    } catch (e) {
+      _emit(
+        ProxyEvent(
+          ProxyEventType.initFailed,
+          fileId: fileId,
+          url: remoteUrl,
+          data: {'reason': 'error', 'error': '$e'},
+        ),
+      );
+      rethrow;
+    } finally {
+      _metaInits.remove(fileId);
+    }
+  }
+
+  /// Probe, preallocate and load metadata; safe to repeat after a failure
+  Future<DownloadMeta?> _initMeta(
+    String fileId,
+    String remoteUrl, {
+    int? knownSize,
+    bool autoDownload = true,
+  }) async {
+    // Ephemeral files live in a scratch folder and have no .meta file
+    final ephemeral = _ephemeralIds.contains(fileId);
+    final dir = ephemeral ? '$storageDir/.ephemeral' : storageDir;
+
+    // A .meta file left by an earlier run already knows the size
+    int? totalSize = knownSize;
+    if (totalSize == null && !ephemeral) {
+      totalSize = await DownloadMeta.peekTotalSize(
+        '$dir/$fileId.meta',
+        cipher: metaCipher,
+      );
+    }
+    totalSize ??= await _getDataSource(fileId, remoteUrl).getContentLength();
+    if (totalSize == 0) {
+      // Genuinely empty: nothing to preallocate, fetch or track
+      _emptyFiles.add(fileId);
+      return null;
+    }
+    if (totalSize < 0) {
+      _liveStreams.add(fileId);
+      _emit(
+        ProxyEvent(
+          ProxyEventType.initFailed,
+          fileId: fileId,
+          url: remoteUrl,
+          data: {'reason': 'unknownLength'},
+        ),
+      );
+      return null;
+    }
+
+    if (ephemeral) {
+      await Directory(dir).create(recursive: true);
+    }
+
+    // Create sparse file (keep existing bytes, they may be cached already)
+    final localPath = ephemeral
+        ? '$dir/$fileId.video'
+        : _coldPaths[fileId] ?? '$dir/$fileId.video';
+    final raf = await File(localPath).open(mode: FileMode.append);
+    if (await raf.length() != totalSize) {
+      await raf.truncate(totalSize);
+    }
+    await raf.close();
+
+    final meta = DownloadMeta(
+      id: fileId,
+      totalSize: totalSize,
+      localPath: localPath,
+      metaPath: '$dir/$fileId.meta',
+      originalUrl: remoteUrl, // Store original URL in metadata
+      ephemeral: ephemeral,
+      cipher: metaCipher,
+    );
+    await meta.load(); // Load existing progress if any
+    await _keyCacheFile(meta);
+    meta.expectedSha256 =
+        _expectedChecksums.remove(fileId) ?? meta.expectedSha256;
+    _metadata[fileId] = meta;
+    _setDownloadState(
+      fileId,
+      meta.isComplete ? DownloadState.completed : DownloadState.queued,
+    );
+
+    // Keep what the probe learned about the file
+    final source = _dataSources[fileId];
+    final stat = source?.lastStat;
+    meta.mimeType ??= stat?.mimeType;
+    meta.fileName ??= stat?.fileName;
+    meta.etag ??= stat?.etag;
+    meta.lastModified ??= stat?.lastModified;
+    if (stat != null) _keepPassedHeaders(meta, stat.headers);
+    _register(meta, remoteUrl);
+    final capabilities = _capabilitiesFor(remoteUrl);
+    if (stat?.acceptsRanges == false ||
+        capabilities?.acceptsRanges == false) {
+      _rangeless.add(fileId);
+    }
+    if (source != null && stat != null) {
+      _probeHost(remoteUrl, source, totalSize);
+    }
+    // Without a probe this run, validate against the stored version
+    if (source is HttpDataSource) source.ifRange ??= meta.validator;
+
+    // AUTO-START background download after first request!
+    // This ensures file completes even if player pauses
+    // (ephemeral sessions only keep what the player actually reads)
+    if (autoDownload && !ephemeral) {
+      unawaited(startBackgroundDownload(remoteUrl));
+    }
+    if (!ephemeral) {
+      _warmFromHistory(meta, remoteUrl);
+    }
+    return meta;
+  }
+
+  /// HYBRID SERVE: Serve cached portions + fetch missing gaps seamlessly
+  Future<void> _hybridServe(
+    HttpResponse response,
+    String localPath,
+    int start,
+    int end,
+    DownloadMeta meta,
+    DataSource dataSource,
+    String remoteUrl, {
+    BodyDigest? digest,
+    int chunkSize = 1024 * 1024,
+    RateLimiter? limiter,
+    _Connection? connection,
+  }) async {
+    final fileId = meta.id;
+
+    // Get or create lock for this file
+    _fileLocks.putIfAbsent(fileId, () => SharedLock());
+
+    if (_rangeless.contains(fileId)) {
+      await _serveSequential(
+        response,
+        meta,
+        remoteUrl,
+        start,
+        end,
+        digest,
+        limiter: limiter,
+      );
+      return;
+    }
+
+    // Queue for an upstream slot before taking the lock, never while
+    // holding it (background work holds slots and waits for the lock)
+    if (_watching.update(fileId, (n) => n + 1, ifAbsent: () => 1) == 1) {
+      _bandwidthGuard?.sessionStarted();
+    }
+    _fairQueue?.promote(fileId);
+    final slot = meta.getGapsIn(start, end).isEmpty
+        ? null
+        : await _admit(fileId, priority: DownloadPriority.foreground);
+    final lock = _fileLocks[fileId]!;
+    int? rangeIgnoredAt;
+    _activeDownloads.add(fileId);
+    try {
+      // Stitch: cached sub-ranges come from disk and only the missing
+      // bytes between them are fetched, [chunkSize] at a time. Reads share
+      // the lock with other players on the file; writes take it alone per
+      // piece, so another player is served from what this one fetches
+      // instead of fetching it again.
+      int pos = start;
+      var fetchingAhead = false;
+      while (pos <= end) {
+        if (connection?.closed ?? false) {
+          _detach(meta, dataSource, pos, end, connection!);
+          break;
+        }
+        final from = pos;
+        final (cachedEnd, gapEnd) = await lock.shared(() async {
+          final gaps = meta.getGapsIn(from, end);
+          var (cachedEnd, gapEnd) = gaps.isEmpty
+              ? (end, null)
+              : (gaps.first.$1 - 1, gaps.first.$2);
+          // Cached bytes go out a chunk at a time, each once the client
+          // took the last (see [deadlines]), and paced ones under [limiter]
+          if (cachedEnd - from >= chunkSize) {
+            (cachedEnd, gapEnd) = (from + chunkSize - 1, null);
+          }
+          // The file may have moved meanwhile (see [moveStorage])
+          await _serveCached(response, meta, from, cachedEnd, digest);
+          return (cachedEnd, gapEnd);
+        });
+        pos = cachedEnd + 1;
+        await _delivered(response);
+        await _pace(limiter, cachedEnd - from + 1);
+        if (gapEnd == null) continue;
+
+        // The chunk after this one is claimed by its own fetch, which the
+        // next pass waits on like any other request's
+        final chunkEnd = min(pos + chunkSize - 1, gapEnd);
+        if (pipelineFetches &&
+            !fetchingAhead &&
+            chunkEnd < end &&
+            !_rangeless.contains(fileId) &&
+            !(_loadShedder?.underPressure ?? false)) {
+          fetchingAhead = true;
+          unawaited(
+            _fetchAhead(
+              meta,
+              dataSource,
+              chunkEnd + 1,
+              min(chunkEnd + chunkSize, end),
+            ).whenComplete(() => fetchingAhead = false),
+          );
+        }
+
+        pos = await _fetchGapAndServe(
+          response,
+          dataSource,
+          pos,
+          chunkEnd,
+          meta,
+          digest: digest,
+          limiter: limiter,
+          connection: connection,
+        );
+        await _delivered(response);
+      }
+    } on _RangeIgnored catch (e) {
+      rangeIgnoredAt = e.start;
+    } finally {
+      _activeDownloads.remove(fileId);
+      if (_watching.update(fileId, (n) => n - 1, ifAbsent: () => 0) <= 0) {
+        _watching.remove(fileId);
+      }
+      slot?.call();
+    }
+
+    _scheduleDebouncedSave(fileId, meta);
+    _reportProgress(meta);
+
+    // The origin sent the whole file instead: continue from where the
+    // player got to once the sequential download has written it
+    final resumeAt = rangeIgnoredAt;
+    if (resumeAt != null) {
+      await _serveSequential(
+        response,
+        meta,
+        remoteUrl,
+        resumeAt,
+        end,
+        digest,
+        limiter: limiter,
+      );
+    }
+  }
+
+  /// The host that served [response], for attributing its bytes
+  static String? _sourceOf(
+    DataSource dataSource,
+    HttpClientResponse response,
+  ) => dataSource is HttpDataSource ? dataSource.sourceOf(response) : null;
+
+  /// The body of [upstream] (bytes [start]..[end]), reconnecting per
+  /// [retryPolicy] when it fails mid-transfer
+  ///
+  /// Chunks already passed on are never requested again, so callers keep
+  /// recording and serving as usual. [onResume] is given each new
+  /// response, which may come from another mirror.
+  Stream<List<int>> _resumable(
+    DataSource dataSource,
+    HttpClientResponse upstream,
+    int start,
+    int end, {
+    void Function(HttpClientResponse response)? onResume,
+  }) async* {
+    var response = upstream;
+    var pos = start;
+    var attempt = 0;
+    while (true) {
+      final before = pos;
+      Object error;
+      try {
+        await for (final chunk in response) {
+          yield chunk;
+          pos += chunk.length;
+        }
+        return;
+      } on UpstreamChangedException {
+        rethrow;
+      } on IOException catch (e) {
+        error = e;
+      }
+      if (pos > before) attempt = 0;
+
+      // Reconnect from the first missing byte
+      while (true) {
+        if (pos > end) return;
+        if (++attempt > retryPolicy.maxAttempts) throw error;
+        final delay = retryPolicy.delayFor(attempt);
+        Logger.info(
+          'Upstream cut off at byte $pos ($error), '
+          'retry $attempt in ${delay.inMilliseconds} ms',
+        );
+        await Future.delayed(delay);
+        try {
+          response = await dataSource.fetchRange(pos, end);
+          onResume?.call(response);
+          break;
+        } on UpstreamChangedException {
+          rethrow;
+        } on IOException catch (e) {
+          error = e;
+        }
+      }
+      if (response.statusCode != HttpStatus.partialContent) {
+        await response.listen(null).cancel();
+        throw HttpException(
+          'Upstream ignored Range on resume (status ${response.statusCode})',
+        );
+      }
+    }
+  }
+
+  /// Serve [start]..[end] of a file whose origin ignores Range
+  ///
+  /// The background download fetches the whole file from its first byte;
+  /// each piece is served as soon as it has been written. Without that
+  /// download (paused, shed, failed) only cached bytes can be served.
+  Future<void> _serveSequential(
+    HttpResponse response,
+    DownloadMeta meta,
+    String remoteUrl,
+    int start,
+    int end,
+    BodyDigest? digest, {
+    int chunkSize = 1024 * 1024,
+    RateLimiter? limiter,
+  }) async {
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    int pos = start;
+    while (pos <= end) {
+      final pieceEnd = min(pos + chunkSize - 1, end);
+      if (meta.hasRange(pos, pieceEnd)) {
+        await lock.shared(
+          () => _serveCached(response, meta, pos, pieceEnd, digest),
+        );
+        await _delivered(response);
+        await _pace(limiter, pieceEnd - pos + 1);
+        pos = pieceEnd + 1;
+        continue;
+      }
+
+      final arrival = _arrivals[meta.id] ??= Completer<void>();
+      await startBackgroundDownload(remoteUrl);
+      if (!_backgroundDownloadRunning(meta.id)) {
+        throw HttpException(
+          'Origin ignores Range and ${meta.id} is not downloading',
+        );
+      }
+      await arrival.future;
+    }
+  }
+
+  bool _backgroundDownloadRunning(String fileId) =>
+      _activeDownloads.contains(fileId) ||
+      _backgroundDownloads.containsKey(fileId);
+
+  /// Whether [upstream], asked for [start]..[end] of [meta], is the whole
+  /// file; the origin is then remembered as ignoring Range
+  bool _ignoresRange(
+    DownloadMeta meta,
+    HttpClientResponse upstream,
+    int start,
+    int end,
+  ) {
+    if (upstream.statusCode != HttpStatus.ok) return false;
+    if (start == 0 && end >= meta.totalSize - 1) return false;
+    if (_rangeless.add(meta.id)) {
+      Logger.info('Origin ignores Range, downloading in order: ${meta.id}');
+    }
+    return true;
+  }
+
+  /// Discard [upstream] and throw unless it holds file bytes, a 206 or a
+  /// 200
+  ///
+  /// Anything else is an error page: written to the sparse file it would
+  /// be served as the video from then on.
+  static Future<void> _expectBytes(
+    HttpClientResponse upstream,
+    int start,
+    int end,
+  ) async {
+    final status = upstream.statusCode;
+    if (status == HttpStatus.partialContent || status == HttpStatus.ok) return;
+    await upstream.listen(null).cancel();
+    throw HttpException('Upstream answered $status for bytes $start-$end');
+  }
+
+  /// Tell players waiting in [_serveSequential] that [fileId] changed
+  void _signalArrival(String fileId) => _arrivals.remove(fileId)?.complete();
+
+  /// Serve [start]..[end] from the sparse file of [meta] in reads of
+  /// [diskReadBufferSize]
+  ///
+  /// A read may return less than asked; the rest is read on. A file that
+  /// ends before [end] was cut short behind the proxy's back: its ranges
+  /// from there are dropped so they are fetched again, and this throws.
+  Future<void> _serveCached(
+    HttpResponse response,
+    DownloadMeta meta,
+    int start,
+    int end,
+    BodyDigest? digest,
+  ) async {
+    if (start > end) return;
+    final bufferSize = max(4096, diskReadBufferSize);
+    final raf = await File(meta.localPath).open(mode: FileMode.read);
+    try {
+      await raf.setPosition(start);
+      int pos = start;
+      while (pos <= end) {
+        final read = await raf.read(min(bufferSize, end - pos + 1));
+        if (read.isEmpty) {
+          _forgetLost(meta, pos, end);
+          throw FileSystemException(
+            'Cache file ends at $pos, before its cached bytes',
+            meta.localPath,
+          );
+        }
+        final data = _opened(meta, pos, read);
+        response.add(data);
+        digest?.add(data);
+        proxyMetrics.bytesFromCache += data.length;
+        pos += data.length;
+      }
+    } finally {
+      await raf.close();
+    }
+  }
+
+  /// Drop [start]..[end] of [meta], cached bytes the file no longer holds
+  ///
+  /// Runs once the readers sharing the file lock are done.
+  void _forgetLost(DownloadMeta meta, int start, int end) {
+    Logger.error('Cache file of ${meta.id} lost $start-$end');
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    unawaited(
+      lock
+          .synchronized(() => meta.removeRange(start, end))
+          .then((_) => meta.save())
+          .catchError((Object e) {
+            Logger.error('Failed to drop lost ranges of ${meta.id}: $e');
+          }),
+    );
+  }
+
+  /// Fetch missing bytes from [start] and serve them up to [end] while
+  /// caching them; returns the first byte not served
+  ///
+  /// When another request is already fetching [start], nothing is fetched:
+  /// this waits for those bytes to land and returns [start], so the caller
+  /// serves them from disk.
+  Future<int> _fetchGapAndServe(
+    HttpResponse response,
+    DataSource dataSource,
+    int start,
+    int end,
+    DownloadMeta meta, {
+    BodyDigest? digest,
+    RateLimiter? limiter,
+    _Connection? connection,
+  }) async {
+    // Hostile origins get fewer, larger requests; the extra is only cached
+    final gate = _hostGate(meta);
+    final fetchEnd = gate?.widen(start, end, meta.totalSize) ?? end;
+    final release = await gate?.acquire();
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+
+    _loadShedder?.fetchStarted();
+    final guard = _bandwidthGuard?..playbackStarted();
+    _Flight? flight;
+    try {
+      flight = await _claim(meta, start, fetchEnd);
+      if (flight == null) return start;
+      final servedEnd = min(end, flight.end);
+
+      final upstream = await dataSource.fetchRange(start, flight.end);
+      await _expectBytes(upstream, start, flight.end);
+      if (_ignoresRange(meta, upstream, start, flight.end)) {
+        // Writing it at start would corrupt the file
+        await upstream.listen(null).cancel();
+        throw _RangeIgnored(start);
+      }
+
+      int currentPos = start;
+      var source = _sourceOf(dataSource, upstream);
+      final body = upstream.statusCode == HttpStatus.partialContent
+          ? _resumable(
+              dataSource,
+              upstream,
+              start,
+              flight.end,
+              onResume: (resumed) => source = _sourceOf(dataSource, resumed),
+            )
+          : upstream;
+      await for (final chunk in body) {
+        // A player gone mid-fetch: stop, or keep caching while detached
+        if (connection != null && connection.closed) {
+          connection.detachedAt ??= currentPos;
+          if (currentPos - connection.detachedAt! >= detachedFetchLimit) {
+            break;
+          }
+        }
+        var served = 0;
+        if (currentPos <= servedEnd && !(connection?.closed ?? false)) {
+          final part = currentPos + chunk.length - 1 <= servedEnd
+              ? chunk
+              : chunk.sublist(0, servedEnd - currentPos + 1);
+          response.add(part);
+          _armDeadline(response);
+          digest?.add(part);
+          served = part.length;
+          proxyMetrics.bytesFromUpstream += served;
+        }
+        final pos = currentPos;
+        await lock.synchronized(() async {
+          final raf = await File(meta.localPath).open(mode: FileMode.append);
+          try {
+            await raf.setPosition(pos);
+            await raf.writeFrom(_sealed(meta, pos, chunk));
+          } finally {
+            await raf.close();
+          }
+          _recordRange(meta, pos, pos + chunk.length - 1, source: source);
+        });
+        currentPos += chunk.length;
+        flight.advance(currentPos);
+        guard?.addPlayback(chunk.length);
+        final pause = _longest(
+          _upstreamLimiter.take(chunk.length),
+          limiter?.take(served) ?? Duration.zero,
+        );
+        if (pause > Duration.zero) await Future.delayed(pause);
+      }
+      return min(servedEnd + 1, currentPos);
+    } finally {
+      if (flight != null) _land(meta.id, flight);
+      guard?.playbackFinished();
+      _loadShedder?.fetchFinished();
+      release?.call();
+    }
+  }
+
+  // ============== SHARED FETCHES ==============
+
+  /// Wait while another fetch is bringing in [start] of [meta], then claim
+  /// [start]..[end] for the caller, cut short where another fetch's
+  /// pending bytes begin
+  ///
+  /// Returns null when [start] was cached meanwhile. Call [_land] once the
+  /// claimed fetch is over, however it ended.
+  Future<_Flight?> _claim(DownloadMeta meta, int start, int end) async {
+    while (true) {
+      final flights = _flights[meta.id] ?? const <_Flight>[];
+      final pending = flights.where((f) => f.covers(start)).firstOrNull;
+      if (pending == null) break;
+      await pending.progress;
+      if (meta.hasRange(start, start)) return null;
+    }
+    if (meta.hasRange(start, start)) return null;
+
+    final flights = _flights.putIfAbsent(meta.id, () => []);
+    for (final other in flights) {
+      if (other.pending && other.next > start && other.next <= end) {
+        end = other.next - 1;
+      }
+    }
+    final flight = _Flight(start, end);
+    flights.add(flight);
+    return flight;
+  }
+
+  /// Keep caching [start]..[end] of [meta] for a player that left over
+  /// [connection], up to [detachedFetchLimit] bytes past where it left
+  void _detach(
+    DownloadMeta meta,
+    DataSource dataSource,
+    int start,
+    int end,
+    _Connection connection,
+  ) {
+    final from = connection.detachedAt ??= start;
+    final last = min(end, from + detachedFetchLimit - 1);
+    if (start > last) return;
+    unawaited(() async {
+      try {
+        for (final (gapStart, gapEnd) in meta.getGapsIn(start, last)) {
+          await _fetchToCache(meta, dataSource, gapStart, gapEnd);
+        }
+        Logger.info('Cached $start-$last of ${meta.id} after player left');
+      } catch (e) {
+        Logger.error('Detached fetch failed for ${meta.id}: $e');
+      }
+    }());
+  }
+
+  /// Cache [start]..[end] of [meta] for a player about to reach it (see
+  /// [pipelineFetches]); on failure the player's own fetch retries
+  Future<void> _fetchAhead(
+    DownloadMeta meta,
+    DataSource dataSource,
+    int start,
+    int end,
+  ) async {
+    try {
+      await _fetchToCache(
+        meta,
+        dataSource,
+        start,
+        end,
+        priority: DownloadPriority.foreground,
+      );
+    } catch (e) {
+      Logger.debug('Fetch ahead of ${meta.id} at $start failed: $e');
+    }
+  }
+
+  /// End a fetch claimed with [_claim] and wake requests waiting on it
+  void _land(String fileId, _Flight flight) {
+    final flights = _flights[fileId];
+    flights?.remove(flight);
+    if (flights != null && flights.isEmpty) _flights.remove(fileId);
+    flight.land();
+  }
+
+  /// POST|PUT /upload?url=TOKEN with `Content-Range: bytes START-END/TOTAL`
+  ///
+  /// Lets a client that already holds part of the file push those bytes
+  /// into the cache; only the remaining gaps are fetched from upstream.
+  /// The URL is signed as for `/stream` (see [_queryTarget]). A malformed
+  /// `Content-Range` is answered `400`, one not fitting the file `416`.
+  Future<void> _handleUploadRequest(HttpRequest request) async {
+    if (request.method != 'PUT' && request.method != 'POST') {
+      request.response.statusCode = HttpStatus.methodNotAllowed;
+      request.response.headers.set(HttpHeaders.allowHeader, 'PUT, POST');
+      return;
+    }
+
+    final remoteUrl = _queryTarget(request.uri, 'url');
+    final range = ContentRange.parse(request.headers.value('content-range'));
+    if (remoteUrl == null || range == null) {
+      request.response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+    final ContentRange(:start, :end, :total) = range;
+
+    final fileId = _hashUrl(remoteUrl);
+    _urlLookup[fileId] = remoteUrl;
+    _getDataSource(fileId, remoteUrl);
+
+    // The size comes from the origin: a client's TOTAL that is wrong
+    // would truncate the file, or leave a tail no fetch can fill
+    final meta = await _getOrCreateMeta(
+      fileId,
+      remoteUrl,
+      autoDownload: false,
+    );
+    if (meta == null) {
+      request.response.statusCode = HttpStatus.badGateway;
+      return;
+    }
+    if (end >= meta.totalSize || (total != null && total != meta.totalSize)) {
+      request.response.statusCode = HttpStatus.requestedRangeNotSatisfiable;
+      request.response.headers.set(
+        'Content-Range',
+        'bytes */${meta.totalSize}',
+      );
+      return;
+    }
+
+    final received = await _ingest(request, meta, start, end);
+
+    // Settle the work unit this upload answers, if any
+    final unitId = request.uri.queryParameters['unit'];
+    if (unitId != null) {
+      final unit = _workCoordinator.release(unitId);
+      if (unit != null && !meta.hasRange(unit.start, unit.end)) {
+        Logger.info('Work unit $unitId returned incomplete');
+      }
+    }
+
+    await _ingested(meta, remoteUrl, start, received);
+    if (!meta.isComplete) unawaited(startBackgroundDownload(remoteUrl));
+
+    if (request.response.statusCode == HttpStatus.ok) {
+      request.response.headers.contentType = ContentType.json;
+      request.response.write(
+        jsonEncode({'received': received, 'progress': meta.progress}),
+      );
+    }
+  }
+
+  /// Write the body of [request] into [meta] from [start], through the
+  /// file's lock; returns the bytes received
+  ///
+  /// Only gaps are filled: cached bytes stay as they are, unless
+  /// [overwrite] (seeding by a trusted service) replaces them. A body
+  /// running past [end] is cut there and answered `400`; the bytes up to
+  /// [end] are kept.
+  Future<int> _ingest(
+    HttpRequest request,
+    DownloadMeta meta,
+    int start,
+    int end, {
+    bool overwrite = false,
+  }) async {
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    int pos = start;
+    await for (final chunk in request) {
+      // Body is longer than the declared range; keep what fits
+      final overflow = pos + chunk.length - 1 > end;
+      final piece = overflow ? chunk.sublist(0, end - pos + 1) : chunk;
+      final pieceEnd = pos + piece.length - 1;
+      if (piece.isNotEmpty) {
+        await lock.synchronized(() async {
+          if (overwrite) _overwriting(meta, pos, pieceEnd);
+          final spans = overwrite
+              ? [(pos, pieceEnd)]
+              : meta.getGapsIn(pos, pieceEnd);
+          if (spans.isEmpty) return;
+          final raf = await File(meta.localPath).open(mode: FileMode.append);
+          try {
+            for (final (from, to) in spans) {
+              final bytes = piece.sublist(from - pos, to - pos + 1);
+              await raf.setPosition(from);
+              await raf.writeFrom(_sealed(meta, from, bytes));
+            }
+          } finally {
+            await raf.close();
+          }
+          for (final (from, to) in spans) {
+            _recordRange(meta, from, to);
+          }
+        });
+        pos += piece.length;
+      }
+      if (overflow) {
+        request.response.statusCode = HttpStatus.badRequest;
+        break;
+      }
+    }
+    return pos - start;
+  }
+
+  /// Drop the checksums vouching for cached bytes in [start]..[end] of
+  /// [meta], which are about to be overwritten
+  void _overwriting(DownloadMeta meta, int start, int end) {
+    final gaps = meta.getGapsIn(start, end);
+    final missing = gaps.fold(0, (sum, gap) => sum + gap.$2 - gap.$1 + 1);
+    if (missing == end - start + 1) return;
+    meta.sha256 = null;
+    final last = end ~/ Scrubber.blockSize;
+    for (int block = start ~/ Scrubber.blockSize; block <= last; block++) {
+      meta.checksums.remove(block);
+    }
+  }
+
+  /// Report [received] bytes pushed into [meta] at [start], and complete
+  /// the file when they were the last missing ones
+  Future<void> _ingested(
+    DownloadMeta meta,
+    String remoteUrl,
+    int start,
+    int received,
+  ) async {
+    Logger.info('Backfilled $received bytes into ${meta.id} at $start');
+    _emit(
+      ProxyEvent(
+        ProxyEventType.backfill,
+        fileId: meta.id,
+        url: remoteUrl,
+        data: {'start': start, 'received': received},
+      ),
+    );
+    _scheduleDebouncedSave(meta.id, meta);
+    _reportProgress(meta);
+
+    if (meta.isComplete && !_activeDownloads.contains(meta.id)) {
+      await meta.save();
+      await _onDownloadComplete(meta);
+    }
+  }
+
+  /// PUT /api/downloads/<id>/content[?url=URL], the whole file or the
+  /// chunk named by `Content-Range: bytes START-END/TOTAL`
+  ///
+  /// Seeds the cache from another service: nothing is fetched from the
+  /// origin, and a file not cached yet needs its `url` (whose id must be
+  /// `<id>`) and a known total size. A whole file needs a
+  /// `Content-Length`.
+  ///
+  /// It overwrites cached bytes, so it is refused without an [apiToken]:
+  /// anyone reaching the port could otherwise replace any file.
+  Future<void> _handleContentPut(HttpRequest request, String fileId) async {
+    final response = request.response;
+    if (apiToken == null) {
+      errorPages.write(
+        response,
+        ProxyFailure.accessDenied,
+        details: {'message': 'Seeding needs an apiToken'},
+      );
+      return;
+    }
+    final url = _queryTarget(request.uri, 'url');
+    final remoteUrl =
+        url ?? _metadata[fileId]?.originalUrl ?? _urlLookup[fileId];
+    if (url != null && _hashUrl(url) != fileId) {
+      errorPages.write(
+        response,
+        ProxyFailure.badRequest,
+        details: {'message': 'url does not belong to $fileId'},
+      );
+      return;
+    }
+    if (remoteUrl == null) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+
+    final contentRange = request.headers.value('content-range');
+    final ContentRange? range;
+    if (contentRange == null) {
+      if (request.contentLength < 0) {
+        response.statusCode = HttpStatus.lengthRequired;
+        return;
+      }
+      range = request.contentLength == 0
+          ? null
+          : ContentRange(
+              0,
+              request.contentLength - 1,
+              request.contentLength,
+            );
+    } else {
+      range = ContentRange.parse(contentRange);
+    }
+    if (range == null) {
+      errorPages.write(
+        response,
+        ProxyFailure.badRequest,
+        details: {'message': 'Invalid Content-Range: ${contentRange ?? ''}'},
+      );
+      return;
+    }
+    final ContentRange(:start, :end, :total) = range;
+
+    _urlLookup[fileId] = remoteUrl;
+    final known = _metadata[fileId];
+    if (known == null && total == null) {
+      errorPages.write(
+        response,
+        ProxyFailure.badRequest,
+        details: {'message': 'The total size of a new file must be given'},
+      );
+      return;
+    }
+    final meta =
+        known ??
+        await _getOrCreateMeta(
+          fileId,
+          remoteUrl,
+          knownSize: total,
+          autoDownload: false,
+        );
+    if (meta == null) {
+      response.statusCode = HttpStatus.badGateway;
+      return;
+    }
+    if (end >= meta.totalSize || (total != null && total != meta.totalSize)) {
+      _rejectRange(response, meta.totalSize);
+      return;
+    }
+    meta.mimeType ??= request.headers.contentType?.mimeType;
+
+    final received = await _ingest(
+      request,
+      meta,
+      start,
+      end,
+      overwrite: true,
+    );
+    await _ingested(meta, remoteUrl, start, received);
+    if (response.statusCode == HttpStatus.ok) {
+      _writeJson(response, {
+        'received': received,
+        'complete': meta.isComplete,
+        'progress': meta.progress,
+      });
+    }
+  }
+
+  // ============== CACHE WARMING ==============
+
+  void _recordAccess(String fileId, int start, int end) {
+    _accessHistory.putIfAbsent(fileId, AccessHistory.new).record(start, end);
+    if (_coldPaths.containsKey(fileId) &&
+        (_tiers?.recordRead(fileId, DateTime.now()) ?? false)) {
+      unawaited(_promote(fileId));
+    }
+
+    _accessHistorySaveTimer?.cancel();
+    _accessHistorySaveTimer = Timer(
+      const Duration(seconds: 2),
+      _saveAccessHistory,
+    );
+  }
+
+  /// Fetch the predicted first reads of a reopened file in the background
+  void _warmFromHistory(DownloadMeta meta, String remoteUrl) {
+    final history = _accessHistory[meta.id];
+    if (!cacheWarmingEnabled || history == null || _isPaused(meta.id)) return;
+
+    final ranges = history
+        .predict(meta.totalSize)
+        .where((r) => !meta.hasRange(r.$1, r.$2))
+        .toList();
+    if (ranges.isEmpty) return;
+
+    unawaited(() async {
+      final dataSource = _getDataSource(meta.id, remoteUrl);
+      for (final (start, end) in ranges) {
+        if (_loadShedder?.underPressure ?? false) return;
+        try {
+          await _fetchToCache(meta, dataSource, start, end);
+        } catch (e) {
+          Logger.error('Cache warming failed for ${meta.id}: $e');
+          return;
+        }
+      }
+      _scheduleDebouncedSave(meta.id, meta);
+      _emit(
+        ProxyEvent(
+          ProxyEventType.cacheWarm,
+          fileId: meta.id,
+          url: remoteUrl,
+          data: {
+            'ranges': [for (final (s, e) in ranges) 'bytes=$s-$e'],
+          },
+        ),
+      );
+    }());
+  }
+
+  Future<void> _saveAccessHistory() async {
+    // Keep the most recently used files only
+    if (_accessHistory.length > _maxAccessHistory) {
+      final oldest = _accessHistory.entries.toList()
+        ..sort((a, b) => a.value.lastAccess.compareTo(b.value.lastAccess));
+      for (final entry in oldest.take(
+        _accessHistory.length - _maxAccessHistory,
+      )) {
+        _accessHistory.remove(entry.key);
+      }
+    }
+
+    try {
+      await File('$storageDir/.access_history.json').writeAsString(
+        jsonEncode(_accessHistory.map((k, v) => MapEntry(k, v.toJson()))),
+      );
+    } catch (e) {
+      Logger.error('Failed to save access history: $e');
+    }
+  }
+
+  Future<void> _loadAccessHistory() async {
+    final file = File('$storageDir/.access_history.json');
+    if (!await file.exists()) return;
+    try {
+      final data =
+          jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+      data.forEach((fileId, json) {
+        _accessHistory[fileId] = AccessHistory.fromJson(
+          json as Map<String, dynamic>,
+        );
+      });
+    } catch (e) {
+      Logger.error('Failed to load access history: $e');
+    }
+  }
+
+  // ============== ASSETS ==============
+
+  /// Download a whole response body into the cache
+  ///
+  /// Used for assets whose origin answers HEAD without a length or does not
+  /// support Range (posters, JSON APIs). Returns null on upstream errors or
+  /// an empty body.
+  Future<DownloadMeta?> _cacheWholeBody(
+    String fileId,
+    String remoteUrl,
+    DataSource dataSource,
+  ) async {
+    final upstream = await dataSource.fetchAll();
+    if (upstream.statusCode != HttpStatus.ok) {
+      await upstream.drain<void>();
+      return null;
+    }
+
+    final ephemeral = _ephemeralIds.contains(fileId);
+    final dir = ephemeral ? '$storageDir/.ephemeral' : storageDir;
+    await Directory(dir).create(recursive: true);
+
+    // Write to a temporary file so a failed download leaves nothing behind
+    final part = File('$dir/$fileId.part');
+    final nonce = cacheCipher?.newNonce();
+    _loadShedder?.fetchStarted();
+    try {
+      await (nonce == null
+              ? upstream
+              : cacheCipher!.applyStream(nonce, 0, upstream))
+          .pipe(part.openWrite());
+    } catch (_) {
+      if (await part.exists()) await part.delete();
+      rethrow;
+    } finally {
+      _loadShedder?.fetchFinished();
+    }
+
+    final size = await part.length();
+    if (size == 0) {
+      await part.delete();
+      return null;
+    }
+    await part.rename('$dir/$fileId.video');
+
+    final meta = await _getOrCreateMeta(
+      fileId,
+      remoteUrl,
+      knownSize: size,
+      autoDownload: false,
+    );
+    if (meta == null) return null;
+    meta.cacheNonce = nonce;
+    meta.mimeType ??= upstream.headers.contentType?.toString();
+    _keepPassedHeaders(meta, HttpDataSource.headersOf(upstream));
+    _recordRange(
+      meta,
+      0,
+      size - 1,
+      source: _sourceOf(dataSource, upstream),
+    );
+    await meta.save();
+    return meta;
+  }
+
+  // ============== SMALL-OBJECT CACHE ==============
+
+  /// Serve a manifest or API response from [objectCache], fetching or
+  /// revalidating it upstream when it is not fresh
+  Future<void> _serveObject(
+    HttpRequest request,
+    String remoteUrl,
+    DataSource dataSource,
+  ) async {
+    final config = objectCache.config;
+    final now = DateTime.now();
+    var object = objectCache[remoteUrl];
+    var cacheStatus = 'HIT';
+
+    if (object == null || !object.isFresh(now)) {
+      final stale = object;
+      final HttpClientResponse upstream;
+      try {
+        upstream = await dataSource.fetchAll(headers: stale?.validatorHeaders);
+      } on IOException {
+        // Origin unreachable: a stream saved by [downloadStream] still plays
+        final pinned = await _pinnedManifest(remoteUrl);
+        if (pinned == null) rethrow;
+        _writeObject(request, remoteUrl, pinned, 'OFFLINE');
+        return;
+      }
+      final policy = CachePolicy.fromHeaders(
+        upstream.headers,
+        defaultMaxAge: config.defaultMaxAge,
+      );
+
+      if (upstream.statusCode == HttpStatus.notModified && stale != null) {
+        await upstream.drain<void>();
+        object = stale
+          ..storedAt = now
+          ..maxAge = policy.maxAge;
+        cacheStatus = 'REVALIDATED';
+      } else {
+        // Buffer up to the object size limit; anything larger streams
+        final buffer = BytesBuilder(copy: false);
+        final iterator = StreamIterator(upstream);
+        bool tooLarge = false;
+        while (await iterator.moveNext()) {
+          buffer.add(iterator.current);
+          if (buffer.length > config.maxObjectSize) {
+            tooLarge = true;
+            break;
+          }
+        }
+
+        final contentType = upstream.headers.value('content-type');
+        if (tooLarge || upstream.statusCode != HttpStatus.ok) {
+          request.response.statusCode = upstream.statusCode;
+          if (contentType != null) {
+            request.response.headers.set('Content-Type', contentType);
+          }
+          request.response.headers.set('X-DownStream-Cache', 'BYPASS');
+          request.response.add(buffer.takeBytes());
+          while (await iterator.moveNext()) {
+            request.response.add(iterator.current);
+          }
+          return;
+        }
+
+        object = CachedObject(
+          statusCode: upstream.statusCode,
+          body: buffer.takeBytes(),
+          maxAge: policy.maxAge,
+          contentType: contentType,
+          etag: upstream.headers.value(HttpHeaders.etagHeader),
+          lastModified: upstream.headers.value(
+            HttpHeaders.lastModifiedHeader,
+          ),
+          storedAt: now,
+        );
+        if (!policy.noStore) objectCache.put(remoteUrl, object);
+        cacheStatus = 'MISS';
+      }
+    }
+
+    _writeObject(request, remoteUrl, object, cacheStatus);
+  }
+
+  void _writeObject(
+    HttpRequest request,
+    String remoteUrl,
+    CachedObject object,
+    String cacheStatus,
+  ) {
+    final body = manifestAware
+        ? _rewriteManifest(request, remoteUrl, object)
+        : object.body;
+    request.response.statusCode = object.statusCode;
+    final type = object.contentType;
+    if (type != null) {
+      request.response.headers.set('Content-Type', type);
+    }
+    request.response.headers.set(
+      HttpHeaders.ageHeader,
+      '${object.age(DateTime.now()).inSeconds}',
+    );
+    request.response.headers.set('X-DownStream-Cache', cacheStatus);
+    request.response.headers.set(
+      HttpHeaders.contentLengthHeader,
+      '${body.length}',
+    );
+    request.response.add(body);
+  }
+
+  // ============== STREAMING MANIFESTS ==============
+
+  // Query parameters a rewritten manifest passes on to what it references
+  static const _inheritedParameters = [
+    'ns',
+    'client',
+    'ephemeral',
+    AccessPolicy.keyParameter,
+  ];
+
+  /// [object]'s body, rewritten when it is an HLS or DASH manifest so the
+  /// player fetches everything it references through this proxy
+  Uint8List _rewriteManifest(
+    HttpRequest request,
+    String remoteUrl,
+    CachedObject object,
+  ) {
+    final kind = StreamManifest.detect(
+      contentType: object.contentType,
+      url: remoteUrl,
+      body: object.body,
+    );
+    if (kind == null) return object.body;
+
+    // Point at the address the player used, which may be another device's
+    // view of this proxy
+    final proxy = request.requestedUri;
+    final inherited = {
+      for (final name in _inheritedParameters)
+        if (request.uri.queryParameters[name] case final value?) name: value,
+    };
+    Uri route(Uri target, ServingProfile profile) {
+      final query = {
+        if (profile != ServingProfile.video) 'profile': profile.name,
+        ...inherited,
+      };
+      return Uri(
+        scheme: proxy.scheme,
+        host: proxy.host,
+        port: proxy.port,
+        path: '/stream/${urlSigner.sign('$target')}',
+        queryParameters: query.isEmpty ? null : query,
+      );
+    }
+
+    final text = utf8.decode(object.body, allowMalformed: true);
+    final base = Uri.parse(remoteUrl);
+    final rewritten = switch (kind) {
+      ManifestKind.hls => StreamManifest.rewriteHls(
+        text,
+        base,
+        (target, uriKind) => route(target, switch (uriKind) {
+          HlsUriKind.playlist => ServingProfile.manifest,
+          HlsUriKind.segment => ServingProfile.segment,
+          HlsUriKind.key => ServingProfile.asset,
+        }),
+      ),
+      ManifestKind.dash => StreamManifest.rewriteDash(
+        text,
+        base,
+        (target) => _dashRoute(proxy, target),
+      ),
+    };
+    return utf8.encode(rewritten);
+  }
+
+  /// Path-based proxy URL for [target], `/dash/<directory>/<file>`
+  ///
+  /// DASH players resolve segment templates against the base URL; with the
+  /// origin directory encoded in the path, whatever they resolve still
+  /// comes through the proxy (see [_dashTarget]).
+  Uri _dashRoute(Uri proxy, Uri target) {
+    final directory = target.removeFragment().resolve('.');
+    final token = urlSigner.sign('$directory');
+    // Encoded as in the manifest, so template variables (`$Number$`) stay
+    final file = target.path.substring(target.path.lastIndexOf('/') + 1);
+    final query = target.hasQuery ? '?${target.query}' : '';
+    return Uri.parse(
+      '${proxy.scheme}://${proxy.authority}/dash/$token/$file$query',
+    );
+  }
+
+  /// Origin URL of a `/dash/<directory>/<path>` request, or null; throws
+  /// a [SignedUrlException] when the directory's signature is bad
+  String? _dashTarget(Uri uri) {
+    if (!uri.path.startsWith('/dash/')) return null;
+    final rest = uri.path.substring('/dash/'.length);
+    final slash = rest.indexOf('/');
+    if (slash < 0) return null;
+    final directory = urlSigner.verify(rest.substring(0, slash));
+    try {
+      final target = Uri.parse(directory).resolve(rest.substring(slash + 1));
+      return (uri.hasQuery ? target.replace(query: uri.query) : target)
+          .toString();
+    } on FormatException {
+      return null;
+    }
+  }
+
+  /// Cache an HLS stream so it plays offline
+  ///
+  /// From a master playlist, the variant with the highest bandwidth up to
+  /// [maxBandwidth] (bits per second) is taken, with its audio and subtitle
+  /// renditions. Playlists are saved to disk and served whenever the origin
+  /// is unreachable, the master listing only the saved variant; segments
+  /// are cached [concurrency] at a time and stay in the cache. Returns the
+  /// number of segments cached.
+  Future<int> downloadStream(
+    String url, {
+    int? maxBandwidth,
+    int concurrency = 4,
+    CallContext? context,
+  }) async {
+    final base = Uri.parse(url);
+    final text = await _fetchText(url);
+    if (StreamManifest.detect(body: utf8.encode(text)) != ManifestKind.hls) {
+      throw FormatException('Not an HLS playlist: $url');
+    }
+
+    final playlists = <Uri>[base];
+    if (StreamManifest.isHlsMaster(text)) {
+      final variants = StreamManifest.hlsVariants(text, base)
+        ..sort((a, b) => a.bandwidth.compareTo(b.bandwidth));
+      if (variants.isEmpty) {
+        throw FormatException('No variants in $url');
+      }
+      final fitting = variants.where(
+        (v) => maxBandwidth == null || v.bandwidth <= maxBandwidth,
+      );
+      final chosen = fitting.isEmpty ? variants.first : fitting.last;
+      await _pinManifest(
+        url,
+        StreamManifest.keepHlsVariant(text, base, chosen.uri),
+      );
+      playlists
+        ..clear()
+        ..addAll([chosen.uri, ...chosen.renditions]);
+    }
+
+    final segments = <Uri>{};
+    for (final playlist in playlists) {
+      context?.throwIfDone();
+      final body = playlist == base ? text : await _fetchText('$playlist');
+      await _pinManifest('$playlist', body);
+      segments.addAll(StreamManifest.hlsSegments(body, playlist));
+    }
+
+    var cached = 0;
+    await runPool(
+      segments,
+      concurrency,
+      (segment) async {
+        await _cacheWhole('$segment');
+        cached++;
+      },
+      isCancelled: () => context?.isDone ?? false,
+    );
+    context?.throwIfDone();
+    Logger.success('Cached $cached segments of $url');
+    return cached;
+  }
+
+  Future<String> _fetchText(String url) async {
+    final upstream = await _getDataSource(_hashUrl(url), url).fetchAll();
+    if (upstream.statusCode != HttpStatus.ok) {
+      await upstream.drain<void>();
+      throw HttpException('Status ${upstream.statusCode}', uri: Uri.parse(url));
+    }
+    return utf8.decodeStream(upstream);
+  }
+
+  /// Cache every byte of [url], leaving it in the cache
+  Future<void> _cacheWhole(String url) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final dataSource = _getDataSource(fileId, url);
+    final meta =
+        await _getOrCreateMeta(fileId, url, autoDownload: false) ??
+        await _cacheWholeBody(fileId, url, dataSource);
+    if (meta == null) {
+      if (_emptyFiles.contains(fileId)) return;
+      throw HttpException('Could not cache', uri: Uri.parse(url));
+    }
+    for (final (start, end) in meta.getDownloadGaps()) {
+      await _fetchToCache(
+        meta,
+        dataSource,
+        start,
+        end,
+        priority: DownloadPriority.background,
+      );
+    }
+    await meta.save();
+  }
+
+  String _pinnedPath(String url) => '$storageDir/.manifests/${_hashUrl(url)}';
+
+  Future<void> _pinManifest(String url, String text) async {
+    final file = File(_pinnedPath(url));
+    await file.parent.create(recursive: true);
+    await file.writeAsString(text);
+  }
+
+  /// Playlist saved by [downloadStream] for [url], if any
+  Future<CachedObject?> _pinnedManifest(String url) async {
+    final file = File(_pinnedPath(url));
+    if (!await file.exists()) return null;
+    return CachedObject(
+      statusCode: HttpStatus.ok,
+      body: await file.readAsBytes(),
+      maxAge: Duration.zero,
+      contentType: 'application/vnd.apple.mpegurl',
+    );
+  }
+
+  // ============== ENCRYPTION AT REST ==============
+
+  /// [bytes] to write at [offset] of the cache file of [meta]: encrypted
+  /// when the file is (see [cacheCipher])
+  List<int> _sealed(DownloadMeta meta, int offset, List<int> bytes) {
+    final nonce = meta.cacheNonce;
+    return nonce == null ? bytes : cacheCipher!.apply(nonce, offset, bytes);
+  }
+
+  /// [bytes] read at [offset] of the cache file of [meta], decrypted
+  Uint8List _opened(DownloadMeta meta, int offset, Uint8List bytes) {
+    final nonce = meta.cacheNonce;
+    return nonce == null ? bytes : cacheCipher!.apply(nonce, offset, bytes);
+  }
+
+  /// Content of [source] from [start] to [end] (exclusive), decrypted
+  /// when it is the encrypted cache file of [meta]
+  Stream<List<int>> _plainRead(
+    File source,
+    DownloadMeta? meta, [
+    int start = 0,
+    int? end,
+  ]) {
+    final body = source.openRead(start, end);
+    final nonce = meta?.cacheNonce;
+    if (nonce == null || !p.equals(source.path, meta!.localPath)) {
+      return body;
+    }
+    return cacheCipher!.applyStream(nonce, start, body);
+  }
+
+  /// SHA-256 of the content of the complete cache file of [meta]
+  Future<String> _plainSha256(DownloadMeta meta) async {
+    if (meta.cacheNonce == null) return sha256OfFile(meta.localPath);
+    final digest = BodyDigest();
+    await for (final chunk in _plainRead(File(meta.localPath), meta)) {
+      digest.add(chunk);
+    }
+    return digest.close();
+  }
+
+  /// Key a new cache file of [meta] when encryption is on
+  ///
+  /// Files cached in plaintext before stay plaintext until evicted; bytes
+  /// encrypted with a key this proxy was not given are dropped and
+  /// fetched again.
+  Future<void> _keyCacheFile(DownloadMeta meta) async {
+    final cipher = cacheCipher;
+    if (meta.cacheNonce != null && cipher == null) {
+      Logger.warn(
+        'Cached bytes are encrypted and no cacheKey is set; discarding them',
+        fields: {'fileId': meta.id},
+      );
+      meta
+        ..removeRange(0, meta.totalSize - 1)
+        ..checksums.clear()
+        ..cacheNonce = null;
+      final raf = await File(meta.localPath).open(mode: FileMode.append);
+      try {
+        await raf.truncate(0);
+        await raf.truncate(meta.totalSize);
+      } finally {
+        await raf.close();
+      }
+      await meta.save();
+    } else if (cipher != null &&
+        meta.cacheNonce == null &&
+        meta.downloadedBytes == 0) {
+      // Saved before any byte is written, so none is ever misread
+      meta.cacheNonce = cipher.newNonce();
+      await meta.save();
+    }
+  }
+
+  /// Rewrite the complete cache file of [meta] in plaintext as it leaves
+  /// the cache for the collection, an export or a document tree
+  Future<void> _decryptCached(DownloadMeta meta) async {
+    if (meta.cacheNonce == null) return;
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    await lock.synchronized(() async {
+      final plain = File('${meta.localPath}.plain');
+      final sink = plain.openWrite();
+      try {
+        await sink.addStream(_plainRead(File(meta.localPath), meta));
+        await sink.close();
+        await plain.rename(meta.localPath);
+      } catch (_) {
+        await sink.close();
+        if (await plain.exists()) await plain.delete();
+        rethrow;
+      }
+      meta.cacheNonce = null;
+    });
+  }
+
+  // ============== CONTENT TYPE ==============
+
+  /// Bytes read to recognize a container (see [MimeTypeDetector])
+  static const int _sniffLength = 4096;
+
+  /// Content-Type of a video response for [meta]
+  ///
+  /// The origin's type is used unless it is missing or generic
+  /// (`application/octet-stream`); the container is then recognized from
+  /// its first bytes, fetched first when not cached yet, and remembered in
+  /// the metadata. The file name comes next, and `video/mp4` last.
+  Future<String> _videoMimeType(
+    DownloadMeta meta,
+    DataSource dataSource,
+  ) async {
+    final type = meta.mimeType;
+    if (!MimeTypeDetector.isGeneric(type)) return type!;
+
+    final head = min(_sniffLength, meta.totalSize);
+    try {
+      final sniffed = MimeTypeDetector.detectFromBytes(
+        await _readThrough(meta, dataSource, 0, head - 1),
+      );
+      if (sniffed != null) {
+        meta.mimeType = sniffed;
+        _scheduleDebouncedSave(meta.id, meta);
+        return sniffed;
+      }
+    } catch (e) {
+      Logger.error('Could not sniff the type of ${meta.id}: $e');
+    }
+
+    final byName = mimeTypeForName(meta.suggestedFileName);
+    return MimeTypeDetector.isGeneric(byName) ? 'video/mp4' : byName;
+  }
+
+  // ============== AUDIO PROFILE ==============
+
+  /// Audio MIME type for a cached file
+  ///
+  /// Origins often send `application/octet-stream` for music files, which
+  /// some players refuse; fall back to the file extension, then MP3.
+  String _audioMimeType(DownloadMeta meta) {
+    final type = meta.mimeType;
+    if (type != null && type.startsWith('audio/')) return type;
+    final byName = mimeTypeForName(meta.suggestedFileName);
+    return byName.startsWith('audio/') ? byName : 'audio/mpeg';
+  }
+
+  // ============== LIVE STREAMS ==============
+
+  /// Append the bytes of live streams (no `Content-Length`: radio,
+  /// chunked feeds) to `<fileId>.live` in the cache directory as they
+  /// pass through; a single request asks for it with `record=1`
+  ///
+  /// Live streams have no ranges to cache or seek in: the recording is
+  /// append-only, one per stream, and grows for as long as a player
+  /// listens.
+  bool recordLive = false;
+
+  // Bytes received by each live stream passing through, and the streams
+  // being recorded
+  final Map<String, int> _liveReceived = {};
+  final Set<String> _liveRecordings = {};
+
+  /// Bytes received so far by each live stream being passed through
+  Map<String, int> get liveStreams => Map.unmodifiable(_liveReceived);
+
+  /// Where the bytes of the live stream [fileId] are recorded
+  String liveRecordingPath(String fileId) => '$_storageDir/$fileId.live';
+
+  /// Pass a stream of unknown length through without caching
+  ///
+  /// Live radio (Shoutcast/Icecast) is the common case: the player's
+  /// `Icy-MetaData` request header and the origin's `icy-*` response
+  /// headers are forwarded so track titles keep working. Progress is
+  /// reported as bytes received, since there is no percent to give;
+  /// with [record] the bytes are also appended to [liveRecordingPath].
+  Future<void> _serveLive(
+    HttpRequest request,
+    DataSource dataSource,
+    String fileId,
+    String remoteUrl, {
+    required bool audio,
+    bool record = false,
+  }) async {
+    final icyMetaData = request.headers.value('icy-metadata');
+    final upstream = await dataSource.fetchAll(
+      headers: icyMetaData == null ? null : {'Icy-MetaData': icyMetaData},
+    );
+    if (upstream.statusCode >= 400) {
+      await upstream.drain<void>();
+      errorPages.write(
+        request.response,
+        ProxyFailure.upstreamUnavailable,
+        details: {'url': remoteUrl, 'upstreamStatus': upstream.statusCode},
+      );
+      return;
+    }
+
+    request.response.statusCode = HttpStatus.ok;
+    request.response.headers.set(
+      HttpHeaders.contentTypeHeader,
+      upstream.headers.contentType?.mimeType ??
+          (audio ? 'audio/mpeg' : 'application/octet-stream'),
+    );
+    upstream.headers.forEach((name, values) {
+      if (isIcyHeader(name)) {
+        request.response.headers.set(name, values.join(','));
+      }
+    });
+
+    if (request.method == 'HEAD') {
+      await upstream.listen(null).cancel();
+      return;
+    }
+
+    // One recording per stream: a second listener only plays
+    IOSink? recording;
+    if (record && _liveRecordings.add(fileId)) {
+      recording = File(
+        liveRecordingPath(fileId),
+      ).openWrite(mode: FileMode.append);
+    }
+
+    Logger.info('Passing through live stream: $remoteUrl');
+    final tracker = ProgressTracker(interval: _progressInterval);
+    var received = 0;
+    try {
+      final relayed = upstream.map((chunk) {
+        recording?.add(chunk);
+        final due = tracker.add(received, received + chunk.length - 1);
+        received += chunk.length;
+        _liveReceived[fileId] = received;
+        if (due) {
+          _emitLiveProgress(fileId, remoteUrl, received, tracker.report());
+        }
+        return chunk;
+      });
+      await request.response.addStream(_deadlined(request.response, relayed));
+    } finally {
+      if (tracker.hasPending) {
+        _emitLiveProgress(fileId, remoteUrl, received, tracker.report());
+      }
+      if (_liveReceived[fileId] == received) _liveReceived.remove(fileId);
+      if (recording != null) {
+        _liveRecordings.remove(fileId);
+        try {
+          await recording.close();
+        } catch (e) {
+          Logger.error('Failed to record live stream $fileId: $e');
+        }
+      }
+    }
+  }
+
+  void _emitLiveProgress(
+    String fileId,
+    String remoteUrl,
+    int received,
+    ProgressReport report,
+  ) {
+    _emit(
+      ProxyEvent(
+        ProxyEventType.progress,
+        fileId: fileId,
+        url: remoteUrl,
+        data: {
+          'live': true,
+          'bytes': received,
+          'bytesPerSecond': report.bytesPerSecond.round(),
+        },
+      ),
+    );
+  }
+
+  // ============== PLAYLISTS ==============
+
+  /// Tell the proxy the play order of [urls] (episodes, album tracks)
+  ///
+  /// Once playback of an item passes [PlaylistPrefetchConfig.threshold],
+  /// the start of the next one is cached so it plays without buffering.
+  void setPlaylist(List<String> urls) {
+    for (int i = 0; i + 1 < urls.length; i++) {
+      _nextUrls[_hashUrl(urls[i])] = urls[i + 1];
+    }
+    if (urls.isNotEmpty) _nextUrls.remove(_hashUrl(urls.last));
+  }
+
+  /// Forget all playlist context
+  void clearPlaylists() {
+    _nextUrls.clear();
+    _prefetchedNext.clear();
+  }
+
+  /// Cache the first [bytes] of [nextUrl] once playback of [meta] passes
+  /// [threshold]
+  void _maybePrefetchNext(
+    DownloadMeta meta,
+    int end,
+    String nextUrl, {
+    required double threshold,
+    required int bytes,
+  }) {
+    if ((end + 1) / meta.totalSize < threshold) return;
+
+    final nextId = _hashUrl(nextUrl);
+    if (_isPaused(nextId) || !_prefetchedNext.add(nextId)) return;
+    _urlLookup[nextId] = nextUrl;
+
+    unawaited(() async {
+      try {
+        final next = await _getOrCreateMeta(
+          nextId,
+          nextUrl,
+          autoDownload: false,
+        );
+        if (next == null) return;
+        final last = min(bytes, next.totalSize);
+        if (last <= 0 || next.hasRange(0, last - 1)) return;
+
+        final dataSource = _getDataSource(nextId, nextUrl);
+        await _fetchToCache(next, dataSource, 0, last - 1);
+        Logger.info('Prefetched next item: $nextUrl');
+      } catch (e) {
+        // Let a later request try again
+        _prefetchedNext.remove(nextId);
+        Logger.error('Next-item prefetch failed: $e');
+      }
+    }());
+  }
+
+  // ============== TAKE OFFLINE ==============
+
+  /// Bytes cached per step of [takeOffline], between status updates
+  static const int _offlineStep = 8 * 1024 * 1024;
+
+  /// Cache what fits of [urls] in [budget] bytes before going offline
+  /// (a flight, a trip)
+  ///
+  /// [urls] are in priority order. Their sizes are probed first, then
+  /// [planner] picks whole short items and prefixes of long ones; the
+  /// budget covers the planned bytes, cached already or not. Planned files
+  /// are pinned so eviction keeps them. Each item's readiness is reported
+  /// through [offlineStatus], `offlineStatus` events and `GET /offline`.
+  /// Returns the final status of every item.
+  Future<List<OfflineItemStatus>> takeOffline(
+    List<String> urls, {
+    required int budget,
+    OfflinePlanner planner = const OfflinePlanner(),
+    int concurrency = 2,
+    CallContext? context,
+  }) async {
+    _offline.clear();
+    for (final url in urls) {
+      _setOffline(OfflineItemStatus(url, OfflineReadiness.pending));
+    }
+
+    // The plan needs every size
+    final metas = <String, DownloadMeta>{};
+    await runPool(
+      _offline.keys.toList(),
+      4,
+      (url) async {
+        final fileId = _hashUrl(url);
+        _urlLookup[fileId] = url;
+        try {
+          final meta = await _getOrCreateMeta(
+            fileId,
+            url,
+            autoDownload: false,
+          );
+          if (meta != null) {
+            metas[url] = meta;
+          } else if (_emptyFiles.contains(fileId)) {
+            _setOffline(
+              OfflineItemStatus(url, OfflineReadiness.ready, totalSize: 0),
+            );
+          } else {
+            _setOffline(
+              OfflineItemStatus(
+                url,
+                OfflineReadiness.failed,
+                error: 'Unknown size',
+              ),
+            );
+          }
+        } catch (e) {
+          _setOffline(
+            OfflineItemStatus(url, OfflineReadiness.failed, error: '$e'),
+          );
+        }
+      },
+      isCancelled: () => context?.isDone ?? false,
+    );
+    context?.throwIfDone();
+
+    final plan = planner.plan([
+      for (final url in _offline.keys)
+        if (metas[url] case final meta?) (url, meta.totalSize),
+    ], budget);
+    for (final target in plan) {
+      final meta = metas[target.url]!;
+      if (target.bytes > 0) await pin(meta.id);
+      _setOffline(_offlineStatusOf(meta, target));
+    }
+
+    await runPool(
+      plan.where((target) => target.bytes > 0),
+      concurrency,
+      (target) async {
+        final meta = metas[target.url]!;
+        final dataSource = _getDataSource(meta.id, target.url);
+        try {
+          for (final (start, end) in meta.getGapsIn(0, target.bytes - 1)) {
+            for (int pos = start; pos <= end; pos += _offlineStep) {
+              context?.throwIfDone();
+              _setOffline(_offlineStatusOf(meta, target, running: true));
+              final last = min(pos + _offlineStep - 1, end);
+              await _fetchToCache(
+                meta,
+                dataSource,
+                pos,
+                last,
+                priority: DownloadPriority.background,
+              );
+            }
+          }
+          await meta.save();
+          _setOffline(_offlineStatusOf(meta, target));
+        } catch (e) {
+          final status = _offlineStatusOf(meta, target);
+          if (context?.isDone ?? false) {
+            _setOffline(status);
+            return;
+          }
+          Logger.error('Taking ${target.url} offline failed: $e');
+          _setOffline(
+            OfflineItemStatus(
+              target.url,
+              OfflineReadiness.failed,
+              totalSize: meta.totalSize,
+              plannedBytes: target.bytes,
+              cachedBytes: status.cachedBytes,
+              error: '$e',
+            ),
+          );
+        }
+      },
+      isCancelled: () => context?.isDone ?? false,
+    );
+    context?.throwIfDone();
+    return offlineStatus;
+  }
+
+  /// Readiness of every item of the last [takeOffline] call, in order
+  List<OfflineItemStatus> get offlineStatus =>
+      List.unmodifiable(_offline.values);
+
+  OfflineItemStatus _offlineStatusOf(
+    DownloadMeta meta,
+    OfflineTarget target, {
+    bool running = false,
+  }) {
+    final cached = target.bytes == 0
+        ? 0
+        : meta.cachedBytesIn(0, target.bytes - 1);
+    final OfflineReadiness readiness;
+    if (target.bytes == 0) {
+      readiness = OfflineReadiness.skipped;
+    } else if (cached == target.bytes) {
+      readiness = target.whole
+          ? OfflineReadiness.ready
+          : OfflineReadiness.partial;
+    } else {
+      readiness = running
+          ? OfflineReadiness.downloading
+          : OfflineReadiness.pending;
+    }
+    final bitrate = _bitrates[meta.id];
+    return OfflineItemStatus(
+      target.url,
+      readiness,
+      totalSize: meta.totalSize,
+      plannedBytes: target.bytes,
+      cachedBytes: cached,
+      seconds: bitrate == null || bitrate <= 0 ? null : cached * 8 / bitrate,
+    );
+  }
+
+  void _setOffline(OfflineItemStatus status) {
+    _offline[status.url] = status;
+    _emit(
+      ProxyEvent(
+        ProxyEventType.offlineStatus,
+        fileId: _hashUrl(status.url),
+        url: status.url,
+        data: status.toJson(),
+      ),
+    );
+  }
+
+  // ============== RANDOM ACCESS ==============
+
+  /// Random-access reader over the cache for [url]
+  ///
+  /// Missing bytes are fetched from upstream and cached on demand, so
+  /// parsers (archives, containers) only pull what they actually read.
+  /// Returns null when the file size cannot be determined.
+  Future<CacheReader?> openReader(String url) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final dataSource = _getDataSource(fileId, url);
+    final meta = await _getOrCreateMeta(fileId, url, autoDownload: false);
+    if (meta == null) return null;
+    return _ProxyCacheReader(this, meta, dataSource);
+  }
+
+  /// Fetch the ranges a local tool will read, ahead of its reads
+  ///
+  /// Ranges are fetched in the given order, skipping cached bytes and
+  /// merging neighbours closer than [maxGap] (see [AccessPlan]). A new plan
+  /// for the same file replaces the previous one. Completes once the plan
+  /// is cached or replaced; returns false when the file size is unknown.
+  Future<bool> planAccess(
+    String url,
+    List<(int, int)> ranges, {
+    int maxGap = 64 * 1024,
+  }) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final dataSource = _getDataSource(fileId, url);
+    final meta = await _getOrCreateMeta(fileId, url, autoDownload: false);
+    if (meta == null) return false;
+
+    final plan = AccessPlan(ranges, meta.totalSize, maxGap: maxGap);
+    _plans[fileId] = plan;
+    try {
+      for (final (start, end) in plan.ranges) {
+        if (!identical(_plans[fileId], plan)) break;
+        for (final (gapStart, gapEnd) in meta.getGapsIn(start, end)) {
+          await _fetchToCache(meta, dataSource, gapStart, gapEnd);
+        }
+      }
+    } finally {
+      if (identical(_plans[fileId], plan)) _plans.remove(fileId);
+      _scheduleDebouncedSave(fileId, meta);
+    }
+    return true;
+  }
+
+  /// POST /plan?url=URL with a JSON body `[[start, end], ...]`
+  ///
+  /// Answers 202 at once; the ranges are fetched in the background.
+  Future<void> _handlePlanRequest(HttpRequest request) async {
+    if (request.method != 'POST') {
+      request.response.statusCode = HttpStatus.methodNotAllowed;
+      request.response.headers.set(HttpHeaders.allowHeader, 'POST');
+      return;
+    }
+    final remoteUrl = _queryTarget(request.uri, 'url');
+    if (remoteUrl == null) {
+      request.response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+
+    final List<(int, int)> ranges;
+    try {
+      final json = jsonDecode(await utf8.decoder.bind(request).join());
+      ranges = [
+        for (final range in (json as List).cast<List<dynamic>>())
+          (range[0] as int, range[1] as int),
+      ];
+    } catch (_) {
+      request.response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+
+    unawaited(
+      planAccess(remoteUrl, ranges).catchError((Object e) {
+        Logger.error('Access plan failed for $remoteUrl: $e');
+        return false;
+      }),
+    );
+    request.response.statusCode = HttpStatus.accepted;
+  }
+
+  /// Fetch [start]..[end] from upstream into the cache (no client)
+  Future<void> _fetchToCache(
+    DownloadMeta meta,
+    DataSource dataSource,
+    int start,
+    int end, {
+    DownloadPriority priority = DownloadPriority.prefetch,
+  }) async {
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    final gate = _hostGate(meta);
+    end = gate?.widen(start, end, meta.totalSize) ?? end;
+    final slot = await _admit(meta.id, priority: priority);
+    final release = await gate?.acquire();
+
+    _loadShedder?.fetchStarted();
+    try {
+      // Bytes another request is fetching are waited for, not fetched
+      // again; only what is still missing after that is claimed
+      int from = start;
+      while (from <= end) {
+        final flight = await _claim(meta, from, end);
+        if (flight == null) {
+          final gaps = meta.getGapsIn(from, end);
+          if (gaps.isEmpty) break;
+          from = gaps.first.$1;
+          continue;
+        }
+        try {
+          await _fetchFlight(meta, dataSource, lock, flight);
+        } finally {
+          _land(meta.id, flight);
+        }
+        from = flight.end + 1;
+      }
+    } finally {
+      _loadShedder?.fetchFinished();
+      release?.call();
+      slot?.call();
+    }
+    _scheduleDebouncedSave(meta.id, meta);
+  }
+
+  /// Fetch and write the bytes claimed by [flight]
+  Future<void> _fetchFlight(
+    DownloadMeta meta,
+    DataSource dataSource,
+    SharedLock lock,
+    _Flight flight,
+  ) async {
+    final start = flight.start;
+    final end = flight.end;
+    final upstream = await dataSource.fetchRange(start, end);
+    await _expectBytes(upstream, start, end);
+    _ignoresRange(meta, upstream, start, end);
+    if (upstream.statusCode != HttpStatus.partialContent && start > 0) {
+      await upstream.listen(null).cancel();
+      throw HttpException(
+        'Upstream ignored Range (status ${upstream.statusCode})',
+      );
+    }
+
+    int pos = start;
+    var source = _sourceOf(dataSource, upstream);
+    final body = upstream.statusCode == HttpStatus.partialContent
+        ? _resumable(
+            dataSource,
+            upstream,
+            start,
+            end,
+            onResume: (resumed) => source = _sourceOf(dataSource, resumed),
+          )
+        : upstream;
+    await for (final chunk in body) {
+      final chunkEnd = min(pos + chunk.length - 1, end);
+      await lock.synchronized(() async {
+        final raf = await File(meta.localPath).open(mode: FileMode.append);
+        try {
+          await raf.setPosition(pos);
+          await raf.writeFrom(
+            _sealed(meta, pos, chunk),
+            0,
+            chunkEnd - pos + 1,
+          );
+        } finally {
+          await raf.close();
+        }
+        _recordRange(meta, pos, chunkEnd, source: source);
+      });
+      pos = chunkEnd + 1;
+      flight.advance(pos);
+      if (pos > end) break;
+      await _yieldToPlayback(meta.id, chunk.length);
+    }
+  }
+
+  /// Read [start]..[end] from the cache, fetching missing gaps first
+  Future<Uint8List> _readThrough(
+    DownloadMeta meta,
+    DataSource dataSource,
+    int start,
+    int end,
+  ) async {
+    if (!meta.hasRange(start, end)) {
+      for (final (gapStart, gapEnd) in meta.getDownloadGaps()) {
+        if (gapEnd < start || gapStart > end) continue;
+        await _fetchToCache(
+          meta,
+          dataSource,
+          max(gapStart, start),
+          min(gapEnd, end),
+          priority: DownloadPriority.foreground,
+        );
+      }
+    }
+
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    return lock.shared(() async {
+      final raf = await File(meta.localPath).open(mode: FileMode.read);
+      try {
+        await raf.setPosition(start);
+        return _opened(meta, start, await raf.read(end - start + 1));
+      } finally {
+        await raf.close();
+      }
+    });
+  }
+
+  // ============== ARCHIVES ==============
+
+  /// GET /archive?url=URL - list ZIP entries as JSON
+  /// GET /archive?url=URL&entry=PATH - stream one entry
+  ///
+  /// Stored entries support Range requests; deflated ones are streamed
+  /// whole with 200.
+  Future<void> _handleArchiveRequest(HttpRequest request) async {
+    final remoteUrl = _queryTarget(request.uri, 'url');
+    if (remoteUrl == null) {
+      request.response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+
+    final reader = await openReader(remoteUrl);
+    if (reader == null) {
+      request.response.statusCode = HttpStatus.badGateway;
+      return;
+    }
+
+    final head = await reader.readAt(0, 4);
+    if (ZipArchive.isRar(head)) {
+      request.response.statusCode = HttpStatus.unsupportedMediaType;
+      request.response.write('RAR archives are not supported');
+      return;
+    }
+
+    final ZipArchive archive;
+    try {
+      archive = await ZipArchive.open(reader);
+    } on ArchiveException catch (e) {
+      request.response.statusCode = HttpStatus.unsupportedMediaType;
+      request.response.write(e.message);
+      return;
+    }
+
+    final entryName = request.uri.queryParameters['entry'];
+    if (entryName == null) {
+      request.response.headers.contentType = ContentType.json;
+      request.response.write(
+        jsonEncode([
+          for (final entry in archive.entries)
+            if (!entry.isDirectory) entry.toJson(),
+        ]),
+      );
+      return;
+    }
+
+    final entry = archive.find(entryName);
+    if (entry == null || entry.isDirectory) {
+      request.response.statusCode = HttpStatus.notFound;
+      return;
+    }
+
+    final response = request.response;
+    response.headers.set(
+      HttpHeaders.contentTypeHeader,
+      mimeTypeForName(entry.name),
+    );
+
+    if (!entry.isStored) {
+      response.headers.set(HttpHeaders.acceptRangesHeader, 'none');
+      response.contentLength = entry.size;
+      await response.addStream(_deadlined(response, archive.read(entry)));
+      return;
+    }
+
+    int start = 0;
+    int end = entry.size - 1;
+    final List<(int, int)>? ranges;
+    try {
+      ranges = RangeHeader.parse(request.headers.value('range'), entry.size);
+    } on RangeNotSatisfiableException {
+      _rejectRange(response, entry.size);
+      return;
+    }
+    response.headers.set(HttpHeaders.acceptRangesHeader, 'bytes');
+    if (ranges != null) {
+      // Entries are served one range at a time: the span of all of them
+      start = ranges.first.$1;
+      end = ranges.last.$2;
+      response.statusCode = HttpStatus.partialContent;
+      response.headers.set(
+        'Content-Range',
+        'bytes $start-$end/${entry.size}',
+      );
+    }
+    response.contentLength = end - start + 1;
+    await response.addStream(
+      _deadlined(response, archive.read(entry, start: start, end: end)),
+    );
+  }
+
+  // ============== SUBTITLES ==============
+
+  /// GET /subtitles?url=URL -> embedded text subtitle tracks (JSON);
+  /// `&track=N` -> that track as WebVTT
+  ///
+  /// Extraction reads the whole file through the cache (see
+  /// [SubtitleExtractor]); each extracted track is kept under `.subtitles`
+  /// and served from there afterwards.
+  Future<void> _handleSubtitlesRequest(HttpRequest request) async {
+    final remoteUrl = _queryTarget(request.uri, 'url');
+    final trackParam = request.uri.queryParameters['track'];
+    final track = trackParam == null ? null : int.tryParse(trackParam);
+    if (remoteUrl == null || (trackParam != null && track == null)) {
+      request.response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+
+    final response = request.response;
+    final fileId = _hashUrl(remoteUrl);
+    final cached = File('$storageDir/.subtitles/$fileId.$track.vtt');
+    if (track != null && await cached.exists()) {
+      _writeWebVtt(response, await cached.readAsString());
+      return;
+    }
+
+    final reader = await openReader(remoteUrl);
+    if (reader == null) {
+      response.statusCode = HttpStatus.badGateway;
+      return;
+    }
+
+    try {
+      final tracks = await SubtitleExtractor.tracks(reader);
+      if (track == null) {
+        response.headers.contentType = ContentType.json;
+        response.write(jsonEncode(tracks));
+        return;
+      }
+      if (!tracks.any((t) => t.number == track)) {
+        response.statusCode = HttpStatus.notFound;
+        return;
+      }
+
+      // Concurrent requests for one track share the extraction
+      final key = '$fileId.$track';
+      final vtt = await _subtitleExtractions.putIfAbsent(key, () async {
+        try {
+          final text = await SubtitleExtractor.toWebVtt(reader, track);
+          await cached.parent.create(recursive: true);
+          await cached.writeAsString(text);
+          return text;
+        } finally {
+          _subtitleExtractions.remove(key);
+        }
+      }());
+      _writeWebVtt(response, vtt);
+    } on SubtitleException catch (e) {
+      response.statusCode = HttpStatus.unsupportedMediaType;
+      response.write(e.message);
+    }
+  }
+
+  void _writeWebVtt(HttpResponse response, String vtt) {
+    response.headers.set(
+      HttpHeaders.contentTypeHeader,
+      'text/vtt; charset=utf-8',
+    );
+    response.write(vtt);
+  }
+
+  // ============== WORK UNITS ==============
+
+  /// Lease missing ranges of [url] to an external downloader
+  ///
+  /// Each unit is fetched by the caller and pushed back to
+  /// [workUnitUploadUrl]. While leases are live the proxy's own
+  /// background download for the file is paused.
+  Future<List<WorkUnit>> leaseWorkUnits(
+    String url, {
+    int maxUnits = 4,
+    int unitSize = 4 * 1024 * 1024,
+    Duration leaseDuration = const Duration(minutes: 2),
+  }) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final meta = await _getOrCreateMeta(fileId, url, autoDownload: false);
+    if (meta == null) return const [];
+
+    return _workCoordinator.lease(
+      meta,
+      url,
+      maxUnits: maxUnits,
+      unitSize: unitSize,
+      leaseDuration: leaseDuration,
+    );
+  }
+
+  /// The fetch path as composable stages, for custom schedulers
+  late final FetchPipeline pipeline = _ProxyFetchPipeline(this);
+
+  /// Upload URL for a leased unit, relative to [base] (defaults to loopback)
+  Uri workUnitUploadUrl(WorkUnit unit, {Uri? base}) {
+    final origin = base ?? baseUrl;
+    return origin.replace(
+      path: '/upload',
+      queryParameters: {
+        'url': urlSigner.sign(unit.url),
+        'unit': unit.id,
+        if (access.key case final key?) AccessPolicy.keyParameter: key,
+      },
+    );
+  }
+
+  /// GET /work?url=TOKEN[&max=N][&unitSize=BYTES] - lease missing ranges
+  Future<void> _handleWorkRequest(HttpRequest request) async {
+    final remoteUrl = _queryTarget(request.uri, 'url');
+    if (remoteUrl == null) {
+      request.response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+
+    final params = request.uri.queryParameters;
+    final units = await leaseWorkUnits(
+      remoteUrl,
+      maxUnits: int.tryParse(params['max'] ?? '') ?? 4,
+      unitSize: int.tryParse(params['unitSize'] ?? '') ?? 4 * 1024 * 1024,
+    );
+    final meta = _metadata[_hashUrl(remoteUrl)];
+    if (meta == null) {
+      request.response.statusCode = HttpStatus.badGateway;
+      return;
+    }
+
+    // Upload URLs point back at the address the client used to reach us
+    final base = request.requestedUri;
+    request.response.headers.contentType = ContentType.json;
+    request.response.write(
+      jsonEncode({
+        'fileId': meta.id,
+        'totalSize': meta.totalSize,
+        'progress': meta.progress,
+        'units': [
+          for (final unit in units)
+            unit.toJson(uploadUrl: workUnitUploadUrl(unit, base: base)),
+        ],
+      }),
+    );
+  }
+
+  /// Store a finished body digest and publish it to the event log
+  void _recordBodyDigest(
+    String requestId,
+    String fileId,
+    String remoteUrl,
+    int start,
+    int end,
+    BodyDigest digest,
+  ) {
+    final event = ProxyEvent(
+      ProxyEventType.bodyDigest,
+      fileId: fileId,
+      url: remoteUrl,
+      data: {
+        'requestId': requestId,
+        'start': start,
+        'end': end,
+        'length': digest.length,
+        'sha256': digest.close(),
+      },
+    );
+
+    _bodyDigests[requestId] = event;
+    if (_bodyDigests.length > _maxBodyDigests) {
+      _bodyDigests.remove(_bodyDigests.keys.first);
+    }
+    _emit(event);
+  }
+
+  /// GET /digest?request=ID - digest of a finished response body
+  Future<void> _handleDigestRequest(HttpRequest request) async {
+    final requestId = request.uri.queryParameters['request'];
+    final event = requestId == null ? null : _bodyDigests[requestId];
+    if (event == null) {
+      request.response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    request.response.headers.contentType = ContentType.json;
+    request.response.write(jsonEncode(event.toJson()));
+  }
+
+  /// Features of this proxy build, for client feature detection
+  Map<String, Object> get capabilities => {
+    'version': BuildInfo.version,
+    'endpoints': [
+      ..._streamRoutes,
+      ..._routes.keys,
+      ..._prefixRoutes.keys,
+    ],
+    'profiles': [for (final profile in ServingProfile.values) profile.name],
+    'features': {
+      'byteRanges': true,
+      'multiRange': true,
+      'hlsRewrite': manifestAware,
+      'bodyDigest': true,
+      'backfill': true,
+      'workUnits': true,
+      'zipEntries': true,
+      'ephemeral': true,
+      'namespaces': true,
+      'pinning': true,
+      'scrubber': _scrubberConfig != null,
+      'events': ['in-process', 'sse', 'websocket'],
+      'icyPassthrough': true,
+      'encryptedMetadata': metaCipher != null,
+      'encryptedCache': cacheCipher != null,
+      'secretStore': _secrets != null,
+      'loadShedding': _loadShedder != null,
+      'rateShaping': _rateShaping != null,
+      'shadowCache': _shadow != null,
+      'requestRecording': _requestLog != null,
+      'readAhead': _readAhead != null,
+      'segmented': _segmented != null,
+      'mirrors': true,
+      'sidecars': true,
+      'storageFallback': true,
+      'fairness': _fairQueue != null,
+      'downloadPriorities': true,
+      'bandwidthGuarantee': _bandwidthGuard != null,
+      'manifests': manifestAware,
+      'libraryRefresh': _libraryRefresher != null,
+      'quota': _quota != null,
+      'variants': true,
+      'certificatePins': true,
+      'hostProbing': hostProbing,
+      'takeOffline': true,
+      'subtitles': true,
+      'downloadsApi': true,
+      'downloadContent': true,
+      'bandwidthLimits': true,
+      'eventThrottling': true,
+      'detachedFetch': detachedFetchLimit > 0,
+      'pipelinedFetches': pipelineFetches,
+      'originIsolation': isolateOriginHeaders,
+      'metrics': true,
+      'rangeSources': true,
+      'preview': true,
+      'handoff': true,
+      'headerPassThrough': passThroughHeaders.isNotEmpty,
+      'tiering': _tiers != null,
+      'checksumVerification': true,
+      'lifetimes': true,
+      'sparseFiles': storageReport.sparseFiles,
+      'cors': corsOrigin != null,
+      'duplicates': duplicatePolicy.name,
+      'completion': completion.mode.name,
+      'contentUpload': true,
+      'liveStreams': true,
+      'contentIds': contentResolver != null,
+      'liveRecording': recordLive,
+      'upstreamProxy':
+          proxyConfig?.host != null || clientConfig.proxyUrl != null,
+    },
+    'auth': [
+      'signedUrls',
+      if (allowUnsignedUrls) 'none',
+      if (apiToken != null) 'bearer',
+      if (access.key != null) 'apiKey',
+    ],
+  };
+
+  /// Version, commit and enabled features of this proxy
+  BuildInfo get buildInfo =>
+      BuildInfo(features: capabilities['features'] as Map<String, Object>);
+
+  /// GET /capabilities
+  void _handleCapabilitiesRequest(HttpRequest request) {
+    request.response.headers.contentType = ContentType.json;
+    request.response.write(jsonEncode(capabilities));
+  }
+
+  /// Schedule a debounced save for metadata
   void _scheduleDebouncedSave(String fileId, DownloadMeta meta) {
     _saveTimers[fileId]?.cancel();
     _saveTimers[fileId] = Timer(Duration(milliseconds: 1000), () async {
+      _saveTimers.remove(fileId);
+      try {
+        await meta.save();
+        Logger.debug('Metadata saved', fields: {'fileId': fileId});
+      } catch (e) {
+        // The next save retries; the journal covers a crash meanwhile
+        Logger.error(
+          'Failed to save metadata',
+          fields: {'fileId': fileId},
+          error: e,
+        );
+      }
+    });
+  }
+
+  /// Handle completed download
+  Future<void> _onDownloadComplete(DownloadMeta meta) async {
+    if (!meta.ephemeral && !await _verifyCompleted(meta)) return;
+    Logger.success('Download complete: ${meta.id}');
+    await _releaseMirrors(meta.id);
+    _setDownloadState(meta.id, DownloadState.completed);
+    _reportProgress(meta);
+    _forgetProgress(meta.id);
+
+    // Ephemeral data stays in the scratch folder until the session ends;
+    // sidecars stay cached until their video completes and takes them
+    if (meta.ephemeral || _sidecarOwners.containsKey(meta.id)) {
+      _emitCompleted(meta, meta.localPath);
+      return;
+    }
+
+    // The collection is plaintext: other apps and the media scanner
+    // read it. A copy leaves the cached file (and its metadata) as it is.
+    final copy = completion.mode == CompletionMode.copy;
+    if (!copy) {
+      await _decryptCached(meta);
+      await File(meta.metaPath).delete();
+    }
+    if (completion.checksum) meta.sha256 ??= await _plainSha256(meta);
+
+    // The container's own signature beats a generic Content-Type
+    final head = <int>[];
+    await for (final chunk in _plainRead(
+      File(meta.localPath),
+      meta,
+      0,
+      4096,
+    )) {
+      head.addAll(chunk);
+    }
+    final sniffed = MimeTypeDetector.detectFromBytes(head);
+    if (sniffed != null &&
+        MimeTypeDetector.extensionFor(meta.mimeType) !=
+            MimeTypeDetector.extensionFor(sniffed)) {
+      meta.mimeType = sniffed;
+    }
+
+    // Write into a document tree the app cannot open by path
+    final target = meta.targetPath;
+    final tree = target != null && isContentUri(target)
+        ? target
+        : collectionTree;
+    if (tree != null && documentStore != null) {
+      final source = File(meta.localPath);
+      final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+      final uri = await lock.shared(
+        () => _copyToDocument(source, tree, meta, meta.id, null),
+      );
+      Logger.success('File written to: $uri');
+      if (!copy) {
+        await lock.synchronized(source.delete);
+        _metadata.remove(meta.id);
+      }
+      await _finishCompletion(meta, uri);
+      return;
+    }
+
+    // Determine final destination path
+    final collection = _collections[_fileCollections[meta.id]];
+    String finalPath;
+    if (meta.targetPath != null && meta.targetPath!.isNotEmpty) {
+      // Use the specified target path
+      finalPath = meta.targetPath!;
+      // Ensure directory exists
+      await Directory(finalPath).parent.create(recursive: true);
+    } else {
+      // The download's collection, else the default collections folder
+      final dir =
+          collection?.directoryIn(_collectionsRoot) ?? _collectionsRoot;
+      await Directory(dir).create(recursive: true);
+      final ext =
+          MimeTypeDetector.extensionFor(meta.mimeType) ?? meta.extension;
+      final name = completion.fileNameFor(
+        meta.id,
+        ext,
+        originName: meta.fileName,
+        url: meta.originalUrl ?? _urlLookup[meta.id],
+        fallback: _outname,
+      );
+      finalPath = completion.naming == CompletionNaming.origin
+          ? await _freePath('$dir/$name')
+          : '$dir/$name';
+    }
+
+    // The same content may already be in the collection; a copy keeps
+    // the cached file, so there is nothing to settle
+    if (!copy && duplicatePolicy != DuplicatePolicy.keep) {
+      final sha256 = meta.sha256 ??= await sha256OfFile(meta.localPath);
+      final duplicate = await _fingerprints.findDuplicate(
+        meta.localPath,
+        sha256,
+        p.dirname(finalPath),
+      );
+      final kept = duplicate == null
+          ? null
+          : await _settleDuplicate(meta, duplicate, finalPath);
+      if (kept != null) {
+        _metadata.remove(meta.id);
+        await _finishCompletion(meta, kept);
+        return;
+      }
+    }
+
+    await _place(meta, finalPath, copy: copy);
+    Logger.success('File ${copy ? 'copied' : 'moved'} to: $finalPath');
+    await _placeSidecars(meta.id, finalPath, copy: copy);
+    if (!copy) {
+      _forgetCold(meta.id);
+      _collected[meta.id] = finalPath;
+      unawaited(_saveCollected());
+    }
+    final fingerprint = meta.sha256;
+    if (fingerprint != null && duplicatePolicy != DuplicatePolicy.keep) {
+      await _fingerprints.remember(finalPath, fingerprint);
+      unawaited(_saveFingerprints());
+    }
+
+    await _writeCompletionMarker(meta, finalPath);
+    _libraryRefresher?.fileAdded(finalPath);
+
+    if (!copy) _metadata.remove(meta.id);
+    if (_fileCollections.remove(meta.id) != null) {
+      unawaited(_saveFileCollections());
+    }
+    if (collection != null) await _enforceCollection(collection);
+    await _finishCompletion(meta, finalPath);
+  }
+
+  // ============== COMPLETION ==============
+
+  /// What happens to downloads once all of them is cached: moved or
+  /// copied, named how, and which hooks run
+  CompletionConfig completion = const CompletionConfig();
+
+  // Files moved into the collection, still served from there
+  Map<String, String> _collected = {};
+
+  /// Put the completed file of [meta] at [path] without ever exposing a
+  /// partial file there
+  ///
+  /// Players keep reading throughout: a copy shares the file's lock with
+  /// them, and a move takes it alone only to rename, pointing [meta] (which
+  /// running requests hold) at the new place.
+  Future<void> _place(
+    DownloadMeta meta,
+    String path, {
+    required bool copy,
+  }) async {
+    final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    if (!copy) {
+      final renamed = await lock.synchronized(() async {
+        try {
+          await File(meta.localPath).rename(path);
+        } on FileSystemException {
+          return false;
+        }
+        meta.localPath = path;
+        return true;
+      });
+      if (renamed) return;
+    }
+
+    // Another disk, or a copy: write beside the target, then rename
+    final part = '$path.part';
+    await lock.shared(
+      () => _copyFile(File(meta.localPath), part, null, meta: meta),
+    );
+    await File(part).rename(path);
+    if (copy) return;
+    await lock.synchronized(() async {
+      await File(meta.localPath).delete();
+      meta.localPath = path;
+    });
+  }
+
+  /// [path], or the first of `name (2).ext`, `name (3).ext` … not taken
+  Future<String> _freePath(String path) async {
+    final stem = p.withoutExtension(path);
+    final ext = p.extension(path);
+    var candidate = path;
+    var n = 1;
+    while (await FileSystemEntity.type(candidate) !=
+        FileSystemEntityType.notFound) {
+      candidate = '$stem (${++n})$ext';
+    }
+    return candidate;
+  }
+
+  /// Run the [CompletionConfig.hooks] for [meta], now at [path], then
+  /// report it completed
+  Future<void> _finishCompletion(DownloadMeta meta, String path) async {
+    final file = CompletedFile(
+      meta.id,
+      path,
+      url: meta.originalUrl ?? _urlLookup[meta.id],
+      size: meta.totalSize,
+      mimeType: meta.mimeType,
+      sha256: meta.sha256,
+    );
+    for (final hook in completion.hooks) {
+      try {
+        await hook(file);
+      } catch (e) {
+        Logger.error('Completion hook failed for ${meta.id}: $e');
+      }
+    }
+    _emitCompleted(meta, path);
+  }
+
+  /// Complete metadata serving [fileId] from the collection file it was
+  /// moved to; null when it is not there (any more)
+  ///
+  /// Never saved nor kept in the cache's bookkeeping, so eviction and
+  /// [clearCache] leave the collection file alone.
+  Future<DownloadMeta?> _collectedMeta(String fileId, String remoteUrl) async {
+    final path = _collected[fileId];
+    if (path == null) return null;
+    final file = File(path);
+    if (!await file.exists()) {
+      _collected.remove(fileId);
+      unawaited(_saveCollected());
+      return null;
+    }
+    final size = await file.length();
+    if (size == 0) return null;
+    _fileLocks.putIfAbsent(fileId, () => SharedLock());
+    return DownloadMeta(
+      id: fileId,
+      totalSize: size,
+      localPath: path,
+      metaPath: '$storageDir/$fileId.meta',
+      originalUrl: remoteUrl,
+      ephemeral: true, // never saved
+    )..addRange(0, size - 1);
+  }
+
+  Future<void> _saveCollected() async {
+    try {
+      await File(
+        '$storageDir/.collected.json',
+      ).writeAsString(jsonEncode(_collected));
+    } catch (e) {
+      Logger.error('Failed to save collected files: $e');
+    }
+  }
+
+  Future<void> _loadCollected() async {
+    final file = File('$storageDir/.collected.json');
+    if (!await file.exists()) return;
+    try {
+      _collected = (jsonDecode(await file.readAsString()) as Map)
+          .cast<String, String>();
+    } catch (e) {
+      Logger.error('Failed to load collected files: $e');
+    }
+  }
+
+  // ============== COLLECTIONS ==============
+
+  final Map<String, Collection> _collections = {};
+
+  // Collection each enqueued download goes to, until it completes
+  Map<String, String> _fileCollections = {};
+
+  /// Folder completed downloads go to, and the collections folders are in
+  String get _collectionsRoot =>
+      completion.directory ?? _outDir ?? '$storageDir/../collections';
+
+  /// Named collections, e.g. to enqueue into with [startBackgroundDownload]
+  List<Collection> get collections => List.unmodifiable(_collections.values);
+
+  /// Add [collection], or replace the one of the same name; its limits
+  /// apply from the next sweep
+  void defineCollection(Collection collection) {
+    _collections[collection.name] = collection;
+  }
+
+  /// Forget the collection [name]; its folder and files stay, and its
+  /// pending downloads go to the default folder
+  void removeCollection(String name) {
+    _collections.remove(name);
+  }
+
+  /// Send [fileId] to the collection [name] once it completes
+  void _assignCollection(String fileId, String name) {
+    if (!_collections.containsKey(name)) {
+      throw ArgumentError.value(name, 'collection', 'Not defined');
+    }
+    _fileCollections[fileId] = name;
+    unawaited(_saveFileCollections());
+  }
+
+  /// Files of the collection [name]; null when there is no such collection
+  Future<List<CollectionFile>?> collectionFiles(String name) async {
+    final collection = _collections[name];
+    if (collection == null) return null;
+    return Collection.list(collection.directoryIn(_collectionsRoot));
+  }
+
+  /// Delete the files [collection] holds beyond its limits
+  Future<void> _enforceCollection(Collection collection) async {
+    final files = await Collection.list(
+      collection.directoryIn(_collectionsRoot),
+    );
+    for (final file in collection.overLimits(files, DateTime.now())) {
+      try {
+        await _fingerprints.delete(file.path);
+      } catch (e) {
+        Logger.error('Failed to delete ${file.path}: $e');
+        continue;
+      }
+      Logger.info('Removed ${file.path} from ${collection.name}');
+      _emit(
+        ProxyEvent(
+          ProxyEventType.evicted,
+          data: {
+            'collection': collection.name,
+            'path': file.path,
+            'bytes': file.size,
+          },
+        ),
+      );
+    }
+  }
+
+  Future<void> _enforceCollections() async {
+    for (final collection in _collections.values.toList()) {
+      await _enforceCollection(collection);
+    }
+  }
+
+  /// GET /api/collections[/<name>]: each collection with its limits and
+  /// usage, or one with its files
+  Future<void> _handleCollectionsApi(HttpRequest request) async {
+    final response = request.response;
+    if (!_checkAuthorized(request)) return;
+    if (request.method != 'GET') {
+      response.statusCode = HttpStatus.methodNotAllowed;
+      response.headers.set(HttpHeaders.allowHeader, 'GET');
+      return;
+    }
+    final segments = request.uri.pathSegments;
+    if (segments.length > 3) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+
+    Future<Map<String, dynamic>> entry(
+      Collection collection, {
+      required bool withFiles,
+    }) async {
+      final directory = collection.directoryIn(_collectionsRoot);
+      final files = await Collection.list(directory);
+      return {
+        ...collection.toJson(),
+        'directory': directory,
+        'bytes': files.fold(0, (sum, f) => sum + f.size),
+        'count': files.length,
+        if (withFiles) 'files': [for (final file in files) file.toJson()],
+      };
+    }
+
+    if (segments.length == 2) {
+      _writeJson(response, {
+        'collections': [
+          for (final collection in _collections.values)
+            await entry(collection, withFiles: false),
+        ],
+      });
+      return;
+    }
+    final collection = _collections[segments[2]];
+    if (collection == null) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    _writeJson(response, await entry(collection, withFiles: true));
+  }
+
+  Future<void> _saveFileCollections() async {
+    try {
+      await File(
+        '$storageDir/.collections.json',
+      ).writeAsString(jsonEncode(_fileCollections));
+    } catch (e) {
+      Logger.error('Failed to save collection assignments: $e');
+    }
+  }
+
+  Future<void> _loadFileCollections() async {
+    final file = File('$storageDir/.collections.json');
+    if (!await file.exists()) return;
+    try {
+      _fileCollections = (jsonDecode(await file.readAsString()) as Map)
+          .cast<String, String>();
+    } catch (e) {
+      Logger.error('Failed to load collection assignments: $e');
+    }
+  }
+
+  // ============== DUPLICATES ==============
+
+  /// What to do with a completed download whose content is already in
+  /// the collection; by default both copies are kept unchecked
+  DuplicatePolicy duplicatePolicy = DuplicatePolicy.keep;
+
+  FingerprintIndex _fingerprints = FingerprintIndex();
+
+  /// Apply [duplicatePolicy] to [meta], whose content matches the
+  /// collection file [existing]; returns where the content now is, or
+  /// null when the new copy is to be moved in as usual
+  Future<String?> _settleDuplicate(
+    DownloadMeta meta,
+    String existing,
+    String finalPath,
+  ) async {
+    final sha256 = meta.sha256!;
+    Logger.info(
+      'Duplicate of a collection file',
+      fields: {
+        'fileId': meta.id,
+        'existing': existing,
+        'policy': duplicatePolicy.name,
+      },
+    );
+    _emit(
+      ProxyEvent(
+        ProxyEventType.duplicateFound,
+        fileId: meta.id,
+        url: meta.originalUrl ?? _urlLookup[meta.id],
+        data: {
+          'existing': existing,
+          'path': finalPath,
+          'sha256': sha256,
+          'policy': duplicatePolicy.name,
+        },
+      ),
+    );
+
+    String? kept;
+    switch (duplicatePolicy) {
+      case DuplicatePolicy.keep:
+        return null;
+      case DuplicatePolicy.skip:
+        await File(meta.localPath).delete();
+        kept = existing;
+      case DuplicatePolicy.replace:
+        // Moved in as usual once the old copy is gone
+        if (!p.equals(existing, finalPath)) {
+          await _fingerprints.delete(existing);
+        }
+        return null;
+      case DuplicatePolicy.hardLink:
+        if (p.equals(existing, finalPath) ||
+            await File(finalPath).exists() ||
+            !await FingerprintIndex.hardLink(existing, finalPath)) {
+          return null;
+        }
+        await File(meta.localPath).delete();
+        await _writeCompletionMarker(meta, finalPath);
+        _libraryRefresher?.fileAdded(finalPath);
+        kept = finalPath;
+    }
+    await _fingerprints.remember(kept, sha256);
+    unawaited(_saveFingerprints());
+    return kept;
+  }
+
+  Future<void> _saveFingerprints() async {
+    try {
+      await File(
+        '$storageDir/.fingerprints.json',
+      ).writeAsString(jsonEncode(_fingerprints.toJson()));
+    } catch (e) {
+      Logger.error('Failed to save fingerprints: $e');
+    }
+  }
+
+  Future<void> _loadFingerprints() async {
+    final file = File('$storageDir/.fingerprints.json');
+    if (!await file.exists()) return;
+    try {
+      _fingerprints = FingerprintIndex.fromJson(
+        jsonDecode(await file.readAsString()) as Map<String, dynamic>,
+      );
+    } catch (e) {
+      Logger.error('Failed to load fingerprints: $e');
+    }
+  }
+
+  Future<void> _writeCompletionMarker(DownloadMeta meta, String path) async {
+    if (!completionMarkers) return;
+    try {
+      final marker = await CompletionMarker.forFile(
+        path,
+        url: meta.originalUrl ?? _urlLookup[meta.id],
+        mimeType: meta.mimeType,
+      );
+      await marker.write(path);
+    } catch (e) {
+      Logger.error('Failed to write completion marker: $e');
+    }
+  }
+
+  void _emitCompleted(DownloadMeta meta, String path) {
+    final lifetime = _lifetimes[meta.id];
+    if (lifetime != null) {
+      lifetime.completedPath = path;
+      unawaited(_saveLifetimes());
+    }
+    _emit(
+      ProxyEvent(
+        ProxyEventType.downloadCompleted,
+        fileId: meta.id,
+        url: meta.originalUrl ?? _urlLookup[meta.id],
+        data: {
+          'path': path,
+          'totalSize': meta.totalSize,
+          if (meta.sha256 != null) 'sha256': meta.sha256,
+        },
+      ),
+    );
+  }
+
+  // ============== CONTENT VERIFICATION ==============
+
+  /// Verify [url] against [sha256] (hex) once it is completely cached
+  ///
+  /// A file that does not match emits a `verificationFailed` event and is
+  /// downloaded again instead of moving to the collection.
+  void setExpectedChecksum(String url, String sha256) {
+    if (!_expectChecksum(_hashUrl(url), sha256)) {
+      throw ArgumentError.value(sha256, 'sha256', 'Not a SHA-256 digest');
+    }
+  }
+
+  /// Record [sha256] for [fileId]; false when it is not a digest
+  bool _expectChecksum(String fileId, String sha256) {
+    final hex = parseSha256(sha256);
+    if (hex == null) return false;
+    final meta = _metadata[fileId];
+    if (meta == null) {
+      _expectedChecksums[fileId] = hex;
+    } else if (meta.expectedSha256 != hex) {
+      meta.expectedSha256 = hex;
+      _scheduleDebouncedSave(fileId, meta);
+    }
+    return true;
+  }
+
+  /// Hash the complete [meta] and check it against its expected checksum
+  ///
+  /// On a mismatch the blocks the scrubber finds changed are fetched
+  /// again, or the whole file when it has no block checksums to tell
+  /// which; after [verifyRetries] attempts the download is marked failed
+  /// and the file stays in the cache. Returns whether the file may be
+  /// completed.
+  Future<bool> _verifyCompleted(DownloadMeta meta) async {
+    final expected = meta.expectedSha256;
+    if (expected == null && !verifyCompletions) return true;
+    final actual = await _plainSha256(meta);
+    meta.sha256 = actual;
+    if (expected == null || actual == expected) {
+      _verifyFailures.remove(meta.id);
+      return true;
+    }
+
+    final url = meta.originalUrl ?? _urlLookup[meta.id];
+    final attempt = (_verifyFailures[meta.id] ?? 0) + 1;
+    _verifyFailures[meta.id] = attempt;
+
+    // Blocks hashed by the scrubber before tell where the damage is
+    final located = meta.checksums.isNotEmpty;
+    final report = ScrubReport();
+    await Scrubber.scrubFile(meta, report, maxBytes: meta.totalSize);
+    final corrupt = located ? report.corrupt[meta.id] : null;
+    final ranges = corrupt ?? [(0, meta.totalSize - 1)];
+    final retry = url != null && attempt <= verifyRetries;
+
+    Logger.error(
+      'Checksum mismatch for ${meta.id} (attempt $attempt): '
+      'expected $expected, got $actual',
+    );
+    _emit(
+      ProxyEvent(
+        ProxyEventType.verificationFailed,
+        fileId: meta.id,
+        url: url,
+        data: {
+          'expected': expected,
+          'actual': actual,
+          'ranges': [for (final (s, e) in ranges) 'bytes=$s-$e'],
+          'attempt': attempt,
+          'retry': retry,
+        },
+      ),
+    );
+
+    if (!retry) {
+      await meta.save();
+      _setDownloadState(
+        meta.id,
+        DownloadState.failed,
+        error: StateError('SHA-256 mismatch: expected $expected'),
+      );
+      return false;
+    }
+
+    await _fileLocks.putIfAbsent(meta.id, () => SharedLock()).synchronized(() {
+      for (final (start, end) in ranges) {
+        // Only located damage says which host served it
+        if (corrupt != null) meta.sources.corrupt(start, end);
+        meta.removeRange(start, end);
+        meta.checksums.remove(start ~/ Scrubber.blockSize);
+      }
+      // Checksums just taken from the bad copy would flag the good one
+      if (corrupt == null) meta.checksums.clear();
+      meta.sha256 = null;
+    });
+    await meta.save();
+    _setDownloadState(meta.id, DownloadState.queued);
+    unawaited(startBackgroundDownload(url));
+    return false;
+  }
+
+  // ============== EPHEMERAL SESSIONS ==============
+
+  /// Cache [url] for the current playback session only
+  ///
+  /// Data is kept in a scratch folder, never written to `.meta` or the
+  /// collection, and deleted after [ephemeralIdleTimeout] without requests.
+  void setEphemeral(String url) {
+    _ephemeralIds.add(_hashUrl(url));
+  }
+
+  /// Check whether [url] is cached for the session only
+  bool isEphemeral(String url) => _ephemeralIds.contains(_hashUrl(url));
+
+  /// End an ephemeral session now and discard its data
+  Future<void> endEphemeralSession(String url) =>
+      _discardEphemeral(_hashUrl(url));
+
+  void _touchEphemeral(String fileId) {
+    _ephemeralTimers[fileId]?.cancel();
+    _ephemeralTimers[fileId] = Timer(ephemeralIdleTimeout, () {
+      unawaited(_discardEphemeral(fileId));
+    });
+  }
+
+  Future<void> _discardEphemeral(String fileId) async {
+    _ephemeralTimers.remove(fileId)?.cancel();
+    if (!_ephemeralIds.remove(fileId)) return;
+
+    // Still streaming: keep the session alive a little longer
+    if (_activeDownloads.contains(fileId)) {
+      _ephemeralIds.add(fileId);
+      _touchEphemeral(fileId);
+      return;
+    }
+
+    final meta = _metadata.remove(fileId);
+    _urlLookup.remove(fileId);
+    final dataSource = _dataSources.remove(fileId);
+    await dataSource?.cancel();
+    await dataSource?.dispose();
+
+    if (meta != null) {
+      final lock = _fileLocks.putIfAbsent(fileId, () => SharedLock());
+      await lock.synchronized(() async {
+        final file = File(meta.localPath);
+        if (await file.exists()) {
+          await file.delete();
+        }
+      });
+    }
+    Logger.info('Ephemeral session ended: $fileId');
+  }
+
+  // ============== LOAD SHEDDING ==============
+
+  /// Refuse new uncached fetches with 503 while under pressure
+  void enableLoadShedding(LoadSheddingConfig config) {
+    _loadShedder?.stop();
+    _loadShedder = LoadShedder(config)..start();
+  }
+
+  /// Stop load shedding
+  void disableLoadShedding() {
+    _loadShedder?.stop();
+    _loadShedder = null;
+  }
+
+  /// Current load shedder, if enabled
+  LoadShedder? get loadShedder => _loadShedder;
+
+  void _shedRequest(
+    HttpRequest request,
+    String fileId,
+    String remoteUrl,
+    String reason,
+  ) {
+    final retryAfter = _loadShedder!.config.retryAfter.inSeconds;
+    Logger.info('Shedding uncached request ($reason): $fileId');
+    _emit(
+      ProxyEvent(
+        ProxyEventType.loadShed,
+        fileId: fileId,
+        url: remoteUrl,
+        data: {'reason': reason},
+      ),
+    );
+    request.response.headers.set(HttpHeaders.retryAfterHeader, '$retryAfter');
+    errorPages.write(
+      request.response,
+      ProxyFailure.overloaded,
+      details: {'reason': reason},
+    );
+  }
+
+  // ============== SHADOW CACHE ==============
+
+  /// Mirror a sample of player requests into a simulated cache with a
+  /// different chunk size or quota and compare hit rates (GET /shadow)
+  ///
+  /// Nothing is fetched or served from the shadow; enabling again starts
+  /// a fresh comparison.
+  void enableShadow([ShadowConfig config = const ShadowConfig()]) {
+    _shadow = ShadowCache(config);
+  }
+
+  /// Stop mirroring requests
+  void disableShadow() {
+    _shadow = null;
+  }
+
+  /// Current comparison, if a shadow is enabled
+  ShadowCache? get shadow => _shadow;
+
+  // ============== REQUEST REPLAY ==============
+
+  RequestLog? _requestLog;
+
+  /// Keep the last [capacity] player requests, with their timing, to
+  /// replay them later (GET /api/requests)
+  void startRecordingRequests({int capacity = 10000}) {
+    _requestLog = RequestLog(capacity: capacity);
+  }
+
+  /// Stop recording; returns what was recorded
+  RequestLog? stopRecordingRequests() {
+    final log = _requestLog;
+    _requestLog = null;
+    return log;
+  }
+
+  /// Requests recorded so far, if recording
+  RequestLog? get requestLog => _requestLog;
+
+  /// Send [requests] (e.g. a user's log, see [RequestLog.toLog]) to this
+  /// proxy again and time each response, to reproduce a reported stall
+  /// against the cache as it is now
+  ///
+  /// Replayed requests are served like any other: they fill the cache
+  /// and count for fair scheduling, as clients named `replay-<client>`.
+  Future<ReplayReport> replay(
+    List<RecordedRequest> requests, {
+    bool keepTiming = true,
+    double speed = 1,
+  }) => RequestReplayer(
+    ReplayConfig(
+      proxy: baseUrl,
+      streamUrl: (url, client) => getProxyUrl(url, client: client),
+      keepTiming: keepTiming,
+      speed: speed,
+    ),
+  ).run(requests);
+
+  /// Record [start]..[end] of [remoteUrl] asked by [request], and how
+  /// long its response stayed open
+  void _recordRequest(
+    HttpRequest request,
+    String remoteUrl,
+    int start,
+    int end,
+  ) {
+    final log = _requestLog;
+    final client = _clientOf(request);
+    if (log == null || client.startsWith('replay-')) return;
+    final recorded = log.record(remoteUrl, start, end, client: client);
+    final clock = Stopwatch()..start();
+    unawaited(
+      request.response.done
+          .catchError((_) {})
+          .whenComplete(() => recorded.held = clock.elapsed),
+    );
+  }
+
+  /// POST /api/replay[?speed=N][&timing=0] with a request log as the
+  /// body -> the timing report
+  ///
+  /// Logs name raw URLs, so it is refused without an [apiToken]: anyone
+  /// reaching the port could have the proxy fetch for them.
+  Future<void> _handleReplayRequest(HttpRequest request) async {
+    final response = request.response;
+    if (apiToken == null) {
+      errorPages.write(
+        response,
+        ProxyFailure.accessDenied,
+        details: {'message': 'Replaying needs an apiToken'},
+      );
+      return;
+    }
+    if (request.method != 'POST') {
+      response.statusCode = HttpStatus.methodNotAllowed;
+      response.headers.set(HttpHeaders.allowHeader, 'POST');
+      return;
+    }
+    final query = request.uri.queryParameters;
+    final speed = double.tryParse(query['speed'] ?? '1');
+    final List<RecordedRequest> requests;
+    try {
+      requests = RecordedRequest.parseLog(
+        await utf8.decoder.bind(request).join(),
+      );
+      if (speed == null || speed <= 0) throw const FormatException();
+    } catch (_) {
+      response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+    final report = await replay(
+      requests,
+      keepTiming: query['timing'] != '0',
+      speed: speed,
+    );
+    _writeJson(response, report.toJson());
+  }
+
+  // ============== RATE SHAPING ==============
+
+  /// Throttle background downloads of playing files to a multiple of their
+  /// bitrate once enough is buffered; [disableRateShaping] bursts instead
+  void enableRateShaping([
+    RateShapingConfig config = const RateShapingConfig(),
+  ]) {
+    _rateShaping = config;
+  }
+
+  /// Download at full speed
+  void disableRateShaping() {
+    _rateShaping = null;
+  }
+
+  /// Set the media bitrate of a URL, in bits per second
+  void setBitrate(String url, int bitsPerSecond) {
+    _bitrates[_hashUrl(url)] = bitsPerSecond;
+  }
+
+  /// Media bitrate of a URL in bits per second, if known
+  int? getBitrate(String url) => _bitrates[_hashUrl(url)];
+
+  /// Probe a URL's container for its duration and derive the bitrate
+  ///
+  /// Supports MP4/MOV. Returns bits per second, or null when unknown.
+  Future<int?> probeBitrate(String url) async {
+    final reader = await openReader(url);
+    if (reader == null) return null;
+    final bitrate = MediaProbe.bitrate(
+      reader.length,
+      await MediaProbe.mp4Duration(reader),
+    );
+    if (bitrate != null) {
+      _bitrates[_hashUrl(url)] = bitrate;
+      Logger.info('Probed bitrate ${bitrate ~/ 1000} kbit/s: $url');
+    }
+    return bitrate;
+  }
+
+  /// Rate shaper for a background download, or null to run at full speed
+  RateShaper? _rateShaperFor(String url, String fileId) {
+    final config = _rateShaping;
+    if (config == null) return null;
+
+    final bitrate = _bitrates[fileId];
+    if (bitrate == null) {
+      // Probe once; the next download segment picks the result up
+      if (_bitrateProbes.add(fileId)) {
+        unawaited(
+          probeBitrate(url).catchError((Object e) {
+            Logger.error('Bitrate probe failed: $e');
+            return null;
+          }),
+        );
+      }
+      return null;
+    }
+    return RateShaper(config, bitrate ~/ 8);
+  }
+
+  /// Pause needed after a background chunk ending at [position]
+  Duration _shapingDelay(
+    RateShaper shaper,
+    String fileId,
+    int bytes,
+    int position,
+  ) {
+    final playhead = _playheads[fileId];
+    final idle = shaper.config.playbackIdle;
+    if (playhead == null || DateTime.now().difference(playhead.$2) > idle) {
+      return Duration.zero; // Not playing: nothing to save bandwidth for
+    }
+    final ahead = position > playhead.$1 ? position - playhead.$1 : null;
+    return shaper.add(bytes, bufferedAhead: ahead);
+  }
+
+  // ============== BANDWIDTH GUARANTEE ==============
+
+  /// Keep [BandwidthGuardConfig.playbackShare] of the upstream link for
+  /// player requests while they fetch
+  ///
+  /// Background downloads, prefetches and read-ahead are paced to the
+  /// rest, so a prefetch burst cannot make a player buffer. Without a
+  /// configured capacity the link is measured from background transfers.
+  void enableBandwidthGuarantee([
+    BandwidthGuardConfig config = const BandwidthGuardConfig(),
+  ]) {
+    _bandwidthGuard = BandwidthGuard(config);
+  }
+
+  /// Let background transfers use the whole link again
+  void disableBandwidthGuarantee() {
+    _bandwidthGuard = null;
+  }
+
+  /// Pause after [bytes] of background transfer of [fileId], per the
+  /// guarantee and the [BandwidthLimits]
+  ///
+  /// A file a player is watching is not held back for playback: its
+  /// transfer is what the player waits for.
+  Future<void> _yieldToPlayback(String fileId, int bytes) async {
+    var pause = Duration.zero;
+    if (_watching.containsKey(fileId)) {
+      _bandwidthGuard?.addPlayback(bytes);
+    } else {
+      pause = _bandwidthGuard?.addBackground(bytes) ?? Duration.zero;
+    }
+    pause = _longest(pause, _upstreamLimiter.take(bytes));
+    final perDownload = _limits.perDownload;
+    if (perDownload != null) {
+      final limiter = _limiterFor(_downloadLimiters, fileId, perDownload);
+      pause = _longest(pause, limiter.take(bytes));
+    }
+    if (pause > Duration.zero) await Future.delayed(pause);
+  }
+
+  // ============== BANDWIDTH LIMITS ==============
+
+  /// Current rate caps
+  BandwidthLimits get bandwidthLimits => _limits;
+
+  /// Cap upstream fetches, each background download and what each client
+  /// is served; takes effect on the next chunk of running transfers
+  ///
+  /// Also at `GET` and `PUT /api/limits` (see [apiToken]).
+  void setBandwidthLimits(BandwidthLimits limits) {
+    _limits = limits;
+    _upstreamLimiter.bytesPerSecond = limits.upstream;
+    for (final limiter in _downloadLimiters.values) {
+      limiter.bytesPerSecond = limits.perDownload;
+    }
+    for (final limiter in _clientLimiters.values) {
+      limiter.bytesPerSecond = limits.perClient;
+    }
+    Logger.info('Bandwidth limits: $limits');
+  }
+
+  /// Limiter for what [client] is served; null when unlimited
+  RateLimiter? _clientLimiter(String client) {
+    final perClient = _limits.perClient;
+    if (perClient == null) return null;
+    return _limiterFor(_clientLimiters, client, perClient);
+  }
+
+  /// The limiter of [key] in [limiters], dropping the idle ones on the
+  /// way: an idle limiter holds no debt, so a new one paces the same
+  RateLimiter _limiterFor(
+    Map<String, RateLimiter> limiters,
+    String key,
+    int bytesPerSecond,
+  ) {
+    final limiter = limiters[key];
+    if (limiter != null) return limiter;
+    limiters.removeWhere((_, l) => l.idle);
+    return limiters[key] = RateLimiter(bytesPerSecond);
+  }
+
+  /// Pause a response paced by [limiter] after [bytes] of it
+  Future<void> _pace(RateLimiter? limiter, int bytes) async {
+    final pause = limiter?.take(bytes) ?? Duration.zero;
+    if (pause > Duration.zero) await Future.delayed(pause);
+  }
+
+  static Duration _longest(Duration a, Duration b) => a > b ? a : b;
+
+  /// GET /api/limits -> the [BandwidthLimits];
+  /// PUT /api/limits {"upstream": n, "perDownload": n, "perClient": n}
+  /// in bytes per second, null or absent for unlimited
+  Future<void> _handleLimitsRequest(HttpRequest request) async {
+    final response = request.response;
+    if (!_checkAuthorized(request)) return;
+    switch (request.method) {
+      case 'GET':
+        _writeJson(response, _limits.toJson());
+      case 'PUT':
+        final BandwidthLimits limits;
+        try {
+          final json = jsonDecode(await utf8.decoder.bind(request).join());
+          limits = BandwidthLimits.fromJson(json as Map<String, dynamic>);
+        } catch (_) {
+          response.statusCode = HttpStatus.badRequest;
+          return;
+        }
+        setBandwidthLimits(limits);
+        _writeJson(response, limits.toJson());
+      default:
+        response.statusCode = HttpStatus.methodNotAllowed;
+        response.headers.set(HttpHeaders.allowHeader, 'GET, PUT');
+    }
+  }
+
+  // ============== FAIR SCHEDULING ==============
+
+  /// Share upstream fetches round-robin between clients, so one device
+  /// prefetching a season cannot starve another device's playback
+  ///
+  /// Clients are told apart by `client=` (see [getProxyUrl]) or the
+  /// `X-DownStream-Client` header, else their session token, else their
+  /// address. Fetches go by [DownloadPriority]: bytes a player waits for
+  /// first, then read-ahead and prefetches, then whole-file downloads.
+  /// When a player opens a file whose fetches are still queued as
+  /// prefetch or background, they are moved to the front.
+  void enableFairness([FairnessConfig config = const FairnessConfig()]) {
+    _fairQueue = FairQueue(config);
+  }
+
+  /// Stop queueing (fetches already waiting still get their turn)
+  void disableFairness() {
+    _fairQueue = null;
+  }
+
+  String _clientOf(HttpRequest request) =>
+      request.uri.queryParameters['client'] ??
+      request.headers.value('x-downstream-client') ??
+      request.uri.queryParameters['session'] ??
+      request.headers.value('x-downstream-session') ??
+      request.connectionInfo?.remoteAddress.address ??
+      'local';
+
+  /// Wait for an upstream slot for [fileId]'s client; null when fairness
+  /// is off. Never call while holding the file's lock.
+  ///
+  /// A file a player is watching is fetched at foreground priority
+  /// whatever [priority] asks.
+  Future<void Function()?> _admit(
+    String fileId, {
+    DownloadPriority priority = DownloadPriority.prefetch,
+  }) async {
+    final queue = _fairQueue;
+    if (queue == null) return null;
+    return queue.acquire(
+      _fileClients[fileId] ?? 'local',
+      priority: _watching.containsKey(fileId)
+          ? DownloadPriority.foreground
+          : priority,
+      key: fileId,
+    );
+  }
+
+  // ============== LIBRARY REFRESH ==============
+
+  /// Ask media servers (Jellyfin, Plex, Kodi) to scan files as they are
+  /// moved into the collection
+  ///
+  /// Each service's outcome is emitted as
+  /// [ProxyEventType.libraryRefreshed]. With
+  /// [LibraryRefreshConfig.watchCollection], files put into the collection
+  /// folder by other tools are picked up too.
+  void enableLibraryRefresh(LibraryRefreshConfig config) {
+    unawaited(_libraryRefresher?.close());
+    final refresher = LibraryRefresher(
+      config,
+      onResult: (service, paths, error) {
+        if (error == null) {
+          Logger.success('${service.name} refreshed ${paths.length} files');
+        } else {
+          Logger.error('${service.name} refresh failed: $error');
+        }
+        _emit(
+          ProxyEvent(
+            ProxyEventType.libraryRefreshed,
+            data: {
+              'service': service.name,
+              'paths': paths,
+              if (error != null) 'error': '$error',
+            },
+          ),
+        );
+      },
+    );
+    if (config.watchCollection) {
+      final collectionsDir = _outDir ?? '$storageDir/../collections';
+      Directory(collectionsDir).createSync(recursive: true);
+      refresher.watch(collectionsDir);
+    }
+    _libraryRefresher = refresher;
+  }
+
+  /// Stop refreshing; files completed in the last moments are dropped
+  Future<void> disableLibraryRefresh() async {
+    final refresher = _libraryRefresher;
+    _libraryRefresher = null;
+    await refresher?.close();
+  }
+
+  // ============== SEGMENTED DOWNLOADS ==============
+
+  /// Download missing data over several parallel connections per file
+  ///
+  /// Applies to background downloads started from now on; files paced by
+  /// rate shaping keep a single connection.
+  void enableSegmented([
+    SegmentedDownloadConfig config = const SegmentedDownloadConfig(),
+  ]) {
+    _segmented = config;
+  }
+
+  /// Back to one connection per file (running downloads finish their
+  /// segments)
+  void disableSegmented() {
+    _segmented = null;
+  }
+
+  // ============== MIRRORS ==============
+
+  MirrorConfig _mirrorConfig = const MirrorConfig();
+
+  // Other URLs each file is fetched from, by file ID
+  final Map<String, MirrorSet> _mirrors = {};
+
+  // Probed data source of each mirror in use, by file ID and mirror URL;
+  // null for a mirror refused
+  final Map<String, Map<String, Future<DataSource?>>> _mirrorSources = {};
+
+  /// When mirrors are accepted and dropped
+  MirrorConfig get mirrorConfig => _mirrorConfig;
+
+  set mirrorConfig(MirrorConfig config) {
+    _mirrorConfig = config;
+    for (final mirrors in _mirrors.values) {
+      mirrors.config = config;
+    }
+  }
+
+  /// Fetch [url] from [mirrors] too: other URLs serving the same file
+  ///
+  /// Background downloads of a file with mirrors are segmented (see
+  /// [enableSegmented]), each segment fetched from the least busy URL.
+  /// A mirror is probed before any of its bytes are cached: one of
+  /// another size, or ETag (see [MirrorConfig.matchEtags]), is refused.
+  /// Returns the mirrors added and accepted.
+  Future<List<String>> addMirrors(String url, Iterable<String> mirrors) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final added = _registerMirrors(fileId, url, mirrors);
+    final meta = await _getOrCreateMeta(fileId, url, autoDownload: false);
+    final accepted = <String>[];
+    for (final mirror in added) {
+      final source = meta == null
+          ? null
+          : await _mirrorSource(meta, _mirrors[fileId]!, mirror);
+      if (source != null) {
+        accepted.add(mirror);
+      } else {
+        _mirrors[fileId]!.remove(mirror);
+      }
+    }
+    await _saveMirrors();
+    return accepted;
+  }
+
+  /// Stop fetching [url] from [mirror]
+  Future<bool> removeMirror(String url, String mirror) async {
+    final fileId = _hashUrl(url);
+    if (!(_mirrors[fileId]?.remove(mirror) ?? false)) return false;
+    await (await _mirrorSources[fileId]?.remove(mirror))?.dispose();
+    await _saveMirrors();
+    return true;
+  }
+
+  /// URLs [url] is fetched from and how each did; null without mirrors
+  MirrorSet? mirrorsOf(String url) => _mirrors[_hashUrl(url)];
+
+  /// Add [mirrors] of [url] without probing them yet; returns the new
+  /// ones
+  List<String> _registerMirrors(
+    String fileId,
+    String url,
+    Iterable<String> mirrors,
+  ) {
+    if (mirrors.isEmpty) return const [];
+    final set = _mirrors.putIfAbsent(
+      fileId,
+      () => MirrorSet(url, config: _mirrorConfig),
+    );
+    return [
+      for (final mirror in mirrors)
+        if (Uri.tryParse(mirror)?.hasScheme ?? false)
+          if (set.add(mirror)) mirror,
+    ];
+  }
+
+  /// Data source of [url], a mirror of [meta], probed and checked
+  /// against the cached file on first use; null once it is dropped
+  Future<DataSource?> _mirrorSource(
+    DownloadMeta meta,
+    MirrorSet mirrors,
+    String url,
+  ) async {
+    if (mirrors[url]?.dropped ?? true) return null;
+    return _mirrorSources
+        .putIfAbsent(meta.id, () => {})
+        .putIfAbsent(url, () => _probeMirror(meta, mirrors, url));
+  }
+
+  Future<DataSource?> _probeMirror(
+    DownloadMeta meta,
+    MirrorSet mirrors,
+    String url,
+  ) async {
+    final source = _newDataSource(meta.id, url, mirror: true);
+    String? mismatch;
+    try {
+      await source.getContentLength();
+      mismatch = mirrors.mismatch(
+        FileStat(totalSize: meta.totalSize, etag: meta.etag),
+        source.lastStat!,
+      );
+    } catch (e) {
+      mismatch = 'probe failed: $e';
+    }
+    if (mismatch == null) return source;
+    Logger.warn(
+      'Mirror refused',
+      fields: {'fileId': meta.id, 'url': url, 'reason': mismatch},
+    );
+    mirrors.drop(url, mismatch);
+    await source.dispose();
+    return null;
+  }
+
+  /// Fetch [start]..[end] of [meta] into the cache from the URL [mirrors]
+  /// picks; what a failing mirror left is fetched again from another
+  ///
+  /// [dataSource] is the file's own, which is never dropped: its errors
+  /// are rethrown.
+  Future<void> _fetchFromMirrors(
+    DownloadMeta meta,
+    MirrorSet mirrors,
+    DataSource dataSource,
+    int start,
+    int end,
+  ) async {
+    final mirror = mirrors.pick();
+    final own = mirror.url == mirrors.primary;
+    final source = own
+        ? dataSource
+        : await _mirrorSource(meta, mirrors, mirror.url);
+    if (source != null) {
+      mirrors.started(mirror);
+      final stopwatch = Stopwatch()..start();
+      try {
+        await _fetchToCache(
+          meta,
+          source,
+          start,
+          end,
+          priority: DownloadPriority.background,
+        );
+        mirrors.finished(mirror, end - start + 1, stopwatch.elapsed);
+        return;
+      } catch (e) {
+        mirrors.failed(mirror, e);
+        if (own) rethrow;
+        Logger.warn('Mirror failed', fields: {'url': mirror.url}, error: e);
+      }
+    }
+    // Refused on its probe, or failed: another URL takes the rest
+    for (final (from, to) in meta.getGapsIn(start, end)) {
+      await _fetchFromMirrors(meta, mirrors, dataSource, from, to);
+    }
+  }
+
+  /// Close the mirror connections of [fileId], e.g. once it is complete;
+  /// the next download probes them again
+  Future<void> _releaseMirrors(String fileId) async {
+    final sources = _mirrorSources.remove(fileId);
+    for (final source in sources?.values ?? const <Future<DataSource?>>[]) {
+      await (await source)?.dispose();
+    }
+  }
+
+  Future<void> _forgetMirrors(String fileId) async {
+    await _releaseMirrors(fileId);
+    if (_mirrors.remove(fileId) != null) await _saveMirrors();
+  }
+
+  Future<void> _saveMirrors() async {
+    try {
+      await File('$storageDir/.mirrors.json').writeAsString(
+        jsonEncode({
+          for (final MapEntry(:key, :value) in _mirrors.entries)
+            if (value.urls.isNotEmpty)
+              key: {'url': value.primary, 'mirrors': value.urls},
+        }),
+      );
+    } catch (e) {
+      Logger.error('Failed to save mirrors: $e');
+    }
+  }
+
+  Future<void> _loadMirrors() async {
+    final file = File('$storageDir/.mirrors.json');
+    if (!await file.exists()) return;
+    try {
+      final json = jsonDecode(await file.readAsString()) as Map;
+      for (final MapEntry(:key, :value) in json.entries) {
+        final entry = value as Map<String, dynamic>;
+        _registerMirrors(
+          key as String,
+          entry['url'] as String,
+          (entry['mirrors'] as List).cast<String>(),
+        );
+      }
+    } catch (e) {
+      Logger.error('Failed to load mirrors: $e');
+    }
+  }
+
+  // ============== SECRETS ==============
+
+  // Keys and per-host credentials, see [ProxyOptions.secrets]
+  SecretStore? _secrets;
+
+  // Request headers by host, read from [_secrets] at startup
+  Map<String, Map<String, String>> _hostCredentials = {};
+
+  /// Send [headers] (e.g. `Authorization`) with every request to [host],
+  /// kept in the secret store rather than in plaintext config; null
+  /// removes them
+  ///
+  /// Needs [ProxyOptions.secrets]. Applies to files first requested from
+  /// now on; a host policy's `requestHeaders` of the same name lose.
+  Future<void> setHostCredentials(
+    String host,
+    Map<String, String>? headers,
+  ) async {
+    final secrets = _secrets;
+    if (secrets == null) throw StateError('No secret store configured');
+    final updated = {..._hostCredentials};
+    if (headers == null) {
+      updated.remove(host.toLowerCase());
+    } else {
+      updated[host.toLowerCase()] = {...headers};
+    }
+    await secrets.write(SecretStore.hostCredentials, jsonEncode(updated));
+    _hostCredentials = updated;
+  }
+
+  /// Hosts with credentials in the secret store
+  Iterable<String> get credentialedHosts => _hostCredentials.keys;
+
+  /// Request headers for [host]: its policy's, then its credentials
+  Map<String, String>? _headersFor(String host, HostPolicy? policy) {
+    final credentials = _hostCredentials[host.toLowerCase()];
+    if (credentials == null) return policy?.requestHeaders;
+    return {...?policy?.requestHeaders, ...credentials};
+  }
+
+  Future<void> _loadHostCredentials() async {
+    final json = await _secrets?.read(SecretStore.hostCredentials);
+    if (json == null) return;
+    try {
+      _hostCredentials = {
+        for (final MapEntry(:key, :value) in (jsonDecode(json) as Map).entries)
+          key as String: (value as Map).cast<String, String>(),
+      };
+    } catch (e) {
+      Logger.error('Failed to load host credentials: $e');
+    }
+  }
+
+  // ============== SIDECARS ==============
+
+  // Subtitles, audio tracks and thumbnails of each file, by file ID
+  final Map<String, List<Sidecar>> _sidecars = {};
+
+  // File ID of each sidecar's video, by the sidecar's file ID
+  final Map<String, String> _sidecarOwners = {};
+
+  // Files whose sidecars are being enqueued
+  final Set<String> _fetchingSidecars = {};
+
+  /// How long a completing video waits for a sidecar not cached yet
+  /// before it moves without it
+  Duration sidecarTimeout = const Duration(minutes: 1);
+
+  /// Cache [sidecars] with the video [url] and serve them under its file
+  /// ID (see [sidecarUrl])
+  ///
+  /// They are downloaded whenever the video is, and move (or are copied)
+  /// next to it when it completes, named after it (see
+  /// [Sidecar.fileNames]); until then they stay in the cache. Returns the
+  /// proxy URLs of the ones added.
+  Future<List<Uri>> addSidecars(String url, Iterable<Sidecar> sidecars) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final added = _registerSidecars(fileId, sidecars);
+    if (added.isEmpty) return const [];
+    await _saveSidecars();
+    // Late sidecars join a video already in the collection
+    final collected = _collected[fileId];
+    if (collected != null) {
+      unawaited(_placeSidecars(fileId, collected, copy: false));
+    } else if (_activeDownloads.contains(fileId)) {
+      unawaited(_fetchSidecars(fileId));
+    }
+    return [for (final sidecar in added) _sidecarProxyUrl(url, sidecar)];
+  }
+
+  /// Stop caching [sidecar] with [url]; what is cached of it stays
+  Future<bool> removeSidecar(String url, String sidecar) async {
+    final fileId = _hashUrl(url);
+    final list = _sidecars[fileId];
+    final before = list?.length ?? 0;
+    list?.removeWhere((entry) => entry.url == sidecar);
+    if ((list?.length ?? 0) == before) return false;
+    _sidecarOwners.remove(_hashUrl(sidecar));
+    if (list!.isEmpty) _sidecars.remove(fileId);
+    await _saveSidecars();
+    return true;
+  }
+
+  /// Sidecars registered for [url], in order
+  List<Sidecar> sidecarsOf(String url) =>
+      List.unmodifiable(_sidecars[_hashUrl(url)] ?? const <Sidecar>[]);
+
+  /// Proxy URL of the [index]th sidecar of [kind] of [url]:
+  /// `/stream/<file ID>/<kind>/<index>`, e.g. `.../subs/0`
+  Uri sidecarUrl(String url, SidecarKind kind, int index) {
+    final key = access.key;
+    return baseUrl.replace(
+      pathSegments: ['stream', _hashUrl(url), kind.segment, '$index'],
+      queryParameters: key == null ? null : {AccessPolicy.keyParameter: key},
+    );
+  }
+
+  /// Whether [uri] is a sidecar path, `/stream/<file ID>/<kind>/<n>`
+  bool _isSidecarPath(Uri uri) {
+    final segments = uri.pathSegments;
+    return segments.length == 4 && segments.first == 'stream';
+  }
+
+  /// Upstream URL of the sidecar [uri] names; null for none registered
+  String? _sidecarTarget(Uri uri) {
+    final [_, fileId, segment, n] = uri.pathSegments;
+    final kind = SidecarKind.fromSegment(segment);
+    final index = int.tryParse(n);
+    if (kind == null || index == null) return null;
+    final ofKind = [
+      for (final sidecar in _sidecars[fileId] ?? const <Sidecar>[])
+        if (sidecar.kind == kind) sidecar,
+    ];
+    return index >= 0 && index < ofKind.length ? ofKind[index].url : null;
+  }
+
+  /// [sidecarUrl] of [sidecar], a sidecar of [url]
+  Uri _sidecarProxyUrl(String url, Sidecar sidecar) {
+    final index = [
+      for (final entry in _sidecars[_hashUrl(url)] ?? const <Sidecar>[])
+        if (entry.kind == sidecar.kind) entry.url,
+    ].indexOf(sidecar.url);
+    return sidecarUrl(url, sidecar.kind, index);
+  }
+
+  /// Add [sidecars] of [fileId]; returns the new ones
+  List<Sidecar> _registerSidecars(String fileId, Iterable<Sidecar> sidecars) {
+    final list = _sidecars.putIfAbsent(fileId, () => []);
+    final added = <Sidecar>[];
+    for (final sidecar in sidecars) {
+      if (!(Uri.tryParse(sidecar.url)?.hasScheme ?? false) ||
+          list.any((entry) => entry.url == sidecar.url)) {
+        continue;
+      }
+      list.add(sidecar);
+      added.add(sidecar);
+      _sidecarOwners[_hashUrl(sidecar.url)] = fileId;
+    }
+    if (list.isEmpty) _sidecars.remove(fileId);
+    return added;
+  }
+
+  /// Download the sidecars of [fileId] whole, next to it
+  Future<void> _fetchSidecars(String fileId) async {
+    if (!_fetchingSidecars.add(fileId)) return;
+    try {
+      for (final sidecar in [...?_sidecars[fileId]]) {
+        try {
+          await enqueueDownload(sidecar.url);
+        } catch (e) {
+          Logger.warn(
+            'Sidecar download failed',
+            fields: {'fileId': fileId, 'url': sidecar.url},
+            error: e,
+          );
+        }
+      }
+    } finally {
+      _fetchingSidecars.remove(fileId);
+    }
+  }
+
+  /// Complete metadata of [sidecar], downloading what is missing; null
+  /// when that fails or takes longer than [sidecarTimeout]
+  Future<DownloadMeta?> _completedSidecar(Sidecar sidecar) async {
+    final sidecarId = _hashUrl(sidecar.url);
+    final cached = _metadata[sidecarId];
+    if (cached != null && cached.isComplete) return cached;
+    // Listen first: the download may complete before enqueueDownload
+    // returns
+    final completed = Completer<void>();
+    final subscription = events.listen((event) {
+      if (event.type == ProxyEventType.downloadCompleted &&
+          event.fileId == sidecarId &&
+          !completed.isCompleted) {
+        completed.complete();
+      }
+    });
+    try {
+      await enqueueDownload(sidecar.url);
+      final meta = _metadata[sidecarId];
+      if (meta != null && meta.isComplete) return meta;
+      await completed.future.timeout(sidecarTimeout);
+      return _metadata[sidecarId];
+    } catch (e) {
+      Logger.warn(
+        'Sidecar not cached',
+        fields: {'url': sidecar.url},
+        error: e,
+      );
+      return null;
+    } finally {
+      await subscription.cancel();
+    }
+  }
+
+  /// Put the sidecars of [fileId] next to its video, completed at
+  /// [videoPath]; moved sidecars are still served from there
+  Future<void> _placeSidecars(
+    String fileId,
+    String videoPath, {
+    required bool copy,
+  }) async {
+    final sidecars = _sidecars[fileId];
+    if (sidecars == null) return;
+    final names = Sidecar.fileNames(videoPath, sidecars);
+    for (int i = 0; i < sidecars.length; i++) {
+      // Placed before, e.g. sidecars added after the video completed
+      if (_collected.containsKey(_hashUrl(sidecars[i].url))) continue;
+      final meta = await _completedSidecar(sidecars[i]);
+      if (meta == null) continue;
+      final path = p.join(p.dirname(videoPath), names[i]);
+      try {
+        if (!copy) {
+          await _decryptCached(meta);
+          await File(meta.metaPath).delete();
+        }
+        await _place(meta, path, copy: copy);
+      } catch (e) {
+        Logger.error('Failed to place sidecar ${sidecars[i].url}: $e');
+        continue;
+      }
+      Logger.success('Sidecar ${copy ? 'copied' : 'moved'} to: $path');
+      if (!copy) {
+        _forgetCold(meta.id);
+        _collected[meta.id] = path;
+        _metadata.remove(meta.id);
+      }
+    }
+    if (!copy) unawaited(_saveCollected());
+  }
+
+  Future<void> _forgetSidecars(String fileId) async {
+    final sidecars = _sidecars.remove(fileId);
+    if (sidecars == null) return;
+    for (final sidecar in sidecars) {
+      _sidecarOwners.remove(_hashUrl(sidecar.url));
+    }
+    await _saveSidecars();
+  }
+
+  Future<void> _saveSidecars() async {
+    try {
+      await File('$storageDir/.sidecars.json').writeAsString(
+        jsonEncode({
+          for (final MapEntry(:key, :value) in _sidecars.entries)
+            key: [for (final sidecar in value) sidecar.toJson()],
+        }),
+      );
+    } catch (e) {
+      Logger.error('Failed to save sidecars: $e');
+    }
+  }
+
+  Future<void> _loadSidecars() async {
+    final file = File('$storageDir/.sidecars.json');
+    if (!await file.exists()) return;
+    try {
+      final json = jsonDecode(await file.readAsString()) as Map;
+      for (final MapEntry(:key, :value) in json.entries) {
+        _registerSidecars(key as String, [
+          for (final entry in value as List)
+            Sidecar.fromJson(entry as Map<String, dynamic>),
+        ]);
+      }
+    } catch (e) {
+      Logger.error('Failed to load sidecars: $e');
+    }
+  }
+
+  // ============== READ-AHEAD ==============
+
+  /// Keep [ReadAheadConfig.window] bytes cached ahead of where each player
+  /// is reading, so its next range requests hit disk
+  void enableReadAhead([ReadAheadConfig config = const ReadAheadConfig()]) {
+    _readAhead = config;
+  }
+
+  /// Stop reading ahead (running batches finish)
+  void disableReadAhead() {
+    _readAhead = null;
+  }
+
+  void _maybeReadAhead(DownloadMeta meta, DataSource dataSource) {
+    if (_readAhead == null || meta.isComplete || _isPaused(meta.id)) return;
+    // A running loop follows the playhead by itself
+    if (!_readingAhead.add(meta.id)) return;
+    unawaited(
+      _readAheadLoop(
+        meta,
+        dataSource,
+      ).whenComplete(() => _readingAhead.remove(meta.id)),
+    );
+  }
+
+  /// Fetch the window in batches of [ReadAheadConfig.concurrency] pieces
+  /// until it is cached or the player goes quiet; the next request
+  /// restarts it
+  Future<void> _readAheadLoop(
+    DownloadMeta meta,
+    DataSource dataSource,
+  ) async {
+    RateShaper? shaper;
+    while (true) {
+      final config = _readAhead;
+      final playhead = _playheads[meta.id];
+      if (config == null || playhead == null || _isPaused(meta.id)) return;
+      if (DateTime.now().difference(playhead.$2) > config.idleTimeout) return;
+      if (_loadShedder?.underPressure ?? false) return;
+
+      final batch = config
+          .pieces(meta, playhead.$1)
+          .take(config.concurrency)
+          .toList();
+      if (batch.isEmpty) return;
+
+      try {
+        await Future.wait([
+          for (final (start, end) in batch)
+            _fetchToCache(meta, dataSource, start, end),
+        ]);
+      } catch (e) {
+        Logger.error('Read-ahead failed for ${meta.id}: $e');
+        return;
+      }
+      _scheduleDebouncedSave(meta.id, meta);
+
+      final limit = config.maxBytesPerSecond;
+      if (limit != null) {
+        shaper ??= RateShaper(
+          const RateShapingConfig(factor: 1.0, safeBuffer: Duration.zero),
+          limit,
+        );
+        final bytes = batch.fold(0, (sum, r) => sum + r.$2 - r.$1 + 1);
+        final wait = shaper.add(bytes);
+        if (wait > Duration.zero) await Future.delayed(wait);
+      }
+    }
+  }
+
+  // ============== INTEGRITY SCRUBBING ==============
+
+  /// Verify cached blocks during idle periods and refetch corrupt ones
+  void enableScrubber([ScrubberConfig config = const ScrubberConfig()]) {
+    _scrubTimer?.cancel();
+    _scrubberConfig = config;
+    _scrubTimer = Timer.periodic(config.interval, (_) => _scrubWhenIdle());
+  }
+
+  /// Stop idle-time scrubbing
+  void disableScrubber() {
+    _scrubTimer?.cancel();
+    _scrubTimer = null;
+    _scrubberConfig = null;
+  }
+
+  /// Scrub every loaded file now, repairing corrupt blocks
+  Future<ScrubReport> scrubNow() async {
+    final report = ScrubReport();
+    for (final meta in _metadata.values.toList()) {
+      if (meta.ephemeral) continue;
+      await Scrubber.scrubFile(meta, report, maxBytes: meta.totalSize);
+      _scheduleDebouncedSave(meta.id, meta);
+    }
+    await _repairCorruption(report);
+    return report;
+  }
+
+  Future<void> _scrubWhenIdle() async {
+    final config = _scrubberConfig;
+    if (config == null || _scrubbing) return;
+    if (DateTime.now().difference(_lastPlayerRequest) < config.idleAfter ||
+        _activeDownloads.isNotEmpty) {
+      return;
+    }
+
+    _scrubbing = true;
+    try {
+      final report = ScrubReport();
+      int budget = config.bytesPerRun;
+      for (final meta in _metadata.values.toList()) {
+        if (meta.ephemeral || budget <= 0) continue;
+
+        final from = _scrubCursors[meta.id] ?? 0;
+        final next = await Scrubber.scrubFile(
+          meta,
+          report,
+          fromBlock: from,
+          maxBytes: budget,
+        );
+        final last = next == 0 ? meta.totalSize : next * Scrubber.blockSize;
+        budget -= last - from * Scrubber.blockSize;
+        _scrubCursors[meta.id] = next;
+        _scheduleDebouncedSave(meta.id, meta);
+      }
+      await _repairCorruption(report);
+    } catch (e) {
+      Logger.error('Scrub failed: $e');
+    } finally {
+      _scrubbing = false;
+    }
+  }
+
+  /// Drop corrupt ranges from the cache and fetch them again
+  Future<void> _repairCorruption(ScrubReport report) async {
+    for (final MapEntry(key: fileId, value: ranges)
+        in report.corrupt.entries) {
+      final meta = _metadata[fileId];
+      if (meta == null) continue;
+      final url = _urlLookup[fileId] ?? meta.originalUrl;
+      final blamed = <String>{};
+
+      await _fileLocks.putIfAbsent(fileId, () => SharedLock()).synchronized(() {
+        for (final (start, end) in ranges) {
+          blamed.addAll(meta.sources.corrupt(start, end));
+          meta.removeRange(start, end);
+          meta.checksums.remove(start ~/ Scrubber.blockSize);
+        }
+      });
       await meta.save();
-      _saveTimers.remove(fileId);
+      Logger.error('Corrupt cache blocks in $fileId: ${ranges.length}');
+      _emit(
+        ProxyEvent(
+          ProxyEventType.corruption,
+          fileId: fileId,
+          url: url,
+          data: {
+            'ranges': [for (final (s, e) in ranges) 'bytes=$s-$e'],
+            'sources': blamed.toList(),
+          },
+        ),
+      );
+
+      if (url == null) continue;
+      final dataSource = _getDataSource(fileId, url);
+      for (final (start, end) in ranges) {
+        try {
+          await _fetchToCache(
+            meta,
+            dataSource,
+            start,
+            end,
+            priority: DownloadPriority.background,
+          );
+        } catch (e) {
+          // Left as a gap; the player or background download fills it
+          Logger.error('Repair fetch failed for $fileId: $e');
+        }
+      }
+    }
+  }
+
+  // ============== HOST POLICIES ==============
+
+  /// Configure everything per-origin for hosts matching [pattern]
+  /// (`cdn.example.com`, `*.example.com` or `*`; see [HostPolicyTable])
+  ///
+  /// Request limits apply at once. Headers, retries and mirrors apply to
+  /// files first opened afterwards.
+  void setHostPolicy(String pattern, HostPolicy policy) {
+    hostPolicies[pattern] = policy;
+    _hostGates.clear(); // Rebuilt from the table on the next request
+  }
+
+  /// Remove the policy for [pattern]
+  void removeHostPolicy(String pattern) {
+    hostPolicies.remove(pattern);
+    _hostGates.clear();
+  }
+
+  HostGate? _hostGate(DownloadMeta meta) {
+    if (hostPolicies.isEmpty && _hostCapabilities.isEmpty) return null;
+    final url = _urlLookup[meta.id] ?? meta.originalUrl;
+    if (url == null) return null;
+
+    // One gate per concrete host, even under a wildcard pattern
+    final host = Uri.parse(url).host.toLowerCase();
+    final gate = _hostGates[host];
+    if (gate != null) return gate;
+    // Hosts found to refuse parallel connections get one at a time
+    final policy =
+        hostPolicies.match(host) ??
+        (_hostCapabilities[host]?.parallel == false
+            ? const HostPolicy(sequential: true)
+            : null);
+    if (policy == null) return null;
+    return _hostGates[host] = HostGate(policy);
+  }
+
+  // ============== HOST CAPABILITIES ==============
+
+  /// What [host] was found to support, or null before it was probed
+  HostCapabilities? getHostCapabilities(String host) =>
+      _hostCapabilities[host.toLowerCase()];
+
+  /// All probed hosts and their profiles
+  Map<String, HostCapabilities> get hostCapabilities =>
+      Map.unmodifiable(_hostCapabilities);
+
+  /// Forget what [host] supports, so it is probed again on next contact
+  void forgetHostCapabilities(String host) {
+    host = host.toLowerCase();
+    if (_hostCapabilities.remove(host) == null) return;
+    _hostGates.remove(host);
+    unawaited(_saveHostCapabilities());
+  }
+
+  HostCapabilities? _capabilitiesFor(String url) =>
+      _hostCapabilities[Uri.parse(url).host.toLowerCase()];
+
+  /// Probe the host of [url] in the background unless its profile is
+  /// known and fresh; [source] has just probed the file's size
+  void _probeHost(String url, DataSource source, int totalSize) {
+    if (!hostProbing) return;
+    final host = Uri.parse(url).host.toLowerCase();
+    final known = _hostCapabilities[host];
+    if (known != null &&
+        !known.isStale(DateTime.now(), hostCapabilitiesMaxAge)) {
+      return;
+    }
+    if (!_probingHosts.add(host)) return;
+    unawaited(
+      HostCapabilities.probe(source, totalSize)
+          .then((capabilities) async {
+            if (capabilities == null) return;
+            _hostCapabilities[host] = capabilities;
+            // A policy gate stays; a gate from the old profile is rebuilt
+            if (hostPolicies.match(host) == null) _hostGates.remove(host);
+            Logger.info('Host $host: $capabilities');
+            _emit(
+              ProxyEvent(
+                ProxyEventType.hostProbed,
+                url: url,
+                data: {'host': host, ...capabilities.toJson()},
+              ),
+            );
+            await _saveHostCapabilities();
+          })
+          .catchError((Object e) {
+            Logger.error('Host probe failed for $host: $e');
+          })
+          .whenComplete(() => _probingHosts.remove(host)),
+    );
+  }
+
+  Future<void> _saveHostCapabilities() async {
+    try {
+      await File('$storageDir/.hosts.json').writeAsString(
+        jsonEncode(
+          _hostCapabilities.map((k, v) => MapEntry(k, v.toJson())),
+        ),
+      );
+    } catch (e) {
+      Logger.error('Failed to save host capabilities: $e');
+    }
+  }
+
+  Future<void> _loadHostCapabilities() async {
+    final file = File('$storageDir/.hosts.json');
+    if (!await file.exists()) return;
+    try {
+      final data =
+          jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+      data.forEach((host, json) {
+        _hostCapabilities[host] = HostCapabilities.fromJson(
+          json as Map<String, dynamic>,
+        );
+      });
+    } catch (e) {
+      Logger.error('Failed to load host capabilities: $e');
+    }
+  }
+
+  // ============== NAMESPACE POLICIES ==============
+
+  /// Set the policy for a namespace (profile)
+  void setNamespacePolicy(String namespace, NamespacePolicy policy) {
+    _policies[namespace] = policy;
+  }
+
+  /// Remove the policy for a namespace
+  void removeNamespacePolicy(String namespace) {
+    _policies.remove(namespace);
+  }
+
+  /// Get the policy for a namespace
+  NamespacePolicy? getNamespacePolicy(String namespace) =>
+      _policies[namespace];
+
+  /// Bytes served to a namespace today
+  int getNamespaceBytesToday(String namespace) {
+    final usage = _namespaceUsage[namespace];
+    final today = NamespaceUsage.dayOf(DateTime.now());
+    return usage != null && usage.day == today ? usage.bytes : 0;
+  }
+
+  PolicyDenial? _checkNamespacePolicy(String? namespace, String remoteUrl) {
+    if (namespace == null) return null;
+    final policy = _policies[namespace];
+    if (policy == null) return null;
+
+    final uri = Uri.tryParse(remoteUrl);
+    if (uri == null) return PolicyDenial.blockedHost;
+    return policy.evaluate(
+      uri,
+      DateTime.now(),
+      getNamespaceBytesToday(namespace),
+    );
+  }
+
+  void _denyByPolicy(
+    HttpRequest request,
+    String namespace,
+    String remoteUrl,
+    PolicyDenial denial,
+  ) {
+    Logger.info('Policy denied ($namespace): ${denial.name} $remoteUrl');
+    _emit(
+      ProxyEvent(
+        ProxyEventType.policyDenied,
+        url: remoteUrl,
+        data: {'namespace': namespace, 'reason': denial.name},
+      ),
+    );
+
+    errorPages.write(
+      request.response,
+      ProxyFailure.policyDenied,
+      details: {'namespace': namespace, 'reason': denial.name},
+    );
+  }
+
+  Future<void> _recordNamespaceUsage(String namespace, int bytes) async {
+    final today = NamespaceUsage.dayOf(DateTime.now());
+    var usage = _namespaceUsage[namespace];
+    if (usage == null || usage.day != today) {
+      usage = NamespaceUsage(today);
+      _namespaceUsage[namespace] = usage;
+    }
+    usage.bytes += bytes;
+
+    try {
+      await File('$storageDir/.namespace_usage.json').writeAsString(
+        jsonEncode(_namespaceUsage.map((k, v) => MapEntry(k, v.toJson()))),
+      );
+    } catch (e) {
+      Logger.error('Failed to save namespace usage: $e');
+    }
+  }
+
+  Future<void> _loadNamespaceUsage() async {
+    final file = File('$storageDir/.namespace_usage.json');
+    if (!await file.exists()) return;
+    try {
+      final data =
+          jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+      data.forEach((namespace, json) {
+        _namespaceUsage[namespace] = NamespaceUsage.fromJson(
+          json as Map<String, dynamic>,
+        );
+      });
+    } catch (e) {
+      Logger.error('Failed to load namespace usage: $e');
+    }
+  }
+
+  /// Answer for a zero-length file: 200 with an empty body, or 416 for
+  /// any Range (no byte can satisfy it)
+  void _serveEmpty(HttpRequest request) {
+    final response = request.response;
+    response.headers.set(HttpHeaders.acceptRangesHeader, 'bytes');
+    if (request.headers.value('range') != null) {
+      _rejectRange(response, 0);
+      return;
+    }
+    response.contentLength = 0;
+  }
+
+  // ============== DEADLINES ==============
+
+  /// Time limits on responses, so connections of clients that went away
+  /// without closing do not pile up (see [RequestDeadlines])
+  RequestDeadlines deadlines = const RequestDeadlines();
+
+  // When each response under [deadlines] began
+  final Expando<DateTime> _responseStarts = Expando();
+
+  /// Put [response] under [deadlines]
+  void _startDeadline(HttpResponse response) {
+    _responseStarts[response] = DateTime.now();
+    _armDeadline(response);
+    // A kept-alive connection must not be closed for a finished response
+    response.done
+        .catchError((_) {})
+        .whenComplete(() => response.deadline = null);
+  }
+
+  /// Give [response] another [RequestDeadlines.writeIdle] to progress,
+  /// within its [RequestDeadlines.maxDuration]
+  void _armDeadline(HttpResponse response) {
+    final startedAt = _responseStarts[response];
+    if (startedAt == null) return;
+    response.deadline = deadlines.next(startedAt, DateTime.now());
+  }
+
+  /// Wait until the client has taken what was added to [response], then
+  /// extend its deadline
+  ///
+  /// A response closed meanwhile (by its deadline or the client) is left
+  /// to [_Connection], which stops serving it.
+  Future<void> _delivered(HttpResponse response) async {
+    if (_responseStarts[response] == null) return;
+    try {
+      await response.flush();
+      _armDeadline(response);
+    } catch (_) {
+      // Closed; the next write is ignored
+    }
+  }
+
+  /// [stream], extending [response]'s deadline each time the client
+  /// pulls a chunk of it
+  Stream<List<int>> _deadlined(
+    HttpResponse response,
+    Stream<List<int>> stream,
+  ) => stream.map((chunk) {
+    _armDeadline(response);
+    return chunk;
+  });
+
+  // ============== CROSS-ORIGIN ACCESS ==============
+
+  // Methods of the stream endpoints
+  static const _streamMethods = 'GET, HEAD, OPTIONS';
+
+  /// Value of `Access-Control-Allow-Origin` on stream responses, so web
+  /// players (Flutter web, a WebView) may read them; null sends none
+  ///
+  /// Stream URLs are signed, so a page can only play what the app handed
+  /// it.
+  String? corsOrigin = '*';
+
+  void _allowCrossOrigin(HttpResponse response) {
+    final origin = corsOrigin;
+    if (origin == null) return;
+    response.headers.set('Access-Control-Allow-Origin', origin);
+    response.headers.set(
+      'Access-Control-Expose-Headers',
+      'Accept-Ranges, Content-Length, Content-Range, Content-Disposition',
+    );
+  }
+
+  /// OPTIONS on a stream URL: the methods and, for a browser's preflight,
+  /// the headers a player may send
+  void _answerPreflight(HttpRequest request) {
+    final response = request.response;
+    response.statusCode = HttpStatus.noContent;
+    response.headers.set(HttpHeaders.allowHeader, _streamMethods);
+    _allowCrossOrigin(response);
+    if (corsOrigin == null) return;
+    response.headers.set('Access-Control-Allow-Methods', _streamMethods);
+    response.headers.set(
+      'Access-Control-Allow-Headers',
+      'Range, ${AccessPolicy.keyHeader}, X-DownStream-Session',
+    );
+    response.headers.set('Access-Control-Max-Age', '86400');
+  }
+
+  // ============== PREVIEWS ==============
+
+  /// Bits per second assumed for a duration-limited preview of a file
+  /// whose bitrate is unknown (see [setBitrate])
+  int previewBitrate = 5000000;
+
+  /// The preview limits of a stream request (bytes, seconds), and whether
+  /// they are valid; no limits means a normal request
+  ((int?, int?)?, bool) _previewOf(Uri uri) {
+    final query = uri.queryParameters;
+    final hasBytes = query.containsKey('preview');
+    final hasSeconds = query.containsKey('previewSeconds');
+    if (!hasBytes && !hasSeconds) return (null, true);
+    final bytes = int.tryParse(query['preview'] ?? '');
+    final seconds = int.tryParse(query['previewSeconds'] ?? '');
+    final valid =
+        (!hasBytes || (bytes != null && bytes > 0)) &&
+        (!hasSeconds || (seconds != null && seconds > 0));
+    return ((bytes, seconds), valid);
+  }
+
+  /// Bytes a preview of [fileId] may serve from its start: the smaller
+  /// of its byte limit and its duration at the file's bitrate
+  int _previewBudget(String fileId, int totalSize, (int?, int?) preview) {
+    final (bytes, seconds) = preview;
+    final bitrate = _bitrates[fileId] ?? previewBitrate;
+    final forDuration = seconds == null ? null : seconds * bitrate ~/ 8;
+    return [
+      totalSize,
+      if (bytes != null) bytes,
+      if (forDuration != null) forDuration,
+    ].reduce(min);
+  }
+
+  /// [ranges] cut to the first [budget] bytes; null when one starts past
+  /// them, which a preview answers with `416`
+  static List<(int, int)>? _clipToBudget(
+    List<(int, int)> ranges,
+    int budget,
+  ) {
+    if (ranges.any((range) => range.$1 >= budget)) return null;
+    return [for (final (start, end) in ranges) (start, min(end, budget - 1))];
+  }
+
+  /// 416 for a Range header no byte of the body satisfies
+  void _rejectRange(HttpResponse response, int totalSize) {
+    response.statusCode = HttpStatus.requestedRangeNotSatisfiable;
+    response.headers.set('Content-Range', 'bytes */$totalSize');
+  }
+
+  /// File ID of [url], unique among cached files (see [CacheRegistry])
+  String _hashUrl(String url) => _registry.idFor(url);
+
+  // ============== CACHE REGISTRY ==============
+
+  CacheRegistry _registry = CacheRegistry();
+  Timer? _registrySaveTimer;
+
+  /// URL cached as [fileId]; null when unknown
+  String? lookupUrl(String fileId) =>
+      _urlLookup[fileId] ??
+      _registry.lookupUrl(fileId) ??
+      _metadata[fileId]?.originalUrl;
+
+  /// Every file in the cache: ID, URL, size, type and when it was added
+  List<CacheEntry> get cacheEntries => _registry.entries;
+
+  void _register(DownloadMeta meta, String url) {
+    if (meta.ephemeral) return;
+    final changed = _registry.record(
+      meta.id,
+      url,
+      size: meta.totalSize,
+      contentType: meta.mimeType,
+    );
+    if (changed) _scheduleRegistrySave();
+  }
+
+  void _unregister(String fileId) {
+    if (_registry.forget(fileId)) _scheduleRegistrySave();
+  }
+
+  void _scheduleRegistrySave() {
+    _registrySaveTimer?.cancel();
+    _registrySaveTimer = Timer(const Duration(seconds: 1), _saveRegistry);
+  }
+
+  Future<void> _saveRegistry() async {
+    try {
+      await File(
+        '$storageDir/.registry.json',
+      ).writeAsString(jsonEncode(_registry.toJson()));
+    } catch (e) {
+      Logger.error('Failed to save cache registry: $e');
+    }
+  }
+
+  Future<void> _loadRegistry() async {
+    final file = File('$storageDir/.registry.json');
+    if (!await file.exists()) return;
+    try {
+      _registry = CacheRegistry.fromJson(
+        jsonDecode(await file.readAsString()) as List<dynamic>,
+      );
+    } catch (e) {
+      Logger.error('Failed to load cache registry: $e');
+    }
+  }
+
+  /// Get download progress for a URL
+  double getProgress(String url) {
+    final fileId = _hashUrl(url);
+    return _metadata[fileId]?.progress ?? 0.0;
+  }
+
+  /// Progress of each variant of [item] (0.0 to 100.0), by variant name
+  Map<String, double> getVariantProgress(String item) {
+    final urls = variants[item]?.urls ?? const <String, String>{};
+    return urls.map((name, url) => MapEntry(name, getProgress(url)));
+  }
+
+  /// Cancel a download task
+  Future<void> cancelDownload(String url, {CallContext? context}) async {
+    context?.throwIfDone();
+    final fileId = _hashUrl(url);
+
+    // Cancel data source
+    final dataSource = _dataSources.remove(fileId);
+    if (dataSource != null) {
+      final cancel = dataSource.cancel();
+      await (context?.guard(cancel) ?? cancel);
+    }
+
+    // Cancel pending save
+    _saveTimers[fileId]?.cancel();
+    _saveTimers.remove(fileId);
+
+    Logger.cancel('Download cancelled: $url');
+  }
+
+  /// Get file stats for a URL
+  Stream<FileStat>? getFileStats(String url) {
+    final fileId = _hashUrl(url);
+    return _dataSources[fileId]?.fileStats;
+  }
+
+  // ============== CACHE MANAGEMENT ==============
+
+  /// Clear all cached files and metadata
+  Future<void> clearAllCache() async {
+    Logger.info('Clearing all cache...');
+
+    // Cancel all background downloads
+    for (final subscription in _backgroundDownloads.values) {
+      await subscription.cancel();
+    }
+    _backgroundDownloads.clear();
+    _activeDownloads.clear();
+    _downloads.clear();
+
+    // Cancel all pending saves
+    for (var timer in _saveTimers.values) {
+      timer.cancel();
+    }
+    _saveTimers.clear();
+
+    // Dispose all data sources
+    for (var dataSource in _dataSources.values) {
+      await dataSource.cancel();
+      await dataSource.dispose();
+    }
+    _dataSources.clear();
+
+    // Clear metadata and URL lookup
+    _metadata.clear();
+    _urlLookup.clear();
+    _registry.clear();
+    _collected.clear();
+
+    // Delete all files in storage directory
+    final dir = Directory(storageDir);
+    if (await dir.exists()) {
+      await for (final entity in dir.list()) {
+        try {
+          await entity.delete(recursive: true);
+        } catch (e) {
+          Logger.error('Failed to delete ${entity.path}: $e');
+        }
+      }
+    }
+
+    Logger.success('All cache cleared');
+  }
+
+  /// Clear cache for a specific URL
+  Future<void> clearCache(String url, {CallContext? context}) async {
+    final fileId = _hashUrl(url);
+
+    // Cancel if downloading
+    await cancelDownload(url, context: context);
+
+    // Cancel background download if any
+    await _backgroundDownloads[fileId]?.cancel();
+    _backgroundDownloads.remove(fileId);
+    _activeDownloads.remove(fileId);
+
+    // Remove metadata and URL lookup
+    _metadata.remove(fileId);
+    _urlLookup.remove(fileId);
+    _unregister(fileId);
+    if (_collected.remove(fileId) != null) unawaited(_saveCollected());
+    await _forgetMirrors(fileId);
+    await _forgetSidecars(fileId);
+    _downloads.remove(fileId);
+    _forgetProgress(fileId);
+    _rangeless.remove(fileId);
+    await unpin(fileId);
+
+    // Delete files
+    final videoFile = File(_videoPath(fileId));
+    _forgetCold(fileId);
+    final metaFile = File('$storageDir/$fileId.meta');
+
+    if (await videoFile.exists()) {
+      await videoFile.delete();
+    }
+    if (await metaFile.exists()) {
+      await metaFile.delete();
+    }
+
+    Logger.info('Cache cleared for: $url');
+  }
+
+  // ============== PLAYBACK SESSIONS ==============
+
+  void _updateSession(
+    String token,
+    DownloadMeta meta,
+    String remoteUrl,
+    int offset,
+  ) {
+    final session = _sessions[token];
+    if (session == null || session.fileId != meta.id) {
+      _sessions[token] = PlaybackSession(
+        token: token,
+        fileId: meta.id,
+        url: remoteUrl,
+        totalSize: meta.totalSize,
+        offset: offset,
+      );
+    } else {
+      session
+        ..offset = offset
+        ..updatedAt = DateTime.now();
+    }
+
+    _sessionSaveTimer?.cancel();
+    _sessionSaveTimer = Timer(const Duration(seconds: 1), _saveSessions);
+  }
+
+  /// Session state for a client token, if known
+  PlaybackSession? getSession(String token) => _sessions[token];
+
+  /// GET /session?token=TOKEN -> where the player was
+  void _handleSessionRequest(HttpRequest request) {
+    final token = request.uri.queryParameters['token'];
+    final session = token == null ? null : _sessions[token];
+    if (session == null) {
+      request.response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    request.response.headers.contentType = ContentType.json;
+    request.response.write(
+      jsonEncode({
+        ...session.toJson(),
+        'proxyUrl': getProxyUrl(session.url, session: token).toString(),
+      }),
+    );
+  }
+
+  Future<void> _saveSessions() async {
+    final now = DateTime.now();
+    _sessions.removeWhere((_, s) => s.isExpired(now, sessionMaxAge));
+    try {
+      await File('$storageDir/.sessions.json').writeAsString(
+        jsonEncode(_sessions.map((k, v) => MapEntry(k, v.toJson()))),
+      );
+    } catch (e) {
+      Logger.error('Failed to save sessions: $e');
+    }
+  }
+
+  Future<void> _loadSessions() async {
+    final file = File('$storageDir/.sessions.json');
+    if (!await file.exists()) return;
+    try {
+      final now = DateTime.now();
+      final data =
+          jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+      data.forEach((token, json) {
+        final session = PlaybackSession.fromJson(
+          json as Map<String, dynamic>,
+        );
+        if (!session.isExpired(now, sessionMaxAge)) {
+          _sessions[token] = session;
+          _urlLookup[session.fileId] = session.url;
+        }
+      });
+    } catch (e) {
+      Logger.error('Failed to load sessions: $e');
+    }
+  }
+
+  // ============== DISK QUOTA ==============
+
+  /// Keep the cache folder under [CacheQuotaConfig.maxBytes] by deleting
+  /// the least recently used files
+  ///
+  /// Pinned files, files in use and the collection are never evicted.
+  void enableQuota(CacheQuotaConfig config) {
+    _quotaTimer?.cancel();
+    _quota = config;
+    _quotaTimer = Timer.periodic(
+      config.checkInterval,
+      (_) => unawaited(enforceQuota()),
+    );
+  }
+
+  /// Let the cache grow without bound
+  void disableQuota() {
+    _quotaTimer?.cancel();
+    _quotaTimer = null;
+    _quota = null;
+  }
+
+  /// Evict files until the cache fits the quota; returns evicted IDs
+  Future<List<String>> enforceQuota() async {
+    final config = _quota;
+    if (config == null || _enforcingQuota) return const [];
+    _enforcingQuota = true;
+    try {
+      final usage = [
+        for (final fileId in await getCachedFileIds())
+          await _cacheUsage(fileId, config),
+      ];
+      final evict = CacheQuota.selectEvictions(usage, config.maxBytes);
+      Logger.debug(
+        'Quota check',
+        fields: {
+          'usedBytes': usage.fold(0, (sum, file) => sum + file.bytes),
+          'maxBytes': config.maxBytes,
+          'protected': usage.where((file) => file.protected).length,
+          'evicting': evict.length,
+        },
+      );
+      for (final file in evict) {
+        await _evict(file);
+      }
+      return [for (final file in evict) file.fileId];
+    } finally {
+      _enforcingQuota = false;
+    }
+  }
+
+  Future<CacheUsage> _cacheUsage(
+    String fileId,
+    CacheQuotaConfig config,
+  ) async {
+    final stat = await File(_videoPath(fileId)).stat();
+    final meta = _metadata[fileId];
+    final bytes = meta == null
+        ? stat.size
+        : (meta.progress / 100 * meta.totalSize).round();
+
+    final lastAccess = _lastAccess(fileId, stat.modified);
+    final inUse =
+        _activeDownloads.contains(fileId) ||
+        _backgroundDownloads.containsKey(fileId) ||
+        _readingAhead.contains(fileId) ||
+        DateTime.now().difference(lastAccess) < config.activeGrace;
+    return CacheUsage(
+      fileId,
+      bytes,
+      lastAccess,
+      protected: inUse || _pinnedIds.contains(fileId),
+    );
+  }
+
+  /// When [fileId] was last read by a player, falling back to
+  /// [modified] for files without history
+  DateTime _lastAccess(String fileId, DateTime modified) {
+    final lastAccess = _accessHistory[fileId]?.lastAccess ?? modified;
+    final playhead = _playheads[fileId];
+    return playhead != null && playhead.$2.isAfter(lastAccess)
+        ? playhead.$2
+        : lastAccess;
+  }
+
+  Future<void> _evict(CacheUsage file) async {
+    final fileId = file.fileId;
+    final url = _urlLookup.remove(fileId) ?? _metadata[fileId]?.originalUrl;
+    final videoPath = _videoPath(fileId);
+    _unregister(fileId);
+    _metadata.remove(fileId);
+    _downloads.remove(fileId);
+    _forgetProgress(fileId);
+    _saveTimers.remove(fileId)?.cancel();
+    _forgetCold(fileId);
+
+    final lock = _fileLocks.putIfAbsent(fileId, () => SharedLock());
+    await lock.synchronized(() async {
+      for (final path in [
+        videoPath,
+        '$storageDir/$fileId.meta',
+      ]) {
+        final entity = File(path);
+        if (await entity.exists()) await entity.delete();
+      }
     });
+
+    Logger.info(
+      'Evicted to stay under quota',
+      fields: {
+        'fileId': fileId,
+        'bytes': file.bytes,
+        'lastAccess': file.lastAccess.toIso8601String(),
+      },
+    );
+    _emit(
+      ProxyEvent(
+        ProxyEventType.evicted,
+        fileId: fileId,
+        url: url,
+        data: {'bytes': file.bytes},
+      ),
+    );
   }
 
-  /// Handle completed download
-  Future<void> _onDownloadComplete(DownloadMeta meta) async {
-    Logger.success('Download complete: ${meta.id}');
+  // ============== STORAGE LOSS ==============
+
+  // When the storage directory was found gone; null while it is usable
+  DateTime? _storageLostAt;
+  Timer? _remountTimer;
+  bool _checkingStorage = false;
+
+  /// How often a lost storage directory is probed for its return
+  Duration remountProbeInterval = const Duration(seconds: 10);
+
+  /// Whether the storage directory is usable
+  ///
+  /// When it goes away (an unmounted SD card, a dropped network share),
+  /// players' requests pass through to their origins uncached, with
+  /// their Range headers, and background downloads stop; a
+  /// `storageLost` event reports it. The directory is probed every
+  /// [remountProbeInterval]; once it is back, `storageRestored` follows,
+  /// the cache is read again and downloads resume.
+  bool get storageAvailable => _storageLostAt == null;
+
+  /// Probe the storage directory, e.g. after a file operation failed
+  /// with [error], and pass requests through when it is gone
+  Future<void> _checkStorage([Object? error]) async {
+    if (!storageAvailable || _checkingStorage) return;
+    _checkingStorage = true;
+    final bool available;
+    try {
+      available = await StorageCheck.isAvailable(storageDir);
+    } finally {
+      _checkingStorage = false;
+    }
+    if (available || !storageAvailable) return;
 
-    // Delete metadata file
-    await File(meta.metaPath).delete();
+    _storageLostAt = DateTime.now();
+    Logger.error(
+      'Storage lost, passing requests through',
+      fields: {'dir': storageDir},
+      error: error,
+    );
+    _emit(
+      ProxyEvent(
+        ProxyEventType.storageLost,
+        data: {
+          'path': storageDir,
+          'reason': error == null ? 'probe failed' : '$error',
+        },
+      ),
+    );
+    for (final fileId in [..._activeDownloads]) {
+      final url = _urlLookup[fileId];
+      if (url != null) await stopBackgroundDownload(url);
+    }
+    _remountTimer?.cancel();
+    _remountTimer = Timer.periodic(
+      remountProbeInterval,
+      (_) => unawaited(_probeRemount()),
+    );
+  }
 
-    // Determine final destination path
-    String finalPath;
-    if (meta.targetPath != null && meta.targetPath!.isNotEmpty) {
-      // Use the specified target path
-      finalPath = meta.targetPath!;
-      // Ensure directory exists
-      await Directory(finalPath).parent.create(recursive: true);
-    } else {
-      // Use default collections folder
-      final collectionsDir = '$storageDir/../collections';
-      await Directory(_outDir ?? collectionsDir).create(recursive: true);
-      finalPath = '${_outDir ?? collectionsDir}/${_outname ?? meta.id}.mp4';
+  Future<void> _probeRemount() async {
+    final lostAt = _storageLostAt;
+    if (lostAt == null || _checkingStorage) return;
+    _checkingStorage = true;
+    try {
+      if (!await StorageCheck.isAvailable(storageDir)) return;
+      _remountTimer?.cancel();
+      _remountTimer = null;
+
+      // Another card may be in: forget files that are not on it, take
+      // up the ones that are
+      for (final meta in [..._metadata.values]) {
+        if (!await File(meta.localPath).exists()) _metadata.remove(meta.id);
+      }
+      await recoverState(resume: false);
+      _storageLostAt = null;
+      final downtime = DateTime.now().difference(lostAt);
+      Logger.success('Storage back after ${downtime.inSeconds}s: $storageDir');
+      _emit(
+        ProxyEvent(
+          ProxyEventType.storageRestored,
+          data: {'path': storageDir, 'downtimeMs': downtime.inMilliseconds},
+        ),
+      );
+      await resumeAllDownloads();
+    } catch (e) {
+      Logger.error('Failed to restore storage: $e');
+    } finally {
+      _checkingStorage = false;
+    }
+  }
+
+  /// Relay [request] to the origin of [remoteUrl] as it is, Range and
+  /// all, caching nothing
+  Future<void> _servePassThrough(
+    HttpRequest request,
+    DataSource dataSource,
+    String remoteUrl,
+  ) async {
+    final range = request.headers.value(HttpHeaders.rangeHeader);
+    final upstream = await dataSource.fetchAll(
+      headers: range == null ? null : {HttpHeaders.rangeHeader: range},
+    );
+    final response = request.response;
+    if (upstream.statusCode >= 400 &&
+        upstream.statusCode != HttpStatus.requestedRangeNotSatisfiable) {
+      await upstream.drain<void>();
+      errorPages.write(
+        response,
+        ProxyFailure.upstreamUnavailable,
+        details: {'url': remoteUrl, 'upstreamStatus': upstream.statusCode},
+      );
+      return;
     }
 
-    // Move file to final destination
-    await File(meta.localPath).rename(finalPath);
-    Logger.success('File moved to: $finalPath');
+    response.statusCode = upstream.statusCode;
+    for (final name in const [
+      HttpHeaders.contentTypeHeader,
+      HttpHeaders.contentRangeHeader,
+      HttpHeaders.acceptRangesHeader,
+      HttpHeaders.etagHeader,
+      HttpHeaders.lastModifiedHeader,
+    ]) {
+      final value = upstream.headers.value(name);
+      if (value != null) response.headers.set(name, value);
+    }
+    // Unknown once the body was decompressed
+    if (upstream.contentLength >= 0) {
+      response.contentLength = upstream.contentLength;
+    }
+    response.headers.set('X-DownStream-Cache', 'BYPASS');
+    if (request.method == 'HEAD') {
+      await upstream.listen(null).cancel();
+      return;
+    }
+    await response.addStream(_deadlined(response, upstream));
+  }
 
-    // Notify UI (you'd use a StreamController or similar)
-    _metadata.remove(meta.id);
+  // ============== STORAGE TIERS ==============
+
+  /// Keep hot files in the cache folder (the fast tier) and demote
+  /// complete files that went cold to [TieredStorageConfig.coldDir]
+  ///
+  /// Demoted files are served from the cold tier like any other, and one
+  /// read often enough is promoted back. Files move whole, so a partial
+  /// file always stays in the fast tier.
+  void enableTiering(TieredStorageConfig config) {
+    _tierTimer?.cancel();
+    _tiers = TieredStorage(config);
+    _tierTimer = Timer.periodic(
+      config.checkInterval,
+      (_) => unawaited(enforceTiering()),
+    );
   }
 
-  /// Parse HTTP Range header
-  (int, int) _parseRange(String header, int totalSize) {
-    // bytes=start-end or bytes=start-
-    final match = RegExp(r'bytes=(\d+)-(\d*)').firstMatch(header);
-    if (match == null) return (0, totalSize - 1);
+  /// Stop moving files; demoted files stay and are still served
+  void disableTiering() {
+    _tierTimer?.cancel();
+    _tierTimer = null;
+    _tiers = null;
+  }
 
-    final start = int.parse(match.group(1)!);
-    final endStr = match.group(2);
-    final end = endStr != null && endStr.isNotEmpty
-        ? int.parse(endStr)
-        : totalSize - 1;
+  /// Demote the files that went cold; returns their IDs
+  Future<List<String>> enforceTiering() async {
+    final tiers = _tiers;
+    if (tiers == null || _retiering) return const [];
+    _retiering = true;
+    try {
+      final usage = [
+        for (final fileId in await getCachedFileIds())
+          if (!_coldPaths.containsKey(fileId))
+            await _tierUsage(fileId, tiers.config),
+      ];
+      final demote = TieredStorage.selectDemotions(
+        usage,
+        tiers.config,
+        DateTime.now(),
+      );
+      final demoted = <String>[];
+      for (final file in demote) {
+        final target = p.join(tiers.config.coldDir, '${file.fileId}.video');
+        try {
+          await _moveTier(file.fileId, target, cold: true);
+          demoted.add(file.fileId);
+        } catch (e) {
+          Logger.error('Failed to demote ${file.fileId}: $e');
+        }
+      }
+      return demoted;
+    } finally {
+      _retiering = false;
+    }
+  }
 
-    return (start, end);
+  Future<CacheUsage> _tierUsage(
+    String fileId,
+    TieredStorageConfig config,
+  ) async {
+    final stat = await File(_videoPath(fileId)).stat();
+    final lastAccess = _lastAccess(fileId, stat.modified);
+    final busy =
+        _activeDownloads.contains(fileId) ||
+        _backgroundDownloads.containsKey(fileId) ||
+        _readingAhead.contains(fileId) ||
+        _promoting.contains(fileId) ||
+        DateTime.now().difference(lastAccess) < config.activeGrace;
+    return CacheUsage(
+      fileId,
+      stat.size,
+      lastAccess,
+      protected: busy || !(_metadata[fileId]?.isComplete ?? true),
+    );
   }
 
-  String _hashUrl(String url) => DownStreamUtils.hashUrl(url);
+  /// Bring the cold file [fileId] back to the fast tier
+  Future<void> _promote(String fileId) async {
+    if (!_promoting.add(fileId)) return;
+    try {
+      await _moveTier(fileId, '$storageDir/$fileId.video', cold: false);
+    } catch (e) {
+      Logger.error('Failed to promote $fileId: $e');
+    } finally {
+      _promoting.remove(fileId);
+    }
+  }
 
-  /// Get download progress for a URL
-  double getProgress(String url) {
-    final fileId = _hashUrl(url);
-    return _metadata[fileId]?.progress ?? 0.0;
+  /// Copy the complete file [fileId] to [target] in the other tier, then
+  /// switch to it under the file's lock and delete the old copy
+  Future<void> _moveTier(
+    String fileId,
+    String target, {
+    required bool cold,
+  }) async {
+    final source = _videoPath(fileId);
+    if (p.equals(source, target)) return;
+    await Directory(p.dirname(target)).create(recursive: true);
+    final staged = '$target.tmp';
+    await File(source).copy(staged);
+
+    final lock = _fileLocks.putIfAbsent(fileId, () => SharedLock());
+    final moved = await lock.synchronized(() async {
+      final meta = _metadata[fileId];
+      // Refreshed or deleted while copying: leave it where it is
+      if ((meta != null && !meta.isComplete) ||
+          !await File(source).exists()) {
+        return false;
+      }
+      await File(staged).rename(target);
+      meta?.localPath = target;
+      if (cold) {
+        _coldPaths[fileId] = target;
+      } else {
+        _coldPaths.remove(fileId);
+      }
+      return true;
+    });
+    if (!moved) {
+      await File(staged).delete();
+      return;
+    }
+    _tiers?.forget(fileId);
+    await _saveColdPaths();
+
+    final bytes = await File(target).length();
+    await File(source).delete();
+    final tier = cold ? 'cold' : 'fast';
+    Logger.info('Moved $fileId ($bytes bytes) to the $tier tier');
+    _emit(
+      ProxyEvent(
+        ProxyEventType.tierMoved,
+        fileId: fileId,
+        url: _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl,
+        data: {'tier': tier, 'bytes': bytes},
+      ),
+    );
   }
 
-  /// Cancel a download task
-  Future<void> cancelDownload(String url) async {
-    final fileId = _hashUrl(url);
+  /// Where the bytes of [fileId] are, in whichever tier
+  String _videoPath(String fileId) =>
+      _metadata[fileId]?.localPath ??
+      _coldPaths[fileId] ??
+      '$storageDir/$fileId.video';
+
+  /// Drop [fileId] from the cold tier's index once its file is gone
+  void _forgetCold(String fileId) {
+    if (_coldPaths.remove(fileId) == null) return;
+    _tiers?.forget(fileId);
+    unawaited(_saveColdPaths());
+  }
 
-    // Cancel data source
-    final dataSource = _dataSources[fileId];
-    if (dataSource != null) {
-      await dataSource.cancel();
-      _dataSources.remove(fileId);
+  Future<void> _saveColdPaths() async {
+    try {
+      await File(
+        '$storageDir/.tiers.json',
+      ).writeAsString(jsonEncode(_coldPaths));
+    } catch (e) {
+      Logger.error('Failed to save storage tiers: $e');
+    }
+  }
+
+  Future<void> _loadColdPaths() async {
+    final file = File('$storageDir/.tiers.json');
+    if (!await file.exists()) return;
+    try {
+      final data =
+          jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+      _coldPaths.addAll(data.cast<String, String>());
+    } catch (e) {
+      Logger.error('Failed to load storage tiers: $e');
     }
+  }
 
-    // Cancel pending save
-    _saveTimers[fileId]?.cancel();
-    _saveTimers.remove(fileId);
+  // ============== METRICS ==============
+
+  /// Counters and gauges in the Prometheus text format, as served at
+  /// `/metrics` (behind [apiToken] when set)
+  String prometheusMetrics() {
+    final metas = _metadata.values.where((m) => !m.ephemeral).toList();
+    final hosts = connectionMetrics.hosts;
+    final text = PrometheusText()
+      ..metric(
+        'downstream_served_bytes_total',
+        'counter',
+        'Bytes sent to players, by source',
+        [
+          (const {'source': 'cache'}, proxyMetrics.bytesFromCache),
+          (const {'source': 'upstream'}, proxyMetrics.bytesFromUpstream),
+        ],
+      )
+      ..single(
+        'downstream_cache_hit_ratio',
+        'gauge',
+        'Share of the bytes served that came from the cache',
+        proxyMetrics.cacheHitRatio,
+      )
+      ..single(
+        'downstream_active_downloads',
+        'gauge',
+        'Background downloads running',
+        _backgroundDownloads.length,
+      )
+      ..metric('downstream_downloads', 'gauge', 'Files by download state', [
+        for (final state in DownloadState.values)
+          (
+            {'state': state.name},
+            _downloads.values.where((d) => d.state == state).length,
+          ),
+      ])
+      ..metric(
+        'downstream_upstream_responses_total',
+        'counter',
+        'Upstream responses by status code',
+        [
+          for (final MapEntry(:key, :value)
+              in connectionMetrics.statusCodes.entries)
+            ({'code': '$key'}, value),
+        ],
+      )
+      ..single(
+        'downstream_upstream_connection_errors_total',
+        'counter',
+        'Upstream requests that got no response',
+        connectionMetrics.connectionErrors,
+      )
+      ..metric(
+        'downstream_upstream_host_errors_total',
+        'counter',
+        'Failed upstream requests by host and kind',
+        [
+          for (final stats in hosts) ...[
+            ({'host': stats.host, 'kind': 'server'}, stats.serverErrors),
+            (
+              {'host': stats.host, 'kind': 'connection'},
+              stats.connectionErrors - stats.timeouts,
+            ),
+            ({'host': stats.host, 'kind': 'timeout'}, stats.timeouts),
+          ],
+        ],
+      )
+      ..metric(
+        'downstream_upstream_host_error_ratio',
+        'gauge',
+        'Share of upstream attempts that failed, by host',
+        [for (final stats in hosts) ({'host': stats.host}, stats.errorRate)],
+      )
+      ..metric(
+        'downstream_upstream_host_retries_total',
+        'counter',
+        'Upstream attempts repeated after an error, by host',
+        [for (final stats in hosts) ({'host': stats.host}, stats.retries)],
+      )
+      ..metric(
+        'downstream_upstream_circuit_state',
+        'gauge',
+        'Circuit breaker state of each upstream host (1 for the current)',
+        [
+          for (final stats in hosts)
+            for (final state in CircuitState.values)
+              (
+                {'host': stats.host, 'state': state.name},
+                stats.circuit == state ? 1 : 0,
+              ),
+        ],
+      )
+      ..metric(
+        'downstream_file_progress_ratio',
+        'gauge',
+        'Cached share of each file',
+        [
+          for (final meta in metas)
+            (
+              {'file': meta.id},
+              meta.totalSize == 0 ? 1 : meta.downloadedBytes / meta.totalSize,
+            ),
+        ],
+      )
+      ..single(
+        'downstream_cache_bytes',
+        'gauge',
+        'Bytes cached',
+        metas.fold(0, (sum, m) => sum + m.downloadedBytes),
+      )
+      ..histogram(
+        'downstream_request_duration_seconds',
+        'Time to handle a request, event streams excluded',
+        proxyMetrics.requestDuration,
+      );
+    final quota = _quota;
+    if (quota != null) {
+      text.single(
+        'downstream_cache_quota_bytes',
+        'gauge',
+        'Disk budget of the cache',
+        quota.maxBytes,
+      );
+    }
+    return '$text';
+  }
 
-    Logger.cancel('Download cancelled: $url');
+  // ============== DOWNLOADS API ==============
+
+  /// REST endpoints for a download manager screen
+  ///
+  /// ```
+  /// GET    /api/downloads       -> every cached file
+  /// GET    /api/downloads/<id>  -> one file
+  /// GET    /api/downloads/<id>/content -> the completed file
+  /// GET    /api/downloads/<id>/ranges  -> cached ranges by source host
+  /// GET    /api/downloads/<id>/mirrors -> its URLs and how each did
+  /// POST   /api/downloads/<id>/mirrors {"urls": ["..."]} -> add mirrors
+  /// DELETE /api/downloads/<id>/mirrors?url=URL -> remove one
+  /// GET    /api/downloads/<id>/sidecars -> its subtitles, audio tracks
+  ///                                        and thumbnails
+  /// POST   /api/downloads/<id>/sidecars {"sidecars": [{"kind": "subtitles",
+  ///                                      "url": "...", "language": "en"}]}
+  /// DELETE /api/downloads/<id>/sidecars?url=URL -> remove one
+  /// POST   /api/downloads       {"url": "...", "collection": "...",
+  ///                              "mirrors": ["..."], "sidecars": [...]}
+  ///                                -> download it whole
+  /// DELETE /api/downloads/<id>  -> stop it and delete its cache
+  /// ```
+  Future<void> _handleDownloadsApi(HttpRequest request) async {
+    final response = request.response;
+    if (!_checkAuthorized(request)) return;
+    final segments = request.uri.pathSegments;
+    final fileId = segments.length > 2 ? segments[2] : null;
+    final content = segments.length == 4 && segments[3] == 'content';
+    final ranges = segments.length == 4 && segments[3] == 'ranges';
+    final mirrors = segments.length == 4 && segments[3] == 'mirrors';
+    final sidecars = segments.length == 4 && segments[3] == 'sidecars';
+    if ((segments.length > 3 &&
+            !content &&
+            !ranges &&
+            !mirrors &&
+            !sidecars) ||
+        (fileId != null && !RegExp(r'^[A-Za-z0-9_-]+$').hasMatch(fileId))) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    if (content) {
+      if (request.method == 'PUT') {
+        await _handleContentPut(request, fileId!);
+      } else {
+        await _handleContentRequest(request, fileId!);
+      }
+      return;
+    }
+    if (ranges) {
+      if (request.method != 'GET') {
+        response.statusCode = HttpStatus.methodNotAllowed;
+        response.headers.set(HttpHeaders.allowHeader, 'GET');
+        return;
+      }
+      final entry = _rangesEntry(fileId!);
+      if (entry == null) {
+        response.statusCode = HttpStatus.notFound;
+        return;
+      }
+      _writeJson(response, entry);
+      return;
+    }
+    if (mirrors) {
+      await _handleMirrorsApi(request, fileId!);
+      return;
+    }
+    if (sidecars) {
+      await _handleSidecarsApi(request, fileId!);
+      return;
+    }
+
+    switch ((request.method, fileId)) {
+      case ('GET', null):
+        final entries = [
+          for (final id in await getCachedFileIds())
+            await _downloadEntry(id),
+        ];
+        _writeJson(
+          response,
+          entries.whereType<Map<String, Object?>>().toList(),
+        );
+      case ('GET', final id?):
+        final entry = await _downloadEntry(id);
+        if (entry == null) {
+          response.statusCode = HttpStatus.notFound;
+          return;
+        }
+        _writeJson(response, entry);
+      case ('POST', null):
+        final String url;
+        final int? ttl;
+        final String? collection;
+        final List<String> mirrors;
+        final List<Sidecar> sidecars;
+        try {
+          final json = jsonDecode(await utf8.decoder.bind(request).join());
+          url = _adminTarget(
+            (json as Map<String, dynamic>)['url'] as String,
+          );
+          ttl = json['ttl'] as int?;
+          collection = json['collection'] as String?;
+          mirrors = [
+            for (final mirror in json['mirrors'] as List? ?? const [])
+              _adminTarget(mirror as String),
+          ];
+          sidecars = _sidecarsFromJson(json['sidecars']);
+          if (!Uri.parse(url).hasScheme ||
+              (ttl != null && ttl <= 0) ||
+              (collection != null && !_collections.containsKey(collection))) {
+            throw const FormatException();
+          }
+        } on SignedUrlException {
+          rethrow;
+        } catch (_) {
+          response.statusCode = HttpStatus.badRequest;
+          return;
+        }
+        final id = await enqueueDownload(
+          url,
+          ttl: ttl == null ? null : Duration(seconds: ttl),
+          collection: collection,
+          mirrors: mirrors,
+          sidecars: sidecars,
+        );
+        if (id == null) {
+          response.statusCode = HttpStatus.badGateway;
+          return;
+        }
+        response.statusCode = HttpStatus.accepted;
+        _writeJson(response, await _downloadEntry(id));
+      case ('DELETE', final id?):
+        if (await _downloadEntry(id) == null) {
+          response.statusCode = HttpStatus.notFound;
+          return;
+        }
+        await _deleteCached(id);
+        response.statusCode = HttpStatus.noContent;
+      default:
+        response.statusCode = HttpStatus.methodNotAllowed;
+        response.headers.set(
+          HttpHeaders.allowHeader,
+          fileId == null ? 'GET, POST' : 'GET, DELETE',
+        );
+    }
   }
 
-  /// Get file stats for a URL
-  Stream<FileStat>? getFileStats(String url) {
-    final fileId = _hashUrl(url);
-    return _dataSources[fileId]?.fileStats;
+  /// Whether [access] lets [request] in; answers and closes it when not
+  Future<bool> _checkAccess(HttpRequest request) async {
+    String? denial;
+    try {
+      denial = await access.denial(request);
+    } catch (e, stack) {
+      Logger.error('Access check failed', error: e, stackTrace: stack);
+      denial = 'Access check failed';
+    }
+    if (denial == null) return true;
+    Logger.debug(
+      'Access denied',
+      fields: {
+        'client': request.connectionInfo?.remoteAddress.address,
+        'reason': denial,
+      },
+    );
+    errorPages.write(
+      request.response,
+      ProxyFailure.accessDenied,
+      details: {'message': denial},
+    );
+    await request.response.close();
+    return false;
   }
 
-  // ============== CACHE MANAGEMENT ==============
+  /// Whether [request] carries [apiToken]; answers `401` when not
+  ///
+  /// Runs after [_checkAccess] let the request in (see [AccessPolicy]).
+  bool _checkAuthorized(HttpRequest request) {
+    if (AccessPolicy.carriesToken(request, apiToken)) return true;
+    request.response.statusCode = HttpStatus.unauthorized;
+    request.response.headers.set(HttpHeaders.wwwAuthenticateHeader, 'Bearer');
+    return false;
+  }
 
-  /// Clear all cached files and metadata
-  Future<void> clearAllCache() async {
-    Logger.info('Clearing all cache...');
+  /// GET (or HEAD) /api/downloads/<id>/content
+  ///
+  /// Serves the completed file as an attachment, with single and
+  /// multiple byte ranges; a file still downloading is answered `409`.
+  Future<void> _handleContentRequest(
+    HttpRequest request,
+    String fileId,
+  ) async {
+    final response = request.response;
+    if (request.method != 'GET' && request.method != 'HEAD') {
+      response.statusCode = HttpStatus.methodNotAllowed;
+      response.headers.set(HttpHeaders.allowHeader, 'GET, HEAD, PUT');
+      return;
+    }
+    final file = File(_videoPath(fileId));
+    final meta = _metadata[fileId];
+    if (!await file.exists() ||
+        (_lifetimes[fileId]?.isExpired(DateTime.now()) ?? false)) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    if (meta != null && !meta.isComplete) {
+      response.statusCode = HttpStatus.conflict;
+      _writeJson(response, {'progress': meta.progress});
+      return;
+    }
+
+    final stat = await file.stat();
+    final size = meta?.totalSize ?? stat.size;
+    final List<(int, int)>? ranges;
+    try {
+      ranges = RangeHeader.parse(request.headers.value('range'), size);
+    } on RangeNotSatisfiableException {
+      _rejectRange(response, size);
+      return;
+    }
+    final parts = ranges ?? [if (size > 0) (0, size - 1)];
+    final fileName = meta?.suggestedFileName ?? fileId;
+    final contentType = meta?.mimeType ?? mimeTypeForName(fileName);
+    final multipart = parts.length > 1
+        ? MultipartByteRanges(
+            parts,
+            size,
+            contentType,
+            DownStreamUtils.randomId(),
+          )
+        : null;
+
+    response.statusCode = ranges == null
+        ? HttpStatus.ok
+        : HttpStatus.partialContent;
+    response.headers
+      ..set(HttpHeaders.acceptRangesHeader, 'bytes')
+      ..set(HttpHeaders.contentTypeHeader, multipart?.mediaType ?? contentType)
+      ..set(
+        'Content-Disposition',
+        DownStreamUtils.contentDisposition(fileName, attachment: true),
+      )
+      ..set(HttpHeaders.lastModifiedHeader, HttpDate.format(stat.modified));
+    response.contentLength =
+        multipart?.contentLength ??
+        parts.fold(0, (sum, r) => sum + r.$2 - r.$1 + 1);
+    if (ranges != null && multipart == null) {
+      response.headers.set(
+        'Content-Range',
+        'bytes ${parts.first.$1}-${parts.first.$2}/$size',
+      );
+    }
+    if (request.method == 'HEAD') return;
+
+    for (int i = 0; i < parts.length; i++) {
+      if (multipart != null) response.add(multipart.partHeader(i));
+      final (start, end) = parts[i];
+      await response.addStream(
+        _deadlined(response, _plainRead(file, meta, start, end + 1)),
+      );
+    }
+    if (multipart != null) response.add(multipart.trailer);
+  }
+
+  void _writeJson(HttpResponse response, Object? json) {
+    response.headers.contentType = ContentType.json;
+    response.write(jsonEncode(json));
+  }
+
+  /// What the downloads API reports about [fileId] (`GET
+  /// /api/downloads/<id>`); null when it is not cached
+  Future<Map<String, Object?>?> downloadInfo(String fileId) =>
+      _downloadEntry(fileId);
+
+  /// What the downloads API reports about [fileId]; null when it is not
+  /// cached
+  Future<Map<String, Object?>?> _downloadEntry(String fileId) async {
+    final file = File(_videoPath(fileId));
+    if (!await file.exists()) return null;
+    final stat = await file.stat();
+    final meta = _metadata[fileId];
+    final complete = meta?.isComplete ?? true;
+    final state =
+        _downloads[fileId]?.state ??
+        (complete ? DownloadState.completed : DownloadState.queued);
+    return {
+      'id': fileId,
+      'url': _urlLookup[fileId] ?? meta?.originalUrl,
+      'fileName': meta?.suggestedFileName,
+      'mimeType': meta?.mimeType,
+      'totalSize': meta?.totalSize ?? stat.size,
+      'cachedBytes': meta?.downloadedBytes ?? stat.size,
+      'progress': meta?.progress ?? 100.0,
+      'state': state.name,
+      'downloading': _backgroundDownloads.containsKey(fileId),
+      'pinned': _pinnedIds.contains(fileId),
+      'lastAccess': _lastAccess(fileId, stat.modified).toIso8601String(),
+    };
+  }
+
+  /// GET, POST or DELETE /api/downloads/<id>/mirrors
+  Future<void> _handleMirrorsApi(HttpRequest request, String fileId) async {
+    final response = request.response;
+    final url = _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl;
+    if (url == null) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    switch (request.method) {
+      case 'GET':
+        _writeJson(
+          response,
+          (mirrorsOf(url) ?? MirrorSet(url, config: _mirrorConfig)).toJson(),
+        );
+      case 'POST':
+        final List<String> urls;
+        try {
+          final json = jsonDecode(await utf8.decoder.bind(request).join());
+          urls = [
+            for (final mirror in (json as Map<String, dynamic>)['urls'] as List)
+              _adminTarget(mirror as String),
+          ];
+        } on SignedUrlException {
+          rethrow;
+        } catch (_) {
+          response.statusCode = HttpStatus.badRequest;
+          return;
+        }
+        final accepted = await addMirrors(url, urls);
+        _writeJson(response, {
+          'accepted': accepted,
+          ...?mirrorsOf(url)?.toJson(),
+        });
+      case 'DELETE':
+        final mirror = request.uri.queryParameters['url'];
+        if (mirror == null || !await removeMirror(url, mirror)) {
+          response.statusCode = HttpStatus.notFound;
+          return;
+        }
+        response.statusCode = HttpStatus.noContent;
+      default:
+        response.statusCode = HttpStatus.methodNotAllowed;
+        response.headers.set(HttpHeaders.allowHeader, 'GET, POST, DELETE');
+    }
+  }
+
+  /// GET, POST or DELETE /api/downloads/<id>/sidecars
+  Future<void> _handleSidecarsApi(HttpRequest request, String fileId) async {
+    final response = request.response;
+    final url = _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl;
+    if (url == null) {
+      response.statusCode = HttpStatus.notFound;
+      return;
+    }
+    List<Map<String, dynamic>> entries() => [
+      for (final sidecar in sidecarsOf(url))
+        {
+          ...sidecar.toJson(),
+          'proxyUrl': '${_sidecarProxyUrl(url, sidecar)}',
+        },
+    ];
+    switch (request.method) {
+      case 'GET':
+        _writeJson(response, {'sidecars': entries()});
+      case 'POST':
+        final List<Sidecar> sidecars;
+        try {
+          final json = jsonDecode(await utf8.decoder.bind(request).join());
+          sidecars = _sidecarsFromJson(
+            (json as Map<String, dynamic>)['sidecars'],
+          );
+        } on SignedUrlException {
+          rethrow;
+        } catch (_) {
+          response.statusCode = HttpStatus.badRequest;
+          return;
+        }
+        final added = await addSidecars(url, sidecars);
+        _writeJson(response, {
+          'added': [for (final uri in added) '$uri'],
+          'sidecars': entries(),
+        });
+      case 'DELETE':
+        final sidecar = request.uri.queryParameters['url'];
+        if (sidecar == null || !await removeSidecar(url, sidecar)) {
+          response.statusCode = HttpStatus.notFound;
+          return;
+        }
+        response.statusCode = HttpStatus.noContent;
+      default:
+        response.statusCode = HttpStatus.methodNotAllowed;
+        response.headers.set(HttpHeaders.allowHeader, 'GET, POST, DELETE');
+    }
+  }
+
+  /// Sidecars in a request body, their URLs checked by [_adminTarget]
+  List<Sidecar> _sidecarsFromJson(Object? json) {
+    final sidecars = <Sidecar>[];
+    for (final entry in json as List? ?? const []) {
+      final sidecar = Sidecar.fromJson(entry as Map<String, dynamic>);
+      sidecars.add(
+        Sidecar(
+          sidecar.kind,
+          _adminTarget(sidecar.url),
+          language: sidecar.language,
+          label: sidecar.label,
+        ),
+      );
+    }
+    return sidecars;
+  }
+
+  /// Cached ranges of [fileId] with the host that supplied each, and the
+  /// order its hosts are now tried in; null when it is not tracked
+  Map<String, Object?>? _rangesEntry(String fileId) {
+    final meta = _metadata[fileId];
+    if (meta == null) return null;
+    final sources = meta.sources;
+    final url = _urlLookup[fileId] ?? meta.originalUrl;
+    final host = url == null ? null : Uri.parse(url).host;
+    return {
+      'id': fileId,
+      'totalSize': meta.totalSize,
+      'cachedBytes': meta.downloadedBytes,
+      'ranges': [
+        for (final (start, end, source) in sources.ranges)
+          {'start': start, 'end': end, 'source': source},
+      ],
+      'bytesByHost': sources.bytesByHost,
+      'failures': sources.failures,
+      if (host != null)
+        'hostOrder': sources.rank([
+          host,
+          ...?hostPolicies.match(host)?.mirrors,
+        ]),
+    };
+  }
+
+  /// Stop every fetch for [fileId] and delete its cached bytes
+  Future<void> _deleteCached(String fileId) async {
+    final url = _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl;
+    if (url != null) {
+      await cancel(fileId, deleteData: true);
+      return;
+    }
+    // Left by an older version without a URL: just the files
+    await _interrupt(fileId);
+    _unregister(fileId);
+    _metadata.remove(fileId);
+    _downloads.remove(fileId);
+    await unpin(fileId);
+    final videoPath = _videoPath(fileId);
+    _forgetCold(fileId);
+    for (final path in [videoPath, '$storageDir/$fileId.meta']) {
+      final file = File(path);
+      if (await file.exists()) await file.delete();
+    }
+  }
+
+  // ============== PINNING ==============
+
+  /// Protect a file from eviction regardless of access recency
+  ///
+  /// Explicit removal ([clearCache]) still deletes pinned files.
+  Future<void> pin(String fileId) async {
+    if (_pinnedIds.add(fileId)) await _savePins();
+  }
+
+  /// Make a pinned file evictable again
+  Future<void> unpin(String fileId) async {
+    if (_pinnedIds.remove(fileId)) await _savePins();
+  }
 
-    // Cancel all background downloads
-    for (final subscription in _backgroundDownloads.values) {
-      await subscription.cancel();
-    }
-    _backgroundDownloads.clear();
-    _activeDownloads.clear();
+  /// Check whether a file is pinned
+  bool isPinned(String fileId) => _pinnedIds.contains(fileId);
 
-    // Cancel all pending saves
-    for (var timer in _saveTimers.values) {
-      timer.cancel();
+  /// IDs of all pinned files
+  Set<String> get pinnedIds => Set.unmodifiable(_pinnedIds);
+
+  Future<void> _savePins() async {
+    try {
+      await File(
+        '$storageDir/.pins.json',
+      ).writeAsString(jsonEncode(_pinnedIds.toList()));
+    } catch (e) {
+      Logger.error('Failed to save pins: $e');
     }
-    _saveTimers.clear();
+  }
 
-    // Dispose all data sources
-    for (var dataSource in _dataSources.values) {
-      await dataSource.cancel();
-      await dataSource.dispose();
+  Future<void> _loadPins() async {
+    final file = File('$storageDir/.pins.json');
+    if (!await file.exists()) return;
+    try {
+      final ids = jsonDecode(await file.readAsString()) as List;
+      _pinnedIds.addAll(ids.cast<String>());
+    } catch (e) {
+      Logger.error('Failed to load pins: $e');
     }
-    _dataSources.clear();
+  }
 
-    // Clear metadata and URL lookup
-    _metadata.clear();
-    _urlLookup.clear();
+  // ============== LIFETIMES ==============
 
-    // Delete all files in storage directory
-    final dir = Directory(storageDir);
-    if (await dir.exists()) {
-      await for (final entity in dir.list()) {
-        try {
-          await entity.delete(recursive: true);
-        } catch (e) {
-          Logger.error('Failed to delete ${entity.path}: $e');
-        }
-      }
-    }
+  /// Delete [url] [ttl] from now, replacing any lifetime it had
+  ///
+  /// The janitor checks every minute and deletes the cache and, once
+  /// complete, the collection copy, whether pinned or not; an expired file
+  /// is never served again from the cache.
+  Future<void> setLifetime(String url, Duration ttl) async {
+    _lifetimes[_hashUrl(url)] = CacheLifetime.fromNow(ttl);
+    await _saveLifetimes();
+  }
 
-    Logger.success('All cache cleared');
+  /// Keep [url] until it is deleted some other way
+  Future<void> clearLifetime(String url) async {
+    if (_lifetimes.remove(_hashUrl(url)) != null) await _saveLifetimes();
   }
 
-  /// Clear cache for a specific URL
-  Future<void> clearCache(String url) async {
-    final fileId = _hashUrl(url);
+  /// The lifetime of [url]; null when it has none
+  CacheLifetime? lifetimeOf(String url) => _lifetimes[_hashUrl(url)];
 
-    // Cancel if downloading
-    await cancelDownload(url);
+  /// Give [fileId] a lifetime of [ttl] unless it has one: only the first
+  /// play or enqueue starts the clock
+  void _keepFor(String fileId, Duration ttl) {
+    if (_lifetimes.containsKey(fileId)) return;
+    _lifetimes[fileId] = CacheLifetime.fromNow(ttl);
+    unawaited(_saveLifetimes());
+  }
 
-    // Cancel background download if any
-    await _backgroundDownloads[fileId]?.cancel();
-    _backgroundDownloads.remove(fileId);
-    _activeDownloads.remove(fileId);
+  void _startJanitor() {
+    _janitorTimer = Timer.periodic(const Duration(minutes: 1), (_) {
+      if (!storageAvailable) return;
+      unawaited(_checkStorage());
+      unawaited(removeExpired());
+      unawaited(_enforceCollections());
+    });
+    unawaited(removeExpired());
+  }
 
-    // Remove metadata and URL lookup
-    _metadata.remove(fileId);
-    _urlLookup.remove(fileId);
+  /// Delete every file whose lifetime is over; returns their IDs
+  Future<List<String>> removeExpired() async {
+    if (_sweeping) return const [];
+    _sweeping = true;
+    try {
+      final now = DateTime.now();
+      final expired = [
+        for (final MapEntry(key: fileId, value: lifetime)
+            in _lifetimes.entries)
+          if (lifetime.isExpired(now)) fileId,
+      ];
+      for (final fileId in expired) {
+        await _expire(fileId);
+      }
+      return expired;
+    } finally {
+      _sweeping = false;
+    }
+  }
 
-    // Delete files
-    final videoFile = File('$storageDir/$fileId.video');
-    final metaFile = File('$storageDir/$fileId.meta');
+  Future<void> _expire(String fileId) async {
+    final lifetime = _lifetimes.remove(fileId);
+    if (lifetime == null) return;
+    final url = _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl;
+    await _deleteCached(fileId);
 
-    if (await videoFile.exists()) {
-      await videoFile.delete();
+    final path = lifetime.completedPath;
+    try {
+      if (path != null && isContentUri(path)) {
+        await documentStore?.delete(path);
+      } else if (path != null) {
+        for (final file in [File(path), File(CompletionMarker.pathFor(path))]) {
+          if (await file.exists()) await file.delete();
+        }
+      }
+    } catch (e) {
+      Logger.error('Failed to delete expired $path: $e');
     }
-    if (await metaFile.exists()) {
-      await metaFile.delete();
+    await _saveLifetimes();
+
+    Logger.info('Expired $fileId');
+    _emit(
+      ProxyEvent(
+        ProxyEventType.expired,
+        fileId: fileId,
+        url: url,
+        data: {
+          'expiresAt': lifetime.expiresAt.toIso8601String(),
+          if (path != null) 'path': path,
+        },
+      ),
+    );
+  }
+
+  Future<void> _saveLifetimes() async {
+    try {
+      await File('$storageDir/.lifetimes.json').writeAsString(
+        jsonEncode(_lifetimes.map((k, v) => MapEntry(k, v.toJson()))),
+      );
+    } catch (e) {
+      Logger.error('Failed to save lifetimes: $e');
     }
+  }
 
-    Logger.info('Cache cleared for: $url');
+  Future<void> _loadLifetimes() async {
+    final file = File('$storageDir/.lifetimes.json');
+    if (!await file.exists()) return;
+    try {
+      final data =
+          jsonDecode(await file.readAsString()) as Map<String, dynamic>;
+      data.forEach((fileId, json) {
+        _lifetimes[fileId] = CacheLifetime.fromJson(
+          json as Map<String, dynamic>,
+        );
+      });
+    } catch (e) {
+      Logger.error('Failed to load lifetimes: $e');
+    }
   }
 
   /// Get list of all cached file IDs
@@ -514,10 +7905,86 @@ class StreamProxyBridge {
         }
       }
     }
+    // Demoted files; a cold disk that is not mounted hides its files
+    for (final MapEntry(key: id, value: path) in _coldPaths.entries) {
+      if (!ids.contains(id) && await File(path).exists()) ids.add(id);
+    }
 
     return ids;
   }
 
+  /// Rebuild metadata for partial downloads left in [storageDir]
+  ///
+  /// Every `.video` with a readable `.meta` is registered, so progress,
+  /// export and resume work before a player asks for it again; with
+  /// [resume] its background download restarts. Called on startup.
+  /// Returns the number of files recovered.
+  Future<int> recoverState({bool resume = true}) async {
+    int recovered = 0;
+    for (final fileId in await getCachedFileIds()) {
+      if (_metadata.containsKey(fileId)) continue;
+
+      final metaPath = '$storageDir/$fileId.meta';
+      final header = await DownloadMeta.readHeader(
+        metaPath,
+        cipher: metaCipher,
+      );
+      final totalSize = header?['totalSize'];
+      if (totalSize is! int || totalSize <= 0) continue;
+
+      // Metadata of older versions may lack the URL; the registry has it
+      final url =
+          header!['originalUrl'] as String? ?? _registry.lookupUrl(fileId);
+      final meta = DownloadMeta(
+        id: fileId,
+        totalSize: totalSize,
+        localPath: _videoPath(fileId),
+        metaPath: metaPath,
+        originalUrl: url,
+        cipher: metaCipher,
+      );
+      await meta.load();
+      final journaled = _journalReplay?.ranges[fileId];
+      if (journaled != null) {
+        for (final (start, end) in journaled.ranges) {
+          meta.addRange(start, end);
+        }
+        await meta.save();
+      }
+      _metadata[fileId] = meta;
+      recovered++;
+
+      if (url == null) continue;
+      _urlLookup[fileId] = url;
+      _register(meta, url);
+      _setDownloadState(fileId, DownloadState.queued);
+      if (_journalReplay?.states[fileId] == DownloadState.paused.name) {
+        _setDownloadState(fileId, DownloadState.paused);
+      }
+      _getDataSource(fileId, url);
+      if (resume && !meta.isComplete) {
+        unawaited(startBackgroundDownload(url));
+      }
+    }
+
+    // Leftovers of saves interrupted by a crash
+    await for (final entity in Directory(storageDir).list()) {
+      if (entity is File &&
+          (entity.path.endsWith('.meta.tmp') ||
+              entity.path.endsWith('.video.delta'))) {
+        await entity.delete();
+      }
+    }
+
+    final replay = _journalReplay;
+    _journalReplay = null;
+    if (replay != null && !replay.isEmpty) {
+      Logger.info('Replayed ${replay.entries} journal entries');
+    }
+    if (recovered > 0) Logger.info('Recovered $recovered partial downloads');
+    return recovered;
+  }
+
   /// Check if a download is currently active
   bool isDownloading(String url) {
     final fileId = _hashUrl(url);
@@ -529,11 +7996,54 @@ class StreamProxyBridge {
 
   // ============== BACKGROUND DOWNLOAD ==============
 
+  /// Download [url] whole in the background, probing it first when it is
+  /// not cached yet; returns its file ID, or null when the origin does not
+  /// tell its size
+  ///
+  /// [ttl], [collection] and [context] as in [startBackgroundDownload];
+  /// [mirrors] as in [addMirrors], [sidecars] as in [addSidecars].
+  Future<String?> enqueueDownload(
+    String url, {
+    Duration? ttl,
+    String? collection,
+    Iterable<String> mirrors = const [],
+    Iterable<Sidecar> sidecars = const [],
+    CallContext? context,
+  }) async {
+    final fileId = _hashUrl(url);
+    _urlLookup[fileId] = url;
+    final meta = await _getOrCreateMeta(fileId, url, autoDownload: false);
+    if (meta == null) return null;
+    if (mirrors.isNotEmpty) await addMirrors(url, mirrors);
+    if (sidecars.isNotEmpty) await addSidecars(url, sidecars);
+    await startBackgroundDownload(
+      url,
+      ttl: ttl,
+      collection: collection,
+      context: context,
+    );
+    return fileId;
+  }
+
   /// Start background download to complete file even when player is paused
-  Future<void> startBackgroundDownload(String url) async {
+  ///
+  /// When [context] ends, the background download is stopped. [ttl]
+  /// deletes the file that long after it is first enqueued. [collection]
+  /// names the [Collection] (see [defineCollection]) the file moves into
+  /// once complete.
+  Future<void> startBackgroundDownload(
+    String url, {
+    Duration? ttl,
+    String? collection,
+    CallContext? context,
+  }) async {
+    context?.throwIfDone();
     final fileId = _hashUrl(url);
+    if (ttl != null) _keepFor(fileId, ttl);
+    if (collection != null) _assignCollection(fileId, collection);
     final meta = _metadata[fileId];
-    if (meta == null || meta.isComplete) return;
+    if (meta == null || meta.isComplete || _isPaused(fileId)) return;
+    if (!storageAvailable) return;
 
     // Don't start if already downloading
     if (_activeDownloads.contains(fileId) ||
@@ -550,7 +8060,29 @@ class StreamProxyBridge {
       return;
     }
 
-    final (gapStart, gapEnd) = gaps.first;
+    var (gapStart, gapEnd) = gaps.first;
+
+    // A sequential host is held for the whole request: keep it short so
+    // the player's requests get their turn
+    final gate = _hostGate(meta);
+    if (gate != null && gate.policy.sequential) {
+      final segment = max(gate.policy.minRequestSize, 8 * 1024 * 1024);
+      gapEnd = min(gapEnd, gapStart + segment - 1);
+    }
+
+    // External downloaders own this file's gaps for now
+    if (_workCoordinator.hasLeases(fileId)) {
+      Logger.info('Background download paused, work units leased: $fileId');
+      return;
+    }
+
+    // Background work is the first thing to go under pressure; the next
+    // player request restarts it
+    final shedReason = _loadShedder?.reason;
+    if (shedReason != null) {
+      Logger.info('Background download deferred ($shedReason): $fileId');
+      return;
+    }
 
     Logger.info('Starting background download from $gapStart to $gapEnd');
 
@@ -558,9 +8090,30 @@ class StreamProxyBridge {
     if (dataSource == null) return;
 
     _activeDownloads.add(fileId);
+    _setDownloadState(fileId, DownloadState.downloading);
+    if (_sidecars.containsKey(fileId)) unawaited(_fetchSidecars(fileId));
 
     // Get or create lock
-    _fileLocks.putIfAbsent(fileId, () => Lock());
+    _fileLocks.putIfAbsent(fileId, () => SharedLock());
+
+    if (context != null) {
+      unawaited(context.done.then((_) => stopBackgroundDownload(url)));
+    }
+
+    // Fast links: several connections at once (rate shaping wants the
+    // single, paced stream); mirrors take a segment each
+    final mirrored = (_mirrors[fileId]?.active.length ?? 0) > 1;
+    final segmented =
+        _segmented ?? (mirrored ? const SegmentedDownloadConfig() : null);
+    if (segmented != null &&
+        _rateShaperFor(url, fileId) == null &&
+        !_rangeless.contains(fileId) &&
+        _capabilitiesFor(url)?.parallel != false) {
+      unawaited(
+        _runSegmentedDownload(url, fileId, meta, dataSource, segmented),
+      );
+      return;
+    }
 
     // Run download in background
     unawaited(
@@ -577,105 +8130,632 @@ class StreamProxyBridge {
     int gapStart,
     int gapEnd,
   ) async {
+    final slot = await _admit(fileId, priority: DownloadPriority.background);
+    final release = await _hostGate(meta)?.acquire();
+    _loadShedder?.fetchStarted();
+    final shaper = _rateShaperFor(url, fileId);
     try {
-      final upstream = await dataSource.fetchRange(gapStart, gapEnd);
-      int currentPos = gapStart;
-
-      await for (final chunk in upstream) {
+      final upstream = _rangeless.contains(fileId)
+          ? await dataSource.fetchAll()
+          : await dataSource.fetchRange(gapStart, gapEnd);
+      await _expectBytes(upstream, gapStart, gapEnd);
+      // The whole file (origin ignores Range): it starts at byte 0, and
+      // bytes already cached are simply written again
+      final whole =
+          _ignoresRange(meta, upstream, gapStart, gapEnd) ||
+          (_rangeless.contains(fileId) &&
+              upstream.statusCode == HttpStatus.ok);
+      int currentPos = whole ? 0 : gapStart;
+      bool replan = false;
+
+      var source = _sourceOf(dataSource, upstream);
+      final body = upstream.statusCode == HttpStatus.partialContent
+          ? _resumable(
+              dataSource,
+              upstream,
+              gapStart,
+              gapEnd,
+              onResume: (resumed) => source = _sourceOf(dataSource, resumed),
+            )
+          : upstream;
+      await for (final chunk in body) {
         // 1. Check stop signal
         if (!_activeDownloads.contains(fileId)) break;
 
+        // Bytes pushed by a client (/upload) landed here meanwhile:
+        // drop this fetch and continue from the next real gap
+        if (!whole &&
+            meta.hasRange(currentPos, currentPos + chunk.length - 1)) {
+          replan = true;
+          break;
+        }
+
         // 2. Lock ONLY for writing this specific chunk
         // This is the CRITICAL FIX for performance
         await _fileLocks[fileId]!.synchronized(() async {
-          final raf = await File(meta.localPath).open(mode: FileMode.write);
+          final raf = await File(meta.localPath).open(mode: FileMode.append);
           try {
             await raf.setPosition(currentPos);
-            await raf.writeFrom(chunk);
+            await raf.writeFrom(_sealed(meta, currentPos, chunk));
           } finally {
             await raf.close(); // Release lock immediately
           }
 
-          meta.addRange(currentPos, currentPos + chunk.length - 1);
-        });
+          _recordRange(
+            meta,
+            currentPos,
+            currentPos + chunk.length - 1,
+            source: source,
+          );
+        });
+
+        currentPos += chunk.length;
+        _signalArrival(fileId);
+        _scheduleDebouncedSave(fileId, meta);
+
+        // Stay near real-time while the player has a safe buffer
+        if (shaper != null) {
+          final delay = _shapingDelay(shaper, fileId, chunk.length, currentPos);
+          if (delay > Duration.zero) await Future.delayed(delay);
+        }
+        await _yieldToPlayback(fileId, chunk.length);
+      }
+
+      await meta.save();
+      _reportProgress(meta);
+      // Still in the active set: not stopped from outside
+      if (_activeDownloads.remove(fileId)) {
+        _setDownloadState(fileId, DownloadState.queued);
+      }
+
+      // If we finished this gap normally, check for more gaps
+      if (meta.isComplete) {
+        await _onDownloadComplete(meta);
+      } else if (currentPos >= gapEnd || replan) {
+        // Recursive call to get next gap
+        unawaited(startBackgroundDownload(url));
+      }
+    } catch (e) {
+      _backgroundFailed(url, fileId, meta, e);
+    } finally {
+      _loadShedder?.fetchFinished();
+      release?.call();
+      slot?.call();
+      _signalArrival(fileId);
+    }
+  }
+
+  /// Fetch every missing segment over [SegmentedDownloadConfig.connections]
+  /// parallel requests, then continue with whatever is still missing
+  Future<void> _runSegmentedDownload(
+    String url,
+    String fileId,
+    DownloadMeta meta,
+    DataSource dataSource,
+    SegmentedDownloadConfig config,
+  ) async {
+    final before = meta.downloadedBytes;
+    final mirrors = _mirrors[fileId];
+    try {
+      await runPool(
+        config.segments(meta),
+        config.connections,
+        (segment) async {
+          // The player or another worker may have filled part of it
+          for (final (start, end) in meta.getGapsIn(segment.$1, segment.$2)) {
+            if (mirrors != null && mirrors.active.length > 1) {
+              await _fetchFromMirrors(meta, mirrors, dataSource, start, end);
+              continue;
+            }
+            await _fetchToCache(
+              meta,
+              dataSource,
+              start,
+              end,
+              priority: DownloadPriority.background,
+            );
+          }
+        },
+        isCancelled: () =>
+            !_activeDownloads.contains(fileId) ||
+            (_loadShedder?.underPressure ?? false),
+      );
+
+      await meta.save();
+      _reportProgress(meta);
+      if (!_activeDownloads.remove(fileId)) return;
+      _setDownloadState(fileId, DownloadState.queued);
+
+      if (meta.isComplete) {
+        await _onDownloadComplete(meta);
+      } else if (meta.downloadedBytes > before) {
+        // Gaps left by a shed or a race with the player
+        unawaited(startBackgroundDownload(url));
+      }
+    } catch (e) {
+      _backgroundFailed(url, fileId, meta, e);
+    }
+  }
+
+  void _backgroundFailed(
+    String url,
+    String fileId,
+    DownloadMeta meta,
+    Object error,
+  ) {
+    // Out of the active set: interrupted on purpose (pause, cancel)
+    if (!_activeDownloads.remove(fileId)) return;
+    Logger.error('Background download error: $error');
+    if (error is FileSystemException) unawaited(_checkStorage(error));
+    _setDownloadState(fileId, DownloadState.failed, error: error);
+    _reportProgress(meta);
+    _emit(
+      ProxyEvent(
+        ProxyEventType.downloadFailed,
+        fileId: fileId,
+        url: url,
+        data: {'error': '$error'},
+      ),
+    );
+  }
+
+  /// Start background download by file ID (for resuming without URL)
+  Future<void> startBackgroundDownloadById(
+    String fileId, {
+    CallContext? context,
+  }) async {
+    final meta = _metadata[fileId];
+    if (meta == null) return;
+
+    // Try to get URL from lookup or metadata
+    final url = _urlLookup[fileId] ?? meta.originalUrl;
+    if (url == null) {
+      Logger.error('Cannot resume download: no URL for $fileId');
+      return;
+    }
+
+    await startBackgroundDownload(url, context: context);
+  }
+
+  /// Stop background download for a URL
+  Future<void> stopBackgroundDownload(String url) async {
+    final fileId = _hashUrl(url);
+    // Remove from active set will cause the loop in _runBackgroundDownload to break
+    _activeDownloads.remove(fileId);
+    if (_downloads[fileId]?.state == DownloadState.downloading) {
+      _setDownloadState(fileId, DownloadState.queued);
+    }
+    await _backgroundDownloads[fileId]?.cancel();
+    _backgroundDownloads.remove(fileId);
+  }
+
+  /// Resume all incomplete downloads
+  Future<void> resumeAllDownloads({CallContext? context}) async {
+    final ids = await getCachedFileIds();
+    for (final fileId in ids) {
+      final meta = _metadata[fileId];
+      if (meta != null && !meta.isComplete) {
+        await startBackgroundDownloadById(fileId, context: context);
+      }
+    }
+    Logger.success('Resumed all incomplete downloads');
+  }
+
+  // ============== DOWNLOAD CONTROL ==============
+
+  /// Lifecycle of the download for [fileId], if the proxy knows the file
+  Download? getDownload(String fileId) => _downloads[fileId];
+
+  /// All known downloads by file ID
+  Map<String, Download> get downloads => Map.unmodifiable(_downloads);
+
+  /// Pause the download for [fileId]
+  ///
+  /// In-flight upstream fetches are interrupted; background download,
+  /// read-ahead, cache warming and next-item prefetch stay off until
+  /// [resume]. The player's own requests are still served and cached.
+  /// Throws a [StateError] for a completed download.
+  Future<void> pause(String fileId) async {
+    final download = _downloads[fileId];
+    if (download == null || download.state == DownloadState.paused) return;
+    download.moveTo(DownloadState.paused);
+    _journal?.setState(fileId, DownloadState.paused.name);
+    _downloadController.add(download);
+    await _interrupt(fileId);
+    Logger.info('Download paused: $fileId');
+  }
+
+  /// Restart a paused, failed or queued download in the background
+  Future<void> resume(String fileId) async {
+    final download = _downloads[fileId];
+    if (download == null ||
+        download.state == DownloadState.completed ||
+        download.state == DownloadState.downloading) {
+      return;
+    }
+    _setDownloadState(fileId, DownloadState.queued);
+    _journal?.setState(fileId, DownloadState.queued.name);
+    _getDataSource(fileId, download.url);
+    await startBackgroundDownload(download.url);
+  }
+
+  /// Stop the download for [fileId] and forget its state
+  ///
+  /// Cached bytes stay for later requests unless [deleteData] is set.
+  Future<void> cancel(String fileId, {bool deleteData = false}) async {
+    final url = _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl;
+    await _interrupt(fileId);
+    _downloads.remove(fileId);
+    if (deleteData && url != null) await clearCache(url);
+    Logger.cancel('Download cancelled: $fileId');
+  }
+
+  /// Stop every fetch for [fileId] and persist its ranges
+  Future<void> _interrupt(String fileId) async {
+    _activeDownloads.remove(fileId);
+    await _backgroundDownloads.remove(fileId)?.cancel();
+    // The next request gets a fresh data source
+    await _dataSources.remove(fileId)?.cancel();
+    _saveTimers.remove(fileId)?.cancel();
+    final meta = _metadata[fileId];
+    if (meta != null) {
+      final lock = _fileLocks.putIfAbsent(fileId, () => SharedLock());
+      await lock.synchronized(meta.save);
+    }
+  }
+
+  /// Move [fileId] to [state] if the state machine allows it and tell
+  /// listeners
+  void _setDownloadState(
+    String fileId,
+    DownloadState state, {
+    Object? error,
+  }) {
+    var download = _downloads[fileId];
+    if (download == null) {
+      final url = _urlLookup[fileId] ?? _metadata[fileId]?.originalUrl;
+      if (url == null) return;
+      download = _downloads[fileId] = Download(fileId, url);
+    } else if (download.state == state || !download.canMoveTo(state)) {
+      return;
+    }
+    download.moveTo(state, error: error);
+    if (!_downloadController.isClosed) _downloadController.add(download);
+  }
+
+  bool _isPaused(String fileId) =>
+      _downloads[fileId]?.state == DownloadState.paused;
+
+  // Files whose upstream change is being handled
+  final Set<String> _invalidating = {};
+
+  /// The origin's copy of [url] changed under the cache
+  ///
+  /// Rebuilt from the blocks both versions share when [manifestResolver]
+  /// has a manifest, else the cached bytes are dropped; either way old and
+  /// new bytes are never served mixed. The next request starts over.
+  Future<void> _upstreamChanged(String fileId, String url) async {
+    if (!_invalidating.add(fileId)) return;
+    try {
+      Logger.info('Upstream changed, invalidating cache: $url');
+      _emit(
+        ProxyEvent(ProxyEventType.upstreamChanged, fileId: fileId, url: url),
+      );
+      if (manifestResolver != null) {
+        try {
+          if (await refreshChanged(url) != null) return;
+        } catch (e) {
+          Logger.error('Delta sync of changed $fileId failed: $e');
+        }
+      }
+      await _interrupt(fileId);
+      await clearCache(url);
+    } finally {
+      _invalidating.remove(fileId);
+    }
+  }
+
+  // ============== DELTA SYNC ==============
+
+  /// Block manifest of the current version of a URL, e.g. fetched from a
+  /// sidecar the origin publishes; used by [refreshChanged]
+  Future<BlockManifest?> Function(String url)? manifestResolver;
+
+  /// Update the cache of [url] to a new upstream version, reusing every
+  /// block the old copy still has
+  ///
+  /// [manifest] (or [manifestResolver]) describes the new version. Blocks
+  /// found in the cached bytes (at any offset) are copied into a new
+  /// sparse file; only the rest is fetched, by the background download.
+  /// Returns null when nothing is cached for [url].
+  Future<DeltaPlan?> refreshChanged(
+    String url, {
+    BlockManifest? manifest,
+  }) async {
+    final fileId = _hashUrl(url);
+    final old = _metadata[fileId];
+    if (old == null || old.ephemeral) return null;
+    final remote = manifest ?? await manifestResolver?.call(url);
+    if (remote == null) {
+      throw StateError('No block manifest for $url');
+    }
+
+    // Nothing may write the old version while it is being rebuilt
+    await _interrupt(fileId);
+    final lock = _fileLocks.putIfAbsent(fileId, () => SharedLock());
+    final plan = await lock.synchronized(() async {
+      final plan = await DeltaSync.plan(
+        remote,
+        old.localPath,
+        _cachedRanges(old),
+        decode: (offset, bytes) => _opened(old, offset, bytes),
+      );
+
+      // The new version gets its own keystream (see [CacheCipher])
+      final meta =
+          DownloadMeta(
+              id: fileId,
+              totalSize: remote.totalSize,
+              localPath: old.localPath,
+              metaPath: old.metaPath,
+              originalUrl: old.originalUrl ?? url,
+              mimeType: old.mimeType,
+              fileName: old.fileName,
+              cipher: metaCipher,
+            )
+            ..targetPath = old.targetPath
+            ..cacheNonce = cacheCipher?.newNonce();
+
+      final staged = '${old.localPath}.delta';
+      final source = await File(old.localPath).open();
+      final target = await File(staged).open(mode: FileMode.write);
+      try {
+        await target.truncate(remote.totalSize);
+        for (final (start, end, from) in plan.copies) {
+          for (int pos = start; pos <= end; pos += 4 * 1024 * 1024) {
+            final length = min(4 * 1024 * 1024, end - pos + 1);
+            final offset = from + pos - start;
+            await source.setPosition(offset);
+            await target.setPosition(pos);
+            final bytes = _opened(old, offset, await source.read(length));
+            await target.writeFrom(_sealed(meta, pos, bytes));
+          }
+        }
+      } finally {
+        await source.close();
+        await target.close();
+      }
+
+      for (final (start, end, _) in plan.copies) {
+        meta.addRange(start, end);
+      }
+      await File(staged).rename(old.localPath);
+      _metadata[fileId] = meta;
+      await meta.save();
+      return plan;
+    });
+
+    Logger.info(
+      'Delta sync of $fileId reused ${plan.reusedBytes} bytes, '
+      '${plan.fetchBytes} to fetch',
+    );
+    _emit(
+      ProxyEvent(
+        ProxyEventType.deltaSync,
+        fileId: fileId,
+        url: url,
+        data: {
+          'reusedBytes': plan.reusedBytes,
+          'fetchBytes': plan.fetchBytes,
+        },
+      ),
+    );
+
+    final meta = _metadata[fileId]!;
+    if (meta.isComplete) {
+      await _onDownloadComplete(meta);
+    } else if (!_isPaused(fileId)) {
+      _getDataSource(fileId, url);
+      unawaited(startBackgroundDownload(url));
+    }
+    return plan;
+  }
+
+  // ============== STORAGE MIGRATION ==============
+
+  // Ranges written to each file while it is being copied
+  Map<String, List<(int, int)>>? _migrationDeltas;
+
+  /// Move the cache to [newDir] while downloads and playback continue
+  ///
+  /// New files are created in [newDir] at once. Each existing file is
+  /// copied while it keeps downloading into the old copy; the bytes
+  /// cached before the copy are then compared, and under the file's lock
+  /// the bytes written meanwhile are copied again before the file switches
+  /// to its new path. A file that fails to copy or verify stays where it
+  /// is. Ending [context] stops after the current file.
+  ///
+  /// Sub-directories (ephemeral data, a collection folder inside the
+  /// cache) are left in place. Returns the number of files moved. Throws
+  /// a [StorageException] before moving anything when [newDir] cannot
+  /// be used.
+  Future<int> moveStorage(String newDir, {CallContext? context}) async {
+    final oldDir = storageDir;
+    if (p.equals(oldDir, newDir)) return 0;
+    if (_migrationDeltas != null) {
+      throw StateError('Storage is already being moved');
+    }
+    final storage = await StorageCheck.run(newDir);
+    for (final warning in storage.warnings) {
+      Logger.warn(warning, fields: {'dir': newDir});
+    }
 
-        currentPos += chunk.length;
-        _scheduleDebouncedSave(fileId, meta);
-        _progressController.add((url, meta.progress));
+    _storageReport = storage;
+    _migrationDeltas = {};
+    _storageDir = newDir;
+    Logger.info('Moving cache from $oldDir to $newDir');
+    var moved = 0;
+    try {
+      for (final meta in _metadata.values.toList()) {
+        if (context?.isDone ?? false) break;
+        if (meta.ephemeral || !p.isWithin(oldDir, meta.localPath)) continue;
+        try {
+          await _moveFile(meta, newDir);
+          moved++;
+        } catch (e) {
+          Logger.error('Failed to move ${meta.id}, left in $oldDir: $e');
+        } finally {
+          _migrationDeltas!.remove(meta.id);
+        }
       }
 
-      await meta.save();
-      _activeDownloads.remove(fileId);
-
-      // If we finished this gap normally, check for more gaps
-      if (meta.isComplete) {
-        await _onDownloadComplete(meta);
-      } else if (currentPos >= gapEnd) {
-        // Recursive call to get next gap
-        unawaited(startBackgroundDownload(url));
+      // Completed files, orphans and state files nobody writes to; a
+      // state file already saved into the new directory is newer
+      await for (final entity in Directory(oldDir).list()) {
+        if (entity is! File || entity.path.endsWith('.tmp')) continue;
+        final name = p.basename(entity.path);
+        // A loaded file that failed to move stays with its metadata
+        final owner = _metadata[p.basenameWithoutExtension(name)];
+        if (owner != null && p.isWithin(oldDir, owner.localPath)) continue;
+        final target = File(p.join(newDir, name));
+        if (!await target.exists()) await entity.copy(target.path);
+        await entity.delete();
       }
-    } catch (e) {
-      Logger.error('Background download error: $e');
-      _activeDownloads.remove(fileId);
+    } finally {
+      _migrationDeltas = null;
+    }
+
+    try {
+      await Directory(oldDir).delete();
+    } on FileSystemException {
+      // Not empty: files that failed to move, or sub-directories
     }
+    Logger.success('Moved $moved files to $newDir');
+    return moved;
   }
 
-  /// Start background download by file ID (for resuming without URL)
-  Future<void> startBackgroundDownloadById(String fileId) async {
-    final meta = _metadata[fileId];
-    if (meta == null) return;
+  /// Copy, verify and switch one file to [newDir]
+  Future<void> _moveFile(DownloadMeta meta, String newDir) async {
+    final oldVideo = meta.localPath;
+    final oldMeta = meta.metaPath;
+    final newVideo = p.join(newDir, p.basename(oldVideo));
+    final newMeta = p.join(newDir, p.basename(oldMeta));
+
+    // Cached bytes never change, so what is cached now can be compared
+    // after the copy without holding the lock
+    _migrationDeltas![meta.id] = [];
+    final cached = _cachedRanges(meta);
+    await File(oldVideo).copy(newVideo);
+    try {
+      for (final (start, end) in cached) {
+        if (!await _sameBytes(oldVideo, newVideo, start, end)) {
+          throw StateError('Copy differs in bytes $start-$end');
+        }
+      }
 
-    // Try to get URL from lookup or metadata
-    final url = _urlLookup[fileId] ?? meta.originalUrl;
-    if (url == null) {
-      Logger.error('Cannot resume download: no URL for $fileId');
-      return;
+      final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+      await lock.synchronized(() async {
+        // Replay the writes that landed in the old copy meanwhile
+        final deltas = _migrationDeltas![meta.id]!;
+        if (deltas.isNotEmpty) {
+          final source = await File(oldVideo).open();
+          final target = await File(newVideo).open(mode: FileMode.append);
+          try {
+            for (final (start, end) in deltas) {
+              await source.setPosition(start);
+              await target.setPosition(start);
+              await target.writeFrom(await source.read(end - start + 1));
+            }
+          } finally {
+            await source.close();
+            await target.close();
+          }
+        }
+
+        meta.localPath = newVideo;
+        meta.metaPath = newMeta;
+        await meta.save();
+      });
+    } catch (_) {
+      meta.localPath = oldVideo;
+      meta.metaPath = oldMeta;
+      final partial = File(newVideo);
+      if (await partial.exists()) await partial.delete();
+      rethrow;
     }
 
-    await startBackgroundDownload(url);
+    await File(oldVideo).delete();
+    final staleMeta = File(oldMeta);
+    if (await staleMeta.exists()) await staleMeta.delete();
   }
 
-  /// Stop background download for a URL
-  Future<void> stopBackgroundDownload(String url) async {
-    final fileId = _hashUrl(url);
-    // Remove from active set will cause the loop in _runBackgroundDownload to break
-    _activeDownloads.remove(fileId);
-    await _backgroundDownloads[fileId]?.cancel();
-    _backgroundDownloads.remove(fileId);
+  /// Ranges of [meta] that are cached, in order
+  List<(int, int)> _cachedRanges(DownloadMeta meta) {
+    final ranges = <(int, int)>[];
+    var pos = 0;
+    for (final (gapStart, gapEnd) in meta.getDownloadGaps()) {
+      if (gapStart > pos) ranges.add((pos, gapStart - 1));
+      pos = gapEnd + 1;
+    }
+    if (pos < meta.totalSize) ranges.add((pos, meta.totalSize - 1));
+    return ranges;
   }
 
-  /// Resume all incomplete downloads
-  Future<void> resumeAllDownloads() async {
-    final ids = await getCachedFileIds();
-    for (final fileId in ids) {
-      final meta = _metadata[fileId];
-      if (meta != null && !meta.isComplete) {
-        await startBackgroundDownloadById(fileId);
+  /// Whether [start]..[end] is byte-for-byte equal in files [a] and [b]
+  Future<bool> _sameBytes(String a, String b, int start, int end) async {
+    const chunkSize = 1024 * 1024;
+    final first = await File(a).open();
+    final second = await File(b).open();
+    try {
+      await first.setPosition(start);
+      await second.setPosition(start);
+      for (var pos = start; pos <= end; pos += chunkSize) {
+        final length = min(chunkSize, end - pos + 1);
+        final x = await first.read(length);
+        final y = await second.read(length);
+        if (x.length != y.length) return false;
+        for (var i = 0; i < x.length; i++) {
+          if (x[i] != y[i]) return false;
+        }
       }
+      return true;
+    } finally {
+      await first.close();
+      await second.close();
     }
-    Logger.success('Resumed all incomplete downloads');
   }
 
   // ============== FILE EXPORT ==============
 
   /// Export/copy a completed file to target path with proper name and extension
-  Future<bool> exportFile(String url, String targetPath) async {
+  Future<bool> exportFile(
+    String url,
+    String targetPath, {
+    CallContext? context,
+  }) async {
     final fileId = _hashUrl(url);
-    return exportFileById(fileId, targetPath);
+    return exportFileById(fileId, targetPath, context: context);
   }
 
   /// Export/copy a completed file by ID
-  Future<bool> exportFileById(String fileId, String targetPath) async {
+  ///
+  /// A cancelled [context] aborts the copy and removes the partial file.
+  Future<bool> exportFileById(
+    String fileId,
+    String targetPath, {
+    CallContext? context,
+  }) async {
+    context?.throwIfDone();
     final meta = _metadata[fileId];
 
     // Check cache folder
-    final videoPath = '$storageDir/$fileId.video';
+    final videoPath = _videoPath(fileId);
     final videoFile = File(videoPath);
 
     if (await videoFile.exists()) {
       // Only export if download is complete
       if (meta == null || meta.isComplete) {
-        await videoFile.copy(targetPath);
+        await _export(videoFile, targetPath, meta, fileId, context);
         Logger.success('Exported to: $targetPath');
         return true;
       }
@@ -687,7 +8767,7 @@ class StreamProxyBridge {
     final collectionFile = File(collectionPath);
 
     if (await collectionFile.exists()) {
-      await collectionFile.copy(targetPath);
+      await _export(collectionFile, targetPath, meta, fileId, context);
       Logger.success('Exported from collections to: $targetPath');
       return true;
     }
@@ -695,23 +8775,142 @@ class StreamProxyBridge {
     return false;
   }
 
+  /// Copy [source] to a path, or into a document tree for content URIs
+  Future<void> _export(
+    File source,
+    String targetPath,
+    DownloadMeta? meta,
+    String fileId,
+    CallContext? context,
+  ) async {
+    if (!isContentUri(targetPath)) {
+      await _copyFile(source, targetPath, context, meta: meta);
+      return;
+    }
+    await _copyToDocument(source, targetPath, meta, fileId, context);
+  }
+
+  /// Write [source] as a new document in [treeUri] and return its URI
+  ///
+  /// The partial document is deleted if the copy fails or is cancelled.
+  Future<String> _copyToDocument(
+    File source,
+    String treeUri,
+    DownloadMeta? meta,
+    String fileId,
+    CallContext? context,
+  ) async {
+    final store = documentStore;
+    if (store == null) {
+      throw StateError('No DocumentStore set for $treeUri');
+    }
+
+    final uri = await store.createDocument(
+      treeUri,
+      meta?.suggestedFileName ?? '$fileId.mp4',
+      meta?.mimeType ?? 'application/octet-stream',
+    );
+    try {
+      await store.write(
+        uri,
+        _plainRead(source, meta).map((chunk) {
+          context?.throwIfDone();
+          return chunk;
+        }),
+      );
+    } catch (_) {
+      await store.delete(uri);
+      rethrow;
+    }
+    return uri;
+  }
+
+  /// Copy [source] to [targetPath], checking [context] between chunks;
+  /// decrypted when it is the encrypted cache file of [meta]
+  Future<void> _copyFile(
+    File source,
+    String targetPath,
+    CallContext? context, {
+    DownloadMeta? meta,
+  }) async {
+    if (context == null && meta?.cacheNonce == null) {
+      await source.copy(targetPath);
+      return;
+    }
+
+    final partFile = File('$targetPath.part');
+    final sink = partFile.openWrite();
+    try {
+      await sink.addStream(
+        _plainRead(source, meta).map((chunk) {
+          context?.throwIfDone();
+          return chunk;
+        }),
+      );
+      await sink.close();
+      await partFile.rename(targetPath);
+    } catch (_) {
+      await sink.close();
+      if (await partFile.exists()) {
+        await partFile.delete();
+      }
+      rethrow;
+    }
+  }
+
   /// Move completed file to target path (removes from cache)
-  Future<bool> moveFile(String url, String targetPath) async {
+  Future<bool> moveFile(
+    String url,
+    String targetPath, {
+    CallContext? context,
+  }) async {
     final fileId = _hashUrl(url);
-    return moveFileById(fileId, targetPath);
+    return moveFileById(fileId, targetPath, context: context);
   }
 
   /// Move completed file by ID (removes from cache)
-  Future<bool> moveFileById(String fileId, String targetPath) async {
+  Future<bool> moveFileById(
+    String fileId,
+    String targetPath, {
+    CallContext? context,
+  }) async {
+    context?.throwIfDone();
     final meta = _metadata[fileId];
 
+    // Documents can't be renamed into: copy, then drop the local copy
+    if (isContentUri(targetPath)) {
+      if (!await exportFileById(fileId, targetPath, context: context)) {
+        return false;
+      }
+      for (final path in [
+        _videoPath(fileId),
+        '$storageDir/$fileId.meta',
+        '$storageDir/../collections/$fileId.mp4',
+      ]) {
+        final file = File(path);
+        if (await file.exists()) await file.delete();
+      }
+      _forgetCold(fileId);
+      _metadata.remove(fileId);
+      _urlLookup.remove(fileId);
+      return true;
+    }
+
     // Check cache folder
-    final videoPath = '$storageDir/$fileId.video';
+    final videoPath = _videoPath(fileId);
     final videoFile = File(videoPath);
 
     if (await videoFile.exists()) {
       if (meta == null || meta.isComplete) {
-        await videoFile.rename(targetPath);
+        if (meta != null) await _decryptCached(meta);
+        try {
+          await videoFile.rename(targetPath);
+        } on FileSystemException {
+          // A cold file may live on another disk than the target
+          await videoFile.copy(targetPath);
+          await videoFile.delete();
+        }
+        _forgetCold(fileId);
 
         // Clean up metadata
         final metaFile = File('$storageDir/$fileId.meta');
@@ -780,10 +8979,314 @@ class StreamProxyBridge {
     }
   }
 
+  // ============== JOURNAL ==============
+
+  /// Read what the last run journaled and how it stopped
+  Future<void> _loadJournal() async {
+    final report = File('$storageDir/.shutdown.json');
+    if (await report.exists()) {
+      try {
+        _previousShutdown = ShutdownReport.fromJson(
+          jsonDecode(await report.readAsString()) as Map<String, dynamic>,
+        );
+      } catch (e) {
+        Logger.error('Failed to load shutdown report: $e');
+      }
+      // Gone until the next clean stop writes it again
+      await report.delete();
+    }
+    try {
+      _journalReplay = await CacheJournal.replay('$storageDir/.journal');
+    } catch (e) {
+      Logger.error('Failed to replay journal: $e');
+    }
+    if (_previousShutdown == null && !(_journalReplay?.isEmpty ?? true)) {
+      Logger.info('Previous run did not stop cleanly, replaying journal');
+    }
+  }
+
+  /// Journal from now on, flushed every two seconds, or drop the journal
+  /// when it is not [enabled]
+  Future<void> _startJournal({required bool enabled}) async {
+    final path = '$storageDir/.journal';
+    if (!enabled) {
+      final file = File(path);
+      if (await file.exists()) await file.delete();
+      return;
+    }
+    // Replayed ranges are in the .meta files now
+    _journal = CacheJournal(path, syncData: _syncVideos);
+    await _journal!.checkpoint(_pausedStates());
+    _journalTimer = Timer.periodic(
+      const Duration(seconds: 2),
+      (_) => unawaited(_flushJournal()),
+    );
+  }
+
+  Future<void> _flushJournal() async {
+    final journal = _journal;
+    if (journal == null) return;
+    try {
+      await journal.flush();
+      if (journal.length > _journalCheckpointBytes) {
+        await _saveAllMeta();
+        await journal.checkpoint(_pausedStates());
+      }
+    } catch (e) {
+      Logger.error('Journal flush failed: $e');
+    }
+  }
+
+  /// Queue states stored only in the journal
+  Map<String, String> _pausedStates() => {
+    for (final download in _downloads.values)
+      if (download.state == DownloadState.paused)
+        download.fileId: DownloadState.paused.name,
+  };
+
+  /// Make the cached bytes of [fileIds] durable
+  Future<void> _syncVideos(Iterable<String> fileIds) async {
+    for (final fileId in fileIds) {
+      final meta = _metadata[fileId];
+      if (meta == null) continue;
+      try {
+        final raf = await File(meta.localPath).open(mode: FileMode.append);
+        try {
+          await raf.flush();
+        } finally {
+          await raf.close();
+        }
+      } on FileSystemException {
+        // Deleted or moved meanwhile; its ranges no longer matter
+      }
+    }
+  }
+
+  /// Save every file's ranges under its lock, so no writer is mid-chunk;
+  /// returns the files that failed, with the error
+  Future<Map<String, String>> _saveAllMeta() async {
+    final errors = <String, String>{};
+    for (final meta in _metadata.values.toList()) {
+      if (meta.ephemeral) continue;
+      final lock = _fileLocks.putIfAbsent(meta.id, () => SharedLock());
+      try {
+        await lock.synchronized(meta.save);
+      } catch (e) {
+        errors[meta.id] = '$e';
+      }
+    }
+    return errors;
+  }
+
+  // ============== HANDOFF ==============
+
+  /// Completes once [handOff] has saved the state for a new process; the
+  /// old one may then exit
+  Future<void> get handedOff => _handedOff.future;
+  final Completer<void> _handedOff = Completer<void>();
+
+  /// Stop like [stop] and leave the in-memory state for the process
+  /// taking over (see `getInstance(takeOver: true)`)
+  ///
+  /// The port is released first; requests in flight may finish until
+  /// [context] ends (5 seconds by default), during which the new process
+  /// holds new connections unanswered. dart:io can pass neither a
+  /// listening socket nor `SO_REUSEPORT` to another process (`shared`
+  /// binds are per process), so connections made before the new process
+  /// binds the port are refused, and players streaming past [context]
+  /// reconnect, with `Range`, to the new one.
+  Future<ShutdownReport> handOff(String nonce, {CallContext? context}) async {
+    final limits = _limits;
+    final interval = _progressInterval;
+    final playheads = Map.of(_playheads);
+    final downloading = [
+      for (final fileId in _backgroundDownloads.keys)
+        if (_urlLookup[fileId] ?? _metadata[fileId]?.originalUrl
+            case final url?)
+          url,
+    ];
+    Logger.info('Handing off to a new process');
+
+    final report = await stop(
+      context: context ?? CallContext(timeout: const Duration(seconds: 5)),
+    );
+    await HandoffState(
+      nonce: nonce,
+      limits: limits,
+      progressInterval: interval,
+      playheads: playheads,
+      downloading: downloading,
+      report: report,
+    ).write(storageDir);
+    if (!_handedOff.isCompleted) _handedOff.complete();
+    return report;
+  }
+
+  /// POST /api/handoff {"nonce": "..."} - hand over to a new process
+  ///
+  /// Answers `202` at once; the handoff runs once this response is sent.
+  Future<void> _handleHandoffRequest(HttpRequest request) async {
+    final response = request.response;
+    if (!_checkAuthorized(request)) return;
+    if (request.method != 'POST') {
+      response.statusCode = HttpStatus.methodNotAllowed;
+      response.headers.set(HttpHeaders.allowHeader, 'POST');
+      return;
+    }
+    final String nonce;
+    try {
+      final json = jsonDecode(await utf8.decoder.bind(request).join());
+      nonce = (json as Map<String, dynamic>)['nonce'] as String;
+    } catch (_) {
+      response.statusCode = HttpStatus.badRequest;
+      return;
+    }
+    response.statusCode = HttpStatus.accepted;
+    _writeJson(response, {'nonce': nonce});
+    unawaited(
+      Future(() => handOff(nonce)).catchError((Object e) {
+        Logger.error('Handoff failed', error: e);
+        return ShutdownReport();
+      }),
+    );
+  }
+
+  static Future<HttpServer> _bind(
+    InternetAddress address,
+    int port,
+    SecurityContext? tls,
+  ) => tls == null
+      ? HttpServer.bind(address, port)
+      : HttpServer.bindSecure(address, port, tls);
+
+  /// Bind the port of [options] as soon as the process handing off
+  /// releases it, polling every 20 ms
+  static Future<HttpServer> _bindWhenFree(
+    ProxyOptions options,
+    SecurityContext? tls,
+    Duration timeout,
+  ) async {
+    final deadline = DateTime.now().add(timeout);
+    while (true) {
+      try {
+        return await _bind(options.address, options.port, tls);
+      } on SocketException {
+        if (DateTime.now().isAfter(deadline)) rethrow;
+        await Future.delayed(const Duration(milliseconds: 20));
+      }
+    }
+  }
+
+  /// Restore what [state] carried over from the previous process
+  Future<void> _resumeFrom(HandoffState state) async {
+    setBandwidthLimits(state.limits);
+    progressInterval = state.progressInterval;
+    for (final MapEntry(key: fileId, value: playhead)
+        in state.playheads.entries) {
+      _playheads.putIfAbsent(fileId, () => playhead);
+    }
+    for (final url in state.downloading) {
+      try {
+        await startBackgroundDownload(url);
+      } catch (e) {
+        Logger.error('Could not resume $url after handoff', error: e);
+      }
+    }
+    Logger.info(
+      'Took over from a previous process',
+      fields: {
+        'downloads': state.downloading.length,
+        'playheads': state.playheads.length,
+        'tookMs': state.report.took.inMilliseconds,
+      },
+    );
+  }
+
+  // ============== LIFECYCLE ==============
+
+  /// Stop the server gracefully, persist all state and release the
+  /// instance so [getInstance] can start a fresh proxy
+  ///
+  /// New connections are refused at once; requests in flight may finish
+  /// until [context] ends, after which their upstream fetches are
+  /// cancelled and connections closed. Background downloads stop and
+  /// every file's range state is saved before [dispose] runs.
+  ///
+  /// The returned report is also saved for the next start, which reads it
+  /// as [previousShutdown].
+  Future<ShutdownReport> stop({CallContext? context}) async {
+    final stopwatch = Stopwatch()..start();
+    final server = _server;
+    _server = null;
+    if (!_stopping.isCompleted) _stopping.complete();
+    final inFlight = _inFlight.length;
+    var aborted = 0;
+    if (server != null) {
+      await server.close();
+      final drained = Future.wait(_inFlight.toList());
+      try {
+        await (context?.guard(drained) ?? drained);
+      } catch (_) {
+        aborted = _inFlight.length;
+        Logger.info('Aborting $aborted requests on stop');
+        for (final dataSource in _dataSources.values) {
+          await dataSource.cancel();
+        }
+        await server.close(force: true);
+      }
+    }
+
+    final downloads = _backgroundDownloads.length;
+    for (final subscription in _backgroundDownloads.values) {
+      await subscription.cancel();
+    }
+    _backgroundDownloads.clear();
+
+    for (final timer in _saveTimers.values) {
+      timer.cancel();
+    }
+    _saveTimers.clear();
+    final saveErrors = await _saveAllMeta();
+    await _libraryRefresher?.flush();
+    _journalTimer?.cancel();
+    if (saveErrors.isEmpty) {
+      await _journal?.checkpoint(_pausedStates());
+    } else {
+      // Keep what the failed saves would have lost
+      await _journal?.flush();
+    }
+
+    final report = ShutdownReport(
+      requestsInFlight: inFlight,
+      requestsAborted: aborted,
+      downloadsStopped: downloads,
+      filesSaved:
+          _metadata.values.where((m) => !m.ephemeral).length -
+          saveErrors.length,
+      saveErrors: saveErrors,
+      took: stopwatch.elapsed,
+    );
+    try {
+      await File(
+        '$storageDir/.shutdown.json',
+      ).writeAsString(jsonEncode(report.toJson()));
+    } catch (e) {
+      Logger.error('Failed to save shutdown report: $e');
+    }
+
+    await dispose();
+    Logger.info('Stream Proxy stopped: $report');
+    return report;
+  }
+
   /// Shutdown the proxy
+  ///
+  /// Pending metadata saves are dropped; use [stop] to shut down cleanly.
   Future<void> dispose() async {
-    // Close progress stream
+    // Close progress and event streams
     await _progressController.close();
+    await _eventController.close();
+    await _downloadController.close();
 
     // Cancel all background downloads
     for (final subscription in _backgroundDownloads.values) {
@@ -797,6 +9300,34 @@ class StreamProxyBridge {
       timer.cancel();
     }
     _saveTimers.clear();
+    for (final timer in _progressTimers.values) {
+      timer.cancel();
+    }
+    _progressTimers.clear();
+
+    // Flush pending session state
+    if (_sessionSaveTimer?.isActive ?? false) {
+      _sessionSaveTimer!.cancel();
+      await _saveSessions();
+    }
+
+    // Flush pending cache registry changes
+    if (_registrySaveTimer?.isActive ?? false) {
+      _registrySaveTimer!.cancel();
+      await _saveRegistry();
+    }
+
+    // Flush pending access history
+    if (_accessHistorySaveTimer?.isActive ?? false) {
+      _accessHistorySaveTimer!.cancel();
+      await _saveAccessHistory();
+    }
+
+    // Discard ephemeral sessions
+    _activeDownloads.clear();
+    for (final fileId in _ephemeralIds.toList()) {
+      await _discardEphemeral(fileId);
+    }
 
     // Dispose all data sources
     for (var dataSource in _dataSources.values) {
@@ -804,7 +9335,216 @@ class StreamProxyBridge {
     }
     _dataSources.clear();
 
+    _loadShedder?.stop();
+    await disableLibraryRefresh();
+    _scrubTimer?.cancel();
+    _quotaTimer?.cancel();
+    _tierTimer?.cancel();
+    _journalTimer?.cancel();
+    await _journal?.close();
+    _janitorTimer?.cancel();
+    _remountTimer?.cancel();
+    if (_ownsClient) httpClient.close();
     await _server?.close();
     _instance = null;
   }
 }
+
+/// Whether a player's connection is still open
+///
+/// A disconnect is noticed at the next write to the response.
+class _Connection {
+  bool closed = false;
+
+  /// Position of the upstream fetch when the player left
+  int? detachedAt;
+
+  _Connection(HttpResponse response) {
+    response.done.then((_) => closed = true, onError: (_) => closed = true);
+  }
+}
+
+/// The origin answered a range request from [start] with the whole file
+class _RangeIgnored implements Exception {
+  final int start;
+
+  const _RangeIgnored(this.start);
+}
+
+/// An upstream fetch writing [start]..[end] of a file in order
+class _Flight {
+  final int start;
+  final int end;
+
+  /// First byte not written yet
+  int next;
+
+  var _progress = Completer<void>();
+
+  _Flight(this.start, this.end) : next = start;
+
+  /// Bytes from [next] on are still to come
+  bool get pending => next <= end;
+
+  /// Whether [pos] is still to be written by this fetch
+  bool covers(int pos) => pos >= next && pos <= end;
+
+  /// Completes on the next write, or when the fetch ends
+  Future<void> get progress => _progress.future;
+
+  void advance(int to) {
+    next = to;
+    _progress.complete();
+    _progress = Completer<void>();
+  }
+
+  void land() {
+    next = end + 1;
+    _progress.complete();
+  }
+}
+
+/// [CacheReader] backed by the proxy's sparse cache
+class _ProxyCacheReader implements CacheReader {
+  final StreamProxyBridge _proxy;
+  final DownloadMeta _meta;
+  final DataSource _dataSource;
+
+  _ProxyCacheReader(this._proxy, this._meta, this._dataSource);
+
+  @override
+  int get length => _meta.totalSize;
+
+  @override
+  Future<Uint8List> readAt(int offset, int count) async {
+    final end = min(offset + count, _meta.totalSize) - 1;
+    if (count <= 0 || end < offset) return Uint8List(0);
+    return _proxy._readThrough(_meta, _dataSource, offset, end);
+  }
+}
+
+/// [FetchPipeline] over the proxy's sparse cache and data sources
+class _ProxyFetchPipeline implements FetchPipeline {
+  final StreamProxyBridge _proxy;
+
+  _ProxyFetchPipeline(this._proxy);
+
+  @override
+  Future<DownloadMeta?> resolve(String url) {
+    final fileId = _proxy._hashUrl(url);
+    _proxy._urlLookup[fileId] = url;
+    return _proxy._getOrCreateMeta(fileId, url, autoDownload: false);
+  }
+
+  @override
+  List<WorkUnit> reserve(
+    DownloadMeta meta, {
+    int maxUnits = 4,
+    int unitSize = 4 * 1024 * 1024,
+    Duration leaseDuration = const Duration(minutes: 2),
+  }) {
+    final url = _proxy._urlLookup[meta.id] ?? meta.originalUrl;
+    if (url == null) throw StateError('No URL for ${meta.id}');
+    return _proxy._workCoordinator.lease(
+      meta,
+      url,
+      maxUnits: maxUnits,
+      unitSize: unitSize,
+      leaseDuration: leaseDuration,
+    );
+  }
+
+  @override
+  Future<Stream<List<int>>> fetch(WorkUnit unit, {DataSource? source}) async {
+    final meta = _proxy._metadata[unit.fileId];
+    if (meta == null) throw StateError('Unknown file ${unit.fileId}');
+    source ??= _proxy._getDataSource(unit.fileId, unit.url);
+
+    final release = await _proxy._hostGate(meta)?.acquire();
+    _proxy._loadShedder?.fetchStarted();
+    var finished = false;
+    void finish() {
+      if (finished) return;
+      finished = true;
+      _proxy._loadShedder?.fetchFinished();
+      release?.call();
+    }
+
+    final HttpClientResponse upstream;
+    try {
+      upstream = await source.fetchRange(unit.start, unit.end);
+      await StreamProxyBridge._expectBytes(upstream, unit.start, unit.end);
+      _proxy._ignoresRange(meta, upstream, unit.start, unit.end);
+      if (upstream.statusCode != HttpStatus.partialContent && unit.start > 0) {
+        await upstream.listen(null).cancel();
+        throw HttpException(
+          'Upstream ignored Range (status ${upstream.statusCode})',
+        );
+      }
+    } catch (_) {
+      finish();
+      rethrow;
+    }
+
+    // Hold the host's slot until the body is consumed or abandoned
+    late final StreamSubscription<List<int>> subscription;
+    final controller = StreamController<List<int>>();
+    controller
+      ..onListen = () {
+        subscription = upstream.listen(
+          controller.add,
+          onError: controller.addError,
+          onDone: () {
+            finish();
+            controller.close();
+          },
+        );
+      }
+      ..onPause = (() => subscription.pause())
+      ..onResume = (() => subscription.resume())
+      ..onCancel = () {
+        finish();
+        return subscription.cancel();
+      };
+    return controller.stream;
+  }
+
+  @override
+  Future<void> write(DownloadMeta meta, int offset, List<int> bytes) {
+    if (offset < 0 || offset + bytes.length > meta.totalSize) {
+      throw RangeError('Write past the end of ${meta.id}');
+    }
+    final lock = _proxy._fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    return lock.synchronized(() async {
+      final raf = await File(meta.localPath).open(mode: FileMode.append);
+      try {
+        await raf.setPosition(offset);
+        await raf.writeFrom(_proxy._sealed(meta, offset, bytes));
+      } finally {
+        await raf.close();
+      }
+    });
+  }
+
+  @override
+  Future<void> record(DownloadMeta meta, int start, int end) async {
+    final lock = _proxy._fileLocks.putIfAbsent(meta.id, () => SharedLock());
+    var completed = false;
+    await lock.synchronized(() {
+      final wasComplete = meta.isComplete;
+      _proxy._recordRange(meta, start, end);
+      completed = !wasComplete && meta.isComplete;
+    });
+    _proxy._scheduleDebouncedSave(meta.id, meta);
+
+    if (completed && !_proxy._activeDownloads.contains(meta.id)) {
+      await meta.save();
+      await _proxy._onDownloadComplete(meta);
+    }
+  }
+
+  @override
+  void release(WorkUnit unit) {
+    _proxy._workCoordinator.release(unit.id);
+  }
+}
@@ -0,0 +1,783 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+
+import 'cache_reader.dart';
+
+/// Thrown for files whose subtitles cannot be read
+class SubtitleException implements Exception {
+  final String message;
+
+  SubtitleException(this.message);
+
+  @override
+  String toString() => 'SubtitleException: $message';
+}
+
+/// A text subtitle track embedded in a media file
+class SubtitleTrack {
+  /// Track number (Matroska) or track ID (MP4), as given to
+  /// [SubtitleExtractor.toWebVtt]
+  final int number;
+
+  /// Codec, e.g. `S_TEXT/UTF8`, `S_TEXT/ASS`, `tx3g` or `wvtt`
+  final String codec;
+
+  /// Language code (`eng`, `en-US`), when the file names one
+  final String? language;
+  final String? name;
+
+  const SubtitleTrack(this.number, this.codec, {this.language, this.name});
+
+  Map<String, Object?> toJson() => {
+    'track': number,
+    'codec': codec,
+    'language': language,
+    'name': name,
+  };
+}
+
+/// One timed subtitle
+class SubtitleCue {
+  final Duration start;
+  final Duration end;
+  final String text;
+
+  /// WebVTT cue settings (`align:start line:0`), when the source had any
+  final String settings;
+
+  const SubtitleCue(this.start, this.end, this.text, [this.settings = '']);
+}
+
+/// Extracts text subtitle tracks from Matroska/WebM and MP4 files as
+/// WebVTT
+///
+/// Supports SRT-style (`S_TEXT/UTF8`), WebVTT and ASS/SSA tracks in
+/// Matroska, and `tx3g` and `wvtt` tracks in (unfragmented) MP4. Image
+/// subtitles (PGS, VobSub) are not text and are not listed. Cues are
+/// interleaved with the media, so extraction reads the whole file: through
+/// a proxy reader, a file that is not cached yet is downloaded.
+class SubtitleExtractor {
+  /// Text subtitle tracks of the file behind [reader]
+  static Future<List<SubtitleTrack>> tracks(CacheReader reader) async {
+    final window = _Window(reader);
+    return switch (await _container(window)) {
+      _Container.matroska => [
+        for (final track in (await _MatroskaTracks.read(window)).tracks)
+          track.info,
+      ],
+      _Container.mp4 => [
+        for (final track in await _mp4Tracks(window)) track.info,
+      ],
+    };
+  }
+
+  /// Track [number] of the file behind [reader] as a WebVTT document
+  static Future<String> toWebVtt(CacheReader reader, int number) async {
+    final window = _Window(reader);
+    final cues = switch (await _container(window)) {
+      _Container.matroska => await _matroskaCues(window, number),
+      _Container.mp4 => await _mp4Cues(window, number),
+    };
+    return formatWebVtt(cues);
+  }
+
+  /// [cues] as a WebVTT document
+  static String formatWebVtt(List<SubtitleCue> cues) {
+    final out = StringBuffer('WEBVTT\n\n');
+    for (final cue in cues) {
+      final text = cue.text.trim();
+      if (text.isEmpty) continue;
+      out.write('${_timestamp(cue.start)} --> ${_timestamp(cue.end)}');
+      if (cue.settings.isNotEmpty) out.write(' ${cue.settings}');
+      // A blank line would end the cue early
+      out.write('\n${text.replaceAll(RegExp(r'\n\s*\n'), '\n')}\n\n');
+    }
+    return out.toString();
+  }
+
+  static String _timestamp(Duration d) {
+    String two(int n) => n.toString().padLeft(2, '0');
+    final ms = (d.inMilliseconds % 1000).toString().padLeft(3, '0');
+    return '${two(d.inHours)}:${two(d.inMinutes % 60)}:'
+        '${two(d.inSeconds % 60)}.$ms';
+  }
+
+  static Future<_Container> _container(_Window window) async {
+    final head = await window.read(0, 8);
+    if (head.length >= 4 &&
+        head[0] == 0x1A &&
+        head[1] == 0x45 &&
+        head[2] == 0xDF &&
+        head[3] == 0xA3) {
+      return _Container.matroska;
+    }
+    if (head.length >= 8 && String.fromCharCodes(head, 4, 8) == 'ftyp') {
+      return _Container.mp4;
+    }
+    throw SubtitleException('Not a Matroska or MP4 file');
+  }
+
+  // ============== MATROSKA ==============
+
+  static const int _segmentId = 0x18538067;
+  static const int _infoId = 0x1549A966;
+  static const int _timecodeScaleId = 0x2AD7B1;
+  static const int _tracksId = 0x1654AE6B;
+  static const int _clusterId = 0x1F43B675;
+  static const int _clusterTimecodeId = 0xE7;
+  static const int _simpleBlockId = 0xA3;
+  static const int _blockGroupId = 0xA0;
+  static const int _blockId = 0xA1;
+  static const int _blockDurationId = 0x9B;
+
+  // An unknown size cue ends at the next one, or after this long
+  static const _defaultCueLength = Duration(seconds: 5);
+
+  static Future<List<SubtitleCue>> _matroskaCues(
+    _Window window,
+    int number,
+  ) async {
+    final header = await _MatroskaTracks.read(window);
+    final track = header.tracks.where((t) => t.info.number == number);
+    if (track.isEmpty) {
+      throw SubtitleException('No text subtitle track $number');
+    }
+    final scale = header.timecodeScale;
+
+    // Cluster children and Segment children have distinct IDs, so one flat
+    // scan walks clusters of known and unknown size alike
+    final blocks = <(int, int?, Uint8List)>[]; // (time, duration, payload)
+    var clusterTime = 0;
+    var pos = header.segmentStart;
+    final end = header.segmentEnd;
+    while (pos < end) {
+      final element = await _element(window, pos);
+      if (element == null) break;
+      final (id, data, size) = element;
+      if (id == _clusterId) {
+        pos = data; // Step into it
+        continue;
+      }
+      if (size == null) break; // Only clusters may have an unknown size
+      if (id == _clusterTimecodeId) {
+        clusterTime = _uint(await window.read(data, size));
+      } else if (id == _simpleBlockId || id == _blockGroupId) {
+        final block = id == _simpleBlockId
+            ? await _trackBlock(window, data, size, number)
+            : await _groupBlock(window, data, size, number);
+        if (block != null) {
+          final (offset, duration, payload) = block;
+          blocks.add((clusterTime + offset, duration, payload));
+        }
+      }
+      pos = data + size;
+    }
+
+    blocks.sort((a, b) => a.$1.compareTo(b.$1));
+    Duration at(int timecode) =>
+        Duration(microseconds: timecode * scale ~/ 1000);
+    final decode = track.first.decode;
+    return [
+      for (int i = 0; i < blocks.length; i++)
+        SubtitleCue(
+          at(blocks[i].$1),
+          switch (blocks[i].$2) {
+            final duration? => at(blocks[i].$1 + duration),
+            null when i + 1 < blocks.length => _minDuration(
+              at(blocks[i + 1].$1),
+              at(blocks[i].$1) + _defaultCueLength,
+            ),
+            null => at(blocks[i].$1) + _defaultCueLength,
+          },
+          _matroskaText(track.first.info.codec, decode(blocks[i].$3)),
+        ),
+    ];
+  }
+
+  static Duration _minDuration(Duration a, Duration b) => a < b ? a : b;
+
+  /// Relative timecode, no duration and payload of a block of [number]
+  static Future<(int, int?, Uint8List)?> _trackBlock(
+    _Window window,
+    int data,
+    int size,
+    int number,
+  ) async {
+    final head = await window.read(data, min(size, 12));
+    final track = _vint(head, 0);
+    if (track == null || track.$1 != number) return null;
+    if (head.length < track.$2 + 3) return null;
+    final flags = head[track.$2 + 2];
+    if (flags & 0x06 != 0) return null; // Laced: not used for text
+    final offset = _int16(head, track.$2);
+    final start = data + track.$2 + 3;
+    final payload = await window.read(start, data + size - start);
+    return (offset, null, Uint8List.fromList(payload));
+  }
+
+  static Future<(int, int?, Uint8List)?> _groupBlock(
+    _Window window,
+    int data,
+    int size,
+    int number,
+  ) async {
+    (int, int?, Uint8List)? block;
+    int? duration;
+    var pos = data;
+    while (pos < data + size) {
+      final element = await _element(window, pos);
+      if (element == null || element.$3 == null) return null;
+      final (id, start, length) = element;
+      if (id == _blockId) {
+        block = await _trackBlock(window, start, length!, number);
+        if (block == null) return null;
+      } else if (id == _blockDurationId) {
+        duration = _uint(await window.read(start, length!));
+      }
+      pos = start + length!;
+    }
+    if (block == null) return null;
+    return (block.$1, duration, block.$3);
+  }
+
+  static String _matroskaText(String codec, Uint8List payload) {
+    final text = utf8.decode(payload, allowMalformed: true);
+    if (codec != 'S_TEXT/ASS' && codec != 'S_TEXT/SSA') return text;
+    // ReadOrder,Layer,Style,Name,MarginL,MarginR,MarginV,Effect,Text
+    var field = text;
+    for (int i = 0; i < 8; i++) {
+      final comma = field.indexOf(',');
+      if (comma < 0) break;
+      field = field.substring(comma + 1);
+    }
+    return field
+        .replaceAll(RegExp(r'\{[^}]*\}'), '')
+        .replaceAll(RegExp(r'\\[Nn]'), '\n')
+        .replaceAll(r'\h', ' ');
+  }
+
+  /// ID, data start and size (null when unknown) of the element at [pos]
+  static Future<(int, int, int?)?> _element(_Window window, int pos) async {
+    final head = await window.read(pos, 12);
+    final id = _vint(head, 0, keepMarker: true);
+    if (id == null) return null;
+    final size = _vint(head, id.$2);
+    if (size == null) return null;
+    final length = id.$2 + size.$2;
+    final unknown = size.$1 == (1 << (7 * size.$2)) - 1;
+    return (id.$1, pos + length, unknown ? null : size.$1);
+  }
+
+  /// Value and length of the EBML variable-size integer at [i]
+  static (int, int)? _vint(Uint8List b, int i, {bool keepMarker = false}) {
+    if (i >= b.length || b[i] == 0) return null;
+    final first = b[i];
+    var length = 1;
+    var mask = 0x80;
+    while (first & mask == 0) {
+      mask >>= 1;
+      length++;
+    }
+    if (i + length > b.length) return null;
+    var value = keepMarker ? first : first & (mask - 1);
+    for (int k = 1; k < length; k++) {
+      value = (value << 8) | b[i + k];
+    }
+    return (value, length);
+  }
+
+  static int _uint(List<int> bytes) =>
+      bytes.fold(0, (value, byte) => (value << 8) | byte);
+
+  static int _int16(Uint8List b, int i) {
+    final value = (b[i] << 8) | b[i + 1];
+    return value >= 0x8000 ? value - 0x10000 : value;
+  }
+
+  // ============== MP4 ==============
+
+  static Future<List<_Mp4Track>> _mp4Tracks(_Window window) async {
+    final moov = await _box(window, 'moov', 0, window.length);
+    if (moov == null) throw SubtitleException('No moov box');
+    final tracks = <_Mp4Track>[];
+    for (final (start, end) in await _boxes(window, 'trak', moov.$1, moov.$2)) {
+      final track = await _Mp4Track.read(window, start, end);
+      if (track != null) tracks.add(track);
+    }
+    return tracks;
+  }
+
+  static Future<List<SubtitleCue>> _mp4Cues(
+    _Window window,
+    int number,
+  ) async {
+    final track = (await _mp4Tracks(window)).where(
+      (t) => t.info.number == number,
+    );
+    if (track.isEmpty) {
+      throw SubtitleException('No text subtitle track $number');
+    }
+    return track.first.cues(window);
+  }
+
+  /// Payload (start, end) of the first [type] box within [start]..[end]
+  static Future<(int, int)?> _box(
+    _Window window,
+    String type,
+    int start,
+    int end,
+  ) async {
+    final found = await _boxes(window, type, start, end, first: true);
+    return found.isEmpty ? null : found.first;
+  }
+
+  /// Payloads (start, end) of the [type] boxes within [start]..[end]
+  static Future<List<(int, int)>> _boxes(
+    _Window window,
+    String type,
+    int start,
+    int end, {
+    bool first = false,
+  }) async {
+    final found = <(int, int)>[];
+    var pos = start;
+    while (pos + 8 <= end) {
+      final header = await window.read(pos, 16);
+      if (header.length < 8) break;
+      var size = _u32(header, 0);
+      var headerSize = 8;
+      if (size == 1) {
+        if (header.length < 16) break;
+        size = _u32(header, 8) * 0x100000000 + _u32(header, 12);
+        headerSize = 16;
+      } else if (size == 0) {
+        size = end - pos; // Box extends to the end of its parent
+      }
+      if (size < headerSize) break;
+      if (String.fromCharCodes(header, 4, 8) == type) {
+        found.add((pos + headerSize, min(pos + size, end)));
+        if (first) break;
+      }
+      pos += size;
+    }
+    return found;
+  }
+
+  static int _u32(Uint8List b, int i) =>
+      (b[i] << 24) | (b[i + 1] << 16) | (b[i + 2] << 8) | b[i + 3];
+
+  static int _u16(Uint8List b, int i) => (b[i] << 8) | b[i + 1];
+}
+
+enum _Container { matroska, mp4 }
+
+/// Reads through a [CacheReader] in large blocks, so walking many small
+/// headers does not cost one read each
+class _Window {
+  static const int _blockSize = 256 * 1024;
+
+  final CacheReader reader;
+  int _start = 0;
+  Uint8List _bytes = Uint8List(0);
+
+  _Window(this.reader);
+
+  int get length => reader.length;
+
+  /// Up to [count] bytes at [offset]; fewer only at end of file
+  Future<Uint8List> read(int offset, int count) async {
+    if (offset >= reader.length || count <= 0) return Uint8List(0);
+    if (count > _blockSize) return reader.readAt(offset, count);
+    final end = min(offset + count, reader.length);
+    if (offset < _start || end > _start + _bytes.length) {
+      _start = offset;
+      _bytes = await reader.readAt(offset, _blockSize);
+    }
+    return Uint8List.sublistView(
+      _bytes,
+      offset - _start,
+      min(end - _start, _bytes.length),
+    );
+  }
+}
+
+/// A Matroska text track and how to undo its content compression
+class _MatroskaTrack {
+  final SubtitleTrack info;
+  final Uint8List Function(Uint8List) decode;
+
+  _MatroskaTrack(this.info, this.decode);
+}
+
+/// Segment bounds, timecode scale and text tracks of a Matroska file
+class _MatroskaTracks {
+  static const int _trackEntryId = 0xAE;
+  static const int _trackNumberId = 0xD7;
+  static const int _trackTypeId = 0x83;
+  static const int _codecId = 0x86;
+  static const int _languageId = 0x22B59C;
+  static const int _languageBcp47Id = 0x22B59D;
+  static const int _nameId = 0x536E;
+  static const int _contentEncodingsId = 0x6D80;
+  static const int _contentEncodingId = 0x6240;
+  static const int _contentCompressionId = 0x5034;
+  static const int _compAlgoId = 0x4254;
+  static const int _compSettingsId = 0x4255;
+
+  static const int _subtitleType = 0x11;
+  static const _textCodecs = {
+    'S_TEXT/UTF8',
+    'S_TEXT/ASCII',
+    'S_TEXT/WEBVTT',
+    'S_TEXT/ASS',
+    'S_TEXT/SSA',
+  };
+
+  final int segmentStart;
+  final int segmentEnd;
+  final int timecodeScale;
+  final List<_MatroskaTrack> tracks;
+
+  _MatroskaTracks(
+    this.segmentStart,
+    this.segmentEnd,
+    this.timecodeScale,
+    this.tracks,
+  );
+
+  static Future<_MatroskaTracks> read(_Window window) async {
+    // EBML header, then the Segment
+    final ebml = await SubtitleExtractor._element(window, 0);
+    if (ebml == null || ebml.$3 == null) {
+      throw SubtitleException('Bad EBML header');
+    }
+    final segment = await SubtitleExtractor._element(
+      window,
+      ebml.$2 + ebml.$3!,
+    );
+    if (segment == null || segment.$1 != SubtitleExtractor._segmentId) {
+      throw SubtitleException('No Matroska segment');
+    }
+    final start = segment.$2;
+    final end = segment.$3 == null
+        ? window.length
+        : min(start + segment.$3!, window.length);
+
+    var scale = 1000000; // Default: milliseconds
+    final tracks = <_MatroskaTrack>[];
+    var pos = start;
+    while (pos < end) {
+      final element = await SubtitleExtractor._element(window, pos);
+      if (element == null) break;
+      final (id, data, size) = element;
+      // Headers come before the first cluster
+      if (id == SubtitleExtractor._clusterId || size == null) break;
+      if (id == SubtitleExtractor._infoId) {
+        for (final (childId, childData) in await _children(
+          window,
+          data,
+          size,
+        )) {
+          if (childId == SubtitleExtractor._timecodeScaleId) {
+            scale = SubtitleExtractor._uint(childData);
+          }
+        }
+      } else if (id == SubtitleExtractor._tracksId) {
+        for (final (childId, childData) in await _children(
+          window,
+          data,
+          size,
+        )) {
+          if (childId != _trackEntryId) continue;
+          final track = await _track(childData);
+          if (track != null) tracks.add(track);
+        }
+      }
+      pos = data + size;
+    }
+    return _MatroskaTracks(start, end, scale, tracks);
+  }
+
+  /// IDs and data of the children of the element at [data]
+  static Future<List<(int, Uint8List)>> _children(
+    _Window window,
+    int data,
+    int size,
+  ) async => _split(Uint8List.fromList(await window.read(data, size)));
+
+  static List<(int, Uint8List)> _split(Uint8List bytes) {
+    final children = <(int, Uint8List)>[];
+    var pos = 0;
+    while (pos < bytes.length) {
+      final id = SubtitleExtractor._vint(bytes, pos, keepMarker: true);
+      if (id == null) break;
+      final size = SubtitleExtractor._vint(bytes, pos + id.$2);
+      if (size == null) break;
+      final start = pos + id.$2 + size.$2;
+      final end = min(start + size.$1, bytes.length);
+      children.add((id.$1, Uint8List.sublistView(bytes, start, end)));
+      pos = end;
+    }
+    return children;
+  }
+
+  static Future<_MatroskaTrack?> _track(Uint8List entry) async {
+    int? number;
+    int? type;
+    String? codec;
+    String? language;
+    String? name;
+    Uint8List Function(Uint8List) decode = (payload) => payload;
+    for (final (id, data) in _split(entry)) {
+      switch (id) {
+        case _trackNumberId:
+          number = SubtitleExtractor._uint(data);
+        case _trackTypeId:
+          type = SubtitleExtractor._uint(data);
+        case _codecId:
+          codec = _string(data);
+        case _languageId:
+          language ??= _string(data);
+        case _languageBcp47Id:
+          language = _string(data);
+        case _nameId:
+          name = utf8.decode(data, allowMalformed: true);
+        case _contentEncodingsId:
+          decode = _decoder(data);
+      }
+    }
+    if (number == null ||
+        type != _subtitleType ||
+        !_textCodecs.contains(codec)) {
+      return null;
+    }
+    return _MatroskaTrack(
+      SubtitleTrack(number, codec!, language: language, name: name),
+      decode,
+    );
+  }
+
+  /// Undo zlib compression or header stripping of block payloads
+  static Uint8List Function(Uint8List) _decoder(Uint8List encodings) {
+    for (final (id, encoding) in _split(encodings)) {
+      if (id != _contentEncodingId) continue;
+      for (final (childId, child) in _split(encoding)) {
+        if (childId != _contentCompressionId) continue;
+        var algo = 0;
+        Uint8List? settings;
+        for (final (field, value) in _split(child)) {
+          if (field == _compAlgoId) algo = SubtitleExtractor._uint(value);
+          if (field == _compSettingsId) settings = value;
+        }
+        if (algo == 0) {
+          return (payload) =>
+              Uint8List.fromList(ZLibDecoder().convert(payload));
+        }
+        if (algo == 3 && settings != null) {
+          final header = settings;
+          return (payload) => Uint8List.fromList([...header, ...payload]);
+        }
+      }
+    }
+    return (payload) => payload;
+  }
+
+  static String _string(Uint8List data) =>
+      String.fromCharCodes(data.takeWhile((byte) => byte != 0));
+}
+
+/// An MP4 text track and its sample tables
+class _Mp4Track {
+  final SubtitleTrack info;
+  final int timescale;
+  final List<(int, int)> _timeToSample; // (count, delta)
+  final List<(int, int)> _sampleToChunk; // (first chunk, samples)
+  final List<int> _sizes;
+  final List<int> _chunkOffsets;
+
+  _Mp4Track(
+    this.info,
+    this.timescale,
+    this._timeToSample,
+    this._sampleToChunk,
+    this._sizes,
+    this._chunkOffsets,
+  );
+
+  static const _textHandlers = {'sbtl', 'text', 'subt'};
+  static const _textFormats = {'tx3g', 'wvtt'};
+
+  static Future<_Mp4Track?> read(_Window window, int start, int end) async {
+    Future<(int, int)?> box(String type, (int, int)? parent) async =>
+        parent == null
+        ? null
+        : await SubtitleExtractor._box(window, type, parent.$1, parent.$2);
+    Future<Uint8List?> payload((int, int)? found) async => found == null
+        ? null
+        : await window.read(found.$1, found.$2 - found.$1);
+
+    final trak = (start, end);
+    final tkhd = await payload(await box('tkhd', trak));
+    final mdia = await box('mdia', trak);
+    final mdhd = await payload(await box('mdhd', mdia));
+    final hdlr = await payload(await box('hdlr', mdia));
+    final stbl = await box('stbl', await box('minf', mdia));
+    final stsd = await payload(await box('stsd', stbl));
+    if (tkhd == null ||
+        mdhd == null ||
+        hdlr == null ||
+        stsd == null ||
+        hdlr.length < 12 ||
+        stsd.length < 16) {
+      return null;
+    }
+    final handler = String.fromCharCodes(hdlr, 8, 12);
+    final format = String.fromCharCodes(stsd, 12, 16);
+    if (!_textHandlers.contains(handler) || !_textFormats.contains(format)) {
+      return null;
+    }
+
+    final u32 = SubtitleExtractor._u32;
+    final v1 = tkhd[0] == 1;
+    final id = u32(tkhd, v1 ? 20 : 12);
+    final timescale = u32(mdhd, mdhd[0] == 1 ? 20 : 12);
+    final packed = SubtitleExtractor._u16(mdhd, mdhd[0] == 1 ? 32 : 20);
+    final language = String.fromCharCodes([
+      for (final shift in const [10, 5, 0]) ((packed >> shift) & 0x1F) + 0x60,
+    ]);
+
+    final stts = await payload(await box('stts', stbl));
+    final stsc = await payload(await box('stsc', stbl));
+    final stsz = await payload(await box('stsz', stbl));
+    final stco = await payload(await box('stco', stbl));
+    final co64 = await payload(await box('co64', stbl));
+    if (stts == null || stsc == null || stsz == null) return null;
+    if (stco == null && co64 == null) return null;
+
+    final sampleSize = u32(stsz, 4);
+    final sampleCount = u32(stsz, 8);
+    final List<int> offsets;
+    if (stco != null) {
+      offsets = [for (int i = 0; i < u32(stco, 4); i++) u32(stco, 8 + i * 4)];
+    } else {
+      final table = co64!;
+      offsets = [
+        for (int i = 0; i < u32(table, 4); i++)
+          u32(table, 8 + i * 8) * 0x100000000 + u32(table, 12 + i * 8),
+      ];
+    }
+    return _Mp4Track(
+      SubtitleTrack(
+        id,
+        format,
+        language: language == 'und' ? null : language,
+      ),
+      timescale == 0 ? 1000 : timescale,
+      [
+        for (int i = 0; i < u32(stts, 4); i++)
+          (u32(stts, 8 + i * 8), u32(stts, 12 + i * 8)),
+      ],
+      [
+        for (int i = 0; i < u32(stsc, 4); i++)
+          (u32(stsc, 8 + i * 12), u32(stsc, 12 + i * 12)),
+      ],
+      sampleSize != 0
+          ? List.filled(sampleCount, sampleSize)
+          : [for (int i = 0; i < sampleCount; i++) u32(stsz, 12 + i * 4)],
+      offsets,
+    );
+  }
+
+  Future<List<SubtitleCue>> cues(_Window window) async {
+    // File offset of each sample, chunk by chunk
+    final offsets = <int>[];
+    for (int c = 0; c < _sampleToChunk.length; c++) {
+      final (first, perChunk) = _sampleToChunk[c];
+      final last = c + 1 < _sampleToChunk.length
+          ? _sampleToChunk[c + 1].$1 - 1
+          : _chunkOffsets.length;
+      for (int chunk = first; chunk <= last; chunk++) {
+        if (chunk - 1 >= _chunkOffsets.length) break;
+        var offset = _chunkOffsets[chunk - 1];
+        for (int s = 0; s < perChunk && offsets.length < _sizes.length; s++) {
+          offsets.add(offset);
+          offset += _sizes[offsets.length - 1];
+        }
+      }
+    }
+
+    final cues = <SubtitleCue>[];
+    var time = 0;
+    var sample = 0;
+    Duration at(int t) => Duration(microseconds: t * 1000000 ~/ timescale);
+    for (final (count, delta) in _timeToSample) {
+      for (int i = 0; i < count && sample < offsets.length; i++, sample++) {
+        final bytes = await window.read(offsets[sample], _sizes[sample]);
+        final start = at(time);
+        final end = at(time + delta);
+        time += delta;
+        if (info.codec == 'tx3g') {
+          if (bytes.length < 2) continue;
+          final length = min(
+            SubtitleExtractor._u16(bytes, 0),
+            bytes.length - 2,
+          );
+          if (length == 0) continue; // Gap between subtitles
+          final text = utf8.decode(
+            bytes.sublist(2, 2 + length),
+            allowMalformed: true,
+          );
+          cues.add(SubtitleCue(start, end, text));
+        } else {
+          cues.addAll(await _vttCues(bytes, start, end));
+        }
+      }
+    }
+    return cues;
+  }
+
+  /// Cues of a `wvtt` sample: `vttc` boxes holding `payl` and `sttg`
+  static Future<List<SubtitleCue>> _vttCues(
+    Uint8List sample,
+    Duration start,
+    Duration end,
+  ) async {
+    final window = _Window(_BytesReader(sample));
+    String text((int, int) box) => utf8.decode(
+      Uint8List.sublistView(sample, box.$1, box.$2),
+      allowMalformed: true,
+    );
+
+    final cues = <SubtitleCue>[];
+    final boxes = await SubtitleExtractor._boxes(
+      window,
+      'vttc',
+      0,
+      sample.length,
+    );
+    for (final (from, to) in boxes) {
+      final payl = await SubtitleExtractor._box(window, 'payl', from, to);
+      final sttg = await SubtitleExtractor._box(window, 'sttg', from, to);
+      if (payl == null) continue;
+      cues.add(
+        SubtitleCue(start, end, text(payl), sttg == null ? '' : text(sttg)),
+      );
+    }
+    return cues;
+  }
+}
+
+class _BytesReader implements CacheReader {
+  final Uint8List bytes;
+
+  _BytesReader(this.bytes);
+
+  @override
+  int get length => bytes.length;
+
+  @override
+  Future<Uint8List> readAt(int offset, int count) async =>
+      Uint8List.sublistView(bytes, offset, min(offset + count, bytes.length));
+}
@@ -0,0 +1,87 @@
+import 'dart:io';
+
+import 'package:genesmanproxy/genesmanproxy.dart';
+
+import 'fake_origin.dart';
+
+/// Thrown when a cache assertion fails
+class CacheAssertionError extends Error {
+  final String message;
+
+  CacheAssertionError(this.message);
+
+  @override
+  String toString() => 'CacheAssertionError: $message';
+}
+
+/// Assertions about what the proxy cached for a [FakeOrigin] file
+///
+/// Framework-agnostic: failures throw [CacheAssertionError], which every
+/// test runner reports as a failure.
+class CacheAssertions {
+  final StreamProxyBridge proxy;
+  final FakeOrigin origin;
+
+  CacheAssertions(this.proxy, this.origin);
+
+  DownloadMeta _meta(String url) {
+    final meta = proxy.getMetadata(url);
+    if (meta == null) {
+      throw CacheAssertionError('No metadata for $url');
+    }
+    return meta;
+  }
+
+  /// [start]..[end] is tracked as cached and matches the origin bytes
+  Future<void> assertCached(String url, int start, int end) async {
+    final meta = _meta(url);
+    if (!meta.hasRange(start, end)) {
+      throw CacheAssertionError('Range $start-$end of $url is not cached');
+    }
+
+    final raf = await File(meta.localPath).open();
+    try {
+      await raf.setPosition(start);
+      final actual = await raf.read(end - start + 1);
+      final expected = origin.bytes(start, end);
+      for (int i = 0; i < expected.length; i++) {
+        if (i >= actual.length || actual[i] != expected[i]) {
+          throw CacheAssertionError(
+            'Cached byte ${start + i} of $url does not match the origin',
+          );
+        }
+      }
+    } finally {
+      await raf.close();
+    }
+  }
+
+  /// [start]..[end] is not fully cached
+  void assertNotCached(String url, int start, int end) {
+    final meta = proxy.getMetadata(url);
+    if (meta != null && meta.hasRange(start, end)) {
+      throw CacheAssertionError('Range $start-$end of $url is cached');
+    }
+  }
+
+  /// The whole file is cached and complete
+  Future<void> assertComplete(String url) async {
+    final meta = _meta(url);
+    if (!meta.isComplete) {
+      throw CacheAssertionError(
+        '$url is ${meta.progress.toStringAsFixed(1)}% complete',
+      );
+    }
+    await assertCached(url, 0, origin.size - 1);
+  }
+
+  /// The origin saw at most [max] ranged GET requests
+  void assertUpstreamRequestsAtMost(int max) {
+    final count = origin.rangeRequestCount;
+    if (count > max) {
+      throw CacheAssertionError(
+        'Expected at most $max upstream range requests, got $count',
+      );
+    }
+  }
+}
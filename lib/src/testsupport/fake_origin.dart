@@ -0,0 +1,237 @@
+import 'dart:convert';
+import 'dart:io';
+import 'dart:math';
+import 'dart:typed_data';
+
+/// How a [FlakyRange] misbehaves
+enum FlakyMode {
+  /// Respond 500 Internal Server Error
+  serverError,
+
+  /// Respond [FlakyRange.status] with an HTML error page as the body
+  errorPage,
+
+  /// Send headers and the bytes before the flaky range, then drop the socket
+  truncate,
+}
+
+/// A byte range of a [FakeOrigin] that fails the next [failures] requests
+class FlakyRange {
+  final int start;
+  final int end;
+  final FlakyMode mode;
+
+  /// Status of an [FlakyMode.errorPage] response
+  final int status;
+  int failures;
+
+  FlakyRange(
+    this.start,
+    this.end, {
+    this.failures = 1,
+    this.mode = FlakyMode.serverError,
+    this.status = HttpStatus.internalServerError,
+  });
+
+  bool overlaps(int s, int e) => s <= end && e >= start;
+}
+
+/// A request received by a [FakeOrigin]
+class FakeOriginRequest {
+  final String method;
+  final String? range;
+  final Map<String, String> headers;
+  final DateTime time;
+
+  FakeOriginRequest(this.method, this.range, this.headers)
+    : time = DateTime.now();
+
+  @override
+  String toString() => 'FakeOriginRequest($method, $range)';
+}
+
+/// Deterministic origin server for tests, bound to the loopback interface
+///
+/// Every byte is derived from its offset via [pattern], so cached data can
+/// be verified without keeping a copy of the file.
+class FakeOrigin {
+  /// Total size of the served file
+  final int size;
+
+  /// Byte value at each offset
+  final int Function(int offset) pattern;
+
+  /// Delay before each response
+  Duration latency;
+
+  /// When false, Range is ignored and the full body is sent with 200
+  bool honorRanges;
+
+  /// When false, HEAD is answered with 405
+  bool supportHead;
+
+  /// Content-Type to advertise
+  String contentType;
+
+  /// Ranges that fail on purpose
+  final List<FlakyRange> flakyRanges = [];
+
+  /// Every request received, oldest first
+  final List<FakeOriginRequest> requests = [];
+
+  HttpServer? _server;
+
+  FakeOrigin({
+    required this.size,
+    int Function(int offset)? pattern,
+    this.latency = Duration.zero,
+    this.honorRanges = true,
+    this.supportHead = true,
+    this.contentType = 'video/mp4',
+  }) : pattern = pattern ?? defaultPattern;
+
+  /// Offset modulo a prime, so shifted ranges never match by accident
+  static int defaultPattern(int offset) => offset % 251;
+
+  /// Start listening on an ephemeral loopback port
+  Future<void> start() async {
+    _server = await HttpServer.bind(InternetAddress.loopbackIPv4, 0);
+    _server!.listen(_handle);
+  }
+
+  /// Bound port
+  int get port {
+    final server = _server;
+    if (server == null) throw StateError('FakeOrigin not started');
+    return server.port;
+  }
+
+  /// URL of the served file
+  String url([String path = '/file.bin']) => 'http://127.0.0.1:$port$path';
+
+  /// Expected bytes for [start]..[end] inclusive
+  Uint8List bytes(int start, int end) {
+    final out = Uint8List(end - start + 1);
+    for (int i = 0; i < out.length; i++) {
+      out[i] = pattern(start + i);
+    }
+    return out;
+  }
+
+  /// Number of ranged GET requests received
+  int get rangeRequestCount =>
+      requests.where((r) => r.method == 'GET' && r.range != null).length;
+
+  /// Fail the next requests touching [start]..[end]
+  void addFlakyRange(
+    int start,
+    int end, {
+    int failures = 1,
+    FlakyMode mode = FlakyMode.serverError,
+    int status = HttpStatus.internalServerError,
+  }) {
+    flakyRanges.add(
+      FlakyRange(start, end, failures: failures, mode: mode, status: status),
+    );
+  }
+
+  /// Body of [FlakyMode.errorPage] responses
+  static final errorPage = utf8.encode(
+    '<html><body><h1>Something went wrong</h1></body></html>',
+  );
+
+  Future<void> _handle(HttpRequest request) async {
+    final headers = <String, String>{};
+    request.headers.forEach((name, values) {
+      headers[name] = values.join(',');
+    });
+    final rangeHeader = request.headers.value('range');
+    requests.add(FakeOriginRequest(request.method, rangeHeader, headers));
+
+    final response = request.response;
+    if (latency > Duration.zero) {
+      await Future<void>.delayed(latency);
+    }
+
+    if (request.method == 'HEAD' && !supportHead) {
+      response.statusCode = HttpStatus.methodNotAllowed;
+      await response.close();
+      return;
+    }
+
+    int start = 0;
+    int end = size - 1;
+    bool partial = false;
+    final match = RegExp(r'bytes=(\d+)-(\d*)').firstMatch(rangeHeader ?? '');
+    if (honorRanges && match != null) {
+      start = int.parse(match.group(1)!);
+      if (match.group(2)!.isNotEmpty) {
+        end = min(int.parse(match.group(2)!), size - 1);
+      }
+      if (start >= size) {
+        response.statusCode = HttpStatus.requestedRangeNotSatisfiable;
+        response.headers.set('Content-Range', 'bytes */$size');
+        await response.close();
+        return;
+      }
+      partial = true;
+    }
+
+    response.headers.contentType = ContentType.parse(contentType);
+    if (honorRanges) {
+      response.headers.set(HttpHeaders.acceptRangesHeader, 'bytes');
+    }
+    response.statusCode = partial ? HttpStatus.partialContent : HttpStatus.ok;
+    if (partial) {
+      response.headers.set('Content-Range', 'bytes $start-$end/$size');
+    }
+    response.contentLength = end - start + 1;
+
+    if (request.method == 'HEAD') {
+      await response.close();
+      return;
+    }
+
+    final flaky = flakyRanges
+        .where((f) => f.failures > 0 && f.overlaps(start, end))
+        .firstOrNull;
+    if (flaky != null) {
+      flaky.failures--;
+      if (flaky.mode == FlakyMode.serverError) {
+        response.statusCode = HttpStatus.internalServerError;
+        response.contentLength = 0;
+        await response.close();
+        return;
+      }
+      if (flaky.mode == FlakyMode.errorPage) {
+        response.statusCode = flaky.status;
+        response.headers.removeAll(HttpHeaders.contentRangeHeader);
+        response.headers.contentType = ContentType.html;
+        response.contentLength = errorPage.length;
+        response.add(errorPage);
+        await response.close();
+        return;
+      }
+      // Truncate: deliver bytes up to the flaky range, then hang up
+      final socket = await response.detachSocket();
+      if (flaky.start > start) {
+        socket.add(bytes(start, flaky.start - 1));
+      }
+      await socket.flush();
+      socket.destroy();
+      return;
+    }
+
+    const chunk = 64 * 1024;
+    for (int pos = start; pos <= end; pos += chunk) {
+      response.add(bytes(pos, min(pos + chunk - 1, end)));
+    }
+    await response.close();
+  }
+
+  /// Stop the server
+  Future<void> close() async {
+    await _server?.close(force: true);
+    _server = null;
+  }
+}
@@ -0,0 +1,95 @@
+import 'cache_quota.dart';
+
+/// Two storage tiers: the cache folder is the fast one (an SSD), [coldDir]
+/// the large one (an HDD)
+///
+/// Only complete files move. A file is demoted after [demoteAfter]
+/// without reads, or earlier, least recently read first, while the fast
+/// tier holds more than [fastMaxBytes]. A cold file read [promoteReads]
+/// times within [promoteWindow] is promoted back.
+class TieredStorageConfig {
+  /// Folder of the large tier
+  final String coldDir;
+
+  /// Complete files not read for this long are demoted
+  final Duration demoteAfter;
+
+  /// Bytes kept in the fast tier at most; null for no limit
+  final int? fastMaxBytes;
+
+  /// Reads of a cold file that bring it back to the fast tier
+  final int promoteReads;
+
+  /// Time within which [promoteReads] must happen
+  final Duration promoteWindow;
+
+  /// How often files are checked for demotion
+  final Duration checkInterval;
+
+  /// Files read more recently than this are never demoted
+  final Duration activeGrace;
+
+  const TieredStorageConfig({
+    required this.coldDir,
+    this.demoteAfter = const Duration(days: 7),
+    this.fastMaxBytes,
+    this.promoteReads = 2,
+    this.promoteWindow = const Duration(hours: 1),
+    this.checkInterval = const Duration(minutes: 10),
+    this.activeGrace = const Duration(minutes: 2),
+  });
+}
+
+/// Picks files to demote and counts reads of cold files
+class TieredStorage {
+  final TieredStorageConfig config;
+
+  // Recent read times of cold files
+  final Map<String, List<DateTime>> _reads = {};
+
+  TieredStorage(this.config);
+
+  /// Record a read of the cold file [fileId]; true when it is now hot
+  /// enough to promote
+  bool recordRead(String fileId, DateTime now) {
+    final reads = _reads.putIfAbsent(fileId, () => [])
+      ..removeWhere((t) => now.difference(t) > config.promoteWindow)
+      ..add(now);
+    if (reads.length < config.promoteReads) return false;
+    _reads.remove(fileId);
+    return true;
+  }
+
+  /// Forget the reads of [fileId], e.g. once it moved
+  void forget(String fileId) => _reads.remove(fileId);
+
+  /// Files of the fast tier to demote
+  ///
+  /// Protected files (incomplete or in use) count towards the fast tier
+  /// but are never chosen. Files idle longer than
+  /// [TieredStorageConfig.demoteAfter] come first, then the least
+  /// recently read until the rest fits [TieredStorageConfig.fastMaxBytes].
+  static List<CacheUsage> selectDemotions(
+    Iterable<CacheUsage> files,
+    TieredStorageConfig config,
+    DateTime now,
+  ) {
+    final candidates = files.where((f) => !f.protected).toList()
+      ..sort((a, b) => a.lastAccess.compareTo(b.lastAccess));
+    final demote = [
+      for (final file in candidates)
+        if (now.difference(file.lastAccess) > config.demoteAfter) file,
+    ];
+
+    final maxBytes = config.fastMaxBytes;
+    if (maxBytes == null) return demote;
+    int total = files.fold(0, (sum, f) => sum + f.bytes);
+    total -= demote.fold(0, (sum, f) => sum + f.bytes);
+    for (final file in candidates.skip(demote.length)) {
+      if (total <= maxBytes) break;
+      demote.add(file);
+      total -= file.bytes;
+    }
+    return demote;
+  }
+}
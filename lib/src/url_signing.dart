@@ -0,0 +1,81 @@
+import 'dart:convert';
+import 'dart:math';
+
+import 'package:crypto/crypto.dart';
+
+import 'utils.dart';
+
+/// A signed proxy URL was rejected
+class SignedUrlException implements Exception {
+  final String message;
+
+  const SignedUrlException(this.message);
+
+  @override
+  String toString() => 'SignedUrlException: $message';
+}
+
+/// HMAC-SHA256 tokens naming an upstream URL, so only URLs handed out by
+/// the app are fetched
+///
+/// Without them anyone who can reach the proxy's port could make it
+/// download arbitrary URLs. A token is `<payload>.<mac>`, both base64url
+/// without padding; the payload holds the URL and an optional expiry, and
+/// is readable but cannot be changed without the key.
+class UrlSigner {
+  final Hmac _hmac;
+
+  UrlSigner(List<int> key) : _hmac = Hmac(sha256, key);
+
+  /// A random 256-bit key
+  static List<int> generateKey() {
+    final random = Random.secure();
+    return List.generate(32, (_) => random.nextInt(256));
+  }
+
+  /// Token for [url], valid until [expires] (forever when null)
+  String sign(String url, {DateTime? expires}) {
+    final payload = utf8.encode(
+      jsonEncode({
+        'u': url,
+        if (expires != null) 'e': expires.millisecondsSinceEpoch ~/ 1000,
+      }),
+    );
+    return '${_encode(payload)}.${_encode(_hmac.convert(payload).bytes)}';
+  }
+
+  /// The URL in [token]; throws a [SignedUrlException] when the token is
+  /// malformed, forged or expired
+  String verify(String token, {DateTime? now}) {
+    final dot = token.indexOf('.');
+    if (dot < 0) throw const SignedUrlException('Malformed token');
+    final List<int> payload;
+    final List<int> mac;
+    try {
+      payload = _decode(token.substring(0, dot));
+      mac = _decode(token.substring(dot + 1));
+    } on FormatException {
+      throw const SignedUrlException('Malformed token');
+    }
+    if (!DownStreamUtils.constantTimeEquals(
+      _hmac.convert(payload).bytes,
+      mac,
+    )) {
+      throw const SignedUrlException('Bad signature');
+    }
+
+    final json = jsonDecode(utf8.decode(payload)) as Map<String, dynamic>;
+    final expires = json['e'] as int?;
+    if (expires != null &&
+        (now ?? DateTime.now()).millisecondsSinceEpoch ~/ 1000 >= expires) {
+      throw const SignedUrlException('Expired');
+    }
+    return json['u'] as String;
+  }
+
+  static String _encode(List<int> bytes) =>
+      base64Url.encode(bytes).replaceAll('=', '');
+
+  static List<int> _decode(String text) =>
+      base64Url.decode(base64Url.normalize(text));
+}
@@ -1,13 +1,54 @@
 import 'dart:convert';
+import 'dart:math';
 import 'package:crypto/crypto.dart';
 
 /// Utility functions for DownStream
 class DownStreamUtils {
+  static final Random _random = Random.secure();
+
   /// Hash URL to generate file ID using SHA-256
-  /// Returns first 16 characters of the hex digest
+  /// Returns first 16 characters of the hex digest; the proxy itself asks
+  /// `CacheRegistry.idFor`, which avoids the rare collision
   static String hashUrl(String url) {
     final bytes = utf8.encode(url);
     final digest = sha256.convert(bytes);
     return digest.toString().substring(0, 16);
   }
+
+  /// Random hex identifier (16 characters) for requests and sessions
+  static String randomId() {
+    final buffer = StringBuffer();
+    for (int i = 0; i < 8; i++) {
+      buffer.write(_random.nextInt(256).toRadixString(16).padLeft(2, '0'));
+    }
+    return buffer.toString();
+  }
+
+  /// `Content-Disposition` value naming [fileName] (RFC 6266)
+  ///
+  /// Non-ASCII names get an ASCII fallback plus the UTF-8 `filename*`.
+  /// An [attachment] is saved rather than shown.
+  static String contentDisposition(
+    String fileName, {
+    bool attachment = false,
+  }) {
+    final type = attachment ? 'attachment' : 'inline';
+    final ascii = fileName
+        .replaceAll(RegExp(r'[^\x20-\x7E]'), '_')
+        .replaceAll(RegExp(r'["\\]'), '_');
+    if (ascii == fileName) return '$type; filename="$fileName"';
+    return "$type; filename=\"$ascii\"; "
+        "filename*=UTF-8''${Uri.encodeComponent(fileName)}";
+  }
+
+  /// Whether [a] and [b] are equal, compared in constant time so timing
+  /// does not leak how much of a MAC or token was right
+  static bool constantTimeEquals(List<int> a, List<int> b) {
+    if (a.length != b.length) return false;
+    var diff = 0;
+    for (int i = 0; i < a.length; i++) {
+      diff |= a[i] ^ b[i];
+    }
+    return diff == 0;
+  }
 }
@@ -0,0 +1,66 @@
+import 'dart:collection';
+
+/// Upstream URLs for the renditions of one logical item
+///
+/// Each variant is cached as its own file (keyed by its URL); the group
+/// only ties them together for resolution, listings and progress.
+class VariantGroup {
+  /// Key the player and UI use for the item (usually its canonical URL)
+  final String item;
+
+  /// Variant name (e.g. `720p`) to upstream URL, in preference order
+  final Map<String, String> urls;
+
+  /// Variant served when the request names none; the first if null
+  final String? defaultVariant;
+
+  VariantGroup(this.item, Map<String, String> urls, {this.defaultVariant})
+    : urls = Map.unmodifiable(urls) {
+    if (urls.isEmpty) {
+      throw ArgumentError.value(urls, 'urls', 'No variants for $item');
+    }
+    if (defaultVariant != null && !urls.containsKey(defaultVariant)) {
+      throw ArgumentError.value(defaultVariant, 'defaultVariant');
+    }
+  }
+
+  /// Upstream URL for [variant] (or the default), null if unknown
+  String? resolve(String? variant) =>
+      urls[variant ?? defaultVariant ?? urls.keys.first];
+}
+
+/// Registered [VariantGroup]s, looked up by item or by variant URL
+class VariantRegistry {
+  final Map<String, VariantGroup> _groups = {};
+
+  // Variant URL -> (item, variant name)
+  final Map<String, (String, String)> _byUrl = {};
+
+  /// Register (or replace) the variants of [item]
+  VariantGroup register(
+    String item,
+    Map<String, String> urls, {
+    String? defaultVariant,
+  }) {
+    remove(item);
+    final group = VariantGroup(item, urls, defaultVariant: defaultVariant);
+    _groups[item] = group;
+    group.urls.forEach((name, url) => _byUrl[url] = (item, name));
+    return group;
+  }
+
+  /// Forget the variants of [item]
+  VariantGroup? remove(String item) {
+    final group = _groups.remove(item);
+    group?.urls.values.forEach(_byUrl.remove);
+    return group;
+  }
+
+  VariantGroup? operator [](String item) => _groups[item];
+
+  /// All registered groups by item
+  Map<String, VariantGroup> get groups => UnmodifiableMapView(_groups);
+
+  /// Item and variant name [url] was registered under, if any
+  (String, String)? lookup(String url) => _byUrl[url];
+}
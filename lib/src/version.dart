@@ -0,0 +1,37 @@
+import 'dart:io';
+
+/// Identifies the proxy build in bug reports
+///
+/// [commit] and [buildDate] are injected at build time, e.g.
+/// `flutter build apk --dart-define=DOWNSTREAM_COMMIT=$(git rev-parse HEAD)`.
+class BuildInfo {
+  /// Semantic version (keep in sync with pubspec.yaml)
+  static const String version = '0.0.1';
+
+  static const String commit = String.fromEnvironment(
+    'DOWNSTREAM_COMMIT',
+    defaultValue: 'unknown',
+  );
+
+  static const String buildDate = String.fromEnvironment(
+    'DOWNSTREAM_BUILD_DATE',
+    defaultValue: 'unknown',
+  );
+
+  /// Enabled feature flags of the running proxy
+  final Map<String, Object> features;
+
+  const BuildInfo({this.features = const {}});
+
+  Map<String, Object> toJson() => {
+    'version': version,
+    'commit': commit,
+    'buildDate': buildDate,
+    'dart': Platform.version,
+    'os': Platform.operatingSystem,
+    'features': features,
+  };
+
+  @override
+  String toString() => 'genesmanproxy $version ($commit, $buildDate)';
+}
@@ -0,0 +1,117 @@
+import 'dart:math';
+
+import 'download_meta.dart';
+import 'utils.dart';
+
+/// A missing byte range leased to an external downloader
+///
+/// The downloader fetches [start]..[end] of [url] itself and pushes the
+/// bytes back through the proxy's `/upload` endpoint.
+class WorkUnit {
+  final String id;
+  final String fileId;
+  final String url;
+  final int start;
+  final int end;
+  final DateTime expiresAt;
+
+  WorkUnit({
+    required this.id,
+    required this.fileId,
+    required this.url,
+    required this.start,
+    required this.end,
+    required this.expiresAt,
+  });
+
+  int get length => end - start + 1;
+
+  bool isExpired(DateTime now) => now.isAfter(expiresAt);
+
+  bool overlaps(int s, int e) => s <= end && e >= start;
+
+  Map<String, Object> toJson({Uri? uploadUrl}) => {
+    'id': id,
+    'fileId': fileId,
+    'url': url,
+    'start': start,
+    'end': end,
+    'range': 'bytes=$start-$end',
+    'expiresAt': expiresAt.toIso8601String(),
+    if (uploadUrl != null) 'uploadUrl': uploadUrl.toString(),
+  };
+}
+
+/// Hands out missing ranges as leased [WorkUnit]s
+///
+/// A range is not handed out twice while its lease is live. Leases that
+/// expire without an upload become available again.
+class WorkCoordinator {
+  final Map<String, WorkUnit> _leases = {};
+
+  void _purge(DateTime now) {
+    _leases.removeWhere((_, unit) => unit.isExpired(now));
+  }
+
+  /// Lease up to [maxUnits] missing ranges of [meta], [unitSize] bytes each
+  List<WorkUnit> lease(
+    DownloadMeta meta,
+    String url, {
+    int maxUnits = 4,
+    int unitSize = 4 * 1024 * 1024,
+    Duration leaseDuration = const Duration(minutes: 2),
+  }) {
+    final now = DateTime.now();
+    _purge(now);
+
+    final leased = _leases.values.where((u) => u.fileId == meta.id).toList();
+    final units = <WorkUnit>[];
+
+    for (final (gapStart, gapEnd) in meta.getDownloadGaps()) {
+      for (int pos = gapStart; pos <= gapEnd; pos += unitSize) {
+        if (units.length >= maxUnits) return units;
+
+        final end = min(pos + unitSize - 1, gapEnd);
+        if (leased.any((u) => u.overlaps(pos, end))) continue;
+
+        final unit = WorkUnit(
+          id: DownStreamUtils.randomId(),
+          fileId: meta.id,
+          url: url,
+          start: pos,
+          end: end,
+          expiresAt: now.add(leaseDuration),
+        );
+        _leases[unit.id] = unit;
+        units.add(unit);
+      }
+    }
+    return units;
+  }
+
+  /// Live lease by ID
+  WorkUnit? operator [](String unitId) {
+    _purge(DateTime.now());
+    return _leases[unitId];
+  }
+
+  /// Finish (or give up) a lease
+  WorkUnit? release(String unitId) => _leases.remove(unitId);
+
+  /// Drop every lease for a file
+  void releaseFile(String fileId) {
+    _leases.removeWhere((_, unit) => unit.fileId == fileId);
+  }
+
+  /// Check whether external downloaders hold live leases for a file
+  bool hasLeases(String fileId) {
+    _purge(DateTime.now());
+    return _leases.values.any((unit) => unit.fileId == fileId);
+  }
+
+  /// All live leases
+  List<WorkUnit> get leases {
+    _purge(DateTime.now());
+    return List.unmodifiable(_leases.values);
+  }
+}
@@ -0,0 +1,7 @@
+/// Test helpers for apps embedding the proxy: a deterministic fake origin
+/// server and assertions about cached data. Not exported by the main
+/// library; import `package:genesmanproxy/testsupport.dart` from tests.
+library;
+
+export 'src/testsupport/cache_assertions.dart';
+export 'src/testsupport/fake_origin.dart';